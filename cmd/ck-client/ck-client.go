@@ -70,7 +70,8 @@ func makeSession(sta *client.State, isAdmin bool) *mux.Session {
 	log.Debug("All underlying connections established")
 
 	sessionKey := _sessionKey.Load().([]byte)
-	obfuscator, err := mux.GenerateObfs(sta.EncryptionMethod, sessionKey, sta.Transport.HasRecordLayer())
+	obfuscator, err := mux.GenerateObfs(sta.EncryptionMethod, sessionKey, mux.WithRecordLayer(sta.Transport.RecordLayer()),
+		mux.WithProtocolVersion(sta.ProtocolVersion))
 	if err != nil {
 		log.Fatal(err)
 	}
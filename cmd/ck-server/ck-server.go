@@ -72,7 +72,8 @@ func dispatchConnection(conn net.Conn, sta *server.State) {
 
 	sessionKey := make([]byte, 32)
 	rand.Read(sessionKey)
-	obfuscator, err := mux.GenerateObfs(ci.EncryptionMethod, sessionKey, ci.Transport.HasRecordLayer())
+	obfuscator, err := mux.GenerateObfs(ci.EncryptionMethod, sessionKey, mux.WithRecordLayer(ci.Transport.RecordLayer()),
+		mux.WithProtocolVersion(ci.ProtocolVersion))
 	if err != nil {
 		log.Error(err)
 		goWeb()
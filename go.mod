@@ -3,7 +3,7 @@ module github.com/cbeuw/Cloak
 go 1.12
 
 require (
-	github.com/Yawning/chacha20 v0.0.0-20170904085104-e3b1f968fc63 // indirect
+	github.com/Yawning/chacha20 v0.0.0-20170904085104-e3b1f968fc63
 	github.com/boltdb/bolt v1.3.1
 	github.com/gorilla/mux v1.7.3
 	github.com/gorilla/websocket v1.4.1
@@ -0,0 +1,184 @@
+// Package aegis implements AEGIS-128L, the AES round based AEAD of draft-irtf-cfrg-aegis-aead.
+//
+// AEGIS-128L runs eight AES rounds for every 32 bytes, which makes it several times faster than AES-GCM where the
+// rounds are done by the CPU. This implementation is portable Go with a bitsliced S-box instead, which keeps it constant
+// time but makes it much slower than crypto/aes's AES-GCM on CPUs with AES instructions. It's here to interoperate
+// with peers that have a fast one, until the rounds can be done in assembly.
+package aegis
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	KeySize   = 16
+	NonceSize = 16
+	TagSize   = 16
+
+	rateLen = 32
+)
+
+var errOpen = errors.New("aegis: message authentication failed")
+
+// c0 and c1 are the constants of the initialisation, from the Fibonacci sequence modulo 256
+var c0 = block{0x00, 0x01, 0x01, 0x02, 0x03, 0x05, 0x08, 0x0d, 0x15, 0x22, 0x37, 0x59, 0x90, 0xe9, 0x79, 0x62}
+var c1 = block{0xdb, 0x3d, 0x18, 0x55, 0x6d, 0xc2, 0x2f, 0xf1, 0x20, 0x11, 0x31, 0x42, 0x73, 0xb5, 0x28, 0xdd}
+
+type aegis128L struct {
+	key block
+}
+
+type state [8]block
+
+// New returns AEGIS-128L keyed with key, which must be 16 bytes long
+func New(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, errors.New("aegis: key must be 16 bytes")
+	}
+	a := &aegis128L{}
+	copy(a.key[:], key)
+	return a, nil
+}
+
+func (a *aegis128L) NonceSize() int { return NonceSize }
+func (a *aegis128L) Overhead() int  { return TagSize }
+
+func (s *state) update(m0, m1 *block) {
+	s0 := xor(&s[0], m0)
+	s4 := xor(&s[4], m1)
+	in := [8]block{s[7], s[0], s[1], s[2], s[3], s[4], s[5], s[6]}
+	rk := [8]block{s0, s[1], s[2], s[3], s4, s[5], s[6], s[7]}
+	*s = aesRounds(&in, &rk)
+}
+
+func (a *aegis128L) init(nonce []byte) (s state) {
+	var n block
+	copy(n[:], nonce)
+	kn := xor(&a.key, &n)
+	s = state{kn, c1, c0, c1, kn, xor(&a.key, &c0), xor(&a.key, &c1), xor(&a.key, &c0)}
+	for i := 0; i < 10; i++ {
+		s.update(&n, &a.key)
+	}
+	return
+}
+
+// keystream returns the two blocks the next 32 bytes of plaintext are XORed with
+func (s *state) keystream() (z0, z1 block) {
+	t := and(&s[2], &s[3])
+	z0 = xor(&s[6], &s[1])
+	z0 = xor(&z0, &t)
+	t = and(&s[6], &s[7])
+	z1 = xor(&s[2], &s[5])
+	z1 = xor(&z1, &t)
+	return
+}
+
+// absorb updates s with the additional data, zero padded to a multiple of 32 bytes
+func (s *state) absorb(additionalData []byte) {
+	for len(additionalData) > 0 {
+		var t0, t1 block
+		n := copy(t0[:], additionalData)
+		copy(t1[:], additionalData[n:])
+		s.update(&t0, &t1)
+		if len(additionalData) < rateLen {
+			break
+		}
+		additionalData = additionalData[rateLen:]
+	}
+}
+
+// crypt XORs src with the keystream into dst, updating s with the plaintext, which is src if encrypting and dst if
+// decrypting. dst and src may overlap exactly
+func (s *state) crypt(dst, src []byte, encrypting bool) {
+	for len(src) > 0 {
+		var in, out [rateLen]byte
+		n := copy(in[:], src)
+		z0, z1 := s.keystream()
+		for i := 0; i < 16; i++ {
+			out[i] = in[i] ^ z0[i]
+			out[16+i] = in[16+i] ^ z1[i]
+		}
+		plaintext := in
+		if !encrypting {
+			// the keystream past the end of a partial block mustn't be absorbed as plaintext
+			plaintext = [rateLen]byte{}
+			copy(plaintext[:n], out[:n])
+		}
+		var t0, t1 block
+		copy(t0[:], plaintext[:16])
+		copy(t1[:], plaintext[16:])
+		s.update(&t0, &t1)
+		copy(dst, out[:n])
+		dst = dst[n:]
+		src = src[n:]
+	}
+}
+
+func (s *state) finalize(adLen, msgLen int) (tag [TagSize]byte) {
+	var lengths block
+	binary.LittleEndian.PutUint64(lengths[:8], uint64(adLen)*8)
+	binary.LittleEndian.PutUint64(lengths[8:], uint64(msgLen)*8)
+	t := xor(&s[2], &lengths)
+	for i := 0; i < 7; i++ {
+		s.update(&t, &t)
+	}
+	sum := s[0]
+	for i := 1; i < 7; i++ {
+		sum = xor(&sum, &s[i])
+	}
+	return sum
+}
+
+func (a *aegis128L) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != NonceSize {
+		panic("aegis: incorrect nonce length given to AEGIS-128L")
+	}
+	s := a.init(nonce)
+	s.absorb(additionalData)
+	ret, out := sliceForAppend(dst, len(plaintext)+TagSize)
+	s.crypt(out, plaintext, true)
+	tag := s.finalize(len(additionalData), len(plaintext))
+	copy(out[len(plaintext):], tag[:])
+	return ret
+}
+
+func (a *aegis128L) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != NonceSize {
+		panic("aegis: incorrect nonce length given to AEGIS-128L")
+	}
+	if len(ciphertext) < TagSize {
+		return nil, errOpen
+	}
+	var expectedTag [TagSize]byte
+	copy(expectedTag[:], ciphertext[len(ciphertext)-TagSize:])
+	ciphertext = ciphertext[:len(ciphertext)-TagSize]
+
+	s := a.init(nonce)
+	s.absorb(additionalData)
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	s.crypt(out, ciphertext, false)
+	tag := s.finalize(len(additionalData), len(ciphertext))
+	if subtle.ConstantTimeCompare(tag[:], expectedTag[:]) != 1 {
+		for i := range out {
+			out[i] = 0
+		}
+		return nil, errOpen
+	}
+	return ret, nil
+}
+
+// sliceForAppend takes a slice and a requested number of bytes. It returns a slice with the contents of the given
+// slice followed by that many bytes and a second slice that aliases into it and contains only the extra bytes.
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
@@ -0,0 +1,235 @@
+package aegis
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"math/bits"
+	"testing"
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// sboxTable is the AES S-box of FIPS 197 section 5.1.1, worked out with tables the way subBytes avoids
+var sboxTable = func() (sbox [256]byte) {
+	// p and q walk through the multiplicative group of GF(2^8) as 3^i and its inverse 3^-i
+	p, q := byte(1), byte(1)
+	for {
+		p = p ^ p<<1 ^ byte(int8(p)>>7)&0x1b
+		q ^= q << 1
+		q ^= q << 2
+		q ^= q << 4
+		q ^= byte(int8(q)>>7) & 0x09
+		sbox[p] = q ^ bits.RotateLeft8(q, 1) ^ bits.RotateLeft8(q, 2) ^ bits.RotateLeft8(q, 3) ^ bits.RotateLeft8(q, 4) ^ 0x63
+		if p == 1 {
+			break
+		}
+	}
+	sbox[0] = 0x63
+	return
+}()
+
+func TestSbox(t *testing.T) {
+	for in, expected := range map[byte]byte{0x00: 0x63, 0x01: 0x7c, 0x53: 0xed, 0xff: 0x16} {
+		if sboxTable[in] != expected {
+			t.Errorf("S(%#x): expecting %#x, got %#x", in, expected, sboxTable[in])
+		}
+	}
+	for offset := 0; offset < 16; offset++ {
+		// every value is seen in every position of a block over the offsets
+		var b [8]block
+		for i := range b {
+			for j := range b[i] {
+				b[i][j] = byte(32*i + 2*((j+offset)%16))
+			}
+		}
+		for i := 0; i < 2; i++ {
+			in := b
+			subBytes(&b)
+			for i := range b {
+				for j := range b[i] {
+					if b[i][j] != sboxTable[in[i][j]] {
+						t.Errorf("S(%#x) in block %v at %v: expecting %#x, got %#x", in[i][j], i, j, sboxTable[in[i][j]], b[i][j])
+					}
+				}
+			}
+			// and the odd values on the second go
+			b = in
+			for i := range b {
+				for j := range b[i] {
+					b[i][j]++
+				}
+			}
+		}
+	}
+}
+
+func TestAESRound(t *testing.T) {
+	// draft-irtf-cfrg-aegis-aead Appendix A.1
+	var in, rk [8]block
+	copy(in[3][:], unhex("000102030405060708090a0b0c0d0e0f"))
+	copy(rk[3][:], unhex("101112131415161718191a1b1c1d1e1f"))
+	out := aesRounds(&in, &rk)
+	if !bytes.Equal(out[3][:], unhex("7a7b4e5638782546a8c0477a3b813f43")) {
+		t.Errorf("expecting 7a7b4e5638782546a8c0477a3b813f43, got %x", out[3])
+	}
+
+	// random rounds with a zero round key are checked against SubBytes, ShiftRows and MixColumns done byte by byte
+	for i := range in {
+		rand.Read(in[i][:])
+		rk[i] = block{}
+	}
+	out = aesRounds(&in, &rk)
+	for i := range in {
+		expected := in[i]
+		for j := range expected {
+			expected[j] = sboxTable[expected[j]]
+		}
+		var shifted block
+		for c := 0; c < 4; c++ {
+			for r := 0; r < 4; r++ {
+				shifted[4*c+r] = expected[4*((c+r)%4)+r]
+			}
+		}
+		x := func(b byte) byte { return b<<1 ^ byte(int8(b)>>7)&0x1b }
+		for c := 0; c < 4; c++ {
+			a := shifted[4*c : 4*c+4]
+			want := [4]byte{
+				x(a[0]) ^ x(a[1]) ^ a[1] ^ a[2] ^ a[3],
+				a[0] ^ x(a[1]) ^ x(a[2]) ^ a[2] ^ a[3],
+				a[0] ^ a[1] ^ x(a[2]) ^ x(a[3]) ^ a[3],
+				x(a[0]) ^ a[0] ^ a[1] ^ a[2] ^ x(a[3]),
+			}
+			if !bytes.Equal(out[i][4*c:4*c+4], want[:]) {
+				t.Errorf("round %v column %v: expecting %x, got %x", i, c, want, out[i][4*c:4*c+4])
+			}
+		}
+	}
+}
+
+// test vectors from draft-irtf-cfrg-aegis-aead Appendix A.2
+var vectors = []struct {
+	key, nonce, aad, plaintext, ciphertext, tag string
+}{
+	{
+		"10010000000000000000000000000000",
+		"10000200000000000000000000000000",
+		"",
+		"00000000000000000000000000000000",
+		"c1c0e58bd913006feba00f4b3cc3594e",
+		"abe0ece80c24868a226a35d16bdae37a",
+	},
+	{
+		"10010000000000000000000000000000",
+		"10000200000000000000000000000000",
+		"",
+		"",
+		"",
+		"c2b879a67def9d74e6c14f708bbcc9b4",
+	},
+	{
+		"10010000000000000000000000000000",
+		"10000200000000000000000000000000",
+		"0001020304050607",
+		"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+		"79d94593d8c2119d7e8fd9b8fc77845c5c077a05b2528b6ac54b563aed8efe84",
+		"cc6f3372f6aa1bb82388d695c3962d9a",
+	},
+	{
+		"10010000000000000000000000000000",
+		"10000200000000000000000000000000",
+		"0001020304050607",
+		"000102030405060708090a0b0c0d",
+		"79d94593d8c2119d7e8fd9b8fc77",
+		"5c04b3dba849b2701effbe32c7f0fab7",
+	},
+	{
+		"10010000000000000000000000000000",
+		"10000200000000000000000000000000",
+		"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20212223242526272829",
+		"101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f3031323334353637",
+		"b31052ad1cca4e291abcf2df3502e6bdb1bfd6db36798be3607b1f94d34478aa7ede7f7a990fec10",
+		"7542a745733014f9474417b337399507",
+	},
+}
+
+func TestVectors(t *testing.T) {
+	for i, v := range vectors {
+		a, err := New(unhex(v.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := append(unhex(v.ciphertext), unhex(v.tag)...)
+		sealed := a.Seal(nil, unhex(v.nonce), unhex(v.plaintext), unhex(v.aad))
+		if !bytes.Equal(sealed, expected) {
+			t.Errorf("vector %v: expecting %x, got %x", i, expected, sealed)
+		}
+		opened, err := a.Open(nil, unhex(v.nonce), expected, unhex(v.aad))
+		if err != nil {
+			t.Errorf("vector %v: failed to open: %v", i, err)
+		} else if !bytes.Equal(opened, unhex(v.plaintext)) {
+			t.Errorf("vector %v: expecting plaintext %v, got %x", i, v.plaintext, opened)
+		}
+
+		expected[0] ^= 1
+		if _, err := a.Open(nil, unhex(v.nonce), expected, unhex(v.aad)); err == nil && len(v.plaintext) > 0 {
+			t.Errorf("vector %v: opened a tampered ciphertext", i)
+		}
+	}
+}
+
+func TestInPlace(t *testing.T) {
+	key := make([]byte, KeySize)
+	nonce := make([]byte, NonceSize)
+	rand.Read(key)
+	rand.Read(nonce)
+	a, _ := New(key)
+	for _, n := range []int{0, 1, 31, 32, 33, 100} {
+		plaintext := make([]byte, n)
+		rand.Read(plaintext)
+		buf := make([]byte, n, n+TagSize)
+		copy(buf, plaintext)
+		sealed := a.Seal(buf[:0], nonce, buf, []byte("ad"))
+		if !bytes.Equal(sealed, a.Seal(nil, nonce, plaintext, []byte("ad"))) {
+			t.Errorf("%v bytes: sealing in place differs", n)
+		}
+		opened, err := a.Open(sealed[:0], nonce, sealed, []byte("ad"))
+		if err != nil || !bytes.Equal(opened, plaintext) {
+			t.Errorf("%v bytes: opening in place failed: %v", n, err)
+		}
+	}
+}
+
+func BenchmarkSeal(b *testing.B) {
+	key := make([]byte, 32)
+	aegis, _ := New(key[:KeySize])
+	block, _ := aes.NewCipher(key[:16])
+	gcm, _ := cipher.NewGCM(block)
+	chacha, _ := chacha20poly1305.New(key)
+	for _, c := range []struct {
+		name string
+		aead cipher.AEAD
+	}{{"AEGIS128L", aegis}, {"AES128GCM", gcm}, {"chacha20Poly1305", chacha}} {
+		for _, size := range []int{64, 1024, 16384} {
+			b.Run(fmt.Sprintf("%v/%v", c.name, size), func(b *testing.B) {
+				nonce := make([]byte, c.aead.NonceSize())
+				plaintext := make([]byte, size)
+				buf := make([]byte, 0, size+c.aead.Overhead())
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					c.aead.Seal(buf, nonce, plaintext, nil)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package aegis
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// block is a 128 bit AES state, with the bytes in the column-major order of FIPS 197
+type block [16]byte
+
+// transpose8 transposes the 8x8 bit matrix whose rows are the bytes of x, so that bit j of byte i becomes bit i of
+// byte j
+func transpose8(x uint64) uint64 {
+	t := (x ^ x>>7) & 0x00aa00aa00aa00aa
+	x ^= t ^ t<<7
+	t = (x ^ x>>14) & 0x0000cccc0000cccc
+	x ^= t ^ t<<14
+	t = (x ^ x>>28) & 0x00000000f0f0f0f0
+	x ^= t ^ t<<28
+	return x
+}
+
+// transposeBytes transposes the 8x8 byte matrix whose rows are the words of r, so that byte j of word i becomes byte
+// i of word j. Blocks of the matrix are swapped across the diagonal, halving in size each time
+func transposeBytes(r *[8]uint64) {
+	for i := 0; i < 4; i++ {
+		t := (r[i]>>32 ^ r[i+4]) & 0x00000000ffffffff
+		r[i] ^= t << 32
+		r[i+4] ^= t
+	}
+	for _, i := range [4]int{0, 1, 4, 5} {
+		t := (r[i]>>16 ^ r[i+2]) & 0x0000ffff0000ffff
+		r[i] ^= t << 16
+		r[i+2] ^= t
+	}
+	for i := 0; i < 8; i += 2 {
+		t := (r[i]>>8 ^ r[i+1]) & 0x00ff00ff00ff00ff
+		r[i] ^= t << 8
+		r[i+1] ^= t
+	}
+}
+
+// subBytes applies the AES S-box to every byte of the blocks, without table lookups. The bytes of four blocks at a
+// time are bitsliced into eight 64 bit planes, plane j holding bit j of each of the 64 bytes, which go through the
+// 113 gate circuit of Boyar and Peralta as BearSSL's aes_ct does. Transposing the bits of each word and then the
+// bytes of the words takes the bytes to the planes and back
+func subBytes(b *[8]block) {
+	for half := 0; half < 2; half++ {
+		blocks := b[4*half : 4*half+4]
+		var q [8]uint64
+		for w := range q {
+			q[w] = transpose8(binary.LittleEndian.Uint64(blocks[w/2][8*(w%2):]))
+		}
+		transposeBytes(&q)
+		bitslicedSbox(&q)
+		transposeBytes(&q)
+		for w := range q {
+			binary.LittleEndian.PutUint64(blocks[w/2][8*(w%2):], transpose8(q[w]))
+		}
+	}
+}
+
+// bitslicedSbox is the S-box, q[j] being bit j of the bytes
+func bitslicedSbox(q *[8]uint64) {
+	x0, x1, x2, x3, x4, x5, x6, x7 := q[7], q[6], q[5], q[4], q[3], q[2], q[1], q[0]
+
+	// top linear transformation
+	y14 := x3 ^ x5
+	y13 := x0 ^ x6
+	y9 := x0 ^ x3
+	y8 := x0 ^ x5
+	t0 := x1 ^ x2
+	y1 := t0 ^ x7
+	y4 := y1 ^ x3
+	y12 := y13 ^ y14
+	y2 := y1 ^ x0
+	y5 := y1 ^ x6
+	y3 := y5 ^ y8
+	t1 := x4 ^ y12
+	y15 := t1 ^ x5
+	y20 := t1 ^ x1
+	y6 := y15 ^ x7
+	y10 := y15 ^ t0
+	y11 := y20 ^ y9
+	y7 := x7 ^ y11
+	y17 := y10 ^ y11
+	y19 := y10 ^ y8
+	y16 := t0 ^ y11
+	y21 := y13 ^ y16
+	y18 := x0 ^ y16
+
+	// non-linear section
+	t2 := y12 & y15
+	t3 := y3 & y6
+	t4 := t3 ^ t2
+	t5 := y4 & x7
+	t6 := t5 ^ t2
+	t7 := y13 & y16
+	t8 := y5 & y1
+	t9 := t8 ^ t7
+	t10 := y2 & y7
+	t11 := t10 ^ t7
+	t12 := y9 & y11
+	t13 := y14 & y17
+	t14 := t13 ^ t12
+	t15 := y8 & y10
+	t16 := t15 ^ t12
+	t17 := t4 ^ t14
+	t18 := t6 ^ t16
+	t19 := t9 ^ t14
+	t20 := t11 ^ t16
+	t21 := t17 ^ y20
+	t22 := t18 ^ y19
+	t23 := t19 ^ y21
+	t24 := t20 ^ y18
+
+	t25 := t21 ^ t22
+	t26 := t21 & t23
+	t27 := t24 ^ t26
+	t28 := t25 & t27
+	t29 := t28 ^ t22
+	t30 := t23 ^ t24
+	t31 := t22 ^ t26
+	t32 := t31 & t30
+	t33 := t32 ^ t24
+	t34 := t23 ^ t33
+	t35 := t27 ^ t33
+	t36 := t24 & t35
+	t37 := t36 ^ t34
+	t38 := t27 ^ t36
+	t39 := t29 & t38
+	t40 := t25 ^ t39
+
+	t41 := t40 ^ t37
+	t42 := t29 ^ t33
+	t43 := t29 ^ t40
+	t44 := t33 ^ t37
+	t45 := t42 ^ t41
+	z0 := t44 & y15
+	z1 := t37 & y6
+	z2 := t33 & x7
+	z3 := t43 & y16
+	z4 := t40 & y1
+	z5 := t29 & y7
+	z6 := t42 & y11
+	z7 := t45 & y17
+	z8 := t41 & y10
+	z9 := t44 & y12
+	z10 := t37 & y3
+	z11 := t33 & y4
+	z12 := t43 & y13
+	z13 := t40 & y5
+	z14 := t29 & y2
+	z15 := t42 & y9
+	z16 := t45 & y14
+	z17 := t41 & y8
+
+	// bottom linear transformation
+	t46 := z15 ^ z16
+	t47 := z10 ^ z11
+	t48 := z5 ^ z13
+	t49 := z9 ^ z10
+	t50 := z2 ^ z12
+	t51 := z2 ^ z5
+	t52 := z7 ^ z8
+	t53 := z0 ^ z3
+	t54 := z6 ^ z7
+	t55 := z16 ^ z17
+	t56 := z12 ^ t48
+	t57 := t50 ^ t53
+	t58 := z4 ^ t46
+	t59 := z3 ^ t54
+	t60 := t46 ^ t57
+	t61 := z14 ^ t57
+	t62 := t52 ^ t58
+	t63 := t49 ^ t58
+	t64 := z4 ^ t59
+	t65 := t61 ^ t62
+	t66 := z1 ^ t63
+	s0 := t59 ^ t63
+	s6 := t56 ^ ^t62
+	s7 := t48 ^ ^t60
+	t67 := t64 ^ t65
+	s3 := t53 ^ t66
+	s4 := t51 ^ t66
+	s5 := t47 ^ t65
+	s1 := t64 ^ ^s3
+	s2 := t55 ^ ^t67
+
+	q[7], q[6], q[5], q[4], q[3], q[2], q[1], q[0] = s0, s1, s2, s3, s4, s5, s6, s7
+}
+
+// xtime multiplies each of the four bytes of w by x in GF(2^8)
+func xtime(w uint32) uint32 {
+	return (w&0x7f7f7f7f)<<1 ^ (w>>7&0x01010101)*0x1b
+}
+
+// aesRounds does one AES encryption round of each of in with the round key of the same index in rk: SubBytes,
+// ShiftRows, MixColumns and AddRoundKey. Nothing in it depends on the bytes of in or rk other than through
+// arithmetic, so it's constant time. The eight rounds of an AEGIS-128L update are independent, so they're done
+// together to share the bitsliced S-box
+func aesRounds(in, rk *[8]block) (out [8]block) {
+	s := *in
+	subBytes(&s)
+	for i := range s {
+		var w [4]uint32
+		for c := range w {
+			w[c] = binary.BigEndian.Uint32(s[i][4*c:])
+		}
+		for c := 0; c < 4; c++ {
+			// ShiftRows moves row r r columns to the left
+			col := w[c]&0xff000000 | w[(c+1)%4]&0x00ff0000 | w[(c+2)%4]&0x0000ff00 | w[(c+3)%4]&0x000000ff
+			r8 := bits.RotateLeft32(col, 8)
+			col = xtime(col) ^ xtime(r8) ^ r8 ^ bits.RotateLeft32(col, 16) ^ bits.RotateLeft32(col, 24)
+			binary.BigEndian.PutUint32(out[i][4*c:], col^binary.BigEndian.Uint32(rk[i][4*c:]))
+		}
+	}
+	return
+}
+
+func xor(a, b *block) (out block) {
+	for i := range out {
+		out[i] = a[i] ^ b[i]
+	}
+	return
+}
+
+func and(a, b *block) (out block) {
+	for i := range out {
+		out[i] = a[i] & b[i]
+	}
+	return
+}
@@ -0,0 +1,197 @@
+// Package ascon implements Ascon-128, the lightweight AEAD of the Ascon v1.2 submission to the NIST Lightweight
+// Cryptography standardisation, which was selected for constrained devices in the CAESAR portfolio.
+//
+// This is Ascon-128 as submitted, with a 64 bit rate, and not the Ascon-AEAD128 variant of NIST SP 800-232, which
+// loads its inputs little-endian and has a different initialisation vector. The two don't interoperate.
+//
+// The permutation is computed on the five 64 bit words of the state with xor, and, not and rotations only, with no
+// table lookups or secret dependent branches, so it runs in constant time. The tag is compared in constant time too
+package ascon
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+const (
+	KeySize   = 16
+	NonceSize = 16
+	TagSize   = 16
+
+	rateLen = 8
+	// iv encodes the key length, rate and the rounds of the permutations p^a and p^b: 128, 64, 12 and 6
+	iv = 0x80400c0600000000
+)
+
+var errOpen = errors.New("ascon: message authentication failed")
+
+type ascon128 struct {
+	k0, k1 uint64
+}
+
+type state [5]uint64
+
+// New returns Ascon-128 keyed with key, which must be 16 bytes long
+func New(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, errors.New("ascon: key must be 16 bytes")
+	}
+	return &ascon128{
+		k0: binary.BigEndian.Uint64(key[:8]),
+		k1: binary.BigEndian.Uint64(key[8:]),
+	}, nil
+}
+
+func (a *ascon128) NonceSize() int { return NonceSize }
+func (a *ascon128) Overhead() int  { return TagSize }
+
+// permute applies the last rounds rounds of the 12 round permutation p^12
+func (s *state) permute(rounds int) {
+	x0, x1, x2, x3, x4 := s[0], s[1], s[2], s[3], s[4]
+	for r := 12 - rounds; r < 12; r++ {
+		// round constant
+		x2 ^= uint64(0xf0 - r*0x0f)
+
+		// substitution layer
+		x0 ^= x4
+		x4 ^= x3
+		x2 ^= x1
+		t0, t1, t2, t3, t4 := ^x0&x1, ^x1&x2, ^x2&x3, ^x3&x4, ^x4&x0
+		x0 ^= t1
+		x1 ^= t2
+		x2 ^= t3
+		x3 ^= t4
+		x4 ^= t0
+		x1 ^= x0
+		x0 ^= x4
+		x3 ^= x2
+		x2 = ^x2
+
+		// linear diffusion layer
+		x0 ^= bits.RotateLeft64(x0, -19) ^ bits.RotateLeft64(x0, -28)
+		x1 ^= bits.RotateLeft64(x1, -61) ^ bits.RotateLeft64(x1, -39)
+		x2 ^= bits.RotateLeft64(x2, -1) ^ bits.RotateLeft64(x2, -6)
+		x3 ^= bits.RotateLeft64(x3, -10) ^ bits.RotateLeft64(x3, -17)
+		x4 ^= bits.RotateLeft64(x4, -7) ^ bits.RotateLeft64(x4, -41)
+	}
+	s[0], s[1], s[2], s[3], s[4] = x0, x1, x2, x3, x4
+}
+
+// padded loads the less than 8 bytes of a final block, followed by the 0x80 padding byte
+func padded(b []byte) uint64 {
+	var buf [rateLen]byte
+	copy(buf[:], b)
+	buf[len(b)] = 0x80
+	return binary.BigEndian.Uint64(buf[:])
+}
+
+// storePartial writes the first len(dst) bytes of x into dst
+func storePartial(dst []byte, x uint64) {
+	var buf [rateLen]byte
+	binary.BigEndian.PutUint64(buf[:], x)
+	copy(dst, buf[:])
+}
+
+func (a *ascon128) init(nonce []byte, additionalData []byte) (s state) {
+	s = state{iv, a.k0, a.k1, binary.BigEndian.Uint64(nonce[:8]), binary.BigEndian.Uint64(nonce[8:])}
+	s.permute(12)
+	s[3] ^= a.k0
+	s[4] ^= a.k1
+
+	if len(additionalData) > 0 {
+		for len(additionalData) >= rateLen {
+			s[0] ^= binary.BigEndian.Uint64(additionalData)
+			s.permute(6)
+			additionalData = additionalData[rateLen:]
+		}
+		s[0] ^= padded(additionalData)
+		s.permute(6)
+	}
+	// domain separation between the additional data and the plaintext
+	s[4] ^= 1
+	return
+}
+
+func (a *ascon128) finalize(s *state) (tag [TagSize]byte) {
+	s[1] ^= a.k0
+	s[2] ^= a.k1
+	s.permute(12)
+	binary.BigEndian.PutUint64(tag[:8], s[3]^a.k0)
+	binary.BigEndian.PutUint64(tag[8:], s[4]^a.k1)
+	return
+}
+
+func (a *ascon128) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != NonceSize {
+		panic("ascon: incorrect nonce length given to Ascon-128")
+	}
+	s := a.init(nonce, additionalData)
+	ret, out := sliceForAppend(dst, len(plaintext)+TagSize)
+	// out may be plaintext itself, but each block is read before it's overwritten
+	i := 0
+	for ; len(plaintext)-i >= rateLen; i += rateLen {
+		s[0] ^= binary.BigEndian.Uint64(plaintext[i:])
+		binary.BigEndian.PutUint64(out[i:], s[0])
+		s.permute(6)
+	}
+	s[0] ^= padded(plaintext[i:])
+	storePartial(out[i:len(plaintext)], s[0])
+
+	tag := a.finalize(&s)
+	copy(out[len(plaintext):], tag[:])
+	return ret
+}
+
+func (a *ascon128) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != NonceSize {
+		panic("ascon: incorrect nonce length given to Ascon-128")
+	}
+	if len(ciphertext) < TagSize {
+		return nil, errOpen
+	}
+	var expectedTag [TagSize]byte
+	copy(expectedTag[:], ciphertext[len(ciphertext)-TagSize:])
+	ciphertext = ciphertext[:len(ciphertext)-TagSize]
+
+	s := a.init(nonce, additionalData)
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	i := 0
+	for ; len(ciphertext)-i >= rateLen; i += rateLen {
+		c := binary.BigEndian.Uint64(ciphertext[i:])
+		binary.BigEndian.PutUint64(out[i:], s[0]^c)
+		s[0] = c
+		s.permute(6)
+	}
+	last := ciphertext[i:]
+	var ks [rateLen]byte
+	binary.BigEndian.PutUint64(ks[:], s[0])
+	for j := range last {
+		out[i+j] = last[j] ^ ks[j]
+	}
+	s[0] ^= padded(out[i:])
+
+	tag := a.finalize(&s)
+	if subtle.ConstantTimeCompare(tag[:], expectedTag[:]) != 1 {
+		for i := range out {
+			out[i] = 0
+		}
+		return nil, errOpen
+	}
+	return ret, nil
+}
+
+// sliceForAppend takes a slice and a requested number of bytes. It returns a slice with the contents of the given
+// slice followed by that many bytes and a second slice that aliases into it and contains only the extra bytes.
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
@@ -0,0 +1,111 @@
+package ascon
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// test vectors from LWC_AEAD_KAT_128_128.txt of the Ascon v1.2 reference implementation, with the key and nonce of
+// every entry being 000102030405060708090a0b0c0d0e0f. The ciphertexts are followed by the tag
+var vectors = []struct {
+	count             int
+	aad, plaintext    string
+	ciphertextWithTag string
+}{
+	{1, "", "", "e355159f292911f794cb1432a0103a8a"},
+	{2, "00", "", "944df887cd4901614c5dedbc42fc0da0"},
+	{34, "", "00", "bc18c3f4e39eca7222490d967c79bffc92"},
+}
+
+func TestVectors(t *testing.T) {
+	key := unhex("000102030405060708090a0b0c0d0e0f")
+	nonce := key
+	a, err := New(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range vectors {
+		expected := unhex(v.ciphertextWithTag)
+		sealed := a.Seal(nil, nonce, unhex(v.plaintext), unhex(v.aad))
+		if !bytes.Equal(sealed, expected) {
+			t.Errorf("count %v: expecting %x, got %x", v.count, expected, sealed)
+		}
+		opened, err := a.Open(nil, nonce, expected, unhex(v.aad))
+		if err != nil {
+			t.Errorf("count %v: failed to open: %v", v.count, err)
+		} else if !bytes.Equal(opened, unhex(v.plaintext)) {
+			t.Errorf("count %v: expecting plaintext %v, got %x", v.count, v.plaintext, opened)
+		}
+
+		expected[0] ^= 1
+		if _, err := a.Open(nil, nonce, expected, unhex(v.aad)); err == nil {
+			t.Errorf("count %v: opened a tampered ciphertext", v.count)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := make([]byte, KeySize)
+	nonce := make([]byte, NonceSize)
+	rand.Read(key)
+	rand.Read(nonce)
+	a, _ := New(key)
+	for _, n := range []int{0, 1, 7, 8, 9, 16, 100} {
+		for _, adLen := range []int{0, 5, 8, 13} {
+			plaintext := make([]byte, n)
+			rand.Read(plaintext)
+			ad := make([]byte, adLen)
+			rand.Read(ad)
+
+			buf := make([]byte, n, n+TagSize)
+			copy(buf, plaintext)
+			sealed := a.Seal(buf[:0], nonce, buf, ad)
+			if !bytes.Equal(sealed, a.Seal(nil, nonce, plaintext, ad)) {
+				t.Errorf("%v bytes with %v of ad: sealing in place differs", n, adLen)
+			}
+			opened, err := a.Open(sealed[:0], nonce, sealed, ad)
+			if err != nil || !bytes.Equal(opened, plaintext) {
+				t.Errorf("%v bytes with %v of ad: opening in place failed: %v", n, adLen, err)
+			}
+		}
+	}
+}
+
+func BenchmarkSeal(b *testing.B) {
+	key := make([]byte, 32)
+	a, _ := New(key[:KeySize])
+	block, _ := aes.NewCipher(key[:16])
+	gcm, _ := cipher.NewGCM(block)
+	chacha, _ := chacha20poly1305.New(key)
+	for _, c := range []struct {
+		name string
+		aead cipher.AEAD
+	}{{"Ascon128", a}, {"AES128GCM", gcm}, {"ChaCha20Poly1305", chacha}} {
+		for _, size := range []int{64, 1024, 16384} {
+			b.Run(fmt.Sprintf("%v/%v", c.name, size), func(b *testing.B) {
+				nonce := make([]byte, c.aead.NonceSize())
+				plaintext := make([]byte, size)
+				buf := make([]byte, 0, size+c.aead.Overhead())
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					c.aead.Seal(buf, nonce, plaintext, nil)
+				}
+			})
+		}
+	}
+}
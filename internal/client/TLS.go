@@ -7,6 +7,8 @@ import (
 	"net"
 
 	log "github.com/sirupsen/logrus"
+
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
 )
 
 type clientHelloFields struct {
@@ -59,7 +61,7 @@ type DirectTLS struct {
 	Transport
 }
 
-func (DirectTLS) HasRecordLayer() bool                              { return true }
+func (DirectTLS) RecordLayer() mux.RecordLayer                      { return mux.TLSRecordLayer{} }
 func (DirectTLS) UnitReadFunc() func(net.Conn, []byte) (int, error) { return util.ReadTLS }
 
 // PrepareConnection handles the TLS handshake for a given conn and returns the sessionKey
@@ -22,11 +22,11 @@ type authenticationPayload struct {
 func makeAuthenticationPayload(sta *State, randReader io.Reader) (ret authenticationPayload, sharedSecret []byte) {
 	/*
 		Authentication data:
-		+----------+----------------+---------------------+-------------+--------------+--------+------------+
-		|  _UID_   | _Proxy Method_ | _Encryption Method_ | _Timestamp_ | _Session Id_ | _Flag_ | _reserved_ |
-		+----------+----------------+---------------------+-------------+--------------+--------+------------+
-		| 16 bytes | 12 bytes       | 1 byte              | 8 bytes     | 4 bytes      | 1 byte | 6 bytes    |
-		+----------+----------------+---------------------+-------------+--------------+--------+------------+
+		+----------+----------------+---------------------+-------------+--------------+--------+-----------+------------+
+		|  _UID_   | _Proxy Method_ | _Encryption Method_ | _Timestamp_ | _Session Id_ | _Flag_ | _Version_ | _reserved_ |
+		+----------+----------------+---------------------+-------------+--------------+--------+-----------+------------+
+		| 16 bytes | 12 bytes       | 1 byte              | 8 bytes     | 4 bytes      | 1 byte | 1 byte    | 5 bytes    |
+		+----------+----------------+---------------------+-------------+--------------+--------+-----------+------------+
 	*/
 	ephPv, ephPub, _ := ecdh.GenerateKey(randReader)
 	copy(ret.randPubKey[:], ecdh.Marshal(ephPub))
@@ -34,13 +34,14 @@ func makeAuthenticationPayload(sta *State, randReader io.Reader) (ret authentica
 	plaintext := make([]byte, 48)
 	copy(plaintext, sta.UID)
 	copy(plaintext[16:28], sta.ProxyMethod)
-	plaintext[28] = sta.EncryptionMethod
+	plaintext[28] = byte(sta.EncryptionMethod)
 	binary.BigEndian.PutUint64(plaintext[29:37], uint64(sta.Now().Unix()))
 	binary.BigEndian.PutUint32(plaintext[37:41], atomic.LoadUint32(&sta.SessionID))
 
 	if sta.Unordered {
 		plaintext[41] |= UNORDERED_FLAG
 	}
+	plaintext[42] = sta.ProtocolVersion
 
 	sharedSecret = ecdh.GenerateSharedSecret(ephPv, sta.staticPub)
 	ciphertextWithTag, _ := util.AESGCMEncrypt(ret.randPubKey[:12], sharedSecret, plaintext)
@@ -23,6 +23,7 @@ type rawConfig struct {
 	Transport        string
 	NumConn          int
 	StreamTimeout    int
+	ProtocolVersion  byte
 }
 
 // State stores the parsed configuration fields
@@ -43,10 +44,13 @@ type State struct {
 	browser   browser
 
 	ProxyMethod      string
-	EncryptionMethod byte
-	ServerName       string
-	NumConn          int
-	Timeout          time.Duration
+	EncryptionMethod mux.Method
+	// ProtocolVersion is the version of the frame format the session is obfsed in, which is sent to the server in
+	// the handshake
+	ProtocolVersion byte
+	ServerName      string
+	NumConn         int
+	Timeout         time.Duration
 }
 
 // semi-colon separated value. This is for Android plugin options
@@ -68,7 +72,7 @@ func ssvToJson(ssv string) (ret []byte) {
 		value := sp[1]
 		// JSON doesn't like quotation marks around int and bool
 		// This is extremely ugly but it's still better than writing a tokeniser
-		if key == "NumConn" || key == "Unordered" || key == "StreamTimeout" {
+		if key == "NumConn" || key == "Unordered" || key == "StreamTimeout" || key == "ProtocolVersion" {
 			ret = append(ret, []byte(`"`+key+`":`+value+`,`)...)
 		} else {
 			ret = append(ret, []byte(`"`+key+`":"`+value+`",`)...)
@@ -97,15 +101,14 @@ func (sta *State) ParseConfig(conf string) (err error) {
 		return err
 	}
 
-	switch strings.ToLower(preParse.EncryptionMethod) {
-	case "plain":
-		sta.EncryptionMethod = mux.E_METHOD_PLAIN
-	case "aes-gcm":
-		sta.EncryptionMethod = mux.E_METHOD_AES_GCM
-	case "chacha20-poly1305":
-		sta.EncryptionMethod = mux.E_METHOD_CHACHA20_POLY1305
-	default:
-		return errors.New("Unknown encryption method")
+	sta.EncryptionMethod, err = mux.ParseMethod(preParse.EncryptionMethod)
+	if err != nil {
+		return err
+	}
+
+	sta.ProtocolVersion, err = mux.ParseProtocolVersion(preParse.ProtocolVersion)
+	if err != nil {
+		return err
 	}
 
 	switch strings.ToLower(preParse.BrowserSig) {
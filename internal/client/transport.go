@@ -1,9 +1,13 @@
 package client
 
-import "net"
+import (
+	"net"
+
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+)
 
 type Transport interface {
 	PrepareConnection(*State, net.Conn) (net.Conn, []byte, error)
-	HasRecordLayer() bool
+	RecordLayer() mux.RecordLayer
 	UnitReadFunc() func(net.Conn, []byte) (int, error)
 }
@@ -12,13 +12,15 @@ import (
 	"net/url"
 
 	utls "github.com/refraction-networking/utls"
+
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
 )
 
 type WSOverTLS struct {
 	Transport
 }
 
-func (WSOverTLS) HasRecordLayer() bool                              { return false }
+func (WSOverTLS) RecordLayer() mux.RecordLayer                      { return mux.NoRecordLayer{} }
 func (WSOverTLS) UnitReadFunc() func(net.Conn, []byte) (int, error) { return util.ReadWebSocket }
 
 func (WSOverTLS) PrepareConnection(sta *State, conn net.Conn) (preparedConn net.Conn, sessionKey []byte, err error) {
@@ -0,0 +1,166 @@
+// Package gcmsiv implements AES-GCM-SIV, the nonce misuse-resistant AEAD specified in RFC 8452.
+//
+// Repeating a nonce under the same key only leaks whether the same (nonce, additional data, plaintext) triple has been
+// encrypted before, rather than destroying confidentiality and authenticity the way it does for AES-GCM.
+package gcmsiv
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	NonceSize = 12
+	TagSize   = 16
+
+	// RFC 8452 section 6. P_MAX and A_MAX are 2^36 bytes
+	maxInputLen = 1 << 36
+)
+
+var errOpen = errors.New("gcmsiv: message authentication failed")
+
+type gcmSIV struct {
+	// keyGen is the key-generating key from which the per-nonce authentication and encryption keys are derived
+	keyGen cipher.Block
+	keyLen int
+}
+
+// New returns AES-GCM-SIV keyed with key, which must be either 16 bytes (AEAD_AES_128_GCM_SIV) or 32 bytes
+// (AEAD_AES_256_GCM_SIV) long
+func New(key []byte) (cipher.AEAD, error) {
+	if len(key) != 16 && len(key) != 32 {
+		return nil, errors.New("gcmsiv: key must be 16 or 32 bytes")
+	}
+	keyGen, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmSIV{keyGen: keyGen, keyLen: len(key)}, nil
+}
+
+func (g *gcmSIV) NonceSize() int { return NonceSize }
+func (g *gcmSIV) Overhead() int  { return TagSize }
+
+// deriveKeys implements the per-nonce key derivation of RFC 8452 section 4
+func (g *gcmSIV) deriveKeys(nonce []byte) (authKey [16]byte, encBlock cipher.Block) {
+	var in, out [16]byte
+	copy(in[4:], nonce)
+
+	encKey := make([]byte, g.keyLen)
+	blocks := 2 + g.keyLen/8
+	for i := 0; i < blocks; i++ {
+		binary.LittleEndian.PutUint32(in[:4], uint32(i))
+		g.keyGen.Encrypt(out[:], in[:])
+		if i < 2 {
+			copy(authKey[i*8:], out[:8])
+		} else {
+			copy(encKey[(i-2)*8:], out[:8])
+		}
+	}
+	// encKey is always a valid AES key length so this cannot fail
+	encBlock, _ = aes.NewCipher(encKey)
+	return
+}
+
+func (g *gcmSIV) tag(authKey [16]byte, encBlock cipher.Block, nonce, plaintext, additionalData []byte) (tag [TagSize]byte) {
+	p := newPolyval(authKey)
+	p.update(additionalData)
+	p.update(plaintext)
+
+	var lengths [16]byte
+	binary.LittleEndian.PutUint64(lengths[:8], uint64(len(additionalData))*8)
+	binary.LittleEndian.PutUint64(lengths[8:], uint64(len(plaintext))*8)
+	p.update(lengths[:])
+
+	s := p.sum()
+	for i := range nonce {
+		s[i] ^= nonce[i]
+	}
+	s[15] &= 0x7f
+	encBlock.Encrypt(tag[:], s[:])
+	return
+}
+
+// ctr is the counter mode described in RFC 8452 section 4, where the rightmost bit of the initial counter block is
+// set, and only the first 32 bits are incremented as a little-endian integer
+func ctr(encBlock cipher.Block, tag [TagSize]byte, dst, src []byte) {
+	counter := tag
+	counter[15] |= 0x80
+	var keystream [16]byte
+	for len(src) > 0 {
+		encBlock.Encrypt(keystream[:], counter[:])
+		binary.LittleEndian.PutUint32(counter[:4], binary.LittleEndian.Uint32(counter[:4])+1)
+		n := len(src)
+		if n > 16 {
+			n = 16
+		}
+		for i := 0; i < n; i++ {
+			dst[i] = src[i] ^ keystream[i]
+		}
+		dst = dst[n:]
+		src = src[n:]
+	}
+}
+
+func (g *gcmSIV) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != NonceSize {
+		panic("gcmsiv: incorrect nonce length given to GCM-SIV")
+	}
+	if uint64(len(plaintext)) > maxInputLen || uint64(len(additionalData)) > maxInputLen {
+		panic("gcmsiv: message too large for GCM-SIV")
+	}
+
+	authKey, encBlock := g.deriveKeys(nonce)
+	// plaintext must be authenticated before it's overwritten by a potentially overlapping dst
+	tag := g.tag(authKey, encBlock, nonce, plaintext, additionalData)
+
+	ret, out := sliceForAppend(dst, len(plaintext)+TagSize)
+	ctr(encBlock, tag, out, plaintext)
+	copy(out[len(plaintext):], tag[:])
+	return ret
+}
+
+func (g *gcmSIV) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != NonceSize {
+		panic("gcmsiv: incorrect nonce length given to GCM-SIV")
+	}
+	if len(ciphertext) < TagSize {
+		return nil, errOpen
+	}
+	if uint64(len(ciphertext)-TagSize) > maxInputLen || uint64(len(additionalData)) > maxInputLen {
+		return nil, errOpen
+	}
+
+	var expectedTag [TagSize]byte
+	copy(expectedTag[:], ciphertext[len(ciphertext)-TagSize:])
+	ciphertext = ciphertext[:len(ciphertext)-TagSize]
+
+	authKey, encBlock := g.deriveKeys(nonce)
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	ctr(encBlock, expectedTag, out, ciphertext)
+
+	tag := g.tag(authKey, encBlock, nonce, out, additionalData)
+	if subtle.ConstantTimeCompare(tag[:], expectedTag[:]) != 1 {
+		for i := range out {
+			out[i] = 0
+		}
+		return nil, errOpen
+	}
+	return ret, nil
+}
+
+// sliceForAppend takes a slice and a requested number of bytes. It returns a slice with the contents of the given
+// slice followed by that many bytes and a second slice that aliases into it and contains only the extra bytes.
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
@@ -0,0 +1,207 @@
+package gcmsiv
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestPolyval(t *testing.T) {
+	// RFC 8452 Appendix A
+	var h [16]byte
+	copy(h[:], unhex("25629347589242761d31f826ba4b757b"))
+	p := newPolyval(h)
+	p.update(unhex("4f4f95668c83dfb6401762bb2d01a262"))
+	p.update(unhex("d1a24ddd2721d006bbe45f20d3c9f362"))
+	s := p.sum()
+	if !bytes.Equal(s[:], unhex("f7a3b47b846119fae5b7866cf5e5b77e")) {
+		t.Errorf("expecting f7a3b47b846119fae5b7866cf5e5b77e, got %x", s)
+	}
+}
+
+// mulBitwise is a*b mod P worked out one bit of b at a time, which dot is checked against
+func mulBitwise(a, b fieldElement) fieldElement {
+	var r fieldElement
+	for i := 127; i >= 0; i-- {
+		carry := -(r.hi >> 63)
+		r.hi = r.hi<<1 | r.lo>>63
+		r.lo <<= 1
+		r.hi ^= carry & 0xc200000000000000
+		r.lo ^= carry & 1
+
+		var bit uint64
+		if i >= 64 {
+			bit = b.hi >> uint(i-64) & 1
+		} else {
+			bit = b.lo >> uint(i) & 1
+		}
+		r.hi ^= a.hi & -bit
+		r.lo ^= a.lo & -bit
+	}
+	return r
+}
+
+func TestDot(t *testing.T) {
+	// x^-128 is x^-1 = x^127 + x^126 + x^125 + x^120 squared seven times
+	xInv128 := fieldElement{hi: 0xe100000000000000}
+	for i := 0; i < 7; i++ {
+		xInv128 = mulBitwise(xInv128, xInv128)
+	}
+	var buf [32]byte
+	for i := 0; i < 1000; i++ {
+		rand.Read(buf[:])
+		a, b := loadFieldElement(buf[:16]), loadFieldElement(buf[16:])
+		if i == 0 {
+			a = fieldElement{lo: ^uint64(0), hi: ^uint64(0)}
+		}
+		if got, expected := dot(a, b), mulBitwise(mulBitwise(a, b), xInv128); got != expected {
+			t.Fatalf("dot(%x, %x): expecting %x, got %x", a, b, expected, got)
+		}
+	}
+}
+
+// test vectors from RFC 8452 Appendix C
+var vectors = []struct {
+	key, nonce, aad, plaintext, result string
+}{
+	{
+		"01000000000000000000000000000000",
+		"030000000000000000000000",
+		"",
+		"",
+		"dc20e2d83f25705bb49e439eca56de25",
+	},
+	{
+		"01000000000000000000000000000000",
+		"030000000000000000000000",
+		"",
+		"0100000000000000",
+		"b5d839330ac7b786578782fff6013b815b287c22493a364c",
+	},
+	{
+		"01000000000000000000000000000000",
+		"030000000000000000000000",
+		"01",
+		"0200000000000000",
+		"1e6daba35669f4273b0a1a2560969cdf790d99759abd1508",
+	},
+	{
+		"0100000000000000000000000000000000000000000000000000000000000000",
+		"030000000000000000000000",
+		"",
+		"",
+		"07f5f4169bbf55a8400cd47ea6fd400f",
+	},
+	{
+		"0100000000000000000000000000000000000000000000000000000000000000",
+		"030000000000000000000000",
+		"",
+		"0100000000000000",
+		"c2ef328e5c71c83b843122130f7364b761e0b97427e3df28",
+	},
+}
+
+func TestVectors(t *testing.T) {
+	for _, v := range vectors {
+		aead, err := New(unhex(v.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := aead.Seal(nil, unhex(v.nonce), unhex(v.plaintext), unhex(v.aad))
+		if !bytes.Equal(result, unhex(v.result)) {
+			t.Errorf("sealing %v under key %v: expecting %v, got %x", v.plaintext, v.key, v.result, result)
+			continue
+		}
+		plaintext, err := aead.Open(nil, unhex(v.nonce), result, unhex(v.aad))
+		if err != nil {
+			t.Errorf("failed to open %v: %v", v.result, err)
+			continue
+		}
+		if !bytes.Equal(plaintext, unhex(v.plaintext)) {
+			t.Errorf("opening %v: expecting %v, got %x", v.result, v.plaintext, plaintext)
+		}
+	}
+}
+
+func TestInPlaceAndTamper(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	nonce := make([]byte, NonceSize)
+	rand.Read(nonce)
+	aad := []byte("additional data")
+	aead, _ := New(key)
+
+	for _, l := range []int{0, 1, 15, 16, 17, 300} {
+		plaintext := make([]byte, l)
+		rand.Read(plaintext)
+		buf := make([]byte, l, l+TagSize)
+		copy(buf, plaintext)
+
+		sealed := aead.Seal(buf[:0], nonce, buf, aad)
+		if &sealed[0] != &buf[:1][0] {
+			t.Errorf("Seal with enough capacity should not reallocate")
+		}
+		opened, err := aead.Open(sealed[:0], nonce, sealed, aad)
+		if err != nil {
+			t.Errorf("failed to open a %v byte message in place: %v", l, err)
+			continue
+		}
+		if !bytes.Equal(opened, plaintext) {
+			t.Errorf("in place round trip of a %v byte message failed", l)
+		}
+
+		sealed = aead.Seal(nil, nonce, plaintext, aad)
+		for i := range sealed {
+			tampered := make([]byte, len(sealed))
+			copy(tampered, sealed)
+			tampered[i] ^= 0x01
+			if _, err := aead.Open(nil, nonce, tampered, aad); err == nil {
+				t.Errorf("flipping byte %v of a %v byte message should fail authentication", i, l)
+			}
+		}
+		if _, err := aead.Open(nil, nonce, sealed, []byte("other data")); err == nil {
+			t.Errorf("mismatched additional data should fail authentication")
+		}
+	}
+}
+
+func TestBadKeyLength(t *testing.T) {
+	if _, err := New(make([]byte, 24)); err == nil {
+		t.Error("24 byte key should be rejected")
+	}
+}
+
+func BenchmarkSeal(b *testing.B) {
+	key := make([]byte, 32)
+	siv, _ := New(key)
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCM(block)
+	for _, c := range []struct {
+		name string
+		aead cipher.AEAD
+	}{{"AES256GCMSIV", siv}, {"AES256GCM", gcm}} {
+		for _, size := range []int{64, 1024, 16384} {
+			b.Run(fmt.Sprintf("%v/%v", c.name, size), func(b *testing.B) {
+				nonce := make([]byte, c.aead.NonceSize())
+				plaintext := make([]byte, size)
+				buf := make([]byte, 0, size+c.aead.Overhead())
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					c.aead.Seal(buf, nonce, plaintext, nil)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package gcmsiv
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// fieldElement is an element of GF(2^128) as defined by POLYVAL, with the irreducible polynomial
+// x^128 + x^127 + x^126 + x^121 + 1. Bit i of the 128 bit little-endian integer (lo, hi) is the coefficient of x^i
+type fieldElement struct {
+	lo, hi uint64
+}
+
+func loadFieldElement(b []byte) fieldElement {
+	return fieldElement{
+		lo: binary.LittleEndian.Uint64(b[:8]),
+		hi: binary.LittleEndian.Uint64(b[8:16]),
+	}
+}
+
+func (e fieldElement) store(b []byte) {
+	binary.LittleEndian.PutUint64(b[:8], e.lo)
+	binary.LittleEndian.PutUint64(b[8:16], e.hi)
+}
+
+// bmul64 returns the low 64 bits of the carryless product of x and y. The bits are spread out four apart so that
+// the carries of ordinary integer multiplication never reach the next bit that is kept, making it constant time
+// wherever integer multiplication is, as in BearSSL's ghash_ctmul64
+func bmul64(x, y uint64) uint64 {
+	const m0, m1, m2, m3 = 0x1111111111111111, 0x2222222222222222, 0x4444444444444444, 0x8888888888888888
+	x0, x1, x2, x3 := x&m0, x&m1, x&m2, x&m3
+	y0, y1, y2, y3 := y&m0, y&m1, y&m2, y&m3
+	z0 := x0*y0 ^ x1*y3 ^ x2*y2 ^ x3*y1
+	z1 := x0*y1 ^ x1*y0 ^ x2*y3 ^ x3*y2
+	z2 := x0*y2 ^ x1*y1 ^ x2*y0 ^ x3*y3
+	z3 := x0*y3 ^ x1*y2 ^ x2*y1 ^ x3*y0
+	return z0&m0 | z1&m1 | z2&m2 | z3&m3
+}
+
+// clmul returns the 128 bit carryless product of x and y. The high half is the low half of the product of the bit
+// reversed operands, reversed back
+func clmul(x, y uint64) (hi, lo uint64) {
+	lo = bmul64(x, y)
+	hi = bits.Reverse64(bmul64(bits.Reverse64(x), bits.Reverse64(y))) >> 1
+	return
+}
+
+// dot computes POLYVAL's dot(a, b) = a*b*x^-128 mod P in constant time. The product is worked out with Karatsuba's
+// three carryless multiplications, and x^-128 is then folded in 64 bits at a time by adding multiples of P that
+// clear the low half, as P = x^128 + x^127 + x^126 + x^121 + 1
+func dot(a, b fieldElement) fieldElement {
+	h1, h0 := clmul(a.hi, b.hi)
+	l1, l0 := clmul(a.lo, b.lo)
+	m1, m0 := clmul(a.hi^a.lo, b.hi^b.lo)
+	m1 ^= h1 ^ l1
+	m0 ^= h0 ^ l0
+	d0, d1, d2, d3 := l0, l1^m0, h0^m1, h1
+
+	// d0 * P cancels d0, adding d0 * (x^127 + x^126 + x^121) to d1 and d2 and d0 * x^128 to d2
+	d1 ^= d0<<63 ^ d0<<62 ^ d0<<57
+	d2 ^= d0 ^ d0>>1 ^ d0>>2 ^ d0>>7
+	// and the same for d1 one word up
+	d2 ^= d1<<63 ^ d1<<62 ^ d1<<57
+	d3 ^= d1 ^ d1>>1 ^ d1>>2 ^ d1>>7
+	return fieldElement{lo: d2, hi: d3}
+}
+
+type polyval struct {
+	h   fieldElement
+	acc fieldElement
+}
+
+func newPolyval(key [16]byte) *polyval {
+	return &polyval{h: loadFieldElement(key[:])}
+}
+
+// update absorbs b, zero padding it to a multiple of 16 bytes
+func (p *polyval) update(b []byte) {
+	for len(b) > 0 {
+		var block [16]byte
+		n := copy(block[:], b)
+		b = b[n:]
+		x := loadFieldElement(block[:])
+		p.acc.lo ^= x.lo
+		p.acc.hi ^= x.hi
+		p.acc = dot(p.acc, p.h)
+	}
+}
+
+func (p *polyval) sum() (s [16]byte) {
+	p.acc.store(s[:])
+	return
+}
@@ -0,0 +1,85 @@
+package multiplex
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Compression is the codec payloads are compressed with before they are encrypted. It's recorded in the frame
+// header of each compressed frame, so the receiving end doesn't need to be told which one is used
+type Compression byte
+
+const (
+	COMPRESSION_NONE Compression = iota
+	COMPRESSION_DEFLATE
+
+	maxCompression = iota - 1
+)
+
+var ErrCompressionUnsupported = errors.New("compression needs PROTOCOL_V7 or above")
+var ErrBadCompression = errors.New("compressed payload is malformed or too long")
+
+const (
+	// payloads shorter than this are never compressed, as they hardly ever get any shorter
+	minCompressLen = 32
+	// maxDecompressedLen is the length of the longest payload a compressed payload is decompressed into
+	maxDecompressedLen = 1 << 20
+)
+
+func (c Compression) Valid() bool { return c <= maxCompression }
+
+type deflater struct {
+	buf bytes.Buffer
+	w   *flate.Writer
+}
+
+var deflaterPool = sync.Pool{
+	New: func() interface{} {
+		d := &deflater{}
+		d.w, _ = flate.NewWriter(&d.buf, flate.BestSpeed)
+		return d
+	},
+}
+
+var inflaterPool sync.Pool
+
+// compress compresses the concatenation of payload with c. The result is only valid until the deflater is put back
+// into deflaterPool
+func compress(c Compression, payload [][]byte) (*deflater, []byte) {
+	d := deflaterPool.Get().(*deflater)
+	d.buf.Reset()
+	d.w.Reset(&d.buf)
+	for _, fragment := range payload {
+		d.w.Write(fragment)
+	}
+	d.w.Close()
+	return d, d.buf.Bytes()
+}
+
+// decompress decompresses a payload compressed with c into a new buffer
+func decompress(c Compression, compressed []byte) ([]byte, error) {
+	if c != COMPRESSION_DEFLATE {
+		return nil, fmt.Errorf("%w: unknown compression %v", ErrBadCompression, c)
+	}
+	var r io.ReadCloser
+	if pooled := inflaterPool.Get(); pooled != nil {
+		r = pooled.(io.ReadCloser)
+		r.(flate.Resetter).Reset(bytes.NewReader(compressed), nil)
+	} else {
+		r = flate.NewReader(bytes.NewReader(compressed))
+	}
+	defer inflaterPool.Put(r)
+	payload, err := ioutil.ReadAll(io.LimitReader(r, maxDecompressedLen+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadCompression, err)
+	}
+	if len(payload) > maxDecompressedLen {
+		return nil, ErrBadCompression
+	}
+	return payload, nil
+}
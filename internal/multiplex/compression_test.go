@@ -0,0 +1,75 @@
+package multiplex
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	compressible := bytes.Repeat([]byte(`{"key": "value"}`), 100)
+	incompressible := make([]byte, 1600)
+	rand.Read(incompressible)
+	obfsBuf := make([]byte, 2000)
+
+	configs := map[string]ObfsConfig{
+		"aes-gcm": {RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V7, Compression: COMPRESSION_DEFLATE},
+		"plain":   {RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V7, Compression: COMPRESSION_DEFLATE, PlainMAC: true},
+	}
+	for name, config := range configs {
+		method := E_METHOD_AES_GCM
+		if config.PlainMAC {
+			method = E_METHOD_PLAIN
+		}
+		compressing, _ := GenerateObfsWithConfig(method, sessionKey, config)
+		config.Compression = COMPRESSION_NONE
+		receiver, _ := GenerateObfsWithConfig(method, sessionKey, config)
+
+		for shrinks, payload := range map[bool][]byte{true: compressible, false: incompressible} {
+			testFrame := &Frame{StreamID: 1, Seq: 2, Payload: payload}
+			n, err := compressing.Obfs(testFrame, obfsBuf)
+			if err != nil {
+				t.Fatalf("%v: %v", name, err)
+			}
+			if shrunk := n < receiver.frameLen(len(payload)); shrunk != shrinks {
+				t.Errorf("%v: a frame of %v bytes for a %v byte payload", name, n, len(payload))
+			}
+			f, err := receiver.Deobfs(obfsBuf[:n])
+			if err != nil {
+				t.Fatalf("%v: failed to deobfs: %v", name, err)
+			}
+			if !bytes.Equal(f.Payload, payload) {
+				t.Errorf("%v: payload mismatch", name)
+			}
+		}
+
+		// the codec is authenticated along with the rest of the header
+		n, _ := compressing.Obfs(&Frame{StreamID: 1, Payload: compressible}, obfsBuf)
+		obfsBuf[recordHeaderLen+headerV7.compressionOffset()] ^= byte(COMPRESSION_DEFLATE)
+		if _, err := receiver.Deobfs(obfsBuf[:n]); !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("%v: expecting %v for a flipped compression flag, got %v", name, ErrAuthFailed, err)
+		}
+	}
+}
+
+func TestCompressionNeedsWideFlags(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	config := ObfsConfig{ProtocolVersion: PROTOCOL_V6, Compression: COMPRESSION_DEFLATE}
+	if _, err := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, config); !errors.Is(err, ErrCompressionUnsupported) {
+		t.Errorf("expecting %v, got %v", ErrCompressionUnsupported, err)
+	}
+}
+
+func TestDecompressionLimit(t *testing.T) {
+	d, compressed := compress(COMPRESSION_DEFLATE, [][]byte{make([]byte, maxDecompressedLen+1)})
+	defer deflaterPool.Put(d)
+	if _, err := decompress(COMPRESSION_DEFLATE, compressed); !errors.Is(err, ErrBadCompression) {
+		t.Errorf("expecting %v for a payload decompressing into too much, got %v", ErrBadCompression, err)
+	}
+	if _, err := decompress(COMPRESSION_DEFLATE, []byte("not deflate")); !errors.Is(err, ErrBadCompression) {
+		t.Errorf("expecting %v for a malformed payload, got %v", ErrBadCompression, err)
+	}
+}
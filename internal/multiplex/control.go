@@ -0,0 +1,148 @@
+package multiplex
+
+import "encoding/binary"
+
+// Control frames are sent on StreamID 0 with FlagControl set and are meant for the session itself. They go through
+// obfs and deobfs like any other frame so they can't be told apart from data on the wire, which means each of them
+// needs a Seq of its own, as the StreamID and Seq make up the nonce. The payload is the ControlType followed by an 8
+// byte token. Window updates are control frames on StreamID 0 too, and carry the 8 byte ID of the stream they are for
+// and a 4 byte credit increment instead of a token.
+
+type ControlType byte
+
+const (
+	// ControlPing asks the remote to reply with a ControlPong carrying the same token
+	ControlPing ControlType = iota + 1
+	ControlPong
+	// ControlWindowUpdate grants the remote the credit to send that many more bytes of payload on the stream, for
+	// flow control of each stream as HTTP/2 has. See NewWindowUpdateFrame
+	ControlWindowUpdate
+	// ControlGoAway tells the remote that the session is being drained: no streams it opens after the last one
+	// accepted will be, though the ones already open are carried on with. See NewGoAwayFrame
+	ControlGoAway
+)
+
+const (
+	controlPayloadLen      = 1 + 8
+	windowUpdatePayloadLen = 1 + 8 + 4
+	goAwayPayloadLen       = 1 + 8 + 4
+)
+
+// NewControlFrame returns a control frame of controlType carrying token. seq must not have been used by any other
+// frame sent on StreamID 0 with the same key
+func NewControlFrame(seq uint64, controlType ControlType, token [8]byte) *Frame {
+	payload := make([]byte, controlPayloadLen)
+	payload[0] = byte(controlType)
+	copy(payload[1:], token[:])
+	return &Frame{
+		StreamID: 0,
+		Seq:      seq,
+		Closing:  FlagControl,
+		Payload:  payload,
+	}
+}
+
+// Control returns the type and token of a control frame. ok is false if f isn't a well formed control frame
+func (f *Frame) Control() (controlType ControlType, token [8]byte, ok bool) {
+	if f.Closing&FlagControl == 0 || len(f.Payload) != controlPayloadLen {
+		return
+	}
+	controlType = ControlType(f.Payload[0])
+	copy(token[:], f.Payload[1:])
+	return controlType, token, true
+}
+
+// NewWindowUpdateFrame returns a window update granting increment more bytes of credit on streamID. It's sent on
+// StreamID 0 rather than on streamID, whose Seqs are taken by its data frames, so seq is one of StreamID 0 as for
+// NewControlFrame
+func NewWindowUpdateFrame(seq uint64, streamID uint64, increment uint32) *Frame {
+	payload := make([]byte, windowUpdatePayloadLen)
+	payload[0] = byte(ControlWindowUpdate)
+	binary.BigEndian.PutUint64(payload[1:9], streamID)
+	binary.BigEndian.PutUint32(payload[9:], increment)
+	return &Frame{
+		StreamID: 0,
+		Seq:      seq,
+		Closing:  FlagControl,
+		Payload:  payload,
+	}
+}
+
+// WindowUpdate returns the stream a window update is for and the credit increment it grants. ok is false if f isn't a
+// well formed window update
+func (f *Frame) WindowUpdate() (streamID uint64, increment uint32, ok bool) {
+	if f.Closing&FlagControl == 0 || f.StreamID != 0 || len(f.Payload) != windowUpdatePayloadLen ||
+		ControlType(f.Payload[0]) != ControlWindowUpdate {
+		return
+	}
+	return binary.BigEndian.Uint64(f.Payload[1:9]), binary.BigEndian.Uint32(f.Payload[9:]), true
+}
+
+// RstCode is the reason a stream was aborted, carried by a frame with FlagRst. Codes this package doesn't define may
+// be sent by the application on the other end
+type RstCode uint32
+
+const (
+	RstNoError RstCode = iota
+	// RstProtocolError means the remote sent something on the stream it shouldn't have
+	RstProtocolError
+	// RstInternalError means the stream failed for a reason of the sender's own
+	RstInternalError
+	// RstRefused means the stream was rejected before anything on it was processed, so it can be safely retried
+	RstRefused
+	// RstCancel means the stream is no longer wanted
+	RstCancel
+	// RstPeerReset means the connection the stream was proxied to was reset
+	RstPeerReset
+	// RstTimeout means the stream was idle for too long
+	RstTimeout
+)
+
+const rstPayloadLen = 4
+
+// NewRstFrame returns the frame aborting streamID with code. Unlike a control frame, it takes seq as any frame of the
+// stream does, so it's only acted on after the frames sent on the stream before it
+func NewRstFrame(streamID uint64, seq uint64, code RstCode) *Frame {
+	payload := make([]byte, rstPayloadLen)
+	binary.BigEndian.PutUint32(payload, uint32(code))
+	return &Frame{
+		StreamID: streamID,
+		Seq:      seq,
+		Closing:  FlagRst,
+		Payload:  payload,
+	}
+}
+
+// ResetCode returns the reason a frame with FlagRst aborted its stream. ok is false if f isn't such a frame or carries
+// no code, as is the case for ones from peers that don't know about them
+func (f *Frame) ResetCode() (code RstCode, ok bool) {
+	if !f.IsRst() || len(f.Payload) != rstPayloadLen {
+		return
+	}
+	return RstCode(binary.BigEndian.Uint32(f.Payload)), true
+}
+
+// NewGoAwayFrame returns the control frame draining the session, with the ID of the last stream opened by the remote
+// that was accepted, and the reason for it. seq is one of StreamID 0 as for NewControlFrame
+func NewGoAwayFrame(seq uint64, lastStreamID uint64, code RstCode) *Frame {
+	payload := make([]byte, goAwayPayloadLen)
+	payload[0] = byte(ControlGoAway)
+	binary.BigEndian.PutUint64(payload[1:9], lastStreamID)
+	binary.BigEndian.PutUint32(payload[9:], uint32(code))
+	return &Frame{
+		StreamID: 0,
+		Seq:      seq,
+		Closing:  FlagControl,
+		Payload:  payload,
+	}
+}
+
+// GoAway returns the last accepted StreamID and the reason of a frame draining the session. ok is false if f isn't a
+// well formed one
+func (f *Frame) GoAway() (lastStreamID uint64, code RstCode, ok bool) {
+	if f.Closing&FlagControl == 0 || f.StreamID != 0 || len(f.Payload) != goAwayPayloadLen ||
+		ControlType(f.Payload[0]) != ControlGoAway {
+		return
+	}
+	return binary.BigEndian.Uint64(f.Payload[1:9]), RstCode(binary.BigEndian.Uint32(f.Payload[9:])), true
+}
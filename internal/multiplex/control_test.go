@@ -0,0 +1,196 @@
+package multiplex
+
+import (
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/util"
+)
+
+func TestControlFrame(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+
+	token := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	obfsBuf := make([]byte, 512)
+	n, _ := obfuscator.Obfs(NewControlFrame(0, ControlPing, token), obfsBuf)
+	f, err := obfuscator.Deobfs(obfsBuf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	controlType, parsedToken, ok := f.Control()
+	if !ok || controlType != ControlPing || parsedToken != token {
+		t.Errorf("expecting ping with token %v, got %v %v %v", token, controlType, parsedToken, ok)
+	}
+
+	// a data frame carrying the same bytes isn't a control frame
+	data := &Frame{StreamID: 0, Payload: f.Payload}
+	if _, _, ok := data.Control(); ok {
+		t.Error("data frame taken as a control frame")
+	}
+}
+
+func TestPingPong(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+	sesh := MakeSession(0, &SessionConfig{Obfuscator: obfuscator, UnitRead: util.ReadTLS})
+	local, remote := net.Pipe()
+	sesh.AddConnection(local)
+
+	token := [8]byte{8, 7, 6, 5, 4, 3, 2, 1}
+	obfsBuf := make([]byte, 512)
+	n, _ := obfuscator.Obfs(NewControlFrame(0, ControlPing, token), obfsBuf)
+	go remote.Write(obfsBuf[:n])
+
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	recvBuf := make([]byte, 512)
+	n, err := util.ReadTLS(remote, recvBuf)
+	if err != nil {
+		t.Fatalf("no pong received: %v", err)
+	}
+	f, err := obfuscator.Deobfs(recvBuf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	controlType, parsedToken, ok := f.Control()
+	if !ok || controlType != ControlPong || parsedToken != token {
+		t.Errorf("expecting pong with token %v, got %v %v %v", token, controlType, parsedToken, ok)
+	}
+	if _, ok := sesh.streams.Load(uint64(0)); ok {
+		t.Error("ping opened a stream")
+	}
+}
+
+func TestControlFramesDontShareNonces(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+	sesh := MakeSession(0, &SessionConfig{Obfuscator: obfuscator, UnitRead: util.ReadTLS})
+	local, remote := net.Pipe()
+	sesh.AddConnection(local)
+
+	obfsBuf := make([]byte, 512)
+	n, _ := obfuscator.Obfs(NewControlFrame(0, ControlPing, [8]byte{}), obfsBuf)
+	go func() {
+		sesh.Ping([8]byte{1})
+		sesh.Ping([8]byte{2})
+		remote.Write(obfsBuf[:n])
+		sesh.GoAway(RstNoError)
+	}()
+
+	// the nonce of a derived nonce AEAD is made of the StreamID and Seq, so no two frames may share both
+	type nonce struct{ streamID, seq uint64 }
+	seen := make(map[nonce]bool)
+	for _, f := range readFrames(t, remote, obfuscator, 4) {
+		if f.Closing&FlagControl == 0 {
+			t.Fatalf("expecting control frames, got %+v", f)
+		}
+		if seen[nonce{f.StreamID, f.Seq}] {
+			t.Errorf("two control frames were sent with StreamID %v and Seq %v", f.StreamID, f.Seq)
+		}
+		seen[nonce{f.StreamID, f.Seq}] = true
+	}
+}
+
+func TestWindowUpdateFrame(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+
+	obfsBuf := make([]byte, 512)
+	for i, increment := range []uint32{0, 1, 65535, 0xffffffff} {
+		n, _ := obfuscator.Obfs(NewWindowUpdateFrame(uint64(i), 0x0102030405, increment), obfsBuf)
+		f, err := obfuscator.Deobfs(obfsBuf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		streamID, parsed, ok := f.WindowUpdate()
+		if !ok || parsed != increment || streamID != 0x0102030405 {
+			t.Errorf("expecting a window update of %v on stream 0x0102030405, got %v %v on stream %x", increment, parsed, ok, streamID)
+		}
+		// sent on a stream of its own, it would share the StreamID and Seq, and so the nonce, of one of its data frames
+		if f.StreamID != 0 || f.Seq != uint64(i) {
+			t.Errorf("expecting the window update to be sent on stream 0 at Seq %v, got stream %v at %v", i, f.StreamID, f.Seq)
+		}
+		if _, _, ok := f.Control(); ok {
+			t.Error("window update taken as a ping")
+		}
+	}
+
+	ping := NewControlFrame(0, ControlPing, [8]byte{})
+	if _, _, ok := ping.WindowUpdate(); ok {
+		t.Error("ping taken as a window update")
+	}
+	if _, _, ok := NewWindowUpdateFrame(0, 5, 1).GoAway(); ok {
+		t.Error("window update taken as a go away")
+	}
+	data := &Frame{StreamID: 0, Payload: NewWindowUpdateFrame(0, 5, 1).Payload}
+	if _, _, ok := data.WindowUpdate(); ok {
+		t.Error("data frame taken as a window update")
+	}
+	onStream := NewWindowUpdateFrame(0, 5, 1)
+	onStream.StreamID = 5
+	if _, _, ok := onStream.WindowUpdate(); ok {
+		t.Error("window update on a stream other than 0 accepted")
+	}
+}
+
+func TestRstFrame(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V2})
+
+	obfsBuf := make([]byte, 512)
+	for _, code := range []RstCode{RstNoError, RstProtocolError, RstCancel, RstPeerReset, 0xdeadbeef} {
+		n, _ := obfuscator.Obfs(NewRstFrame(3, 7, code), obfsBuf)
+		f, err := obfuscator.Deobfs(obfsBuf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, ok := f.ResetCode()
+		if !ok || parsed != code || f.StreamID != 3 || f.Seq != 7 || !f.ClosesStream() {
+			t.Errorf("expecting a reset of stream 3 at seq 7 with code %v, got %v %v on stream %v at %v", code, parsed, ok, f.StreamID, f.Seq)
+		}
+	}
+
+	if _, ok := (&Frame{Closing: FlagRst}).ResetCode(); ok {
+		t.Error("expecting no code without a payload")
+	}
+	data := &Frame{Payload: NewRstFrame(3, 7, RstCancel).Payload}
+	if _, ok := data.ResetCode(); ok {
+		t.Error("data frame taken as a reset")
+	}
+}
+
+func TestGoAwayFrame(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+
+	obfsBuf := make([]byte, 512)
+	n, _ := obfuscator.Obfs(NewGoAwayFrame(0, 0x0102030405, RstNoError), obfsBuf)
+	f, err := obfuscator.Deobfs(obfsBuf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastStreamID, code, ok := f.GoAway()
+	if !ok || lastStreamID != 0x0102030405 || code != RstNoError {
+		t.Errorf("expecting a go away after stream %v, got %v %v %v", 0x0102030405, lastStreamID, code, ok)
+	}
+	if _, _, ok := f.Control(); ok {
+		t.Error("go away taken as a ping")
+	}
+	if _, _, ok := f.WindowUpdate(); ok {
+		t.Error("go away taken as a window update")
+	}
+
+	onStream := NewGoAwayFrame(0, 1, RstNoError)
+	onStream.StreamID = 1
+	if _, _, ok := onStream.GoAway(); ok {
+		t.Error("expecting a go away to be on StreamID 0")
+	}
+}
@@ -66,7 +66,7 @@ func (d *datagramBuffer) Write(f Frame) (toBeClosed bool, err error) {
 		d.rwCond.Wait()
 	}
 
-	if f.Closing != C_NOOP {
+	if f.ClosesStream() || f.ClosesSession() {
 		atomic.StoreUint32(&d.closed, 1)
 		d.rwCond.Broadcast()
 		return true, nil
@@ -0,0 +1,87 @@
+package multiplex
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/cbeuw/Cloak/internal/util"
+)
+
+func TestDatagramRecordLayer(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: DatagramRecordLayer{}, ReplayWindow: 64})
+	testFrame := &Frame{StreamID: 1, Seq: 2, Closing: FlagDatagram, Payload: make([]byte, 500)}
+	rand.Read(testFrame.Payload)
+	obfsBuf := make([]byte, 1000)
+
+	n, err := obfuscator.Obfs(testFrame, obfsBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frameLen := int(obfsBuf[0])<<8 | int(obfsBuf[1]); frameLen != n-datagramHeaderLen {
+		t.Errorf("datagram length %v doesn't match the %v byte frame", frameLen, n-datagramHeaderLen)
+	}
+	if _, err := obfuscator.Deobfs(obfsBuf[:n-1]); !errors.Is(err, ErrBadRecordLayer) {
+		t.Errorf("expecting %v for a truncated datagram, got %v", ErrBadRecordLayer, err)
+	}
+
+	// duplicated datagrams are delivered again, even with a ReplayWindow
+	for i := 0; i < 2; i++ {
+		resultFrame, err := obfuscator.Deobfs(obfsBuf[:n])
+		if err != nil {
+			t.Fatalf("failed to deobfs datagram %v: %v", i, err)
+		}
+		if !resultFrame.IsDatagram() || !bytes.Equal(resultFrame.Payload, testFrame.Payload) {
+			t.Errorf("datagram %v doesn't match", i)
+		}
+	}
+
+	testFrame.Closing = C_NOOP
+	n, _ = obfuscator.Obfs(testFrame, obfsBuf)
+	obfuscator.Deobfs(obfsBuf[:n])
+	if _, err := obfuscator.Deobfs(obfsBuf[:n]); !errors.Is(err, ErrReplayedFrame) {
+		t.Errorf("expecting %v for a replayed ordinary frame, got %v", ErrReplayedFrame, err)
+	}
+}
+
+func TestRecvDatagramFromRemote(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+	sesh := MakeSession(0, &SessionConfig{Obfuscator: obfuscator, UnitRead: util.ReadTLS})
+	obfsBuf := make([]byte, 512)
+
+	// the datagram stream delivers seq 1 before seq 0, while the ordinary stream waits for seq 0
+	for _, f := range []*Frame{
+		{StreamID: 1, Seq: 1, Closing: FlagDatagram, Payload: []byte("second")},
+		{StreamID: 1, Seq: 0, Closing: FlagDatagram, Payload: []byte("first")},
+		{StreamID: 2, Seq: 1, Payload: []byte("second")},
+	} {
+		n, _ := sesh.Obfs(f, obfsBuf)
+		if err := sesh.recvDataFromRemote(obfsBuf[:n]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	datagramStream, _ := sesh.streams.Load(uint64(1))
+	readBuf := make([]byte, 64)
+	for _, expected := range []string{"second", "first"} {
+		n, err := datagramStream.(*Stream).Read(readBuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(readBuf[:n]) != expected {
+			t.Errorf("expecting %q, got %q", expected, readBuf[:n])
+		}
+	}
+	orderedStream, _ := sesh.streams.Load(uint64(2))
+	if orderedStream.(*Stream).datagram {
+		t.Error("ordinary frame opened a datagram stream")
+	}
+	if waiting := len(orderedStream.(*Stream).recvBuf.(*streamBuffer).sh); waiting != 1 {
+		t.Errorf("ordinary stream should be waiting for seq 0, %v frames are waiting", waiting)
+	}
+}
@@ -0,0 +1,101 @@
+package multiplex
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A message too long for one frame is sent as fragments, frames of consecutive Seqs on the same stream all but the last
+// of which have FlagMore set. Closing is authenticated from PROTOCOL_V2, so which fragment is the last one can't be
+// tampered with, and a fragment that is dropped leaves a gap in the Seqs that Reassembler refuses.
+
+var ErrFragmentGap = errors.New("fragment doesn't follow the one before it")
+var ErrMessageTooLarge = errors.New("reassembled message is too long")
+var ErrMessageCutShort = errors.New("stream closed in the middle of a fragmented message")
+
+// Fragment splits payload into the frames of a message on streamID, starting at Seq seq, with payloads of at most
+// maxPayloadLen bytes. All but the last of them have FlagMore set. The payloads of the frames are slices of payload
+func Fragment(streamID uint64, seq uint64, payload []byte, maxPayloadLen int) []*Frame {
+	if maxPayloadLen <= 0 {
+		panic("maxPayloadLen must be positive")
+	}
+	frames := make([]*Frame, 0, len(payload)/maxPayloadLen+1)
+	for {
+		f := &Frame{StreamID: streamID, Seq: seq + uint64(len(frames)), Payload: payload}
+		frames = append(frames, f)
+		if len(payload) <= maxPayloadLen {
+			return frames
+		}
+		f.Closing = FlagMore
+		f.Payload = payload[:maxPayloadLen]
+		payload = payload[maxPayloadLen:]
+	}
+}
+
+type partialMessage struct {
+	nextSeq uint64
+	payload []byte
+}
+
+// Reassembler joins the fragments of messages back together. Frames are given to it in order of Seq for each stream,
+// as they are delivered by a stream, and fragments of different streams can be interleaved. It isn't safe for
+// concurrent use
+type Reassembler struct {
+	// MaxMessageLen, if not 0, is the length of the longest message that is reassembled. Fragments of a longer one
+	// are refused with ErrMessageTooLarge without being buffered
+	MaxMessageLen int
+
+	partial map[uint64]*partialMessage
+}
+
+// Push adds the fragment f. Once the last fragment of a message arrives, the whole of it is returned with done set.
+// A frame that isn't fragmented is returned as it is, with its own Payload. Otherwise the payloads of the fragments
+// are copied, so the frames needn't be kept. A fragment whose Seq doesn't follow the one before it fails with
+// ErrFragmentGap, and a stream that is closed with a message unfinished fails with ErrMessageCutShort. Either way
+// the partial message is dropped
+func (r *Reassembler) Push(f *Frame) (message []byte, done bool, err error) {
+	p := r.partial[f.StreamID]
+	if p != nil && f.Seq != p.nextSeq {
+		r.Discard(f.StreamID)
+		return nil, false, fmt.Errorf("%w: expecting Seq %v on stream %v, got %v", ErrFragmentGap, p.nextSeq, f.StreamID, f.Seq)
+	}
+	if f.HasMore() && f.ClosesStream() {
+		r.Discard(f.StreamID)
+		return nil, false, fmt.Errorf("%w: stream %v", ErrMessageCutShort, f.StreamID)
+	}
+
+	messageLen := len(f.Payload)
+	if p != nil {
+		messageLen += len(p.payload)
+	}
+	if r.MaxMessageLen > 0 && messageLen > r.MaxMessageLen {
+		r.Discard(f.StreamID)
+		return nil, false, fmt.Errorf("%w: %v bytes on stream %v", ErrMessageTooLarge, messageLen, f.StreamID)
+	}
+
+	if !f.HasMore() {
+		if p == nil {
+			return f.Payload, true, nil
+		}
+		r.Discard(f.StreamID)
+		return append(p.payload, f.Payload...), true, nil
+	}
+	if p == nil {
+		if r.partial == nil {
+			r.partial = make(map[uint64]*partialMessage)
+		}
+		p = &partialMessage{}
+		r.partial[f.StreamID] = p
+	}
+	p.payload = append(p.payload, f.Payload...)
+	p.nextSeq = f.Seq + 1
+	return nil, false, nil
+}
+
+// Discard drops the fragments of the unfinished message on streamID, if there is one
+func (r *Reassembler) Discard(streamID uint64) {
+	delete(r.partial, streamID)
+}
+
+// Pending returns the number of streams with a message that is still being reassembled
+func (r *Reassembler) Pending() int { return len(r.partial) }
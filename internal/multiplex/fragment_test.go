@@ -0,0 +1,113 @@
+package multiplex
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestFragment(t *testing.T) {
+	payload := make([]byte, 2500)
+	rand.Read(payload)
+	frames := Fragment(3, 10, payload, 1000)
+	if len(frames) != 3 {
+		t.Fatalf("expecting 3 fragments, got %v", len(frames))
+	}
+	for i, f := range frames {
+		if f.StreamID != 3 || f.Seq != uint64(10+i) || f.HasMore() != (i < 2) {
+			t.Errorf("fragment %v: unexpected stream %v, seq %v or flags %x", i, f.StreamID, f.Seq, f.Closing)
+		}
+	}
+	if len(frames[2].Payload) != 500 {
+		t.Errorf("expecting 500 bytes in the last fragment, got %v", len(frames[2].Payload))
+	}
+
+	if frames := Fragment(3, 0, payload[:1000], 1000); len(frames) != 1 || frames[0].HasMore() {
+		t.Error("expecting a message that fits to be sent in a single frame")
+	}
+}
+
+func TestReassembler(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V2})
+
+	first := make([]byte, 3000)
+	second := make([]byte, 1500)
+	rand.Read(first)
+	rand.Read(second)
+	fragments1 := Fragment(1, 0, first, 1000)
+	fragments2 := Fragment(2, 0, second, 1000)
+	// fragments of the two streams are interleaved
+	interleaved := []*Frame{fragments1[0], fragments2[0], fragments1[1], fragments2[1], fragments1[2]}
+
+	var r Reassembler
+	var messages [][]byte
+	buf := make([]byte, 2000)
+	for _, fragment := range interleaved {
+		n, err := obfuscator.Obfs(fragment, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := obfuscator.Deobfs(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		message, done, err := r.Push(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if done {
+			messages = append(messages, message)
+		}
+	}
+	if len(messages) != 2 || !bytes.Equal(messages[0], second) || !bytes.Equal(messages[1], first) {
+		t.Errorf("expecting both messages to be reassembled, got %v", len(messages))
+	}
+	if r.Pending() != 0 {
+		t.Errorf("expecting nothing pending, got %v streams", r.Pending())
+	}
+
+	t.Run("gap", func(t *testing.T) {
+		var r Reassembler
+		r.Push(fragments1[0])
+		if _, _, err := r.Push(fragments1[2]); !errors.Is(err, ErrFragmentGap) {
+			t.Errorf("expecting %v when a fragment is dropped, got %v", ErrFragmentGap, err)
+		}
+		if r.Pending() != 0 {
+			t.Error("expecting the partial message to be dropped")
+		}
+	})
+
+	t.Run("cut short", func(t *testing.T) {
+		var r Reassembler
+		r.Push(fragments1[0])
+		fin := &Frame{StreamID: 1, Seq: 1, Closing: FlagFin | FlagMore}
+		if _, _, err := r.Push(fin); !errors.Is(err, ErrMessageCutShort) {
+			t.Errorf("expecting %v, got %v", ErrMessageCutShort, err)
+		}
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		r := Reassembler{MaxMessageLen: 1500}
+		r.Push(fragments1[0])
+		if _, _, err := r.Push(fragments1[1]); !errors.Is(err, ErrMessageTooLarge) {
+			t.Errorf("expecting %v, got %v", ErrMessageTooLarge, err)
+		}
+	})
+
+	t.Run("flag is authenticated", func(t *testing.T) {
+		n, _ := obfuscator.Obfs(&Frame{StreamID: 1, Seq: 5, Closing: FlagMore, Payload: []byte("more")}, buf)
+		// FlagMore is cleared with the header key, as if it had leaked, leaving the ciphertext as it is
+		tampered := append([]byte{}, buf[:n]...)
+		header := tampered[recordHeaderLen : recordHeaderLen+HEADER_LEN]
+		nonce := tampered[len(tampered)-8:]
+		HEADER_CIPHER_SALSA20.scramble(header, nonce, &obfuscator.keys.salsaKey)
+		header[12] &^= FlagMore
+		HEADER_CIPHER_SALSA20.scramble(header, nonce, &obfuscator.keys.salsaKey)
+		if _, err := obfuscator.Deobfs(tampered); err == nil {
+			t.Error("deobfsed a fragment whose FlagMore was cleared")
+		}
+	})
+}
@@ -1,14 +1,184 @@
 package multiplex
 
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// Frame.Closing is a bitmask of these. C_NOOP, the zero value, is an open data frame
 const (
 	C_NOOP = iota
 	C_STREAM
 	C_SESSION
 )
 
+// Flags that can be combined in Frame.Closing. FlagFin is the same bit as C_STREAM, so frames from older peers keep
+// their meaning. Older peers take any non-zero Closing as the end of the stream though, so FlagMore must only be sent
+// to peers that know about it
+const (
+	// FlagFin means the sender has finished sending on the stream
+	FlagFin = C_STREAM
+	// FlagRst means the stream is aborted rather than finished cleanly
+	FlagRst = 0x04
+	// FlagMore means more fragments of the same message follow in later frames
+	FlagMore = 0x08
+	// FlagPadding marks cover traffic, which is obfsed like any other frame but is thrown away by the receiving
+	// session. It must only be sent to peers that know about it
+	FlagPadding = 0x10
+	// FlagControl marks a control frame, such as a ping, for the session rather than any stream. See Frame.Control
+	FlagControl = 0x20
+	// FlagDatagram marks a frame of a datagram stream, whose payloads are delivered one by one as they arrive without
+	// being ordered or deduplicated, as they are for every stream with SessionConfig.Unordered. It must only be sent
+	// to peers that know about it
+	FlagDatagram = 0x40
+	// FlagHandshake marks a frame of the exchange setting the session up. It's only valid on HandshakeStreamID. See
+	// NewHandshakeFrame
+	FlagHandshake = 0x80
+)
+
 type Frame struct {
-	StreamID uint32
+	StreamID uint64
 	Seq      uint64
 	Closing  uint8
 	Payload  []byte
 }
+
+func (f *Frame) IsFin() bool   { return f.Closing&FlagFin != 0 }
+func (f *Frame) IsRst() bool   { return f.Closing&FlagRst != 0 }
+func (f *Frame) HasMore() bool { return f.Closing&FlagMore != 0 }
+
+// IsPadding reports whether f is cover traffic that carries no data
+func (f *Frame) IsPadding() bool { return f.Closing&FlagPadding != 0 }
+
+// IsDatagram reports whether f belongs to a datagram stream
+func (f *Frame) IsDatagram() bool { return f.Closing&FlagDatagram != 0 }
+
+// ClosesStream reports whether f ends its stream, either by finishing or aborting it
+func (f *Frame) ClosesStream() bool { return f.Closing&(FlagFin|FlagRst) != 0 }
+
+// ClosesSession reports whether f ends the whole session
+func (f *Frame) ClosesSession() bool { return f.Closing&C_SESSION != 0 }
+
+// Equal reports whether f and other have the same StreamID, Seq, Closing and Payload. A nil and an empty Payload are
+// equal, and so are two nil frames, but a nil frame isn't equal to any other
+func (f *Frame) Equal(other *Frame) bool {
+	if f == nil || other == nil {
+		return f == other
+	}
+	return f.StreamID == other.StreamID && f.Seq == other.Seq && f.Closing == other.Closing && bytes.Equal(f.Payload, other.Payload)
+}
+
+// frameFlagNames are the names String gives the bits of Frame.Closing, from the lowest one up
+var frameFlagNames = [...]string{"Fin", "Session", "Rst", "More", "Padding", "Control", "Datagram", "Handshake"}
+
+// stringPayloadPrefix is how many bytes of the payload String shows in hex
+const stringPayloadPrefix = 8
+
+// String renders f for debugging, as its StreamID, Seq, the names of its flags, the length of its payload and the
+// first 8 bytes of the payload in hex. It builds the string in one go, with a single allocation for the result
+func (f *Frame) String() string {
+	if f == nil {
+		return "<nil>"
+	}
+	// long enough for the longest result, so that nothing but the string is allocated
+	var buf [192]byte
+	b := append(buf[:0], "Frame{StreamID:"...)
+	b = strconv.AppendUint(b, f.StreamID, 10)
+	b = append(b, " Seq:"...)
+	b = strconv.AppendUint(b, f.Seq, 10)
+	b = append(b, " Flags:"...)
+	if f.Closing == 0 {
+		b = append(b, '0')
+	}
+	first := true
+	for i := uint(0); i < 8; i++ {
+		bit := uint8(1) << i
+		if f.Closing&bit == 0 {
+			continue
+		}
+		if !first {
+			b = append(b, '|')
+		}
+		first = false
+		if int(i) < len(frameFlagNames) {
+			b = append(b, frameFlagNames[i]...)
+		} else {
+			b = append(b, "0x"...)
+			b = strconv.AppendUint(b, uint64(bit), 16)
+		}
+	}
+	b = append(b, " Len:"...)
+	b = strconv.AppendInt(b, int64(len(f.Payload)), 10)
+	if len(f.Payload) > 0 {
+		prefix := f.Payload
+		if len(prefix) > stringPayloadPrefix {
+			prefix = prefix[:stringPayloadPrefix]
+		}
+		b = append(b, " Payload:"...)
+		var hexBuf [2 * stringPayloadPrefix]byte
+		hex.Encode(hexBuf[:], prefix)
+		b = append(b, hexBuf[:2*len(prefix)]...)
+		if len(f.Payload) > stringPayloadPrefix {
+			b = append(b, "..."...)
+		}
+	}
+	b = append(b, '}')
+	return string(b)
+}
+
+var framePool = sync.Pool{
+	New: func() interface{} { return new(Frame) },
+}
+
+// AcquireFrame takes a frame from the pool, to be deobfsed into with Obfuscator.DeobfsInto. Its Payload may already be
+// backed by a buffer from an earlier frame, which is reused. It should be given back with ReleaseFrame
+func AcquireFrame() *Frame {
+	return framePool.Get().(*Frame)
+}
+
+// ReleaseFrame gives a frame returned by a Deobfser with ObfsConfig.PooledDeobfs enabled, or one from AcquireFrame,
+// back to the pool, so that it and the buffer backing its Payload can be reused for a later frame. The two go back
+// together: neither the frame nor its Payload may be used by the caller after it is released
+func ReleaseFrame(f *Frame) {
+	f.Reset()
+	framePool.Put(f)
+}
+
+// Reset clears the fields of f, keeping the buffer backing its Payload so that it can be decrypted into again
+func (f *Frame) Reset() {
+	f.StreamID = 0
+	f.Seq = 0
+	f.Closing = 0
+	f.Payload = f.Payload[:0]
+}
+
+// MarshalBinary encodes f into the unobfsed frame layout: the HEADER_LEN byte header followed by the payload, with
+// no extra bytes, encryption or record layer. StreamID must fit in 32 bits
+func (f *Frame) MarshalBinary() ([]byte, error) {
+	data := make([]byte, HEADER_LEN+len(f.Payload))
+	if err := headerV1.put(data[:HEADER_LEN], f, COMPRESSION_NONE, 0, 0); err != nil {
+		return nil, err
+	}
+	copy(data[HEADER_LEN:], f.Payload)
+	return data, nil
+}
+
+// UnmarshalBinary decodes a frame in the layout produced by MarshalBinary. Any extra bytes recorded in the header
+// are dropped from the end of the payload. The payload is copied out of data
+func (f *Frame) UnmarshalBinary(data []byte) error {
+	if len(data) < HEADER_LEN {
+		return fmt.Errorf("%w: cannot be shorter than %v bytes", ErrInputTooShort, HEADER_LEN)
+	}
+	extraLen := int(data[13])
+	if extraLen > len(data)-HEADER_LEN {
+		return ErrExtraLenTooLarge
+	}
+	f.StreamID = uint64(u32(data[0:4]))
+	f.Seq = u64(data[4:12])
+	f.Closing = data[12]
+	f.Payload = append(f.Payload[:0], data[HEADER_LEN:len(data)-extraLen]...)
+	return nil
+}
@@ -0,0 +1,239 @@
+package multiplex
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// recordHeaderLen is the length of a TLS record layer header: content type, version and length
+const recordHeaderLen = 5
+
+// FrameReader reads frames off a byte stream such as a TCP connection, where records can arrive split across several
+// Reads, or several of them in a single Read. It finds the boundaries of records through their record layer, so the
+// frames must have been obfsed with TLSRecordLayer, or with LengthPrefixRecordLayer if LengthPrefix is set.
+//
+// The Deobfser must not work in place (MakeDeobfsInPlace), as the buffer records are read into is reused.
+type FrameReader struct {
+	// MaxRecordLen joins records of MaxRecordLen bytes with the ones that follow them, up to and including the first
+	// record that is shorter, into the frame they were split from by a TLSRecordLayer with the same MaxRecordLen
+	MaxRecordLen int
+	// LengthPrefix, if not 0, makes records be found through a length prefix of LengthPrefix bytes instead of a TLS
+	// record header, for frames obfsed with a LengthPrefixRecordLayer of the same Width
+	LengthPrefix int
+	// MaxFrameSize, if not 0, is the length of the longest frame, after its record layer header, that is buffered. A
+	// record claiming a longer one is refused with ErrFrameTooLarge before any more of it is read. It's
+	// DefaultMaxFrameSize if made by NewFrameReader, which is too short for split frames of a MaxRecordLen. Records
+	// claiming more than 1MiB are always refused, with ErrRecordTooLarge
+	MaxFrameSize int
+
+	r      io.Reader
+	deobfs Deobfser
+
+	// buf[start:end] has been read from r but not yet consumed
+	buf   []byte
+	start int
+	end   int
+}
+
+func NewFrameReader(r io.Reader, deobfs Deobfser) *FrameReader {
+	return &FrameReader{
+		MaxFrameSize: DefaultMaxFrameSize,
+		r:            r,
+		deobfs:       deobfs,
+		buf:          make([]byte, 16384),
+	}
+}
+
+// checkFrameLen returns an error if frames of frameLen bytes can't be read
+func (fr *FrameReader) checkFrameLen(frameLen int) error {
+	return checkFrameLen(frameLen, fr.MaxFrameSize)
+}
+
+// checkFrameLen returns an error if a record carries a frame of frameLen bytes that is too long to be buffered with a
+// maximum frame size of maxFrameSize, which is no limit if it's 0
+func checkFrameLen(frameLen, maxFrameSize int) error {
+	if frameLen > maxSplitFrameLen {
+		return ErrRecordTooLarge
+	}
+	if maxFrameSize > 0 && frameLen > maxFrameSize {
+		return fmt.Errorf("%w: a frame of %v bytes", ErrFrameTooLarge, frameLen)
+	}
+	return nil
+}
+
+// fill makes sure at least n bytes are buffered. It returns io.EOF if r ends before anything is buffered, and
+// io.ErrUnexpectedEOF if r ends with fewer than n bytes buffered. ctx is checked before each Read
+func (fr *FrameReader) fill(ctx context.Context, n int) error {
+	if fr.end-fr.start >= n {
+		return nil
+	}
+	if len(fr.buf) < n {
+		newBuf := make([]byte, n)
+		fr.end = copy(newBuf, fr.buf[fr.start:fr.end])
+		fr.start = 0
+		fr.buf = newBuf
+	} else if len(fr.buf)-fr.start < n {
+		fr.end = copy(fr.buf, fr.buf[fr.start:fr.end])
+		fr.start = 0
+	}
+	for fr.end-fr.start < n {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		i, err := fr.r.Read(fr.buf[fr.end:])
+		fr.end += i
+		if err != nil {
+			if fr.end-fr.start >= n {
+				return nil
+			}
+			if err == io.EOF && fr.end != fr.start {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadFrame reads and deobfses the next record that carries a frame. It returns io.EOF if the underlying reader ends on a record boundary,
+// and io.ErrUnexpectedEOF if it ends in the middle of one
+func (fr *FrameReader) ReadFrame() (*Frame, error) {
+	return fr.ReadFrameContext(context.Background())
+}
+
+// readDeadliner is implemented by readers such as net.Conn whose blocked Reads can be cut short
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// ReadFrameContext reads the next frame as ReadFrame does, until ctx is done, in which case it returns ctx.Err(). A
+// Read that is blocked is cut short if the underlying reader has a SetReadDeadline, as a net.Conn does, by setting
+// a read deadline in the past, after which the read deadline is cleared. Otherwise ctx is only checked between Reads,
+// which still stops a peer from holding the reader up by sending a record a byte at a time. A frame that has been
+// read in full by the time ctx is done is returned rather than ctx.Err(), as it can't be read again.
+//
+// Nothing but the bytes read is kept across calls, so once a read is cut short by ctx, a read deadline or any other
+// error of the underlying reader, the next one picks up the record that was being read from where it was left
+func (fr *FrameReader) ReadFrameContext(ctx context.Context) (*Frame, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if d, ok := fr.r.(readDeadliner); ok && ctx.Done() != nil {
+		done := make(chan struct{})
+		interrupted := make(chan bool, 1)
+		go func() {
+			select {
+			case <-ctx.Done():
+				d.SetReadDeadline(time.Unix(1, 0))
+				interrupted <- true
+			case <-done:
+				interrupted <- false
+			}
+		}()
+		f, err := fr.readFrame(ctx)
+		close(done)
+		if <-interrupted {
+			d.SetReadDeadline(time.Time{})
+			// ctx may be done just as the frame has been read, which is then returned all the same as it's been
+			// taken off the reader. Only a read cut short by the deadline set here fails with ctx.Err()
+			if err != nil && isTimeout(err) {
+				return nil, ctx.Err()
+			}
+		}
+		return f, err
+	}
+	return fr.readFrame(ctx)
+}
+
+func (fr *FrameReader) readFrame(ctx context.Context) (*Frame, error) {
+	if fr.LengthPrefix != 0 {
+		return fr.readPrefixed(ctx)
+	}
+	for {
+		err := fr.fill(ctx, recordHeaderLen)
+		if err != nil {
+			return nil, err
+		}
+		recordLen := recordHeaderLen + int(binary.BigEndian.Uint16(fr.buf[fr.start+3:fr.start+5]))
+		if err := fr.checkFrameLen(recordLen - recordHeaderLen); err != nil {
+			return nil, err
+		}
+		err = fr.fill(ctx, recordLen)
+		if err != nil {
+			return nil, err
+		}
+		consumed := recordLen
+		if fr.MaxRecordLen > 0 && recordLen == recordHeaderLen+fr.MaxRecordLen && fr.buf[fr.start] == tlsApplicationData {
+			recordLen, consumed, err = fr.join(ctx, recordLen)
+			if err != nil {
+				return nil, err
+			}
+		}
+		record := fr.buf[fr.start : fr.start+recordLen]
+		fr.start += consumed
+		f, err := fr.deobfs(record)
+		// dummy records such as change_cipher_spec are skipped
+		if errors.Is(err, ErrDummyRecord) {
+			continue
+		}
+		return f, err
+	}
+}
+
+// readPrefixed reads and deobfses the next record written by a LengthPrefixRecordLayer
+func (fr *FrameReader) readPrefixed(ctx context.Context) (*Frame, error) {
+	err := fr.fill(ctx, fr.LengthPrefix)
+	if err != nil {
+		return nil, err
+	}
+	frameLen := lengthPrefix(fr.buf[fr.start : fr.start+fr.LengthPrefix])
+	if err := fr.checkFrameLen(frameLen); err != nil {
+		return nil, err
+	}
+	recordLen := fr.LengthPrefix + frameLen
+	err = fr.fill(ctx, recordLen)
+	if err != nil {
+		return nil, err
+	}
+	record := fr.buf[fr.start : fr.start+recordLen]
+	fr.start += recordLen
+	return fr.deobfs(record)
+}
+
+// join buffers the records following the full length record of recordLen buffered bytes, up to and including the
+// first one that is shorter than MaxRecordLen, and then joins them onto it by stripping their headers. It returns the
+// length of the joined record, which keeps the header of the first one, and how many buffered bytes the records took
+// up. Nothing is moved until all of the records are buffered, so a join cut short by an error can be started over
+func (fr *FrameReader) join(ctx context.Context, recordLen int) (joinedLen, consumed int, err error) {
+	consumed = recordLen
+	frameLen := recordLen - recordHeaderLen
+	for {
+		err := fr.fill(ctx, consumed+recordHeaderLen)
+		if err != nil {
+			return 0, 0, err
+		}
+		next := fr.buf[fr.start+consumed : fr.end]
+		if next[0] != tlsApplicationData {
+			return 0, 0, fmt.Errorf("%w: record of content type %x in the middle of a split frame", ErrBadRecordLayer, next[0])
+		}
+		nextLen := int(binary.BigEndian.Uint16(next[3:5]))
+		frameLen += nextLen
+		if err := fr.checkFrameLen(frameLen); err != nil {
+			return 0, 0, err
+		}
+		err = fr.fill(ctx, consumed+recordHeaderLen+nextLen)
+		if err != nil {
+			return 0, 0, err
+		}
+		consumed += recordHeaderLen + nextLen
+		if nextLen != fr.MaxRecordLen {
+			break
+		}
+	}
+	joined := TLSRecordLayer{MaxRecordLen: fr.MaxRecordLen}.join(fr.buf[fr.start : fr.start+consumed])
+	return len(joined), consumed, nil
+}
@@ -0,0 +1,303 @@
+package multiplex
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func makeRecords(t *testing.T, obfuscator *Obfuscator, count int) ([]byte, []*Frame) {
+	var stream []byte
+	var frames []*Frame
+	obfsBuf := make([]byte, 20000)
+	for i := 0; i < count; i++ {
+		f := &Frame{
+			StreamID: 1,
+			Seq:      uint64(i),
+			Closing:  C_NOOP,
+			Payload:  make([]byte, rand.Intn(16385)),
+		}
+		rand.Read(f.Payload)
+		n, err := obfuscator.Obfs(f, obfsBuf)
+		if err != nil {
+			t.Fatalf("failed to obfs: %v", err)
+		}
+		stream = append(stream, obfsBuf[:n]...)
+		frames = append(frames, f)
+	}
+	return stream, frames
+}
+
+func TestFrameReader(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+	stream, frames := makeRecords(t, obfuscator, 20)
+
+	readers := map[string]func() io.Reader{
+		"coalesced":   func() io.Reader { return bytes.NewReader(stream) },
+		"one byte":    func() io.Reader { return iotest.OneByteReader(bytes.NewReader(stream)) },
+		"half":        func() io.Reader { return iotest.HalfReader(bytes.NewReader(stream)) },
+		"eof w/ data": func() io.Reader { return iotest.DataErrReader(bytes.NewReader(stream)) },
+	}
+	for name, reader := range readers {
+		fr := NewFrameReader(reader(), obfuscator.Deobfs)
+		for i, expected := range frames {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				t.Errorf("%v: failed to read frame %v: %v", name, i, err)
+				break
+			}
+			if f.Seq != expected.Seq || !bytes.Equal(f.Payload, expected.Payload) {
+				t.Errorf("%v: frame %v mismatch", name, i)
+				break
+			}
+		}
+		if _, err := fr.ReadFrame(); err != io.EOF {
+			t.Errorf("%v: expecting io.EOF at the end of the stream, got %v", name, err)
+		}
+	}
+
+	t.Run("ends mid record", func(t *testing.T) {
+		for _, cut := range []int{3, 5, 100} {
+			fr := NewFrameReader(bytes.NewReader(stream[:len(stream)-cut]), obfuscator.Deobfs)
+			var err error
+			for err == nil {
+				_, err = fr.ReadFrame()
+			}
+			if err != io.ErrUnexpectedEOF {
+				t.Errorf("expecting io.ErrUnexpectedEOF when cut %v bytes short, got %v", cut, err)
+			}
+		}
+	})
+}
+
+func TestFrameReaderSkipsDummyRecords(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{CCSProbability: 0.5}))
+	stream, frames := makeRecords(t, obfuscator, 20)
+
+	fr := NewFrameReader(bytes.NewReader(stream), obfuscator.Deobfs)
+	for i, expected := range frames {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatalf("failed to read frame %v: %v", i, err)
+		}
+		if f.Seq != expected.Seq || !bytes.Equal(f.Payload, expected.Payload) {
+			t.Fatalf("frame %v mismatch", i)
+		}
+	}
+	if _, err := fr.ReadFrame(); err != io.EOF {
+		t.Errorf("expecting io.EOF at the end of the stream, got %v", err)
+	}
+}
+
+func TestFrameReaderLengthPrefix(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	for _, width := range []int{2, 4} {
+		obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(LengthPrefixRecordLayer{Width: width}))
+		stream, frames := makeRecords(t, obfuscator, 20)
+
+		fr := NewFrameReader(iotest.HalfReader(bytes.NewReader(stream)), obfuscator.Deobfs)
+		fr.LengthPrefix = width
+		for i, expected := range frames {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				t.Fatalf("width %v: failed to read frame %v: %v", width, i, err)
+			}
+			if f.Seq != expected.Seq || !bytes.Equal(f.Payload, expected.Payload) {
+				t.Fatalf("width %v: frame %v mismatch", width, i)
+			}
+		}
+		if _, err := fr.ReadFrame(); err != io.EOF {
+			t.Errorf("width %v: expecting io.EOF at the end of the stream, got %v", width, err)
+		}
+	}
+
+	// a frame whose prefix is rewritten is either cut short or read on into the next one, and is refused either way
+	for _, method := range []Method{E_METHOD_PLAIN, E_METHOD_AES_GCM} {
+		obfuscator, _ := GenerateObfsWithConfig(method, sessionKey, ObfsConfig{RecordLayer: LengthPrefixRecordLayer{}, ProtocolVersion: PROTOCOL_V6, PlainMAC: true})
+		for _, delta := range []int{-1, 1} {
+			stream, _ := makeRecords(t, obfuscator, 2)
+			putLengthPrefix(stream[:2], lengthPrefix(stream[:2])+delta)
+			fr := NewFrameReader(bytes.NewReader(stream), obfuscator.Deobfs)
+			fr.LengthPrefix = 2
+			if f, err := fr.ReadFrame(); err == nil {
+				t.Errorf("%v: frame read with a prefix off by %v: %v", method, delta, f)
+			}
+		}
+	}
+
+	fr := NewFrameReader(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}), nil)
+	fr.LengthPrefix = 4
+	if _, err := fr.ReadFrame(); err != ErrRecordTooLarge {
+		t.Errorf("expecting %v for a 4GiB length prefix, got %v", ErrRecordTooLarge, err)
+	}
+}
+
+func TestFrameReaderMaxFrameSize(t *testing.T) {
+	fr := NewFrameReader(bytes.NewReader([]byte{0x17, 0x03, 0x03, 0x42, 0x01}), nil)
+	if fr.MaxFrameSize != DefaultMaxFrameSize {
+		t.Errorf("expecting a MaxFrameSize of %v, got %v", DefaultMaxFrameSize, fr.MaxFrameSize)
+	}
+	// the record header claims 16897 bytes, none of which are there to be read
+	if _, err := fr.ReadFrame(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("expecting %v, got %v", ErrFrameTooLarge, err)
+	}
+
+	fr = NewFrameReader(bytes.NewReader([]byte{0x00, 0x00, 0x01, 0x00}), nil)
+	fr.LengthPrefix = 4
+	fr.MaxFrameSize = 255
+	if _, err := fr.ReadFrame(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("expecting %v for a 256 byte length prefix, got %v", ErrFrameTooLarge, err)
+	}
+}
+
+// cancellingReader cancels a context after every Read, as a deadline would run out while a record is dribbled in
+type cancellingReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (c cancellingReader) Read(p []byte) (int, error) {
+	defer c.cancel()
+	return c.r.Read(p)
+}
+
+// deadlineCancellingReader cancels a context once the last of r has been read, and returns from that Read only after
+// the read deadline has been set for the cancellation, so that ctx is done by the time the frame has been read
+type deadlineCancellingReader struct {
+	r           *bytes.Reader
+	cancel      context.CancelFunc
+	deadlineSet chan struct{}
+}
+
+func (c *deadlineCancellingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if c.r.Len() == 0 && c.cancel != nil {
+		c.cancel()
+		c.cancel = nil
+		<-c.deadlineSet
+	}
+	return n, err
+}
+
+func (c *deadlineCancellingReader) SetReadDeadline(t time.Time) error {
+	if !t.IsZero() {
+		c.deadlineSet <- struct{}{}
+	}
+	return nil
+}
+
+func TestFrameReaderContext(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+
+	for name, rl := range map[string]TLSRecordLayer{
+		"whole":  {},
+		"split":  {MaxRecordLen: 4096},
+		"single": {MaxRecordLen: 16384},
+	} {
+		obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(rl))
+		stream, frames := makeRecords(t, obfuscator, 3)
+		firstLen := len(stream) - len(stream)/3
+
+		clientConn, serverConn := net.Pipe()
+		fr := NewFrameReader(serverConn, obfuscator.Deobfs)
+		fr.MaxRecordLen = rl.MaxRecordLen
+
+		ctx, cancel := context.WithCancel(context.Background())
+		// the reader is blocked in the middle of a record when ctx is cancelled
+		go func() {
+			clientConn.Write(stream[:firstLen])
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		}()
+		var read []*Frame
+		var err error
+		for {
+			var f *Frame
+			f, err = fr.ReadFrameContext(ctx)
+			if err != nil {
+				break
+			}
+			read = append(read, f)
+		}
+		if err != context.Canceled {
+			t.Errorf("%v: expecting %v, got %v", name, context.Canceled, err)
+		}
+
+		// the read deadline is cleared, and the record that was cut short is read on from where it was left
+		go func() {
+			clientConn.Write(stream[firstLen:])
+			clientConn.Close()
+		}()
+		for {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				if err != io.EOF {
+					t.Errorf("%v: failed to read after cancelling: %v", name, err)
+				}
+				break
+			}
+			read = append(read, f)
+		}
+		if len(read) != len(frames) {
+			t.Errorf("%v: expecting %v frames, got %v", name, len(frames), len(read))
+			continue
+		}
+		for i := range frames {
+			if !bytes.Equal(read[i].Payload, frames[i].Payload) {
+				t.Errorf("%v: frame %v mismatch", name, i)
+			}
+		}
+	}
+
+	t.Run("cancelled once read", func(t *testing.T) {
+		obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+		stream, frames := makeRecords(t, obfuscator, 1)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		r := &deadlineCancellingReader{bytes.NewReader(stream), cancel, make(chan struct{}, 1)}
+		fr := NewFrameReader(r, obfuscator.Deobfs)
+		f, err := fr.ReadFrameContext(ctx)
+		if err != nil || !bytes.Equal(f.Payload, frames[0].Payload) {
+			t.Errorf("expecting the frame read as ctx was cancelled to be returned, got %v", err)
+		}
+	})
+
+	t.Run("without a deadline", func(t *testing.T) {
+		obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{MaxRecordLen: 4096}))
+		stream, frames := makeRecords(t, obfuscator, 1)
+		r := iotest.OneByteReader(bytes.NewReader(stream))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		fr := NewFrameReader(cancellingReader{r, cancel}, obfuscator.Deobfs)
+		fr.MaxRecordLen = 4096
+		if _, err := fr.ReadFrameContext(ctx); err != context.Canceled {
+			t.Errorf("expecting %v from a reader dribbling bytes in, got %v", context.Canceled, err)
+		}
+		fr.r = r
+		f, err := fr.ReadFrame()
+		if err != nil || !bytes.Equal(f.Payload, frames[0].Payload) {
+			t.Errorf("failed to read on after cancelling: %v", err)
+		}
+	})
+
+	t.Run("already done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		fr := NewFrameReader(bytes.NewReader(nil), nil)
+		if _, err := fr.ReadFrameContext(ctx); err != context.Canceled {
+			t.Errorf("expecting %v, got %v", context.Canceled, err)
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package multiplex
+
+import (
+	"io"
+)
+
+// FrameWriter obfses frames and writes them to an underlying io.Writer, such as a TCP connection. It is the
+// writing counterpart of FrameReader. A FrameWriter is not safe for concurrent use
+type FrameWriter struct {
+	w          io.Writer
+	obfuscator *Obfuscator
+
+	// buf is reused across frames and grows when a frame doesn't fit
+	buf []byte
+}
+
+func NewFrameWriter(w io.Writer, obfuscator *Obfuscator) *FrameWriter {
+	return &FrameWriter{
+		w:          w,
+		obfuscator: obfuscator,
+		buf:        make([]byte, 16384),
+	}
+}
+
+// WriteFrame obfses f and writes all of the resulting bytes to the underlying writer
+func (fw *FrameWriter) WriteFrame(f *Frame) error {
+	frameLen := fw.obfuscator.frameLen(len(f.Payload))
+	if fw.obfuscator.config.Padding != nil {
+		// leave room for as much padding as a frame can carry
+		frameLen += fw.obfuscator.config.layout().maxExtraLen()
+	}
+	if frameLen > len(fw.buf) {
+		fw.buf = make([]byte, frameLen)
+	}
+	n, err := fw.obfuscator.Obfs(f, fw.buf)
+	if err != nil {
+		return err
+	}
+	return writeAll(fw.w, fw.buf[:n])
+}
+
+// writeAll keeps writing to w until all of b is written or an error occurs
+func writeAll(w io.Writer, b []byte) error {
+	for len(b) > 0 {
+		n, err := w.Write(b)
+		b = b[n:]
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package multiplex
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// shortWriter writes at most max bytes at a time without returning an error, which misbehaves as an io.Writer but
+// is what FrameWriter should cope with
+type shortWriter struct {
+	w   io.Writer
+	max int
+}
+
+func (sw *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > sw.max {
+		p = p[:sw.max]
+	}
+	return sw.w.Write(p)
+}
+
+func TestFrameWriter(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfs(E_METHOD_CHACHA20_POLY1305, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+
+	var wire bytes.Buffer
+	fw := NewFrameWriter(&shortWriter{w: &wire, max: 1000}, obfuscator)
+	var frames []*Frame
+	// the last ones don't fit in the initial buffer
+	for i, payloadLen := range []int{0, 10, 5000, 16384, 40000, 100} {
+		f := &Frame{
+			StreamID: 1,
+			Seq:      uint64(i),
+			Closing:  C_NOOP,
+			Payload:  make([]byte, payloadLen),
+		}
+		rand.Read(f.Payload)
+		if err := fw.WriteFrame(f); err != nil {
+			t.Fatalf("failed to write a frame with %v bytes of payload: %v", payloadLen, err)
+		}
+		frames = append(frames, f)
+	}
+
+	fr := NewFrameReader(&wire, obfuscator.Deobfs)
+	fr.MaxFrameSize = 0
+	for i, expected := range frames {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatalf("failed to read frame %v: %v", i, err)
+		}
+		if f.Seq != expected.Seq || !bytes.Equal(f.Payload, expected.Payload) {
+			t.Errorf("frame %v mismatch", i)
+		}
+	}
+	if _, err := fr.ReadFrame(); err != io.EOF {
+		t.Errorf("expecting io.EOF, got %v", err)
+	}
+}
+
+type zeroWriter struct{}
+
+func (zeroWriter) Write([]byte) (int, error) { return 0, nil }
+
+func TestFrameWriterStuck(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfs(E_METHOD_PLAIN, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+	fw := NewFrameWriter(zeroWriter{}, obfuscator)
+	if err := fw.WriteFrame(&Frame{Payload: []byte("hello")}); err != io.ErrShortWrite {
+		t.Errorf("expecting io.ErrShortWrite, got %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package multiplex
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestFrameMarshalBinary(t *testing.T) {
+	frames := map[string]*Frame{
+		"empty payload": {StreamID: 1, Seq: 2, Closing: C_STREAM, Payload: []byte{}},
+		"max ids":       {StreamID: math.MaxUint32, Seq: math.MaxUint64, Closing: C_SESSION, Payload: []byte("hello")},
+	}
+	for name, f := range frames {
+		data, err := f.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if len(data) != HEADER_LEN+len(f.Payload) {
+			t.Errorf("%v: expecting %v bytes, got %v", name, HEADER_LEN+len(f.Payload), len(data))
+		}
+		var decoded Frame
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if decoded.StreamID != f.StreamID || decoded.Seq != f.Seq || decoded.Closing != f.Closing || !bytes.Equal(decoded.Payload, f.Payload) {
+			t.Errorf("%v: expecting %v, got %v", name, f, decoded)
+		}
+	}
+}
+
+func TestFrameUnmarshalBinary(t *testing.T) {
+	data, _ := (&Frame{StreamID: 1, Payload: []byte("payload+extra")}).MarshalBinary()
+	data[13] = 6
+	var f Frame
+	if err := f.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if string(f.Payload) != "payload" {
+		t.Errorf("expecting extra to be stripped, got %q", f.Payload)
+	}
+	data[HEADER_LEN] = 'P'
+	if string(f.Payload) != "payload" {
+		t.Error("payload aliases the input")
+	}
+
+	data[13] = 14
+	if err := f.UnmarshalBinary(data); !errors.Is(err, ErrExtraLenTooLarge) {
+		t.Errorf("expecting %v, got %v", ErrExtraLenTooLarge, err)
+	}
+	if err := f.UnmarshalBinary(data[:HEADER_LEN-1]); !errors.Is(err, ErrInputTooShort) {
+		t.Errorf("expecting %v, got %v", ErrInputTooShort, err)
+	}
+}
+
+func TestFrameFlags(t *testing.T) {
+	cases := []struct {
+		closing                         uint8
+		fin, rst, more, stream, session bool
+	}{
+		{C_NOOP, false, false, false, false, false},
+		{C_STREAM, true, false, false, true, false},
+		{C_SESSION, false, false, false, false, true},
+		{FlagRst, false, true, false, true, false},
+		{FlagMore, false, false, true, false, false},
+		{FlagFin | FlagMore, true, false, true, true, false},
+		{FlagPadding, false, false, false, false, false},
+	}
+	for _, c := range cases {
+		f := &Frame{Closing: c.closing}
+		if f.IsPadding() != (c.closing == FlagPadding) {
+			t.Errorf("unexpected IsPadding of Closing %#x", c.closing)
+		}
+		if f.IsFin() != c.fin || f.IsRst() != c.rst || f.HasMore() != c.more || f.ClosesStream() != c.stream || f.ClosesSession() != c.session {
+			t.Errorf("unexpected flags of Closing %#x", c.closing)
+		}
+	}
+}
+
+func TestFrameString(t *testing.T) {
+	payload := make([]byte, 100)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	for expected, f := range map[string]*Frame{
+		"Frame{StreamID:1 Seq:2 Flags:0 Len:0}":                                     {StreamID: 1, Seq: 2},
+		"Frame{StreamID:3 Seq:4 Flags:Fin|More Len:3 Payload:616263}":               {StreamID: 3, Seq: 4, Closing: FlagFin | FlagMore, Payload: []byte("abc")},
+		"Frame{StreamID:0 Seq:0 Flags:Rst|Control|Handshake Len:0}":                 {Closing: FlagRst | FlagControl | FlagHandshake},
+		"Frame{StreamID:5 Seq:6 Flags:Padding Len:100 Payload:0001020304050607...}": {StreamID: 5, Seq: 6, Closing: FlagPadding, Payload: payload},
+	} {
+		if s := f.String(); s != expected {
+			t.Errorf("expecting %q, got %q", expected, s)
+		}
+	}
+	var f *Frame
+	if f.String() != "<nil>" {
+		t.Errorf("expecting a nil frame to be <nil>, got %q", f.String())
+	}
+
+	f = &Frame{StreamID: math.MaxUint64, Seq: math.MaxUint64, Closing: 0xff, Payload: payload}
+	if allocs := testing.AllocsPerRun(100, func() { _ = f.String() }); allocs > 1 {
+		t.Errorf("expecting at most one allocation, got %v", allocs)
+	}
+}
+
+func TestFrameEqual(t *testing.T) {
+	f := &Frame{StreamID: 1, Seq: 2, Closing: FlagFin, Payload: []byte("abc")}
+	if !f.Equal(&Frame{StreamID: 1, Seq: 2, Closing: FlagFin, Payload: []byte("abc")}) {
+		t.Error("expecting frames with the same fields to be equal")
+	}
+	for name, other := range map[string]*Frame{
+		"stream":  {StreamID: 3, Seq: 2, Closing: FlagFin, Payload: []byte("abc")},
+		"seq":     {StreamID: 1, Seq: 3, Closing: FlagFin, Payload: []byte("abc")},
+		"closing": {StreamID: 1, Seq: 2, Closing: FlagRst, Payload: []byte("abc")},
+		"payload": {StreamID: 1, Seq: 2, Closing: FlagFin, Payload: []byte("abd")},
+		"nil":     nil,
+	} {
+		if f.Equal(other) || other.Equal(f) {
+			t.Errorf("%v: expecting frames that differ not to be equal either way round", name)
+		}
+	}
+	if !(&Frame{Payload: []byte{}}).Equal(&Frame{}) {
+		t.Error("expecting a nil and an empty payload to be equal")
+	}
+	var nilFrame *Frame
+	if !nilFrame.Equal(nil) {
+		t.Error("expecting two nil frames to be equal")
+	}
+}
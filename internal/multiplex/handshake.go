@@ -0,0 +1,30 @@
+package multiplex
+
+import "errors"
+
+// Handshake frames carry the messages exchanged to set a session up, before data frames flow. They are sent on
+// HandshakeStreamID with FlagHandshake set, and go through obfs and deobfs like any other frame so they can't be told
+// apart from data on the wire. Their Seqs count up from 0 as on any stream, for the handshake messages to be kept in
+// order. A Deobfser refuses frames with FlagHandshake on any other stream.
+
+// HandshakeStreamID is the stream handshake frames are sent on. It's never opened as a data stream, as streams of a
+// Session are numbered from 1, and is shared with control frames, which have FlagControl set instead
+const HandshakeStreamID = 0
+
+var ErrHandshakeStreamID = errors.New("handshake frame outside of the handshake stream")
+
+// NewHandshakeFrame returns the handshake frame carrying the seqth message of the handshake
+func NewHandshakeFrame(seq uint64, payload []byte) *Frame {
+	return &Frame{
+		StreamID: HandshakeStreamID,
+		Seq:      seq,
+		Closing:  FlagHandshake,
+		Payload:  payload,
+	}
+}
+
+// IsHandshake reports whether f is a handshake frame, to be given to whatever sets the session up rather than to a
+// stream
+func (f *Frame) IsHandshake() bool {
+	return f.Closing&FlagHandshake != 0 && f.StreamID == HandshakeStreamID
+}
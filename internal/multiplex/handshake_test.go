@@ -0,0 +1,57 @@
+package multiplex
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestHandshakeFrame(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	for name, c := range map[string]struct {
+		method  Method
+		version byte
+	}{
+		"v1 plain":   {E_METHOD_PLAIN, PROTOCOL_V1},
+		"v1 aes-gcm": {E_METHOD_AES_GCM, PROTOCOL_V1},
+		"v6 aes-gcm": {E_METHOD_AES_GCM, PROTOCOL_V6},
+		"v9 aes-gcm": {E_METHOD_AES_GCM, PROTOCOL_V9},
+	} {
+		obfuscator, err := GenerateObfs(c.method, sessionKey, WithRecordLayer(TLSRecordLayer{}), WithProtocolVersion(c.version))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hello := NewHandshakeFrame(1, []byte("hello"))
+		obfsBuf := make([]byte, 512)
+		n, err := obfuscator.Obfs(hello, obfsBuf)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		f, err := obfuscator.Deobfs(obfsBuf[:n])
+		if err != nil {
+			t.Fatalf("%v: failed to deobfs: %v", name, err)
+		}
+		if !f.IsHandshake() || f.Seq != 1 || !bytes.Equal(f.Payload, hello.Payload) {
+			t.Errorf("%v: expecting %v, got %v", name, hello, f)
+		}
+		if _, _, ok := f.Control(); ok {
+			t.Errorf("%v: handshake frame taken as a control frame", name)
+		}
+
+		// the flag is refused on a data stream
+		n, _ = obfuscator.Obfs(&Frame{StreamID: 3, Closing: FlagHandshake, Payload: []byte("hello")}, obfsBuf)
+		if _, err := obfuscator.Deobfs(obfsBuf[:n]); !errors.Is(err, ErrHandshakeStreamID) {
+			t.Errorf("%v: expecting %v, got %v", name, ErrHandshakeStreamID, err)
+		}
+	}
+
+	// control and data frames on stream 0 aren't handshake frames
+	if (&Frame{StreamID: HandshakeStreamID, Payload: []byte("hello")}).IsHandshake() {
+		t.Error("data frame taken as a handshake frame")
+	}
+	if NewControlFrame(0, ControlPing, [8]byte{}).IsHandshake() {
+		t.Error("control frame taken as a handshake frame")
+	}
+}
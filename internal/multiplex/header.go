@@ -0,0 +1,164 @@
+package multiplex
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var ErrStreamIDTooLarge = errors.New("stream ID doesn't fit in the frame header of this protocol version")
+
+var errReservedFlags = errors.New("reserved flags in the frame header are set")
+
+// errSeqOutOfNonceRange is returned by a Deobfser for a frame of a wide header whose Seq is too large to be part of the
+// nonce derived from the header. An Obfser refuses to send such frames with ErrSeqExhausted
+var errSeqOutOfNonceRange = errors.New("seq is too large for the nonce derived from the frame header")
+
+// headerLayout describes where the fields of the plaintext frame header are in a given protocol version. StreamID and
+// Seq always come first, and header[:12] is the AEAD nonce.
+type headerLayout struct {
+	len int
+	// wideStreamID headers have a 64 bit StreamID at header[0:8], followed by Seq in little-endian so that its low
+	// 32 bits are at header[8:12] and the nonce remains StreamID||Seq. Such a nonce is only unique while Seq fits in
+	// 32 bits. Otherwise StreamID is 32 bits at header[0:4] and Seq is big-endian at header[4:12]
+	wideStreamID bool
+	// flags is a big-endian field of flagsLen bytes at flagsOffset. Closing is its lowest byte, and the Compression of
+	// the payload is the one above it. Anything above that is reserved and must be zero
+	flagsOffset int
+	flagsLen    int
+	// extraLen is a big-endian field of extraLenLen bytes at extraLenOffset
+	extraLenOffset int
+	extraLenLen    int
+	// epochOffset is 0 if the header has no key epoch
+	epochOffset int
+}
+
+var (
+	// headerV1 is the original HEADER_LEN byte header
+	headerV1 = headerLayout{len: HEADER_LEN, flagsOffset: 12, flagsLen: 1, extraLenOffset: 13, extraLenLen: 1}
+	// headerV4 appends the key epoch
+	headerV4 = headerLayout{len: HEADER_LEN + 1, flagsOffset: 12, flagsLen: 1, extraLenOffset: 13, extraLenLen: 1, epochOffset: 14}
+	// headerV7 widens the flags field to 16 bits
+	headerV7 = headerLayout{len: HEADER_LEN + 2, flagsOffset: 12, flagsLen: 2, extraLenOffset: 14, extraLenLen: 1, epochOffset: 15}
+	// headerV8 widens StreamID to 64 bits
+	headerV8 = headerLayout{len: HEADER_LEN + 6, wideStreamID: true, flagsOffset: 16, flagsLen: 2, extraLenOffset: 18, extraLenLen: 1, epochOffset: 19}
+	// headerV9 widens extraLen to 16 bits
+	headerV9 = headerLayout{len: HEADER_LEN + 7, wideStreamID: true, flagsOffset: 16, flagsLen: 2, extraLenOffset: 18, extraLenLen: 2, epochOffset: 20}
+)
+
+// layout returns the header layout of the protocol version
+func (c ObfsConfig) layout() *headerLayout {
+	switch {
+	case c.ProtocolVersion >= PROTOCOL_V9:
+		return &headerV9
+	case c.ProtocolVersion >= PROTOCOL_V8:
+		return &headerV8
+	case c.ProtocolVersion >= PROTOCOL_V7:
+		return &headerV7
+	case c.ProtocolVersion >= PROTOCOL_V4:
+		return &headerV4
+	default:
+		return &headerV1
+	}
+}
+
+func (l *headerLayout) closingOffset() int { return l.flagsOffset + l.flagsLen - 1 }
+
+// compressionOffset is where the Compression of the payload is, or -1 if the flags field has no room for it
+func (l *headerLayout) compressionOffset() int {
+	if l.flagsLen < 2 {
+		return -1
+	}
+	return l.closingOffset() - 1
+}
+
+// maxStreamID is the largest StreamID the header can carry
+func (l *headerLayout) maxStreamID() uint64 {
+	if l.wideStreamID {
+		return math.MaxUint64
+	}
+	return math.MaxUint32
+}
+
+// maxExtraLen is the largest extraLen the header can carry
+func (l *headerLayout) maxExtraLen() int {
+	if l.extraLenLen == 2 {
+		return math.MaxUint16
+	}
+	return math.MaxUint8
+}
+
+// maxNonceSeq is the largest Seq for which header[:12] is still a unique nonce
+func (l *headerLayout) maxNonceSeq() uint64 {
+	if l.wideStreamID {
+		return math.MaxUint32
+	}
+	return math.MaxUint64
+}
+
+// put writes the header of f into header, which must be l.len bytes long
+func (l *headerLayout) put(header []byte, f *Frame, compression Compression, extraLen int, epoch byte) error {
+	if f.StreamID > l.maxStreamID() {
+		return ErrStreamIDTooLarge
+	}
+	if compression != COMPRESSION_NONE && l.compressionOffset() < 0 {
+		return ErrCompressionUnsupported
+	}
+	if l.wideStreamID {
+		putU64(header[0:8], f.StreamID)
+		binary.LittleEndian.PutUint64(header[8:16], f.Seq)
+	} else {
+		putU32(header[0:4], uint32(f.StreamID))
+		putU64(header[4:12], f.Seq)
+	}
+	for i := l.flagsOffset; i < l.closingOffset(); i++ {
+		header[i] = 0
+	}
+	header[l.closingOffset()] = f.Closing
+	if l.compressionOffset() >= 0 {
+		header[l.compressionOffset()] = byte(compression)
+	}
+	if l.extraLenLen == 2 {
+		binary.BigEndian.PutUint16(header[l.extraLenOffset:], uint16(extraLen))
+	} else {
+		header[l.extraLenOffset] = uint8(extraLen)
+	}
+	if l.epochOffset != 0 {
+		header[l.epochOffset] = epoch
+	}
+	return nil
+}
+
+// parse reads the fields of a header written by put. The epoch is 0 if the layout doesn't have one
+func (l *headerLayout) parse(header []byte) (streamID uint64, seq uint64, closing byte, compression Compression, extraLen int, epoch byte, err error) {
+	for i := l.flagsOffset; i < l.closingOffset(); i++ {
+		if i != l.compressionOffset() && header[i] != 0 {
+			err = errReservedFlags
+			return
+		}
+	}
+	if l.compressionOffset() >= 0 {
+		compression = Compression(header[l.compressionOffset()])
+		if !compression.Valid() {
+			err = errReservedFlags
+			return
+		}
+	}
+	if l.wideStreamID {
+		streamID = u64(header[0:8])
+		seq = binary.LittleEndian.Uint64(header[8:16])
+	} else {
+		streamID = uint64(u32(header[0:4]))
+		seq = u64(header[4:12])
+	}
+	closing = header[l.closingOffset()]
+	if l.extraLenLen == 2 {
+		extraLen = int(binary.BigEndian.Uint16(header[l.extraLenOffset:]))
+	} else {
+		extraLen = int(header[l.extraLenOffset])
+	}
+	if l.epochOffset != 0 {
+		epoch = header[l.epochOffset]
+	}
+	return
+}
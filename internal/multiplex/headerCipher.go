@@ -0,0 +1,46 @@
+package multiplex
+
+import (
+	"errors"
+	"github.com/Yawning/chacha20"
+	"golang.org/x/crypto/salsa20"
+)
+
+// HeaderCipher is the stream cipher the frame header is scrambled with, keyed by the header key and the last 8 bytes
+// of the frame as the nonce
+type HeaderCipher byte
+
+const (
+	HEADER_CIPHER_SALSA20 HeaderCipher = iota
+	// HEADER_CIPHER_CHACHA20 is the original ChaCha20 with a 64 bit nonce, for implementations that would rather only
+	// carry the one stream cipher alongside E_METHOD_CHACHA20_POLY1305
+	HEADER_CIPHER_CHACHA20
+	// HEADER_CIPHER_NONE leaves the header in the clear, so that StreamID, Seq and the rest of it can be read straight
+	// off a packet capture. It's INSECURE: the header gives away what Cloak is to anyone watching, as would the
+	// payload if the method is E_METHOD_PLAIN. It's only meant for debugging, and for transports that are encrypted
+	// on their own
+	HEADER_CIPHER_NONE
+
+	maxHeaderCipher = iota - 1
+)
+
+var ErrHeaderCipherUnsupported = errors.New("the chacha20 header cipher needs PROTOCOL_V3 or above")
+
+func (h HeaderCipher) Valid() bool { return h <= maxHeaderCipher }
+
+// scramble XORs header with the keystream of key and the 8 byte nonce. It's a method rather than a function picked
+// once, as calling through a function value would make the nonce escape to the heap
+func (h HeaderCipher) scramble(header, nonce []byte, key *[32]byte) {
+	switch h {
+	case HEADER_CIPHER_NONE:
+		// left in the clear
+	case HEADER_CIPHER_CHACHA20:
+		var c chacha20.Cipher
+		// the key and nonce are always of the right length
+		c.ReKey(key[:], nonce)
+		c.XORKeyStream(header, header)
+		c.Reset()
+	default:
+		salsa20.XORKeyStream(header, header, nonce, key)
+	}
+}
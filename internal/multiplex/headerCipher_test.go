@@ -0,0 +1,115 @@
+package multiplex
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestChaCha20HeaderKeystream(t *testing.T) {
+	// the first block of RFC 8439 Appendix A.1 test vector #1, which has an all zero key, nonce and block counter
+	var key [32]byte
+	header := make([]byte, 32)
+	HEADER_CIPHER_CHACHA20.scramble(header, make([]byte, 8), &key)
+	expected := "76b8e0ada0f13d90405d6ae55386bd28bdd219b8a08ded1aa836efcc8b770dc7"
+	if hex.EncodeToString(header) != expected {
+		t.Errorf("expecting keystream %v, got %x", expected, header)
+	}
+}
+
+func TestChaCha20HeaderCipher(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfsBuf := make([]byte, 512)
+
+	for _, method := range []Method{E_METHOD_PLAIN, E_METHOD_AES_GCM, E_METHOD_CHACHA20_POLY1305, E_METHOD_XCHACHA20_POLY1305} {
+		for _, version := range []byte{PROTOCOL_V3, PROTOCOL_V6, PROTOCOL_V9} {
+			for _, recordLayer := range []RecordLayer{TLSRecordLayer{}, NoRecordLayer{}, WebSocketRecordLayer{Mask: true}} {
+				config := ObfsConfig{RecordLayer: recordLayer, ProtocolVersion: version, PlainMAC: version >= PROTOCOL_V6}
+				salsa, _ := GenerateObfsWithConfig(method, sessionKey, config)
+				config.HeaderCipher = HEADER_CIPHER_CHACHA20
+				chacha, err := GenerateObfsWithConfig(method, sessionKey, config)
+				if err != nil {
+					t.Fatalf("%v v%v %T: %v", method, version, recordLayer, err)
+				}
+
+				testFrame := &Frame{StreamID: 1, Seq: 2, Closing: C_STREAM, Payload: []byte("chacha header")}
+				n, err := chacha.Obfs(testFrame, obfsBuf)
+				if err != nil {
+					t.Fatalf("%v v%v %T: %v", method, version, recordLayer, err)
+				}
+				obfsed := append([]byte(nil), obfsBuf[:n]...)
+				f, err := chacha.Deobfs(obfsed)
+				if err != nil {
+					t.Fatalf("%v v%v %T: failed to deobfs: %v", method, version, recordLayer, err)
+				}
+				if f.StreamID != testFrame.StreamID || f.Seq != testFrame.Seq || f.Closing != testFrame.Closing || !bytes.Equal(f.Payload, testFrame.Payload) {
+					t.Errorf("%v v%v %T: expecting %v, got %v", method, version, recordLayer, testFrame, f)
+				}
+				if f, err := salsa.Deobfs(obfsed); err == nil && f.StreamID == testFrame.StreamID && f.Seq == testFrame.Seq {
+					t.Errorf("%v v%v %T: a salsa20 header Deobfser read a chacha20 header", method, version, recordLayer)
+				}
+			}
+		}
+	}
+}
+
+// TestChaCha20HeaderVector pins a whole frame with a ChaCha20 header for other implementations to compare against
+func TestChaCha20HeaderVector(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	for i := range sessionKey {
+		sessionKey[i] = byte(i)
+	}
+	obfuscator, _ := GenerateObfs(E_METHOD_CHACHA20_POLY1305, sessionKey, WithRecordLayer(TLSRecordLayer{}), WithProtocolVersion(PROTOCOL_V3), WithHeaderCipher(HEADER_CIPHER_CHACHA20))
+	testFrame := &Frame{StreamID: 0x01020304, Seq: 0x05060708, Closing: C_STREAM, Payload: []byte("golden vector payload")}
+	buf := make([]byte, 512)
+	n, _ := obfuscator.Obfs(testFrame, buf)
+	expected := "1703030033b9f7960920fbe5b60c4bb0c40f7554187cfd2cc8b7289ddac53e915515ff211dddc378aad5e9c2a9fabddee9f2e723af6ad446"
+	if obfsed := hex.EncodeToString(buf[:n]); obfsed != expected {
+		t.Errorf("expecting\n%v\ngot\n%v", expected, obfsed)
+	}
+}
+
+func TestHeaderCipherUnsupported(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	if _, err := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithProtocolVersion(PROTOCOL_V2), WithHeaderCipher(HEADER_CIPHER_CHACHA20)); !errors.Is(err, ErrHeaderCipherUnsupported) {
+		t.Errorf("expecting %v, got %v", ErrHeaderCipherUnsupported, err)
+	}
+	if _, err := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithProtocolVersion(PROTOCOL_V3), WithHeaderCipher(maxHeaderCipher+1)); err == nil {
+		t.Error("accepted an unknown header cipher")
+	}
+}
+
+func TestClearHeader(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	if obfuscator, _ := GenerateObfs(E_METHOD_PLAIN, sessionKey); obfuscator.config.HeaderCipher != HEADER_CIPHER_SALSA20 {
+		t.Errorf("headers aren't scrambled by default")
+	}
+
+	for _, method := range []Method{E_METHOD_PLAIN, E_METHOD_AES_GCM} {
+		for _, version := range []byte{PROTOCOL_V1, PROTOCOL_V9} {
+			obfuscator, err := GenerateObfs(method, sessionKey, WithRecordLayer(TLSRecordLayer{}), WithProtocolVersion(version), WithHeaderEncryption(false))
+			if err != nil {
+				t.Fatalf("%v v%v: %v", method, version, err)
+			}
+			testFrame := &Frame{StreamID: 3, Seq: 4, Closing: C_STREAM, Payload: []byte("in the clear")}
+			buf := make([]byte, 512)
+			n, _ := obfuscator.Obfs(testFrame, buf)
+
+			// the header can be read without any key
+			streamID, seq, closing, _, _, _, err := obfuscator.config.layout().parse(buf[recordHeaderLen : recordHeaderLen+obfuscator.config.headerLen()])
+			if err != nil || streamID != testFrame.StreamID || seq != testFrame.Seq || closing != testFrame.Closing {
+				t.Errorf("%v v%v: read stream %v seq %v closing %v from the header, %v", method, version, streamID, seq, closing, err)
+			}
+			if f, err := obfuscator.Deobfs(buf[:n]); err != nil || !bytes.Equal(f.Payload, testFrame.Payload) {
+				t.Errorf("%v v%v: failed to deobfs: %v", method, version, err)
+			}
+			if method == E_METHOD_PLAIN && !bytes.Contains(buf[:n], testFrame.Payload) {
+				t.Errorf("%v v%v: payload isn't in the clear", method, version)
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package multiplex
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestHeaderLayout(t *testing.T) {
+	layouts := map[byte]*headerLayout{
+		PROTOCOL_V1: &headerV1,
+		PROTOCOL_V3: &headerV1,
+		PROTOCOL_V4: &headerV4,
+		PROTOCOL_V6: &headerV4,
+		PROTOCOL_V7: &headerV7,
+		PROTOCOL_V8: &headerV8,
+		PROTOCOL_V9: &headerV9,
+	}
+	for version, expected := range layouts {
+		config := ObfsConfig{ProtocolVersion: version}
+		if config.layout() != expected {
+			t.Errorf("v%v: wrong layout", version+1)
+		}
+	}
+
+	for _, l := range []*headerLayout{&headerV1, &headerV4, &headerV7, &headerV8, &headerV9} {
+		f := &Frame{StreamID: 0xdeadbeef, Seq: 0x0102030405060708, Closing: FlagFin | FlagMore}
+		header := make([]byte, l.len)
+		rand.Read(header)
+		l.put(header, f, COMPRESSION_NONE, l.maxExtraLen()-1, 7)
+		streamID, seq, closing, _, extraLen, epoch, err := l.parse(header)
+		if err != nil {
+			t.Fatalf("%v byte header: %v", l.len, err)
+		}
+		if streamID != f.StreamID || seq != f.Seq || closing != f.Closing || extraLen != l.maxExtraLen()-1 {
+			t.Errorf("%v byte header: fields mismatch", l.len)
+		}
+		if l.epochOffset != 0 && epoch != 7 {
+			t.Errorf("%v byte header: expecting epoch 7, got %v", l.len, epoch)
+		}
+	}
+}
+
+func TestWideFlagsHeader(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	testFrame := &Frame{StreamID: 1, Seq: 2, Closing: FlagRst, Payload: []byte("wide flags")}
+	obfsBuf := make([]byte, 512)
+
+	for _, method := range []Method{E_METHOD_PLAIN, E_METHOD_AES_GCM, E_METHOD_CHACHA20_POLY1305} {
+		v7, _ := GenerateObfsWithConfig(method, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V7})
+		n, err := v7.Obfs(testFrame, obfsBuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != v7.frameLen(len(testFrame.Payload)) {
+			t.Errorf("%v: expecting a %v byte frame, got %v", method, v7.frameLen(len(testFrame.Payload)), n)
+		}
+		resultFrame, err := v7.Deobfs(obfsBuf[:n])
+		if err != nil {
+			t.Fatalf("%v: %v", method, err)
+		}
+		if resultFrame.StreamID != testFrame.StreamID || resultFrame.Seq != testFrame.Seq ||
+			resultFrame.Closing != testFrame.Closing || !bytes.Equal(resultFrame.Payload, testFrame.Payload) {
+			t.Errorf("%v: expecting %v, got %v", method, testFrame, resultFrame)
+		}
+
+		// salsa20 is a stream cipher so flipping a bit of the scrambled header flips the same bit of the plain header
+		obfsBuf[5+12] ^= 0x80
+		if _, err := v7.Deobfs(obfsBuf[:n]); !errors.Is(err, errReservedFlags) {
+			t.Errorf("%v: expecting %v, got %v", method, errReservedFlags, err)
+		}
+	}
+}
+
+func TestWideStreamID(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfsBuf := make([]byte, 512)
+
+	for _, method := range []Method{E_METHOD_PLAIN, E_METHOD_AES_GCM, E_METHOD_XCHACHA20_POLY1305} {
+		v7, _ := GenerateObfsWithConfig(method, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V7})
+		v8, _ := GenerateObfsWithConfig(method, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V8})
+
+		if _, err := v7.Obfs(&Frame{StreamID: math.MaxUint32}, obfsBuf); err != nil {
+			t.Errorf("%v: v7 should take a StreamID of %v: %v", method, uint64(math.MaxUint32), err)
+		}
+		if _, err := v7.Obfs(&Frame{StreamID: math.MaxUint32 + 1}, obfsBuf); !errors.Is(err, ErrStreamIDTooLarge) {
+			t.Errorf("%v: expecting %v from v7, got %v", method, ErrStreamIDTooLarge, err)
+		}
+
+		for _, streamID := range []uint64{0, math.MaxUint32, math.MaxUint32 + 1, math.MaxUint64} {
+			testFrame := &Frame{StreamID: streamID, Seq: math.MaxUint32, Closing: FlagFin, Payload: []byte("wide stream id")}
+			n, err := v8.Obfs(testFrame, obfsBuf)
+			if err != nil {
+				t.Fatalf("%v %v: %v", method, streamID, err)
+			}
+			resultFrame, err := v8.Deobfs(obfsBuf[:n])
+			if err != nil {
+				t.Fatalf("%v %v: %v", method, streamID, err)
+			}
+			if resultFrame.StreamID != streamID || resultFrame.Seq != testFrame.Seq || resultFrame.Closing != testFrame.Closing ||
+				!bytes.Equal(resultFrame.Payload, testFrame.Payload) {
+				t.Errorf("%v: expecting %v, got %v", method, testFrame, resultFrame)
+			}
+		}
+
+		// only AEADs whose nonce is taken from the header are limited to 32 bit Seqs
+		_, err := v8.Obfs(&Frame{StreamID: 1, Seq: math.MaxUint32 + 1}, obfsBuf)
+		if method == E_METHOD_AES_GCM && !errors.Is(err, ErrSeqExhausted) {
+			t.Errorf("%v: expecting %v, got %v", method, ErrSeqExhausted, err)
+		}
+		if method != E_METHOD_AES_GCM && err != nil {
+			t.Errorf("%v: %v", method, err)
+		}
+	}
+}
+
+func TestWideHeaderNonce(t *testing.T) {
+	// frames that would share a nonce if StreamID were truncated to 32 bits, or Seq to its high half
+	frames := []*Frame{
+		{StreamID: 1, Seq: 0},
+		{StreamID: 1<<32 + 1, Seq: 0},
+		{StreamID: 1, Seq: 1},
+		{StreamID: 1, Seq: math.MaxUint32},
+	}
+	nonces := make(map[string]bool)
+	for _, f := range frames {
+		header := make([]byte, headerV8.len)
+		if err := headerV8.put(header, f, COMPRESSION_NONE, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		nonce := string(header[:derivedNonceLen])
+		if nonces[nonce] {
+			t.Errorf("nonce of stream %v seq %v is repeated", f.StreamID, f.Seq)
+		}
+		nonces[nonce] = true
+	}
+}
@@ -0,0 +1,36 @@
+package multiplex
+
+// loopbackSessionKey is the session key of every loopback Obfuscator. It keys nothing, as nothing is encrypted
+var loopbackSessionKey = make([]byte, 32)
+
+// NewLoopbackObfuscator returns an Obfuscator for TESTS ONLY, such as integration tests of packages built on top of
+// this one, whose frames are neither encrypted nor scrambled. Obfs and Deobfs are exact inverses of each other and
+// produce the same bytes for the same frame every time, and any two loopback Obfuscators of the same options can
+// deobfs each other's frames.
+//
+// Without options, a frame is obfsed into the PROTOCOL_V1 header in the clear, which is StreamID as 4 bytes and Seq as
+// 8 bytes big endian, Closing and extraLen, followed by the payload and then extraLen zero bytes filling payloads
+// shorter than 8 bytes up to 8 bytes. There is no record layer. opts are applied on top of this, and may change the
+// format, but the method is always E_METHOD_PLAIN and the header always left in the clear. Frames of a loopback
+// Obfuscator give away that they are Cloak to anyone watching, so it must never be used on a real connection
+func NewLoopbackObfuscator(opts ...ObfsOption) (*Obfuscator, error) {
+	var config ObfsConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+	config.HeaderCipher = HEADER_CIPHER_NONE
+	if config.Rand == nil {
+		config.Rand = zeroReader{}
+	}
+	return GenerateObfsWithConfig(E_METHOD_PLAIN, loopbackSessionKey, config)
+}
+
+// zeroReader reads as zeros, for the bytes of loopback frames that would otherwise be random
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
@@ -0,0 +1,49 @@
+package multiplex
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLoopbackObfuscator(t *testing.T) {
+	sender, err := NewLoopbackObfuscator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, _ := NewLoopbackObfuscator()
+	obfsBuf := make([]byte, 512)
+
+	n, err := sender.Obfs(&Frame{StreamID: 1, Seq: 2, Closing: FlagFin, Payload: []byte("hi")}, obfsBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 2, FlagFin, 6, 'h', 'i', 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(obfsBuf[:n], expected) {
+		t.Errorf("expecting the frame in the clear as %x, got %x", expected, obfsBuf[:n])
+	}
+	f, err := receiver.Deobfs(obfsBuf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Equal(&Frame{StreamID: 1, Seq: 2, Closing: FlagFin, Payload: []byte("hi")}) {
+		t.Errorf("expecting the frame back, got %v", f)
+	}
+
+	// the same frame is obfsed into the same bytes every time
+	testFrame := &Frame{StreamID: 3, Seq: 4, Payload: []byte("a payload of more than 8 bytes")}
+	n, _ = sender.Obfs(testFrame, obfsBuf)
+	first := append([]byte{}, obfsBuf[:n]...)
+	n, _ = sender.Obfs(testFrame, obfsBuf)
+	if !bytes.Equal(first, obfsBuf[:n]) {
+		t.Error("loopback frames aren't deterministic")
+	}
+
+	withRecordLayer, err := NewLoopbackObfuscator(WithRecordLayer(LengthPrefixRecordLayer{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ = withRecordLayer.Obfs(testFrame, obfsBuf)
+	if f, err := withRecordLayer.Deobfs(obfsBuf[:n]); err != nil || !f.Equal(testFrame) {
+		t.Errorf("expecting the frame back through the record layer, got %v: %v", f, err)
+	}
+}
@@ -0,0 +1,147 @@
+package multiplex
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cbeuw/Cloak/internal/aegis"
+	"github.com/cbeuw/Cloak/internal/ascon"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Method is the encryption method used for frame payloads. It's sent to the server as a single byte during the
+// handshake
+type Method byte
+
+const (
+	E_METHOD_PLAIN Method = iota
+	E_METHOD_AES_GCM
+	E_METHOD_CHACHA20_POLY1305
+	E_METHOD_XCHACHA20_POLY1305
+	E_METHOD_AES_128_GCM
+	E_METHOD_AES_GCM_SIV
+	E_METHOD_AEGIS_128L
+	E_METHOD_ASCON_128
+	E_METHOD_AES_192_GCM
+
+	maxMethod = iota - 1
+)
+
+// E_METHOD_EXTERNAL is the method of Obfuscators made by GenerateObfsWithAEAD, which is what Metrics are given for
+// them. It isn't Valid, as it can't be sent to the remote: both ends have to agree on the AEAD by themselves
+const E_METHOD_EXTERNAL Method = 0xfe
+
+var methodNames = [...]string{
+	E_METHOD_PLAIN:              "plain",
+	E_METHOD_AES_GCM:            "aes-gcm",
+	E_METHOD_CHACHA20_POLY1305:  "chacha20-poly1305",
+	E_METHOD_XCHACHA20_POLY1305: "xchacha20-poly1305",
+	E_METHOD_AES_128_GCM:        "aes-128-gcm",
+	E_METHOD_AES_GCM_SIV:        "aes-gcm-siv",
+	E_METHOD_AEGIS_128L:         "aegis-128l",
+	E_METHOD_ASCON_128:          "ascon-128",
+	E_METHOD_AES_192_GCM:        "aes-192-gcm",
+}
+
+// methodAliases are the other names ParseMethod accepts on top of the canonical ones
+var methodAliases = map[string]Method{
+	"none":   E_METHOD_PLAIN,
+	"aes":    E_METHOD_AES_GCM,
+	"chacha": E_METHOD_CHACHA20_POLY1305,
+}
+
+// ParseMethod returns the Method called name, which is case insensitive. It can either be the canonical name
+// returned by MethodName, or one of the common aliases "none", "aes" and "chacha"
+func ParseMethod(name string) (Method, error) {
+	name = strings.ToLower(name)
+	for m, canonical := range methodNames {
+		if name == canonical {
+			return Method(m), nil
+		}
+	}
+	if m, ok := methodAliases[name]; ok {
+		return m, nil
+	}
+	return 0, fmt.Errorf("%w %q, supported: %v", ErrUnknownMethod, name, strings.Join(supportedMethodNames(), ", "))
+}
+
+// SupportedMethods returns every encryption method this build supports, in the order of their values, which is the
+// order they were added in. The slice is the caller's to modify
+func SupportedMethods() []Method {
+	methods := make([]Method, 0, maxMethod+1)
+	for m := Method(0); m.Valid(); m++ {
+		methods = append(methods, m)
+	}
+	return methods
+}
+
+func supportedMethodNames() []string {
+	names := make([]string, 0, maxMethod+1)
+	for _, m := range SupportedMethods() {
+		names = append(names, m.String())
+	}
+	return names
+}
+
+// MethodName returns the canonical name of m, which is the same as m.String()
+func MethodName(m Method) string { return m.String() }
+
+// Valid reports whether m is a known encryption method
+func (m Method) Valid() bool { return m <= maxMethod }
+
+// String returns the name of m as used in config files
+func (m Method) String() string {
+	if m == E_METHOD_EXTERNAL {
+		return "external"
+	}
+	if !m.Valid() {
+		return fmt.Sprintf("Method(%d)", byte(m))
+	}
+	return methodNames[m]
+}
+
+// KeySize returns the length of the key used by the payload cipher of m, which may be shorter than the 32 byte session
+// key it's taken from. It's 0 for E_METHOD_PLAIN and unknown methods
+func (m Method) KeySize() int {
+	switch m {
+	case E_METHOD_AES_GCM, E_METHOD_CHACHA20_POLY1305, E_METHOD_XCHACHA20_POLY1305, E_METHOD_AES_GCM_SIV:
+		return 32
+	case E_METHOD_AES_192_GCM:
+		return 24
+	case E_METHOD_AES_128_GCM, E_METHOD_AEGIS_128L, E_METHOD_ASCON_128:
+		return 16
+	default:
+		return 0
+	}
+}
+
+// validSessionKeyLen reports whether a session key of n bytes can be used with m. Every method takes a 32 byte one,
+// and E_METHOD_AES_192_GCM also takes a 24 byte one as is handed out by some key management services
+func (m Method) validSessionKeyLen(n int) bool {
+	return n == 32 || (m == E_METHOD_AES_192_GCM && n == 24)
+}
+
+// Overhead returns the length of the authentication tag m appends to each payload. It's 0 for E_METHOD_PLAIN and
+// unknown methods. A frame also carries an explicit nonce on top of this for methods whose nonce can't be taken
+// from the header, see Obfuscator.Overhead for the full overhead of a frame
+func (m Method) Overhead() int {
+	if m == E_METHOD_PLAIN || !m.Valid() {
+		return 0
+	}
+	return 16
+}
+
+// explicitNonceLen returns the length of the nonce carried in each frame of m, which is what explicitNonceLenOf returns
+// for its payload cipher without it having to be set up. It's 0 for methods whose nonce is taken from the header
+func (m Method) explicitNonceLen() int {
+	switch m {
+	case E_METHOD_XCHACHA20_POLY1305:
+		return chacha20poly1305.NonceSizeX
+	case E_METHOD_AEGIS_128L:
+		return aegis.NonceSize
+	case E_METHOD_ASCON_128:
+		return ascon.NonceSize
+	default:
+		return 0
+	}
+}
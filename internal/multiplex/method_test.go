@@ -0,0 +1,92 @@
+package multiplex
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMethod(t *testing.T) {
+	key := make([]byte, 32)
+	for m := Method(0); m.Valid(); m++ {
+		payloadCipher, err := makePayloadCipher(m, key)
+		if err != nil {
+			t.Fatalf("%v: %v", m, err)
+		}
+		if payloadCipher == nil {
+			if m.Overhead() != 0 || m.KeySize() != 0 {
+				t.Errorf("%v: expecting no overhead or key", m)
+			}
+			continue
+		}
+		if m.Overhead() != payloadCipher.Overhead() {
+			t.Errorf("%v: expecting overhead %v, got %v", m, payloadCipher.Overhead(), m.Overhead())
+		}
+		if m.KeySize() == 0 || m.KeySize() > len(key) {
+			t.Errorf("%v: bad key size %v", m, m.KeySize())
+		}
+	}
+
+	if E_METHOD_CHACHA20_POLY1305.String() != "chacha20-poly1305" {
+		t.Errorf("unexpected name %v", E_METHOD_CHACHA20_POLY1305)
+	}
+	unknown := Method(0xff)
+	if unknown.Valid() || unknown.String() != "Method(255)" || unknown.KeySize() != 0 || unknown.Overhead() != 0 {
+		t.Errorf("unexpected properties of an unknown method")
+	}
+}
+
+func TestParseMethod(t *testing.T) {
+	for m := Method(0); m.Valid(); m++ {
+		parsed, err := ParseMethod(MethodName(m))
+		if err != nil || parsed != m {
+			t.Errorf("%v: parsed as %v, %v", m, parsed, err)
+		}
+	}
+
+	aliases := map[string]Method{
+		"none":    E_METHOD_PLAIN,
+		"AES":     E_METHOD_AES_GCM,
+		"Chacha":  E_METHOD_CHACHA20_POLY1305,
+		"AES-GCM": E_METHOD_AES_GCM,
+	}
+	for name, expected := range aliases {
+		if m, err := ParseMethod(name); err != nil || m != expected {
+			t.Errorf("%v: expecting %v, got %v, %v", name, expected, m, err)
+		}
+	}
+
+	for _, name := range []string{"", "rot13", "aes-256"} {
+		if _, err := ParseMethod(name); !errors.Is(err, ErrUnknownMethod) {
+			t.Errorf("%q: expecting %v, got %v", name, ErrUnknownMethod, err)
+		}
+	}
+}
+
+func TestSupportedMethods(t *testing.T) {
+	methods := SupportedMethods()
+	if len(methods) != int(maxMethod)+1 {
+		t.Fatalf("expecting %v methods, got %v", maxMethod+1, len(methods))
+	}
+	for i, m := range methods {
+		if m != Method(i) {
+			t.Errorf("expecting method %v at %v, got %v", Method(i), i, m)
+		}
+	}
+	// every supported method can be used
+	sessionKey := make([]byte, 32)
+	for _, m := range methods {
+		if _, err := GenerateObfs(m, sessionKey); err != nil {
+			t.Errorf("%v: %v", m, err)
+		}
+	}
+	methods[0] = E_METHOD_EXTERNAL
+	if SupportedMethods()[0] != E_METHOD_PLAIN {
+		t.Error("expecting a fresh slice on every call")
+	}
+
+	_, err := ParseMethod("rot13")
+	if err == nil || !strings.Contains(err.Error(), "supported: plain, aes-gcm, chacha20-poly1305") {
+		t.Errorf("expecting the supported methods to be listed, got %v", err)
+	}
+}
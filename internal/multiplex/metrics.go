@@ -0,0 +1,15 @@
+package multiplex
+
+// Metrics is told about every frame an Obfuscator obfses or deobfses, for counters kept outside of this package. Its
+// methods are called from whichever goroutines obfs and deobfs frames, so they must be safe for concurrent use, and
+// should return quickly as frames are held up while they run.
+type Metrics interface {
+	// FrameObfsed is called for each frame obfsed, with the length of its payload before any compression, the number
+	// of bytes it was obfsed into, and how many of them are padding added by ObfsConfig.Padding
+	FrameObfsed(method Method, payloadLen, frameLen, paddingLen int)
+	// FrameDeobfsed is called for each frame deobfsed, with the number of bytes it was obfsed into and the length of
+	// its payload
+	FrameDeobfsed(method Method, frameLen, payloadLen int)
+	// AuthFailed is called for each frame that fails authentication (ErrAuthFailed)
+	AuthFailed(method Method)
+}
@@ -0,0 +1,75 @@
+package multiplex
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+type countingMetrics struct {
+	mu                          sync.Mutex
+	obfsed, deobfsed, authFails map[Method]int
+	bytesOut, bytesIn, padding  int
+}
+
+func newCountingMetrics() *countingMetrics {
+	return &countingMetrics{obfsed: make(map[Method]int), deobfsed: make(map[Method]int), authFails: make(map[Method]int)}
+}
+
+func (c *countingMetrics) FrameObfsed(method Method, payloadLen, frameLen, paddingLen int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.obfsed[method]++
+	c.bytesOut += frameLen
+	c.padding += paddingLen
+}
+
+func (c *countingMetrics) FrameDeobfsed(method Method, frameLen, payloadLen int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deobfsed[method]++
+	c.bytesIn += frameLen
+}
+
+func (c *countingMetrics) AuthFailed(method Method) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.authFails[method]++
+}
+
+func TestMetrics(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	metrics := newCountingMetrics()
+	obfsBuf := make([]byte, 2048)
+	for _, method := range []Method{E_METHOD_PLAIN, E_METHOD_AES_GCM} {
+		config := ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V9, Padding: BucketPadding{1024}, PlainMAC: true, Metrics: metrics}
+		obfuscator, _ := GenerateObfsWithConfig(method, sessionKey, config)
+
+		n, err := obfuscator.Obfs(&Frame{StreamID: 1, Payload: make([]byte, 100)}, obfsBuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := obfuscator.Deobfs(obfsBuf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		obfsBuf[recordHeaderLen+obfuscator.config.headerLen()] ^= 0xff
+		if _, err := obfuscator.Deobfs(obfsBuf[:n]); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("%v: expecting %v, got %v", method, ErrAuthFailed, err)
+		}
+	}
+
+	for _, method := range []Method{E_METHOD_PLAIN, E_METHOD_AES_GCM} {
+		if metrics.obfsed[method] != 1 || metrics.deobfsed[method] != 1 || metrics.authFails[method] != 1 {
+			t.Errorf("%v: expecting a frame obfsed, deobfsed and failing authentication, got %v, %v and %v", method,
+				metrics.obfsed[method], metrics.deobfsed[method], metrics.authFails[method])
+		}
+	}
+	if metrics.bytesOut != 2048 || metrics.bytesIn != 2048 {
+		t.Errorf("expecting 2048 bytes each way, got %v out and %v in", metrics.bytesOut, metrics.bytesIn)
+	}
+	if metrics.padding == 0 {
+		t.Error("padding isn't counted")
+	}
+}
@@ -0,0 +1,57 @@
+package multiplex
+
+// The AEAD nonce taken from the frame header is StreamID||Seq, both of which start over in every session. A key that
+// is used for more than one session, such as one configured statically by an operator who can't rekey, would then
+// encrypt the first frames of every session under the same nonces. ObfsConfig.NoncePrefix tells the sessions apart
+// by being XORed over the top bytes of StreamID in the nonce, the same way the role bit is, which are then not
+// available for stream IDs. With a bound role, the prefix goes right below the role bit rather than over it: a prefix
+// flipping the role bit would otherwise make the nonces of one role those of the other role with a prefix differing
+// only in that bit. As long as every session under a key has a prefix of its own, no two frames share a nonce. The nonce stays 12 bytes long: AEADs with nonces of any other size already get random explicit nonces, and
+// don't need or use a prefix.
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrNoncePrefixTooLong = errors.New("nonce prefix would leave StreamID too short")
+
+// maxNoncePrefixLen is the longest NoncePrefix the layout takes, which is half of its StreamID: stream IDs are then
+// limited to 16 bits before PROTOCOL_V8 and to 32 bits from it
+func (l *headerLayout) maxNoncePrefixLen() int {
+	if l.wideStreamID {
+		return 4
+	}
+	return 2
+}
+
+func validateNoncePrefix(config ObfsConfig) error {
+	if max := config.layout().maxNoncePrefixLen(); len(config.NoncePrefix) > max {
+		return fmt.Errorf("%w: %v bytes is more than the %v of protocol version %v", ErrNoncePrefixTooLong,
+			len(config.NoncePrefix), max, config.ProtocolVersion)
+	}
+	return nil
+}
+
+// noncePrefixMask returns what is XORed over the top bytes of StreamID for the NoncePrefix of config, which is the
+// prefix shifted one bit down, out of the way of the role bit, if a role is bound into the nonce
+func noncePrefixMask(config ObfsConfig) []byte {
+	prefix := config.NoncePrefix
+	if len(prefix) == 0 || config.Role == ROLE_UNBOUND || config.DirectionalKeys {
+		return prefix
+	}
+	mask := make([]byte, len(prefix)+1)
+	for i, b := range prefix {
+		mask[i] |= b >> 1
+		mask[i+1] = b << 7
+	}
+	return mask
+}
+
+// xorNoncePrefix flips the mask from noncePrefixMask into the top bytes of StreamID in header. Doing it a second time
+// undoes it
+func xorNoncePrefix(header, prefix []byte) {
+	for i, b := range prefix {
+		header[i] ^= b
+	}
+}
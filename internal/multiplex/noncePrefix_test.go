@@ -0,0 +1,104 @@
+package multiplex
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestNoncePrefix(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	f := &Frame{StreamID: 1, Seq: 0, Payload: []byte("first frame of the session")}
+	obfs := func(t *testing.T, obfuscator *Obfuscator) []byte {
+		buf := make([]byte, 200)
+		n, err := obfuscator.Obfs(f, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+
+	first, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithNoncePrefix([]byte{0x12, 0x34}))
+	second, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithNoncePrefix([]byte{0x56, 0x78}))
+	unprefixed, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey)
+	firstFrame := obfs(t, first)
+	secondFrame := obfs(t, second)
+	if bytes.Equal(firstFrame, secondFrame) || bytes.Equal(firstFrame, obfs(t, unprefixed)) {
+		t.Error("expecting frames of sessions with different prefixes to be encrypted under different nonces")
+	}
+	if got, err := first.Deobfs(firstFrame); err != nil || !bytes.Equal(got.Payload, f.Payload) || got.StreamID != 1 {
+		t.Errorf("expecting the frame to be deobfsed with the same prefix, got %v: %v", got, err)
+	}
+	var authErr *AuthFailedError
+	if _, err := second.Deobfs(firstFrame); !errors.As(err, &authErr) {
+		t.Errorf("expecting the frame to fail authentication with another prefix, got %v", err)
+	}
+
+	t.Run("stream ID limit", func(t *testing.T) {
+		buf := make([]byte, 200)
+		if _, err := first.Obfs(&Frame{StreamID: 0xffff, Payload: []byte{1}}, buf); err != nil {
+			t.Errorf("expecting a 16 bit stream ID to be sent, got %v", err)
+		}
+		if _, err := first.Obfs(&Frame{StreamID: 0x10000, Payload: []byte{1}}, buf); err != ErrStreamIDTooLarge {
+			t.Errorf("expecting %v, got %v", ErrStreamIDTooLarge, err)
+		}
+		bound, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithNoncePrefix([]byte{1, 2}), WithRole(ROLE_CLIENT))
+		if _, err := bound.Obfs(&Frame{StreamID: 0x8000, Payload: []byte{1}}, buf); err != ErrStreamIDTooLarge {
+			t.Errorf("expecting the role bit to take one more bit, got %v", err)
+		}
+		plain, _ := GenerateObfs(E_METHOD_PLAIN, sessionKey, WithNoncePrefix([]byte{1, 2}))
+		if _, err := plain.Obfs(&Frame{StreamID: 0x10000, Payload: []byte{1}}, buf); err != nil {
+			t.Errorf("expecting no limit without a nonce taken from the header, got %v", err)
+		}
+	})
+
+	t.Run("role bit", func(t *testing.T) {
+		// the prefixes differ only in the top bit, which is where the role bit goes
+		client, err := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithNoncePrefix([]byte{0x12, 0x34}), WithRole(ROLE_CLIENT))
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithNoncePrefix([]byte{0x92, 0x34}), WithRole(ROLE_SERVER))
+		clientFrame := obfs(t, client)
+		serverFrame := obfs(t, server)
+		l := client.Layout(len(f.Payload))
+		if bytes.Equal(clientFrame[l.Payload:l.End], serverFrame[l.Payload:l.End]) {
+			t.Error("expecting the two roles to be encrypted under different nonces")
+		}
+
+		sameServer, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithNoncePrefix([]byte{0x12, 0x34}), WithRole(ROLE_SERVER))
+		if got, err := sameServer.Deobfs(clientFrame); err != nil || !bytes.Equal(got.Payload, f.Payload) {
+			t.Errorf("expecting the server to deobfs the client's frame with the same prefix, got %v: %v", got, err)
+		}
+		widest := &Frame{StreamID: 0x7fff, Payload: []byte{1}}
+		buf := make([]byte, 200)
+		n, err := client.Obfs(widest, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := sameServer.Deobfs(buf[:n]); err != nil || !got.Equal(widest) {
+			t.Errorf("expecting the largest stream ID to round trip below the prefix, got %v: %v", got, err)
+		}
+	})
+
+	t.Run("too long", func(t *testing.T) {
+		if _, err := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithNoncePrefix([]byte{1, 2, 3})); !errors.Is(err, ErrNoncePrefixTooLong) {
+			t.Errorf("expecting %v, got %v", ErrNoncePrefixTooLong, err)
+		}
+		wide, err := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithProtocolVersion(PROTOCOL_V8), WithNoncePrefix([]byte{1, 2, 3, 4}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		wideFrame := &Frame{StreamID: 0xffffffff, Seq: 3, Payload: []byte("wide")}
+		buf := make([]byte, 200)
+		n, err := wide.Obfs(wideFrame, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := wide.Deobfs(buf[:n]); err != nil || !got.Equal(wideFrame) {
+			t.Errorf("expecting a round trip with a 4 byte prefix from PROTOCOL_V8, got %v: %v", got, err)
+		}
+	})
+}
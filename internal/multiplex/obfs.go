@@ -4,14 +4,28 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"github.com/cbeuw/Cloak/internal/aegis"
+	"github.com/cbeuw/Cloak/internal/ascon"
+	"github.com/cbeuw/Cloak/internal/gcmsiv"
 	"golang.org/x/crypto/chacha20poly1305"
-	"golang.org/x/crypto/salsa20"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Obfser func(*Frame, []byte) (int, error)
+
+// VectoredObfser is an Obfser that takes the payload as a number of fragments, which are obfsed as if they had been
+// joined together. The Payload of the frame is ignored
+type VectoredObfser func(f *Frame, payload [][]byte, buf []byte) (int, error)
 type Deobfser func([]byte) (*Frame, error)
 
 var u32 = binary.BigEndian.Uint32
@@ -21,144 +35,1246 @@ var putU64 = binary.BigEndian.PutUint64
 
 const HEADER_LEN = 14
 
+var ErrBadSessionKeySize = errors.New("sessionKey size must be 32 bytes, or 24 for aes-192-gcm")
+var ErrBufferTooSmall = errors.New("buffer is too small")
+var ErrInputTooShort = errors.New("input is too short")
+var ErrExtraLenTooLarge = errors.New("extra length is greater than total pldWithOverHead length")
+var ErrExtraLenTooSmall = errors.New("extra length is smaller than the AEAD or MAC overhead")
+var ErrExtraLenMismatch = errors.New("extra length doesn't match the AEAD overhead")
+var ErrPaddingUnsupported = errors.New("padding AEAD frames needs PROTOCOL_V2 or above")
+var ErrUnknownMethod = errors.New("Unknown encryption method")
+var ErrAuthFailed = errors.New("failed to authenticate frame")
+var ErrBadRecordLayer = errors.New("malformed TLS record layer")
+
+// ErrRecordTooLarge is returned by an Obfser for a frame that is too long for the record layer, and by a FrameReader
+// for records that would be joined into a frame longer than a record layer can split
+var ErrRecordTooLarge = errors.New("frame is too long for the record layer")
+
+// ErrFrameTooLarge is returned for a frame longer than ObfsConfig.MaxFrameSize or FrameReader.MaxFrameSize
+var ErrFrameTooLarge = errors.New("frame is longer than the maximum frame size")
+
+// DefaultMaxFrameSize is the MaxFrameSize of a FrameReader made by NewFrameReader: a 16KiB payload, the most a real
+// TLS record carries, with room for the header and the overhead and padding an 8 bit extraLen can describe
+const DefaultMaxFrameSize = 16384 + 512
+
+// ErrDummyRecord is returned by a Deobfser for input that only has dummy records sent by the record layer, such as the
+// change_cipher_spec records of TLSRecordLayer. It should be ignored like a padding frame
+var ErrDummyRecord = errors.New("record doesn't carry a frame")
+
+var ErrUninitialisedObfuscator = errors.New("obfuscator wasn't made by GenerateObfs")
+var ErrObfuscatorClosed = errors.New("obfuscator is closed")
+var ErrDirectionalKeysUnsupported = errors.New("directional keys need PROTOCOL_V3 or above and a bound role")
+
+// ErrBadHeaderKeySize is returned by GenerateObfsWithAEAD for a header key the header cipher can't be keyed with
+var ErrBadHeaderKeySize = errors.New("header key must be 32 bytes")
+
+// ErrExternalAEADUnsupported is returned for what an Obfuscator made by GenerateObfsWithAEAD can't do, as it has no
+// session key to derive keys from
+var ErrExternalAEADUnsupported = errors.New("not supported with an external AEAD")
+
+// ErrSeqExhausted is returned by an Obfser for a frame whose Seq is past what can be sent without reusing an AEAD nonce.
+// The stream has to be reset, or the session rekeyed, before anything more can be sent on it
+var ErrSeqExhausted = errors.New("sequence numbers of the stream are exhausted")
+
+// ErrEmptyDataFrame is returned with ObfsConfig.RejectEmptyData for a data frame with no payload, both by the Obfser
+// refusing to send it and by the Deobfser refusing to deliver it
+var ErrEmptyDataFrame = errors.New("data frame has an empty payload")
+
+// notDataFlags are the flags of frames that aren't data frames, which ObfsConfig.RejectEmptyData lets have an empty
+// payload
+const notDataFlags = FlagFin | FlagRst | C_SESSION | FlagPadding | FlagControl | FlagHandshake
+
+// AuthFailedError is returned by a Deobfser when a frame's payload fails AEAD authentication. This is usually the
+// sign of an active prober or corruption, as opposed to a malformed or partially read frame. StreamID and Seq are read
+// from the header the frame claims to have, which an attacker can forge or garble. It matches ErrAuthFailed under
+// errors.Is
+type AuthFailedError struct {
+	StreamID uint64
+	Seq      uint64
+	Err      error
+}
+
+func (e *AuthFailedError) Error() string {
+	return fmt.Sprintf("%v of stream %v seq %v: %v", ErrAuthFailed, e.StreamID, e.Seq, e.Err)
+}
+
+func (e *AuthFailedError) Is(target error) bool { return target == ErrAuthFailed }
+func (e *AuthFailedError) Unwrap() error        { return e.Err }
+
+const (
+	// PROTOCOL_V1 is the original frame format. Closing and extraLen in the header are not authenticated, except with
+	// AEADs of explicit nonces, for which the whole header is authenticated at every version
+	PROTOCOL_V1 = iota
+	// PROTOCOL_V2 authenticates Closing and extraLen (header[12:14]) as AEAD additional data, so tampering with either
+	// fails decryption
+	PROTOCOL_V2
+	// PROTOCOL_V3 additionally stops using the session key directly. The salsa20 header key and the payload key are
+	// derived from it with HKDF-SHA256, so that no key is shared between the two ciphers
+	PROTOCOL_V3
+	// PROTOCOL_V4 appends a key epoch byte to the header, authenticated along with Closing and extraLen, so that
+	// the session key can be rotated with Obfuscator.Rekey
+	PROTOCOL_V4
+	// PROTOCOL_V5 gives E_METHOD_PLAIN frames a salsa20 header nonce of their own at the end of the frame, taken from a
+	// counter, instead of the tail of the payload which may well be the same across frames. This can't be derived
+	// from StreamID and Seq since they are only known once the header has been unscrambled
+	PROTOCOL_V5
+	// PROTOCOL_V6 authenticates the whole header, and the length field of the record layer if there is one, so that
+	// rewriting the record length is detected too. This covers the MAC of ObfsConfig.PlainMAC as well as the AEAD
+	PROTOCOL_V6
+	// PROTOCOL_V7 widens the flags field holding Closing to 16 bits, for a header of HEADER_LEN+2 bytes. The bits
+	// above Closing are reserved and frames with any of them set are rejected
+	PROTOCOL_V7
+	// PROTOCOL_V8 widens StreamID to 64 bits, for a header of HEADER_LEN+6 bytes. The AEAD nonce is then StreamID and
+	// the low 32 bits of Seq, so with AEADs of 12 byte nonces a stream can't have more than 2^32 frames
+	PROTOCOL_V8
+	// PROTOCOL_V9 widens extraLen to 16 bits, for a header of HEADER_LEN+7 bytes. Frames can then carry up to 65535
+	// bytes of overhead and padding, enough for ObfsConfig.Padding to pad records up to lengths far apart
+	PROTOCOL_V9
+
+	maxProtocolVersion = iota - 1
+)
+
 const (
-	E_METHOD_PLAIN = iota
-	E_METHOD_AES_GCM
-	E_METHOD_CHACHA20_POLY1305
+	headerKeyInfo  = "cloak-header"
+	payloadKeyInfo = "cloak-payload"
+	// the key of ObfsConfig.PlainMAC is derived from the header key rather than the session key
+	plainMACKeyInfo = "cloak-plain-mac"
+	// with ObfsConfig.DirectionalKeys, the key of each direction is derived from the session key first, and the
+	// header and payload keys of the direction are then derived from it
+	clientToServerKeyInfo = "cloak-client-to-server"
+	serverToClientKeyInfo = "cloak-server-to-client"
 )
 
-func MakeObfs(salsaKey [32]byte, payloadCipher cipher.AEAD, hasRecordLayer bool) Obfser {
-	var rlLen int
-	if hasRecordLayer {
-		rlLen = 5
+// deriveSubkey derives an independent 32 byte key from sessionKey for the purpose described by info
+func deriveSubkey(sessionKey []byte, info string) (subkey [32]byte) {
+	// HKDF can output far more than 32 bytes so this cannot fail
+	_, _ = io.ReadFull(hkdf.New(sha256.New, sessionKey, nil, []byte(info)), subkey[:])
+	return
+}
+
+// subkeyDeriver derives a number of subkeys from the same session key as deriveSubkey does, but only extracts the
+// HKDF pseudorandom key once for all of them. Key derivation, rather than setting up the payload cipher, is most of
+// what making an Obfuscator costs
+type subkeyDeriver struct {
+	prk []byte
+}
+
+func newSubkeyDeriver(sessionKey []byte) subkeyDeriver {
+	return subkeyDeriver{prk: hkdf.Extract(sha256.New, sessionKey, nil)}
+}
+
+func (d subkeyDeriver) derive(info string) (subkey [32]byte) {
+	_, _ = io.ReadFull(hkdf.Expand(sha256.New, d.prk, []byte(info)), subkey[:])
+	return
+}
+
+func (d subkeyDeriver) wipe() {
+	for i := range d.prk {
+		d.prk[i] = 0
 	}
-	obfs := func(f *Frame, buf []byte) (int, error) {
-		// we need the encrypted data to be at least 8 bytes to be used as nonce for salsa20 stream header encryption
-		// this will be the case if the encryption method is an AEAD cipher, however for plain, it's well possible
-		// that the frame payload is smaller than 8 bytes, so we need to add on the difference
-		var extraLen uint8
-		if payloadCipher == nil {
-			if len(f.Payload) < 8 {
-				extraLen = uint8(8 - len(f.Payload))
+}
+
+// obfsKeys is the key material an Obfser and a Deobfser are made from. They share it through a pointer, so that it
+// can be wiped by Obfuscator.Close
+type obfsKeys struct {
+	// usage is first so that its counters are 64 bit aligned on 32 bit platforms
+	usage    keyUsage
+	salsaKey [32]byte
+	// mac is nil unless E_METHOD_PLAIN frames are authenticated with ObfsConfig.PlainMAC
+	mac *plainMAC
+	// recv is the keys the Deobfser is made from, with ObfsConfig.DirectionalKeys. Otherwise it's nil and the
+	// Deobfser shares these keys
+	recv *obfsKeys
+}
+
+func newObfsKeys(salsaKey [32]byte, payloadCipher cipher.AEAD, config ObfsConfig) *obfsKeys {
+	keys := &obfsKeys{salsaKey: salsaKey}
+	if payloadCipher == nil && config.PlainMAC {
+		keys.mac = newPlainMAC(salsaKey)
+	}
+	return keys
+}
+
+func (k *obfsKeys) wipe() {
+	if k == nil {
+		return
+	}
+	k.salsaKey = [32]byte{}
+	if k.mac != nil {
+		k.mac.wipe()
+	}
+	k.recv.wipe()
+}
+
+// ObfsConfig holds the optional parameters of an Obfuscator. Unless stated otherwise, both ends of a session must agree
+// on each of them for frames to be deobfsed. The zero value produces frames in the original PROTOCOL_V1 format without
+// a record layer
+type ObfsConfig struct {
+	// RecordLayer is what frames are wrapped in on the wire. nil is the same as NoRecordLayer. The options of a
+	// RecordLayer, such as whether it's strict or masks frames, only affect the local end
+	RecordLayer     RecordLayer
+	ProtocolVersion byte
+
+	// PooledDeobfs makes the Deobfser take the frames it returns, along with the buffers their payloads are
+	// decrypted into, from a pool instead of allocating them for every frame. A frame returned by a pooled Deobfser
+	// should be given back with ReleaseFrame once its Payload is no longer needed. This only affects the local end
+	PooledDeobfs bool
+
+	// ReplayWindow, if not 0, makes the Deobfser reject a frame with ErrReplayedFrame if a frame with the same
+	// StreamID and Seq has been deobfsed before, or if its Seq is ReplayWindow or more below the highest one seen on
+	// its stream. Reordering within the window is tolerated. Frames are only recorded once they have been successfully
+	// authenticated. Datagram frames (FlagDatagram) are never checked. This only affects the local end
+	ReplayWindow int
+
+	// StrictSeq makes the Deobfser reject a frame with ErrSeqGap unless its Seq is the one right after that of the
+	// last frame of its stream, starting from 0. It's only meant for transports that deliver every frame in order, over
+	// which a gap means corruption or tampering. The Seq a stream is at is forgotten once the stream is closed with
+	// FlagFin or FlagRst. Datagram, padding, control and handshake frames are never checked. This only affects the
+	// local end
+	StrictSeq bool
+
+	// RejectEmptyData makes an empty payload an error on a data frame, which is one without FlagFin, FlagRst,
+	// C_SESSION, FlagPadding, FlagControl or FlagHandshake. The Obfser refuses to send one, and the Deobfser rejects
+	// one once it has been authenticated, both with ErrEmptyDataFrame. It's for protocols in which an empty data frame
+	// can only be a bug, and is off by default as some send them on purpose. This only affects the local end
+	RejectEmptyData bool
+
+	// RekeyGracePeriod is how long frames of the previous key epoch are still accepted after Obfuscator.Rekey.
+	// defaultRekeyGracePeriod is used if it's 0. This only affects the local end
+	RekeyGracePeriod time.Duration
+
+	// NoncePrefix, if not empty, is XORed over the top bytes of StreamID in the AEAD nonce taken from the frame header,
+	// so that sessions sharing a key don't reuse each other's nonces. Each session must have a prefix of its own,
+	// given to both ends out of band or in the handshake, and keep it for as long as the session lasts. It takes
+	// the room of as many bytes of StreamID, which the Obfser refuses with ErrStreamIDTooLarge: it can be up to 2
+	// bytes long, leaving 16 bit stream IDs, or 4 bytes from PROTOCOL_V8, leaving 32 bit ones. With a bound Role it
+	// goes below the role bit, which takes one more bit of StreamID as it does without a prefix. It has no effect on
+	// E_METHOD_PLAIN, nor on AEADs whose nonces are not 12 bytes long, as they get random nonces. See noncePrefix.go.
+	// It mustn't be modified once the Obfuscator is made
+	NoncePrefix []byte
+
+	// RekeyAfterBytes and RekeyAfterFrames, if not 0, are how many payload bytes, after any compression, and how
+	// many frames can be obfsed under a key before Obfuscator.ShouldRekey reports that it's time for a new one. They
+	// only signal the caller, who has to call Rekey, which starts the counts over. This only affects the local end
+	RekeyAfterBytes  uint64
+	RekeyAfterFrames uint64
+
+	// Padding, if not nil, adds random padding to frames sent. A Deobfser strips padding regardless of its own
+	// Padding, so this only affects the local end. AEAD frames can only be padded from PROTOCOL_V2
+	Padding PaddingPolicy
+
+	// PlainMAC appends a truncated HMAC-SHA256 of the header and payload to E_METHOD_PLAIN frames, so that
+	// tampering with them is detected even though they are not encrypted. It has no effect with AEAD methods
+	PlainMAC bool
+
+	// PlainChecksum appends a CRC32C of the header and everything after it up to the checksum, the MAC of PlainMAC
+	// included, to E_METHOD_PLAIN frames, so that frames corrupted by an unreliable link are refused with
+	// ErrChecksumMismatch. It's much cheaper than PlainMAC, but does nothing against tampering, as anyone can
+	// recompute it. It has no effect with AEAD methods
+	PlainChecksum bool
+
+	// TagLen, if not 0, truncates the AEAD tag of every frame to its first TagLen bytes, which saves bandwidth on
+	// small frames. It must be between 8 and 16, and is only supported by the AES-GCM and ChaCha20-Poly1305 methods.
+	// A truncated tag is weaker against forgery: each forged frame is accepted with a chance of 2^-(8*TagLen), so an
+	// attacker who can send 2^32 frames into a session with TagLen 8 has a 2^-32 chance of one of them getting through.
+	// Deobfsing a frame costs about twice as much, as the full tag has to be recomputed from the plaintext. It's applied
+	// by GenerateObfsWithConfig, and not to the cipher given to MakeObfs and MakeDeobfs
+	TagLen int
+
+	// Rand is where the random bytes in frames, such as explicit nonces and the padding of plain frames, are read
+	// from. crypto/rand.Reader is used if it's nil, and anything else should only be used to make output reproducible
+	// in tests. The lengths chosen by Padding don't come from Rand. This only affects the local end
+	Rand io.Reader
+
+	// Compression compresses payloads with the given codec before they are encrypted, whenever that makes them
+	// shorter. It needs PROTOCOL_V7 or above, where the codec is recorded in the authenticated frame header.
+	// Compressing data an attacker controls along with secrets and then encrypting them leaks the secrets through
+	// the length of the frames, as in CRIME and BREACH, so it must only be used for traffic that doesn't mix the two.
+	// Compressed frames are decompressed regardless, so this only affects the local end
+	Compression Compression
+
+	// HeaderCipher is the stream cipher frame headers are scrambled with. HEADER_CIPHER_CHACHA20 needs PROTOCOL_V3 or
+	// above, where the header key is derived from the session key. HEADER_CIPHER_NONE is insecure, see there
+	HeaderCipher HeaderCipher
+
+	// SeqLimit, if not 0, makes the Obfser refuse frames whose Seq is SeqLimit or above with ErrSeqExhausted. Seqs are
+	// always refused before they could wrap around, or outgrow the nonce of a PROTOCOL_V8 header, so this only needs
+	// to be set to exhaust them early, such as in tests. This only affects the local end
+	SeqLimit uint64
+
+	// DirectionalKeys derives a key of its own for each direction of the session from the session key, so that frames
+	// sent by the client and by the server are never encrypted with the same key. It needs PROTOCOL_V3 or above, and
+	// a Role bound on both ends, which then decides which of the keys frames are sent with rather than being flipped
+	// into the nonce
+	DirectionalKeys bool
+
+	// Role binds the direction frames are sent in into their AEAD nonce, so that the two ends of a session never use
+	// the same nonce. The two ends must take opposite roles, or both leave it ROLE_UNBOUND. See Role
+	Role Role
+
+	// Metrics, if not nil, is told about every frame obfsed and deobfsed. Obfsers and Deobfsers made straight from a
+	// cipher with MakeObfs and MakeDeobfs aren't told the method, and report E_METHOD_PLAIN. This only affects the
+	// local end
+	Metrics Metrics
+
+	// OnDeobfsError, if not nil, is called with every error the Deobfser returns, apart from ErrDummyRecord, along
+	// with the length of the input and its first bytes (up to 16 of them). It's meant for telemetry such as telling
+	// active probes apart from corrupted traffic, and doesn't change what is returned. prefix is a slice of the
+	// input, which a Deobfser working in place may already have modified past the record layer, and must not be kept
+	// after the call returns. This only affects the local end
+	OnDeobfsError func(err error, inLen int, prefix []byte)
+
+	// Tap, if not nil, is given every frame the Obfser produces, exactly as it is to be sent, and every input given to
+	// the Deobfser, before it is deobfsed, whether or not it turns out to be valid. It's meant for capturing the bytes
+	// on both ends to diff them when two builds don't interoperate, and doesn't change what is sent or received. raw
+	// must not be modified, nor kept after the call returns. This only affects the local end
+	Tap func(direction TapDirection, raw []byte)
+
+	// MaxFrameSize, if not 0, is the length of the longest frame, from its header to the end of its padding, that the
+	// Obfser produces and the Deobfser accepts. Longer ones are refused with ErrFrameTooLarge, and padding is cut
+	// short so as not to exceed it. DefaultMaxFrameSize suits TLS like traffic. This only affects the local end, but
+	// the other end shouldn't send frames longer than it
+	MaxFrameSize int
+
+	// AdditionalData, if not empty, is authenticated along with every AEAD frame, in front of what the protocol
+	// version authenticates, so as to bind frames to something both ends know, such as a TLS exporter value or a
+	// connection ID. It's never sent: the other end must be given exactly the same, or every frame fails decryption.
+	// E_METHOD_PLAIN frames aren't bound to it, even with PlainMAC. It mustn't be modified once the Obfuscator is made
+	AdditionalData []byte
+
+	// method is the encryption method reported to Metrics. It's set by GenerateObfsWithConfig
+	method Method
+
+	// keyEpoch is written into and expected from the header in PROTOCOL_V4 and above. It's managed by Rekey
+	keyEpoch byte
+}
+
+// headerLen returns the length of the frame header
+func (c ObfsConfig) headerLen() int { return c.layout().len }
+
+// recordLenLen is the length of the length field at the end of the record layer, which is authenticated from
+// PROTOCOL_V6. It's 0 for record layers that aren't a lengthAuthenticator, such as WebSocketRecordLayer whose length is
+// followed by the masking key
+func (c ObfsConfig) recordLenLen() int {
+	if a, ok := c.RecordLayer.(lengthAuthenticator); ok {
+		return a.authenticatedLen()
+	}
+	return 0
+}
+
+// additionalData returns what is authenticated by the AEAD on top of the nonce. authRegion is the plaintext header,
+// preceded by the record length field if there is a record layer
+func (c ObfsConfig) additionalData(authRegion []byte) []byte {
+	if c.ProtocolVersion >= PROTOCOL_V6 {
+		return authRegion
+	}
+	if c.ProtocolVersion >= PROTOCOL_V2 {
+		header := authRegion[c.recordLenLen():]
+		return header[c.layout().flagsOffset:c.headerLen()]
+	}
+	return nil
+}
+
+// explicitNonceAdditionalData is additionalData for AEADs with an explicit nonce. Their nonce is random rather than
+// taken from the header, so nothing but the additional data ties StreamID and Seq to the frame, and below PROTOCOL_V6
+// the whole header is authenticated for them
+func (c ObfsConfig) explicitNonceAdditionalData(authRegion []byte) []byte {
+	if c.ProtocolVersion >= PROTOCOL_V6 {
+		return authRegion
+	}
+	return authRegion[c.recordLenLen():]
+}
+
+var additionalDataPool sync.Pool // *[]byte
+
+// boundAdditionalData returns ad preceded by AdditionalData. It's in a buffer from additionalDataPool, which is
+// returned as well to be given back with releaseAdditionalData once the frame is sealed or opened, unless there's no
+// AdditionalData in which case ad is returned as it is
+func (c ObfsConfig) boundAdditionalData(ad []byte) ([]byte, *[]byte) {
+	if len(c.AdditionalData) == 0 {
+		return ad, nil
+	}
+	buf, _ := additionalDataPool.Get().(*[]byte)
+	if buf == nil {
+		buf = new([]byte)
+	}
+	*buf = append(append((*buf)[:0], c.AdditionalData...), ad...)
+	return *buf, buf
+}
+
+func releaseAdditionalData(buf *[]byte) {
+	if buf != nil {
+		additionalDataPool.Put(buf)
+	}
+}
+
+// macHeader returns what the MAC of ObfsConfig.PlainMAC covers on top of the payload
+func (c ObfsConfig) macHeader(authRegion []byte) []byte {
+	if c.ProtocolVersion >= PROTOCOL_V6 {
+		return authRegion
+	}
+	return authRegion[c.recordLenLen():]
+}
+
+// derivedNonceLen is the length of the AEAD nonce that can be taken straight from the frame header (StreamID+Seq).
+// AEADs with any other nonce size get a random nonce of their own, carried in the clear between the header and the
+// ciphertext
+const derivedNonceLen = 12
+
+// deobfsErrorPrefixLen is how much of the input ObfsConfig.OnDeobfsError is given
+const deobfsErrorPrefixLen = 16
+
+func explicitNonceLenOf(payloadCipher cipher.AEAD) int {
+	if payloadCipher != nil && payloadCipher.NonceSize() != derivedNonceLen {
+		return payloadCipher.NonceSize()
+	}
+	return 0
+}
+
+// extraLenOf returns the number of bytes that will be sent after the header on top of a payload of payloadLen bytes
+func extraLenOf(payloadCipher cipher.AEAD, config ObfsConfig, payloadLen int) int {
+	// we need the encrypted data to be at least 8 bytes to be used as nonce for salsa20 stream header encryption
+	// this will be the case if the encryption method is an AEAD cipher, however for plain, it's well possible
+	// that the frame payload is smaller than 8 bytes, so we need to add on the difference
+	if payloadCipher == nil {
+		trailerLen := plainTrailerLenOf(config)
+		if payloadLen+trailerLen < 8 {
+			return 8 - payloadLen
+		}
+		return trailerLen
+	}
+	return explicitNonceLenOf(payloadCipher) + payloadCipher.Overhead()
+}
+
+// headerNonceLenOf returns the length of the separate salsa20 header nonce at the end of the frame
+func headerNonceLenOf(payloadCipher cipher.AEAD, config ObfsConfig) int {
+	if payloadCipher == nil && config.ProtocolVersion >= PROTOCOL_V5 {
+		return 8
+	}
+	return 0
+}
+
+// plainTrailerLenOf returns the length of what comes after the payload and padding of a plain frame: the MAC, then
+// the checksum, followed by the header nonce
+func plainTrailerLenOf(config ObfsConfig) int {
+	trailerLen := headerNonceLenOf(nil, config)
+	if config.PlainMAC {
+		trailerLen += plainMACLen
+	}
+	if config.PlainChecksum {
+		trailerLen += plainChecksumLen
+	}
+	return trailerLen
+}
+
+func MakeObfs(salsaKey [32]byte, payloadCipher cipher.AEAD, config ObfsConfig) Obfser {
+	obfs := makeObfs(newObfsKeys(salsaKey, payloadCipher, config), payloadCipher, config)
+	return func(f *Frame, buf []byte) (int, error) {
+		n, _, err := obfs(f, nil, buf, false, nil)
+		return n, err
+	}
+}
+
+// MakeVectoredObfs returns a VectoredObfser, which copies the payload fragments straight into buf so that they don't
+// need to be joined beforehand. Unlike the Payload given to an Obfser, the fragments must not be slices of buf. If
+// the fragments are nil, f.Payload is used instead
+func MakeVectoredObfs(salsaKey [32]byte, payloadCipher cipher.AEAD, config ObfsConfig) VectoredObfser {
+	obfs := makeObfs(newObfsKeys(salsaKey, payloadCipher, config), payloadCipher, config)
+	return func(f *Frame, payload [][]byte, buf []byte) (int, error) {
+		n, _, err := obfs(f, payload, buf, false, nil)
+		return n, err
+	}
+}
+
+// obfsFunc is what all kinds of Obfsers are built on. Unless segmented, the whole frame is written into buf and its
+// length is returned. Otherwise the frame is appended to segments as a number of slices, which for E_METHOD_PLAIN
+// refer to the payload directly rather than having it copied into buf, and the number of bytes used in buf is returned
+type obfsFunc func(f *Frame, payload [][]byte, buf []byte, segmented bool, segments net.Buffers) (int, net.Buffers, error)
+
+func makeObfs(keys *obfsKeys, payloadCipher cipher.AEAD, config ObfsConfig) obfsFunc {
+	rl := config.recordLayer()
+	headerCipher := config.HeaderCipher
+	m, masked := rl.(masker)
+	masked = masked && m.masks()
+	dummies, _ := rl.(dummyRecorder)
+	splitter, _ := rl.(recordSplitter)
+	maxFrameLen := math.MaxInt32
+	splitLen := 0
+	if splitter != nil {
+		maxFrameLen = splitter.maxFrameLen()
+		splitLen = splitter.splitLen()
+	}
+	errTooLarge := ErrRecordTooLarge
+	if config.MaxFrameSize > 0 && config.MaxFrameSize < maxFrameLen {
+		maxFrameLen = config.MaxFrameSize
+		errTooLarge = ErrFrameTooLarge
+	}
+	explicitNonceLen := explicitNonceLenOf(payloadCipher)
+	layout := config.layout()
+	headerLen := layout.len
+	maxExtraLen := layout.maxExtraLen()
+	recordLenLen := config.recordLenLen()
+	mac := keys.mac
+	checksum := payloadCipher == nil && config.PlainChecksum
+	random := config.Rand
+	if random == nil {
+		random = rand.Reader
+	}
+	headerNonceLen := headerNonceLenOf(payloadCipher, config)
+	// header nonces count up from a random starting point, so that they're unique to this Obfser and are very
+	// unlikely to run into the ones used by the other end with the same key
+	var headerNonceCounter uint64
+	if headerNonceLen != 0 {
+		var start [8]byte
+		// starting from 0 if this fails still keeps the nonces unique to this Obfser
+		io.ReadFull(random, start[:])
+		headerNonceCounter = u64(start[:])
+	}
+	// whether the AEAD nonce is taken from the header, which limits the Seq of wide headers
+	derivedNonce := payloadCipher != nil && explicitNonceLen == 0
+	// a bound role takes the top bit of StreamID in the nonce
+	roleBit := config.Role.sendNonceBit()
+	maxStreamID := layout.maxStreamID()
+	if config.DirectionalKeys {
+		roleBit = 0
+	} else if derivedNonce && config.Role != ROLE_UNBOUND {
+		maxStreamID >>= 1
+	}
+	var noncePrefix []byte
+	if derivedNonce {
+		noncePrefix = noncePrefixMask(config)
+		maxStreamID >>= uint(8 * len(config.NoncePrefix))
+	}
+	// Seqs from seqLimit on are refused. The very last uint64 is never used, so that a counter saturating at it (see
+	// Stream.nextSeq) can't go on to wrap around
+	seqLimit := uint64(math.MaxUint64)
+	if derivedNonce && layout.maxNonceSeq() < seqLimit {
+		seqLimit = layout.maxNonceSeq() + 1
+	}
+	if config.SeqLimit != 0 && config.SeqLimit < seqLimit {
+		seqLimit = config.SeqLimit
+	}
+	metrics := config.Metrics
+	countUsage := config.RekeyAfterBytes != 0 || config.RekeyAfterFrames != 0
+	rejectEmptyData := config.RejectEmptyData
+	obfs := func(f *Frame, payload [][]byte, buf []byte, segmented bool, segments net.Buffers) (int, net.Buffers, error) {
+		if f.Seq >= seqLimit {
+			return 0, segments, ErrSeqExhausted
+		}
+		if f.StreamID > maxStreamID {
+			return 0, segments, ErrStreamIDTooLarge
+		}
+		if payload == nil {
+			payload = [][]byte{f.Payload}
+		}
+		payloadLen := 0
+		for _, fragment := range payload {
+			payloadLen += len(fragment)
+		}
+		if rejectEmptyData && payloadLen == 0 && f.Closing&notDataFlags == 0 {
+			return 0, segments, ErrEmptyDataFrame
+		}
+		uncompressedLen := payloadLen
+		compression := COMPRESSION_NONE
+		if config.Compression != COMPRESSION_NONE && payloadLen >= minCompressLen {
+			d, compressed := compress(config.Compression, payload)
+			defer deflaterPool.Put(d)
+			if len(compressed) < payloadLen {
+				compression = config.Compression
+				payload = [][]byte{compressed}
+				payloadLen = len(compressed)
 			}
-		} else {
-			extraLen = uint8(payloadCipher.Overhead())
+		}
+		extraLen := extraLenOf(payloadCipher, config, payloadLen)
+		// plain payloads are referenced rather than copied into buf when obfsing into segments. Masked frames are
+		// masked as a whole, and frames that may be split are moved around, so their payloads have to be in buf, as
+		// do compressed payloads which are only around until the frame is obfsed
+		referencePayload := segmented && payloadCipher == nil && !masked && compression == COMPRESSION_NONE &&
+			(splitLen == 0 || headerLen+payloadLen+maxExtraLen < splitLen)
+		referencedLen := 0
+		if referencePayload {
+			referencedLen = payloadLen
 		}
 
-		// usefulLen is the amount of bytes that will be eventually sent off
-		usefulLen := rlLen + HEADER_LEN + len(f.Payload) + int(extraLen)
-		if len(buf) < usefulLen {
-			return 0, errors.New("buffer is too small")
+		innerLen := headerLen + payloadLen + extraLen
+		// rlLen covers any dummy record sent in front of the record layer
+		dummyLen := 0
+		if dummies != nil {
+			dummyLen = dummies.dummyLen()
+		}
+		rlLen := dummyLen + rl.HeaderLen(innerLen)
+		if innerLen > maxFrameLen {
+			return 0, segments, errTooLarge
+		}
+		if len(buf) < rlLen+innerLen-referencedLen {
+			return 0, segments, ErrBufferTooSmall
 
 		}
+		paddingLen := 0
+		if config.Padding != nil {
+			padding := config.Padding.PaddingLen(rlLen - dummyLen + innerLen)
+			if padding > maxExtraLen-extraLen {
+				padding = maxExtraLen - extraLen
+			}
+			// the record layer may grow along with the frame
+			if room := len(buf) - (rlLen + innerLen - referencedLen) - (dummyLen + rl.HeaderLen(innerLen+padding) - rlLen); padding > room {
+				padding = room
+			}
+			if padding > maxFrameLen-innerLen {
+				padding = maxFrameLen - innerLen
+			}
+			if padding > 0 {
+				paddingLen = padding
+				extraLen += padding
+				innerLen += padding
+				rlLen = dummyLen + rl.HeaderLen(innerLen)
+			}
+		}
+		// usefulLen is the amount of bytes that will be eventually sent off, and bufLen is how much of it is in buf
+		usefulLen := rlLen + innerLen
+		bufLen := usefulLen - referencedLen
 		// we do as much in-place as possible to save allocation
-		useful := buf[:usefulLen] // (tls header) + payload + potential overhead
-		header := useful[rlLen : rlLen+HEADER_LEN]
-		encryptedPayloadWithExtra := useful[rlLen+HEADER_LEN:]
+		useful := buf[:bufLen] // (tls header) + payload + potential overhead
+		header := useful[rlLen : rlLen+headerLen]
+		encryptedPayloadWithExtra := useful[rlLen+headerLen:]
 
-		putU32(header[0:4], f.StreamID)
-		putU64(header[4:12], f.Seq)
-		header[12] = f.Closing
-		header[13] = extraLen
+		var pldInPlace []byte
+		if !referencePayload {
+			// f.Payload may itself be a slice of buf, so it's moved to where it will be encrypted before anything
+			// else gets written into buf. copy is safe with overlapping slices and the AEADs can then seal in place
+			pldInPlace = encryptedPayloadWithExtra[explicitNonceLen : explicitNonceLen+payloadLen]
+			copied := 0
+			for _, fragment := range payload {
+				copied += copy(pldInPlace[copied:], fragment)
+			}
+		}
+
+		if err := layout.put(header, f, compression, extraLen, config.keyEpoch); err != nil {
+			return 0, segments, err
+		}
+		if dummyLen != 0 {
+			dummies.putDummy(useful[:dummyLen])
+		}
+		rl.Wrap(useful[dummyLen:rlLen], innerLen)
+		authRegion := useful[rlLen-recordLenLen : rlLen+headerLen]
 
 		if payloadCipher == nil {
-			copy(encryptedPayloadWithExtra, f.Payload)
+			extra := useful[bufLen-extraLen:]
 			if extraLen != 0 {
-				rand.Read(encryptedPayloadWithExtra[len(encryptedPayloadWithExtra)-int(extraLen):])
+				if _, err := io.ReadFull(random, extra); err != nil {
+					return 0, segments, err
+				}
+			}
+			macEnd := extraLen - headerNonceLen
+			if checksum {
+				macEnd -= plainChecksumLen
+			}
+			if mac != nil {
+				macStart := macEnd - plainMACLen
+				if referencePayload {
+					mac.sum(extra[macStart:macEnd], config.macHeader(authRegion), append(payload, extra[:macStart])...)
+				} else {
+					mac.sum(extra[macStart:macEnd], config.macHeader(authRegion), encryptedPayloadWithExtra[:len(encryptedPayloadWithExtra)-extraLen+macStart])
+				}
+			}
+			checksumEnd := macEnd
+			if checksum {
+				checksumEnd += plainChecksumLen
+				if referencePayload {
+					putPlainChecksum(extra[macEnd:checksumEnd], config.macHeader(authRegion), append(payload, extra[:macEnd])...)
+				} else {
+					putPlainChecksum(extra[macEnd:checksumEnd], config.macHeader(authRegion), encryptedPayloadWithExtra[:len(encryptedPayloadWithExtra)-extraLen+macEnd])
+				}
+			}
+			if headerNonceLen != 0 {
+				putU64(extra[checksumEnd:], atomic.AddUint64(&headerNonceCounter, 1))
 			}
 		} else {
-			ciphertext := payloadCipher.Seal(nil, header[:12], f.Payload, nil)
-			copy(encryptedPayloadWithExtra, ciphertext)
+			if explicitNonceLen != 0 {
+				explicitNonce := encryptedPayloadWithExtra[:explicitNonceLen]
+				if _, err := io.ReadFull(random, explicitNonce); err != nil {
+					return 0, segments, err
+				}
+				ad, pooled := config.boundAdditionalData(config.explicitNonceAdditionalData(authRegion))
+				payloadCipher.Seal(pldInPlace[:0], explicitNonce, pldInPlace, ad)
+				releaseAdditionalData(pooled)
+			} else {
+				// the role is flipped into the nonce in place, and so is in the additional data while it's sealed as
+				// well, just as it is when the frame is opened
+				header[0] ^= roleBit
+				xorNoncePrefix(header, noncePrefix)
+				ad, pooled := config.boundAdditionalData(config.additionalData(authRegion))
+				payloadCipher.Seal(pldInPlace[:0], header[:12], pldInPlace, ad)
+				releaseAdditionalData(pooled)
+				xorNoncePrefix(header, noncePrefix)
+				header[0] ^= roleBit
+			}
+			// any padding goes after the AEAD tag
+			if padding := extraLen - explicitNonceLen - payloadCipher.Overhead(); padding > 0 {
+				if _, err := io.ReadFull(random, encryptedPayloadWithExtra[len(encryptedPayloadWithExtra)-padding:]); err != nil {
+					return 0, segments, err
+				}
+			}
 		}
 
-		nonce := encryptedPayloadWithExtra[len(encryptedPayloadWithExtra)-8:]
-		salsa20.XORKeyStream(header, header, nonce, &salsaKey)
+		if referencePayload {
+			// the nonce is the last 8 bytes of the frame, which may be split between the payload and the extra
+			var nonce [8]byte
+			tailOf(nonce[:], payload, useful[bufLen-extraLen:])
+			headerCipher.scramble(header, nonce[:], &keys.salsaKey)
+		} else {
+			nonce := encryptedPayloadWithExtra[len(encryptedPayloadWithExtra)-8:]
+			headerCipher.scramble(header, nonce, &keys.salsaKey)
+		}
+		if masked {
+			xorMask(useful[rlLen:], m.maskKey(useful[dummyLen:]))
+		}
+		if metrics != nil {
+			metrics.FrameObfsed(config.method, uncompressedLen, usefulLen, paddingLen)
+		}
+		if countUsage {
+			keys.usage.add(payloadLen)
+		}
+		if splitLen != 0 && innerLen >= splitLen {
+			splitter.split(useful[dummyLen:], innerLen)
+			if segmented {
+				return bufLen, append(segments, useful), nil
+			}
+			return usefulLen, segments, nil
+		}
 
-		if hasRecordLayer {
-			recordLayer := useful[0:5]
-			// We don't use util.AddRecordLayer here to avoid unnecessary malloc
-			recordLayer[0] = 0x17
-			recordLayer[1] = 0x03
-			recordLayer[2] = 0x03
-			binary.BigEndian.PutUint16(recordLayer[3:5], uint16(HEADER_LEN+len(encryptedPayloadWithExtra)))
+		if segmented {
+			segments = append(segments, useful[:rlLen], header)
+			if referencePayload {
+				for _, fragment := range payload {
+					if len(fragment) != 0 {
+						segments = append(segments, fragment)
+					}
+				}
+				segments = append(segments, useful[bufLen-extraLen:])
+			} else {
+				segments = append(segments, encryptedPayloadWithExtra)
+			}
+			return bufLen, segments, nil
 		}
 		// Composing final obfsed message
-		return usefulLen, nil
+		return usefulLen, segments, nil
+	}
+	if tap := config.Tap; tap != nil {
+		return tapObfs(obfs, tap)
 	}
 	return obfs
 }
 
-func MakeDeobfs(salsaKey [32]byte, payloadCipher cipher.AEAD, hasRecordLayer bool) Deobfser {
-	var rlLen int
-	if hasRecordLayer {
-		rlLen = 5
+// tailOf fills dst with the last len(dst) bytes of the concatenation of fragments followed by last
+func tailOf(dst []byte, fragments [][]byte, last []byte) {
+	n := len(dst)
+	if len(last) >= n {
+		copy(dst, last[len(last)-n:])
+		return
+	}
+	n -= copy(dst[n-len(last):], last)
+	for i := len(fragments) - 1; i >= 0 && n > 0; i-- {
+		fragment := fragments[i]
+		if len(fragment) >= n {
+			copy(dst[:n], fragment[len(fragment)-n:])
+			return
+		}
+		n -= copy(dst[n-len(fragment):n], fragment)
+	}
+}
+
+// MakeDeobfs returns a Deobfser that leaves its input untouched. The Payload of frames it returns is backed by a
+// separate buffer
+func MakeDeobfs(salsaKey [32]byte, payloadCipher cipher.AEAD, config ObfsConfig) Deobfser {
+	return makeDeobfs(newObfsKeys(salsaKey, payloadCipher, config), payloadCipher, config, false).deobfser()
+}
+
+// MakeDeobfsInPlace returns a Deobfser that unscrambles the header and decrypts the payload directly in its input,
+// which saves copying the input when the caller is going to throw it away anyway. The input is overwritten and the
+// Payload of frames returned points into the input's backing array, so the input must not be reused for as long as
+// the frame is in use. ObfsConfig.PooledDeobfs has no effect on it
+func MakeDeobfsInPlace(salsaKey [32]byte, payloadCipher cipher.AEAD, config ObfsConfig) Deobfser {
+	return makeDeobfs(newObfsKeys(salsaKey, payloadCipher, config), payloadCipher, config, true).deobfser()
+}
+
+// deobfsFunc is what all kinds of Deobfsers are built on. If into isn't nil the frame is decoded into it, with its
+// Payload decrypted into the buffer backing into.Payload if it's big enough, and into is returned. Otherwise the frame
+// is a new one, or one from framePool with ObfsConfig.PooledDeobfs
+type deobfsFunc func(in []byte, into *Frame) (*Frame, error)
+
+func (d deobfsFunc) deobfser() Deobfser {
+	return func(in []byte) (*Frame, error) { return d(in, nil) }
+}
+
+func makeDeobfs(keys *obfsKeys, payloadCipher cipher.AEAD, config ObfsConfig, inPlace bool) deobfsFunc {
+	pooled := config.PooledDeobfs && !inPlace
+	headerCipher := config.HeaderCipher
+	var replay *replayGuard
+	if config.ReplayWindow > 0 {
+		replay = &replayGuard{size: config.ReplayWindow}
+	}
+	var strictSeq *seqGuard
+	if config.StrictSeq {
+		strictSeq = newSeqGuard()
+	}
+	rl := config.recordLayer()
+	explicitNonceLen := explicitNonceLenOf(payloadCipher)
+	derivedNonce := payloadCipher != nil && explicitNonceLen == 0
+	roleBit := config.Role.recvNonceBit()
+	if config.DirectionalKeys {
+		roleBit = 0
 	}
-	deobfs := func(in []byte) (*Frame, error) {
-		if len(in) < rlLen+HEADER_LEN+8 {
-			return nil, fmt.Errorf("Input cannot be shorter than %v bytes", rlLen+HEADER_LEN+8)
+	var noncePrefix []byte
+	if derivedNonce {
+		noncePrefix = noncePrefixMask(config)
+	}
+	layout := config.layout()
+	headerLen := layout.len
+	recordLenLen := config.recordLenLen()
+	mac := keys.mac
+	checksum := payloadCipher == nil && config.PlainChecksum
+	headerNonceLen := headerNonceLenOf(payloadCipher, config)
+	plainTrailerLen := plainTrailerLenOf(config)
+	metrics := config.Metrics
+	deobfs := func(in []byte, into *Frame) (*Frame, error) {
+		rlLen, frameLen, err := rl.Unwrap(in)
+		if err != nil {
+			return nil, err
+		}
+		// RecordLayer can be implemented outside of this package, so what it returns is never trusted to be in range
+		if rlLen < recordLenLen || frameLen < 0 || rlLen > len(in) || frameLen > len(in)-rlLen {
+			return nil, fmt.Errorf("%w: frame at %v of %v bytes is outside the %v bytes received", ErrBadRecordLayer, rlLen, frameLen, len(in))
+		}
+		if config.MaxFrameSize > 0 && frameLen > config.MaxFrameSize {
+			return nil, fmt.Errorf("%w: %v bytes", ErrFrameTooLarge, frameLen)
+		}
+		in = in[:rlLen+frameLen]
+		if frameLen < headerLen+8 {
+			return nil, fmt.Errorf("%w: cannot be shorter than %v bytes", ErrInputTooShort, rlLen+headerLen+8)
 		}
 
-		peeled := make([]byte, len(in)-rlLen)
-		copy(peeled, in[rlLen:])
+		inPlace := inPlace
+		if m, ok := rl.(masker); ok {
+			if maskKey := m.maskKey(in); maskKey != nil {
+				// a masked frame is unmasked into a copy of the input, unless we are working in place anyway, and is
+				// deobfsed in place from there
+				if !inPlace {
+					in = append([]byte(nil), in...)
+					inPlace = true
+				}
+				xorMask(in[rlLen:], maskKey)
+			}
+		}
 
-		header := peeled[:HEADER_LEN]
-		pldWithOverHead := peeled[HEADER_LEN:] // payload + potential overhead
+		pldWithOverHead := in[rlLen+headerLen:] // payload + potential overhead
 
-		nonce := peeled[len(peeled)-8:]
-		salsa20.XORKeyStream(header, header, nonce, &salsaKey)
+		ret := into
+		pooled := pooled && into == nil
+		if pooled {
+			ret = framePool.Get().(*Frame)
+		} else if ret == nil {
+			ret = &Frame{}
+		}
+		fail := func(err error) (*Frame, error) {
+			if pooled {
+				ReleaseFrame(ret)
+			}
+			if metrics != nil && errors.Is(err, ErrAuthFailed) {
+				metrics.AuthFailed(config.method)
+			}
+			return nil, err
+		}
 
-		streamID := u32(header[0:4])
-		seq := u64(header[4:12])
-		closing := header[12]
-		extraLen := header[13]
+		// Unless we are working in place, the output payload is decrypted into the start of scratch, and the header
+		// (along with the record length before it) is unscrambled into the tail of it so that the input is never
+		// modified. Keeping the payload at the very start of the buffer means a released frame's Payload[:0] still
+		// spans the whole buffer for reuse
+		var scratch, authRegion []byte
+		if inPlace {
+			authRegion = in[rlLen-recordLenLen : rlLen+headerLen]
+		} else {
+			authRegionLen := recordLenLen + headerLen
+			scratch = ret.Payload[:0]
+			if cap(scratch) < len(pldWithOverHead)+authRegionLen {
+				scratch = make([]byte, 0, len(pldWithOverHead)+authRegionLen)
+			}
+			authRegion = scratch[len(pldWithOverHead) : len(pldWithOverHead)+authRegionLen]
+			copy(authRegion, in[rlLen-recordLenLen:rlLen+headerLen])
+		}
+		header := authRegion[recordLenLen:]
 
-		usefulPayloadLen := len(pldWithOverHead) - int(extraLen)
+		nonce := in[len(in)-8:]
+		headerCipher.scramble(header, nonce, &keys.salsaKey)
+
+		// the checksum is at a fixed distance from the end, so a corrupted header is caught before it's parsed
+		if checksum {
+			checksumEnd := len(pldWithOverHead) - headerNonceLen
+			checksumStart := checksumEnd - plainChecksumLen
+			if checksumStart < 0 {
+				return fail(fmt.Errorf("%w: cannot be shorter than the checksum", ErrInputTooShort))
+			}
+			if !verifyPlainChecksum(pldWithOverHead[checksumStart:checksumEnd], config.macHeader(authRegion), pldWithOverHead[:checksumStart]) {
+				return fail(ErrChecksumMismatch)
+			}
+		}
+
+		streamID, seq, closing, compression, extraLen, epoch, err := layout.parse(header)
+		if err != nil {
+			return fail(err)
+		}
+		if layout.epochOffset != 0 && epoch != config.keyEpoch {
+			return fail(errWrongKeyEpoch)
+		}
+		if closing&FlagHandshake != 0 && streamID != HandshakeStreamID {
+			return fail(ErrHandshakeStreamID)
+		}
+		if derivedNonce && seq > layout.maxNonceSeq() {
+			return fail(errSeqOutOfNonceRange)
+		}
+
+		usefulPayloadLen := len(pldWithOverHead) - extraLen
 		if usefulPayloadLen < 0 {
-			return nil, errors.New("extra length is greater than total pldWithOverHead length")
+			return fail(ErrExtraLenTooLarge)
+		}
+
+		// AEAD frames may carry random padding after the tag. Frames from senders without padding have none
+		var padding int
+		if payloadCipher != nil {
+			padding = extraLen - explicitNonceLen - payloadCipher.Overhead()
+			if padding < 0 {
+				return fail(ErrExtraLenTooSmall)
+			}
+			// only an authenticated extraLen can claim padding, otherwise anything past the overhead was tampered with
+			if padding != 0 && config.ProtocolVersion < PROTOCOL_V2 {
+				return fail(ErrExtraLenMismatch)
+			}
 		}
 
 		var outputPayload []byte
 
 		if payloadCipher == nil {
-			if extraLen == 0 {
-				outputPayload = pldWithOverHead
-			} else {
+			if extraLen < plainTrailerLen {
+				return fail(ErrExtraLenTooSmall)
+			}
+			if mac != nil {
+				macEnd := len(pldWithOverHead) - headerNonceLen
+				if checksum {
+					macEnd -= plainChecksumLen
+				}
+				macStart := macEnd - plainMACLen
+				if !mac.verify(pldWithOverHead[macStart:macEnd], config.macHeader(authRegion), pldWithOverHead[:macStart]) {
+					return fail(&AuthFailedError{StreamID: streamID, Seq: seq, Err: errPlainMACMismatch})
+				}
+			}
+			if inPlace {
 				outputPayload = pldWithOverHead[:usefulPayloadLen]
+			} else {
+				outputPayload = scratch[:usefulPayloadLen]
+				copy(outputPayload, pldWithOverHead)
+			}
+		} else if explicitNonceLen != 0 {
+			if len(pldWithOverHead) < explicitNonceLen {
+				return fail(fmt.Errorf("%w: pldWithOverHead is shorter than the explicit nonce", ErrInputTooShort))
+			}
+			explicitNonce := pldWithOverHead[:explicitNonceLen]
+			ciphertext := pldWithOverHead[explicitNonceLen : len(pldWithOverHead)-padding]
+			if inPlace {
+				scratch = ciphertext[:0]
 			}
+			ad, pooled := config.boundAdditionalData(config.explicitNonceAdditionalData(authRegion))
+			plaintext, err := payloadCipher.Open(scratch, explicitNonce, ciphertext, ad)
+			releaseAdditionalData(pooled)
+			if err != nil {
+				return fail(&AuthFailedError{StreamID: streamID, Seq: seq, Err: err})
+			}
+			outputPayload = plaintext
 		} else {
-			_, err := payloadCipher.Open(pldWithOverHead[:0], header[:12], pldWithOverHead, nil)
+			if inPlace {
+				scratch = pldWithOverHead[:0]
+			}
+			header[0] ^= roleBit
+			xorNoncePrefix(header, noncePrefix)
+			ad, pooled := config.boundAdditionalData(config.additionalData(authRegion))
+			plaintext, err := payloadCipher.Open(scratch, header[:12], pldWithOverHead[:len(pldWithOverHead)-padding], ad)
+			releaseAdditionalData(pooled)
+			xorNoncePrefix(header, noncePrefix)
+			header[0] ^= roleBit
 			if err != nil {
-				return nil, err
+				return fail(&AuthFailedError{StreamID: streamID, Seq: seq, Err: err})
 			}
-			outputPayload = pldWithOverHead[:usefulPayloadLen]
+			outputPayload = plaintext
 		}
 
-		ret := &Frame{
-			StreamID: streamID,
-			Seq:      seq,
-			Closing:  closing,
-			Payload:  outputPayload,
+		// datagram frames are delivered as they are, duplicates and all
+		if replay != nil && closing&FlagDatagram == 0 {
+			if err := replay.check(streamID, seq); err != nil {
+				return fail(err)
+			}
+		}
+		if strictSeq != nil {
+			if err := strictSeq.check(streamID, seq, closing); err != nil {
+				return fail(err)
+			}
+		}
+
+		// the payload is only decompressed once it's been authenticated
+		if compression != COMPRESSION_NONE {
+			outputPayload, err = decompress(compression, outputPayload)
+			if err != nil {
+				return fail(err)
+			}
+		}
+		if config.RejectEmptyData && len(outputPayload) == 0 && closing&notDataFlags == 0 {
+			return fail(ErrEmptyDataFrame)
+		}
+
+		ret.StreamID = streamID
+		ret.Seq = seq
+		ret.Closing = closing
+		ret.Payload = outputPayload
+		if metrics != nil {
+			metrics.FrameDeobfsed(config.method, len(in), len(outputPayload))
 		}
 		return ret, nil
 	}
+	if onError := config.OnDeobfsError; onError != nil {
+		inner := deobfs
+		deobfs = func(in []byte, into *Frame) (*Frame, error) {
+			f, err := inner(in, into)
+			if err != nil && !errors.Is(err, ErrDummyRecord) {
+				prefix := in
+				if len(prefix) > deobfsErrorPrefixLen {
+					prefix = prefix[:deobfsErrorPrefixLen]
+				}
+				onError(err, len(in), prefix)
+			}
+			return f, err
+		}
+	}
+	if tap := config.Tap; tap != nil {
+		return tapDeobfs(deobfs, tap)
+	}
 	return deobfs
 }
 
-func GenerateObfs(encryptionMethod byte, sessionKey []byte, hasRecordLayer bool) (obfuscator *Obfuscator, err error) {
-	if len(sessionKey) != 32 {
-		err = errors.New("sessionKey size must be 32 bytes")
+// GenerateObfs creates an Obfuscator with the default config, as changed by opts in the order they are given
+func GenerateObfs(encryptionMethod Method, sessionKey []byte, opts ...ObfsOption) (obfuscator *Obfuscator, err error) {
+	var config ObfsConfig
+	for _, opt := range opts {
+		opt(&config)
 	}
+	return GenerateObfsWithConfig(encryptionMethod, sessionKey, config)
+}
 
+// GenerateObfsWithRecordLayer creates an Obfuscator with the default config and the given record layer, as
+// GenerateObfs used to before it took ObfsOptions.
+//
+// Deprecated: use GenerateObfs with WithRecordLayer
+func GenerateObfsWithRecordLayer(encryptionMethod Method, sessionKey []byte, recordLayer RecordLayer) (*Obfuscator, error) {
+	return GenerateObfs(encryptionMethod, sessionKey, WithRecordLayer(recordLayer))
+}
+
+// GenerateObfsWithConfig creates an Obfuscator with config. Most of what it costs is deriving the header and payload
+// keys with HKDF-SHA256 from PROTOCOL_V3, twice over with DirectionalKeys, rather than setting up the payload cipher:
+// with E_METHOD_PLAIN it costs nearly as much as with E_METHOD_AES_GCM (see BenchmarkGenerateObfs). Nothing derived
+// from a session key is cached, as session keys are unique to their session and a cache would only keep key
+// material around after the Obfuscator is closed
+func GenerateObfsWithConfig(encryptionMethod Method, sessionKey []byte, config ObfsConfig) (obfuscator *Obfuscator, err error) {
+	if !encryptionMethod.Valid() {
+		return nil, fmt.Errorf("%w %v", ErrUnknownMethod, byte(encryptionMethod))
+	}
+	if err := validateConfig(encryptionMethod, config); err != nil {
+		return nil, err
+	}
+	config.method = encryptionMethod
+	obfs, deobfs, payloadCipher, keys, err := makeObfsPair(encryptionMethod, sessionKey, config)
+	if err != nil {
+		return nil, err
+	}
+	return newObfuscator(sessionKey, obfs, deobfs, payloadCipher, keys, config), nil
+}
+
+// GenerateObfsWithAEAD creates an Obfuscator whose payloads are sealed by aead, which the caller has keyed, rather
+// than one of the built in methods, such as for a hardware backed or FIPS validated implementation. Its nonce is
+// taken from the header if NonceSize is 12, and is otherwise random and carried in the frame as for
+// E_METHOD_XCHACHA20_POLY1305. headerKey is the 32 byte key the header is scrambled with, used as it is whatever the
+// protocol version. It must be independent of the key of aead, as the header cipher is keyed only with headerKey.
+//
+// Nothing is derived from a session key, so ObfsConfig.DirectionalKeys, ObfsConfig.TagLen, Rekey and Clone aren't
+// supported, and SessionKey is nil. Close wipes the copy of headerKey but not aead, which is left to the caller.
+// Metrics are given E_METHOD_EXTERNAL as the method
+func GenerateObfsWithAEAD(headerKey []byte, aead cipher.AEAD, opts ...ObfsOption) (*Obfuscator, error) {
+	var config ObfsConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+	if len(headerKey) != 32 {
+		return nil, ErrBadHeaderKeySize
+	}
+	if aead == nil {
+		return nil, fmt.Errorf("%w: the AEAD is nil", ErrExternalAEADUnsupported)
+	}
+	if config.DirectionalKeys {
+		return nil, fmt.Errorf("%w: directional keys", ErrExternalAEADUnsupported)
+	}
+	if err := validateConfig(E_METHOD_EXTERNAL, config); err != nil {
+		return nil, err
+	}
+	config.method = E_METHOD_EXTERNAL
 	var salsaKey [32]byte
-	copy(salsaKey[:], sessionKey)
+	copy(salsaKey[:], headerKey)
+	keys := newObfsKeys(salsaKey, aead, config)
+	salsaKey = [32]byte{}
+	return newObfuscator(nil, makeObfs(keys, aead, config), makeDeobfs(keys, aead, config, false), aead, keys, config), nil
+}
+
+// validateConfig checks that config can be used with encryptionMethod
+func validateConfig(encryptionMethod Method, config ObfsConfig) error {
+	if config.ProtocolVersion > maxProtocolVersion {
+		return fmt.Errorf("%w %v", ErrUnknownProtocolVersion, config.ProtocolVersion)
+	}
+	if !config.Role.Valid() {
+		return fmt.Errorf("Unknown role %v", config.Role)
+	}
+	if config.DirectionalKeys && (config.ProtocolVersion < PROTOCOL_V3 || config.Role == ROLE_UNBOUND) {
+		return ErrDirectionalKeysUnsupported
+	}
+	if config.TagLen != 0 && (config.TagLen < minTagLen || config.TagLen > 16) {
+		return fmt.Errorf("Tag length %v is outside %v to 16", config.TagLen, minTagLen)
+	}
+	if config.TagLen != 0 && !truncatable(encryptionMethod) {
+		return ErrTagTruncationUnsupported
+	}
+	if config.Padding != nil && encryptionMethod != E_METHOD_PLAIN && config.ProtocolVersion < PROTOCOL_V2 {
+		return ErrPaddingUnsupported
+	}
+	if err := validateNoncePrefix(config); err != nil {
+		return err
+	}
+	if !config.HeaderCipher.Valid() {
+		return fmt.Errorf("Unknown header cipher %v", config.HeaderCipher)
+	}
+	if config.HeaderCipher == HEADER_CIPHER_CHACHA20 && config.ProtocolVersion < PROTOCOL_V3 {
+		return ErrHeaderCipherUnsupported
+	}
+	if !config.Compression.Valid() {
+		return fmt.Errorf("Unknown compression %v", config.Compression)
+	}
+	if config.Compression != COMPRESSION_NONE && config.layout().compressionOffset() < 0 {
+		return ErrCompressionUnsupported
+	}
+	if l, ok := config.RecordLayer.(LengthPrefixRecordLayer); ok && l.width() != 2 && l.width() != 4 {
+		return fmt.Errorf("Unsupported length prefix width %v", l.Width)
+	}
+	if t, ok := config.RecordLayer.(TLSRecordLayer); ok && (t.MaxRecordLen < 0 || t.MaxRecordLen > math.MaxUint16) {
+		return fmt.Errorf("Unsupported max record length %v, which must fit a 16 bit record length", t.MaxRecordLen)
+	}
+	if q, ok := config.RecordLayer.(QUICRecordLayer); ok && !q.valid() {
+		return fmt.Errorf("Unsupported QUIC connection ID length %v or packet number length %v", len(q.ConnectionID), q.PacketNumberLen)
+	}
+	return nil
+}
+
+// newObfuscator puts together an Obfuscator from the obfsFunc and deobfsFunc of the first key epoch
+func newObfuscator(sessionKey []byte, obfs obfsFunc, deobfs deobfsFunc, payloadCipher cipher.AEAD, keys *obfsKeys, config ObfsConfig) *Obfuscator {
+	obfuscator := &Obfuscator{
+		deobfs:           deobfs,
+		SessionKey:       sessionKey,
+		encryptionMethod: config.method,
+		obfs:             obfs,
+		keys:             keys,
+		payloadCipher:    payloadCipher,
+		config:           config,
+	}
+	obfuscator.obfser = func(f *Frame, buf []byte) (int, error) {
+		n, _, err := obfs(f, nil, buf, false, nil)
+		return n, err
+	}
+	if config.ProtocolVersion >= PROTOCOL_V4 {
+		obfuscator.epochs.Store(&keyEpoch{obfs: obfs, deobfs: deobfs, keys: keys})
+		obfuscator.obfser = obfuscator.epochObfs
+		obfuscator.deobfs = obfuscator.epochDeobfs
+	}
+	return obfuscator
+}
+
+// makeObfsPair creates the Obfser and Deobfser of a session key, and the keys they are made from
+func makeObfsPair(encryptionMethod Method, sessionKey []byte, config ObfsConfig) (obfsFunc, deobfsFunc, cipher.AEAD, *obfsKeys, error) {
+	if !encryptionMethod.validSessionKeyLen(len(sessionKey)) {
+		return nil, nil, nil, nil, ErrBadSessionKeySize
+	}
+	if !config.DirectionalKeys {
+		keys, payloadCipher, err := makeKeys(encryptionMethod, sessionKey, config)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		return makeObfs(keys, payloadCipher, config), makeDeobfs(keys, payloadCipher, config, false), payloadCipher, keys, nil
+	}
 
-	var payloadCipher cipher.AEAD
+	sendInfo, recvInfo := clientToServerKeyInfo, serverToClientKeyInfo
+	if config.Role == ROLE_SERVER {
+		sendInfo, recvInfo = recvInfo, sendInfo
+	}
+	deriver := newSubkeyDeriver(sessionKey)
+	sendKey := deriver.derive(sendInfo)
+	recvKey := deriver.derive(recvInfo)
+	deriver.wipe()
+	defer func() {
+		sendKey = [32]byte{}
+		recvKey = [32]byte{}
+	}()
+	keys, sendCipher, err := makeKeys(encryptionMethod, sendKey[:], config)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	recvKeys, recvCipher, err := makeKeys(encryptionMethod, recvKey[:], config)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	keys.recv = recvKeys
+	return makeObfs(keys, sendCipher, config), makeDeobfs(recvKeys, recvCipher, config, false), sendCipher, keys, nil
+}
+
+// makeKeys derives the header key and the payload cipher from a 32 byte key
+func makeKeys(encryptionMethod Method, sessionKey []byte, config ObfsConfig) (*obfsKeys, cipher.AEAD, error) {
+	var salsaKey, derivedPayloadKey [32]byte
+	payloadKey := sessionKey
+	if config.ProtocolVersion >= PROTOCOL_V3 {
+		deriver := newSubkeyDeriver(sessionKey)
+		salsaKey = deriver.derive(headerKeyInfo)
+		derivedPayloadKey = deriver.derive(payloadKeyInfo)
+		deriver.wipe()
+		payloadKey = derivedPayloadKey[:]
+	} else if len(sessionKey) < len(salsaKey) {
+		// salsa20 needs a full 32 byte key, which a shorter session key is expanded into. The payload cipher still
+		// uses the session key as it is
+		salsaKey = deriveSubkey(sessionKey, headerKeyInfo)
+	} else {
+		copy(salsaKey[:], sessionKey)
+	}
+
+	payloadCipher, err := makePayloadCipher(encryptionMethod, payloadKey)
+	// the cipher keeps a key schedule of its own
+	derivedPayloadKey = [32]byte{}
+	if err != nil {
+		return nil, nil, err
+	}
+	if config.TagLen != 0 && config.TagLen < payloadCipher.Overhead() {
+		payloadCipher = &truncatedAEAD{AEAD: payloadCipher, tagLen: config.TagLen}
+	}
+	keys := newObfsKeys(salsaKey, payloadCipher, config)
+	salsaKey = [32]byte{}
+	return keys, payloadCipher, nil
+}
+
+func makePayloadCipher(encryptionMethod Method, payloadKey []byte) (payloadCipher cipher.AEAD, err error) {
 	switch encryptionMethod {
 	case E_METHOD_PLAIN:
 		payloadCipher = nil
 	case E_METHOD_AES_GCM:
 		var c cipher.Block
-		c, err = aes.NewCipher(sessionKey)
+		c, err = aes.NewCipher(payloadKey)
 		if err != nil {
 			return
 		}
@@ -167,18 +1283,329 @@ func GenerateObfs(encryptionMethod byte, sessionKey []byte, hasRecordLayer bool)
 			return
 		}
 	case E_METHOD_CHACHA20_POLY1305:
-		payloadCipher, err = chacha20poly1305.New(sessionKey)
+		payloadCipher, err = chacha20poly1305.New(payloadKey)
+		if err != nil {
+			return
+		}
+	case E_METHOD_AES_128_GCM:
+		// only the AES key is shortened, salsa20 header encryption still uses the full 32 byte key
+		var c cipher.Block
+		c, err = aes.NewCipher(payloadKey[:16])
+		if err != nil {
+			return
+		}
+		payloadCipher, err = cipher.NewGCM(c)
+		if err != nil {
+			return
+		}
+	case E_METHOD_AES_192_GCM:
+		// the first 24 bytes, which is all of a 24 byte session key below PROTOCOL_V3
+		var c cipher.Block
+		c, err = aes.NewCipher(payloadKey[:24])
+		if err != nil {
+			return
+		}
+		payloadCipher, err = cipher.NewGCM(c)
+		if err != nil {
+			return
+		}
+	case E_METHOD_AES_GCM_SIV:
+		payloadCipher, err = gcmsiv.New(payloadKey)
+		if err != nil {
+			return
+		}
+	case E_METHOD_XCHACHA20_POLY1305:
+		payloadCipher, err = chacha20poly1305.NewX(payloadKey)
+		if err != nil {
+			return
+		}
+	case E_METHOD_AEGIS_128L:
+		// like E_METHOD_AES_128_GCM, only the first 16 bytes are used. Its 16 byte nonce can't be taken from the
+		// header, so it's sent explicitly as XChaCha20's is
+		payloadCipher, err = aegis.New(payloadKey[:aegis.KeySize])
+		if err != nil {
+			return
+		}
+	case E_METHOD_ASCON_128:
+		// a 16 byte key and an explicit 16 byte nonce as E_METHOD_AEGIS_128L
+		payloadCipher, err = ascon.New(payloadKey[:ascon.KeySize])
 		if err != nil {
 			return
 		}
 	default:
-		return nil, errors.New("Unknown encryption method")
+		return nil, fmt.Errorf("%w %v", ErrUnknownMethod, byte(encryptionMethod))
 	}
+	return
+}
 
-	obfuscator = &Obfuscator{
-		MakeObfs(salsaKey, payloadCipher, hasRecordLayer),
-		MakeDeobfs(salsaKey, payloadCipher, hasRecordLayer),
-		sessionKey,
+// Obfs adds the frame header to f, encrypts it and wraps it in the record layer, writing the result into buf. It
+// returns the number of bytes written
+func (o *Obfuscator) Obfs(f *Frame, buf []byte) (int, error) {
+	if o == nil || o.obfser == nil {
+		return 0, ErrUninitialisedObfuscator
 	}
-	return
+	if o.isClosed() {
+		return 0, ErrObfuscatorClosed
+	}
+	return o.obfser(f, buf)
+}
+
+// Deobfs unwraps the record layer of in, and decrypts and parses the frame it carries
+func (o *Obfuscator) Deobfs(in []byte) (*Frame, error) {
+	if o == nil || o.deobfs == nil {
+		return nil, ErrUninitialisedObfuscator
+	}
+	if o.isClosed() {
+		return nil, ErrObfuscatorClosed
+	}
+	return o.deobfs(in, nil)
+}
+
+// DeobfsInto deobfses in as Deobfs does, but into f rather than a frame of its own. f.Payload is decrypted into the
+// buffer already backing it if that is big enough, so a frame from AcquireFrame that is deobfsed into over and over
+// needs no allocation once its buffer has grown to fit. The Payload is only valid until f is deobfsed into again or
+// released, and f is left in an unspecified state if this fails
+func (o *Obfuscator) DeobfsInto(in []byte, f *Frame) error {
+	if o == nil || o.deobfs == nil {
+		return ErrUninitialisedObfuscator
+	}
+	if o.isClosed() {
+		return ErrObfuscatorClosed
+	}
+	_, err := o.deobfs(in, f)
+	return err
+}
+
+// DeobfsTo deobfses in as Deobfs does, but copies the payload into dst, which the caller owns outright, and returns
+// its length along with the rest of the frame in f, whose Payload is nil. It fails with ErrBufferTooSmall if the
+// payload doesn't fit in dst, by which point the frame has been authenticated and recorded by the replay window, so
+// it can't be deobfsed again. A dst of len(in) bytes fits the payload of any frame that isn't compressed
+func (o *Obfuscator) DeobfsTo(in []byte, dst []byte) (n int, f Frame, err error) {
+	scratch := AcquireFrame()
+	defer ReleaseFrame(scratch)
+	if err := o.DeobfsInto(in, scratch); err != nil {
+		return 0, Frame{}, err
+	}
+	if len(scratch.Payload) > len(dst) {
+		return 0, Frame{}, fmt.Errorf("%w: %v byte payload doesn't fit in %v bytes", ErrBufferTooSmall, len(scratch.Payload), len(dst))
+	}
+	f = Frame{StreamID: scratch.StreamID, Seq: scratch.Seq, Closing: scratch.Closing}
+	return copy(dst, scratch.Payload), f, nil
+}
+
+// DeobfsAll deobfses every record in in, for callers that buffer what they read themselves rather than using a
+// FrameReader. It returns the frames carried, and the number of bytes of in they were read from. A record at the end
+// of in that is cut short is left for the next call, with the number of bytes read falling short of len(in) but no
+// error. Dummy records are skipped over. On error, the frames before the bad record are returned along with where it
+// starts. As with Deobfs, records aren't decrypted in place: the payloads of the frames are copies of their own, and
+// in can be reused or overwritten once DeobfsAll returns.
+//
+// Records are found through the length in their header. With NoRecordLayer, or a RecordLayer of another package, the
+// whole of in is deobfsed as a single record. Split frames of a TLSRecordLayer with MaxRecordLen are joined in place by
+// stripping the headers of all but their first record, which is the only way in is modified. Those bytes of in no
+// longer hold the records as they were read, and can't be deobfsed from again
+func (o *Obfuscator) DeobfsAll(in []byte) ([]*Frame, int, error) {
+	if o == nil || o.deobfs == nil {
+		return nil, 0, ErrUninitialisedObfuscator
+	}
+	if o.isClosed() {
+		return nil, 0, ErrObfuscatorClosed
+	}
+	delimiter, ok := o.config.recordLayer().(recordDelimiter)
+	if !ok {
+		if len(in) == 0 {
+			return nil, 0, nil
+		}
+		f, err := o.deobfs(in, nil)
+		if errors.Is(err, ErrDummyRecord) {
+			return nil, len(in), nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		return []*Frame{f}, len(in), nil
+	}
+
+	var frames []*Frame
+	read := 0
+	for read < len(in) {
+		recordLen, err := delimiter.recordLen(in[read:], o.config.MaxFrameSize)
+		if err != nil {
+			return frames, read, err
+		}
+		if recordLen == 0 || recordLen > len(in)-read {
+			break
+		}
+		record := in[read : read+recordLen]
+		if t, ok := delimiter.(TLSRecordLayer); ok {
+			record = t.join(record)
+		}
+		f, err := o.deobfs(record, nil)
+		if errors.Is(err, ErrDummyRecord) {
+			read += recordLen
+			continue
+		}
+		if err != nil {
+			return frames, read, err
+		}
+		frames = append(frames, f)
+		read += recordLen
+	}
+	return frames, read, nil
+}
+
+func (o *Obfuscator) isClosed() bool { return atomic.LoadUint32(&o.closed) != 0 }
+
+// Close wipes SessionKey, which is the slice given to GenerateObfs, and the keys derived from it, after which every
+// call to obfs or deobfs a frame returns ErrObfuscatorClosed. It must not be called while any of them are in progress.
+//
+// Only key material held by Cloak itself can be wiped. The key schedule inside the payload cipher, and the HMAC state of
+// PlainMAC, are out of reach and are only left to the garbage collector
+func (o *Obfuscator) Close() error {
+	if !atomic.CompareAndSwapUint32(&o.closed, 0, 1) {
+		return nil
+	}
+	for i := range o.SessionKey {
+		o.SessionKey[i] = 0
+	}
+	o.keys.wipe()
+	if o.config.ProtocolVersion >= PROTOCOL_V4 {
+		e := o.epochs.Load().(*keyEpoch)
+		e.keys.wipe()
+		e.prevKeys.wipe()
+	}
+	return nil
+}
+
+// Clone creates an Obfuscator with the same encryption method and ObfsConfig as o, but keyed with newSessionKey, such
+// as for a new session. The clone starts at the first key epoch with a replay window of its own, whatever o has been
+// rekeyed to or seen. Anything in the config that isn't copied by value, such as Metrics, Padding or Rand, is shared
+// with o
+func (o *Obfuscator) Clone(newSessionKey []byte) (*Obfuscator, error) {
+	if o == nil || o.deobfs == nil {
+		return nil, ErrUninitialisedObfuscator
+	}
+	if o.isClosed() {
+		return nil, ErrObfuscatorClosed
+	}
+	if o.encryptionMethod == E_METHOD_EXTERNAL {
+		return nil, fmt.Errorf("%w: cloning", ErrExternalAEADUnsupported)
+	}
+	config := o.config
+	config.keyEpoch = 0
+	return GenerateObfsWithConfig(o.encryptionMethod, newSessionKey, config)
+}
+
+// ObfsVectored obfses f as Obfs does, with its payload given as fragments. See MakeVectoredObfs
+func (o *Obfuscator) ObfsVectored(f *Frame, payload [][]byte, buf []byte) (int, error) {
+	if o.isClosed() {
+		return 0, ErrObfuscatorClosed
+	}
+	n, _, err := o.currentObfs()(f, payload, buf, false, nil)
+	return n, err
+}
+
+// ObfsBuffers obfses f into segments that are appended to bufs, ready to be written with a single writev through
+// net.Buffers.WriteTo. The record layer, header and any extra bytes are written into buf. With an AEAD, the
+// ciphertext is sealed into buf as well so the segments are consecutive slices of it. With E_METHOD_PLAIN, f.Payload
+// is referenced in the segments rather than copied, and buf only needs to be big enough for everything apart from the
+// payload. Masked WebSocket frames are the exception, as their payload has to be masked in buf. The segments are only
+// valid until buf or f.Payload is reused
+func (o *Obfuscator) ObfsBuffers(f *Frame, buf []byte, bufs net.Buffers) (net.Buffers, error) {
+	if o.isClosed() {
+		return bufs, ErrObfuscatorClosed
+	}
+	_, bufs, err := o.currentObfs()(f, nil, buf, true, bufs)
+	return bufs, err
+}
+
+// frameLen returns the number of bytes a frame with a payload of payloadLen bytes is obfsed into, counting the longest
+// dummy record the record layer may send in front of it
+func (o *Obfuscator) frameLen(payloadLen int) int {
+	return o.config.maxDummyLen() + o.Layout(payloadLen).End
+}
+
+// Overhead returns the number of bytes an obfsed frame takes up on top of its payload. In plain mode without PlainMAC,
+// payloads shorter than 8 bytes are padded to 8 bytes, so frames carrying them take up to 8-len(payload) bytes more
+// than this. The record layer is counted as it is for frames of up to 65535 bytes, which for WebSocketRecordLayer is 2
+// bytes longer than it is for frames of up to 125 bytes. Any dummy record the record layer may send is counted as well
+func (o *Obfuscator) Overhead() int {
+	return o.config.maxDummyLen() + o.config.recordLayer().HeaderLen(math.MaxUint16) + o.config.headerLen() + extraLenOf(o.payloadCipher, o.config, 8)
+}
+
+// MaxOverhead returns the most bytes a frame obfsed with method takes up on top of its payload in the default config,
+// with a TLSRecordLayer if recordLayer is set and no record layer otherwise, or -1 if method isn't supported. This is
+// what an empty payload is obfsed into, E_METHOD_PLAIN frames being filled up to 8 bytes of payload, so a buffer of a
+// payload's length and MaxOverhead always fits the frame. Unlike Overhead it needs no Obfuscator, for buffers sized
+// before there is a session, but other configs, such as later protocol versions with longer headers, take more. It's
+// worked out from the header layout, the tag and explicit nonce of method and the record layer, with no key derived
+// or cipher set up
+func MaxOverhead(method Method, recordLayer bool) int {
+	if !method.Valid() {
+		return -1
+	}
+	var config ObfsConfig
+	if recordLayer {
+		config.RecordLayer = TLSRecordLayer{}
+	}
+	extraLen := method.explicitNonceLen() + method.Overhead()
+	if method == E_METHOD_PLAIN {
+		extraLen = extraLenOf(nil, config, 0)
+	}
+	innerLen := config.headerLen() + extraLen
+	return config.maxDummyLen() + config.recordLayer().HeaderLen(innerLen) + innerLen
+}
+
+// MaxPayload returns the length of the largest payload that can be obfsed into a buffer of bufLen bytes, or -1 if
+// bufLen is too small for even an empty payload
+func (o *Obfuscator) MaxPayload(bufLen int) int {
+	maxPayload := bufLen - o.Overhead()
+	// the WebSocket header of frames too long for a 16 bit length, and the headers of frames split across more TLS
+	// records, are longer than Overhead accounts for
+	for maxPayload > 0 && o.frameLen(maxPayload) > bufLen {
+		maxPayload -= o.frameLen(maxPayload) - bufLen
+	}
+	// plain payloads that come to less than 8 bytes with their trailer are padded up to 8 bytes, so if a frame of
+	// maxPayload that's padded doesn't fit, no shorter one does either
+	if maxPayload < 0 || o.frameLen(maxPayload) > bufLen {
+		return -1
+	}
+	return maxPayload
+}
+
+// FrameLayout is where each part of an obfsed frame starts, counted from the start of its record layer header. The
+// record layer header is followed by the frame header, in the clear only with HEADER_CIPHER_NONE, then by the explicit
+// nonce of methods that carry one, the encrypted payload, the AEAD tag, and last the trailer of E_METHOD_PLAIN frames:
+// anything a short payload is filled up to 8 bytes with, the MAC of ObfsConfig.PlainMAC, the checksum of
+// ObfsConfig.PlainChecksum and the header nonce from PROTOCOL_V5. Parts a frame doesn't have are empty, starting where the next one does
+type FrameLayout struct {
+	Header        int
+	ExplicitNonce int
+	Payload       int
+	Tag           int
+	Trailer       int
+	// End is the length of the whole frame
+	End int
+}
+
+// Layout returns where the parts of a frame with a payload of payloadLen bytes are once obfsed, as Obfs lays them out,
+// for callers that splice or inspect obfsed frames themselves. payloadLen is the length after any compression. Dummy
+// records and padding aren't counted, as their lengths are only decided once a frame is obfsed: a dummy record goes in
+// front of the whole layout, and padding goes after the tag, or in front of the trailer of E_METHOD_PLAIN frames. For
+// split frames of a TLSRecordLayer with MaxRecordLen, the record layer header counts the headers of all the records,
+// which end up between parts of the frame
+func (o *Obfuscator) Layout(payloadLen int) FrameLayout {
+	extraLen := extraLenOf(o.payloadCipher, o.config, payloadLen)
+	innerLen := o.config.headerLen() + payloadLen + extraLen
+	var l FrameLayout
+	l.Header = o.config.recordLayer().HeaderLen(innerLen)
+	l.ExplicitNonce = l.Header + o.config.headerLen()
+	l.Payload = l.ExplicitNonce + explicitNonceLenOf(o.payloadCipher)
+	l.Tag = l.Payload + payloadLen
+	l.Trailer = l.Tag
+	if o.payloadCipher != nil {
+		l.Trailer += o.payloadCipher.Overhead()
+	}
+	l.End = l.Header + innerLen
+	return l
 }
@@ -0,0 +1,299 @@
+package multiplex
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrStreamReset is returned by ObfsConn.Read once the remote has aborted the stream with FlagRst
+var ErrStreamReset = errors.New("stream reset by the remote")
+
+// ErrRecordLayerUnsupported is returned by NewObfsConn for record layers a FrameReader can't find the records of
+var ErrRecordLayerUnsupported = errors.New("record layer can't be read off a byte stream")
+
+// obfsConnPayloadLen is the most payload each frame written by an ObfsConn carries, as much as a real TLS record does
+const obfsConnPayloadLen = 16384
+
+// ObfsConn implements io.ReaderFrom and io.WriterTo, so that io.Copy into it sends what it reads as the payload of a
+// frame as it is, and io.Copy out of it writes the payloads of the frames as they are read
+var (
+	_ io.ReaderFrom = (*ObfsConn)(nil)
+	_ io.WriterTo   = (*ObfsConn)(nil)
+)
+
+// ObfsConn carries a single stream of bytes over a net.Conn as obfsed frames of one StreamID, without a Session.
+// Writes are cut into frames of consecutive Seqs, and the payloads of the frames read are returned by Read in order.
+// Frames of other StreamIDs, padding, handshake and control frames are ignored. The obfuscator's record layer must be
+// TLSRecordLayer or LengthPrefixRecordLayer, as the records are found with a FrameReader. Read and Write are each
+// safe to be called from a goroutine of their own
+type ObfsConn struct {
+	conn     net.Conn
+	streamID uint64
+
+	writeM      sync.Mutex
+	fw          *FrameWriter
+	nextSendSeq uint64
+	// maxPayloadLen is the most payload a frame written carries, which is less than obfsConnPayloadLen if frames that
+	// long would exceed the obfuscator's MaxFrameSize
+	maxPayloadLen int
+	// chunk is what ReadFrom reads into, and sendFrame the frame payloads are sent in, both kept across calls
+	chunk       []byte
+	sendFrame   Frame
+	writeClosed bool
+	// writeErr is the error a Write failed with, which may have left a frame half written
+	writeErr error
+
+	readM       sync.Mutex
+	fr          *FrameReader
+	nextRecvSeq uint64
+	// pending is what is left of the payload of the last frame read
+	pending []byte
+	readErr error
+}
+
+// NewObfsConn returns an ObfsConn carrying the stream streamID over conn
+func NewObfsConn(conn net.Conn, obfuscator *Obfuscator, streamID uint64) (*ObfsConn, error) {
+	if obfuscator == nil || obfuscator.deobfs == nil {
+		return nil, ErrUninitialisedObfuscator
+	}
+	fr := NewFrameReader(conn, obfuscator.Deobfs)
+	// frames are refused by the obfuscator's MaxFrameSize, if it has one, before they're read
+	fr.MaxFrameSize = obfuscator.config.MaxFrameSize
+	switch rl := obfuscator.config.recordLayer().(type) {
+	case TLSRecordLayer:
+		fr.MaxRecordLen = rl.MaxRecordLen
+	case LengthPrefixRecordLayer:
+		fr.LengthPrefix = rl.width()
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrRecordLayerUnsupported, rl)
+	}
+	return &ObfsConn{
+		conn:          conn,
+		streamID:      streamID,
+		fw:            NewFrameWriter(conn, obfuscator),
+		maxPayloadLen: maxFramePayloadLen(obfuscator, obfsConnPayloadLen),
+		fr:            fr,
+	}, nil
+}
+
+// maxFramePayloadLen returns limit, or less if frames with a payload that long would exceed the obfuscator's
+// MaxFrameSize. It's never less than 1, so that frames of it fail rather than none being sent
+func maxFramePayloadLen(obfuscator *Obfuscator, limit int) int {
+	maxFrameSize := obfuscator.config.MaxFrameSize
+	if maxFrameSize <= 0 {
+		return limit
+	}
+	// MaxFrameSize doesn't count the record layer header, and the rest of the overhead is the same for any payload
+	// of 8 bytes or more
+	l := obfuscator.Layout(limit)
+	if fits := maxFrameSize - (l.End - l.Header - limit); fits < limit {
+		limit = fits
+	}
+	if limit < 1 {
+		return 1
+	}
+	return limit
+}
+
+// Read reads the payloads of the frames of the stream. It returns io.EOF once the remote has closed the stream or the
+// session, and an error wrapping ErrStreamReset if it was aborted
+func (c *ObfsConn) Read(b []byte) (int, error) {
+	c.readM.Lock()
+	defer c.readM.Unlock()
+	for len(c.pending) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if len(b) == 0 {
+			return 0, nil
+		}
+		payload, err := c.readPayload()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = payload
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// WriteTo writes the payloads of the frames of the stream to w as they are read, straight from the buffer they are
+// deobfsed in, until the remote closes the stream or the session. It returns nil then, as with io.Copy, and the
+// error wrapping ErrStreamReset if the stream was aborted
+func (c *ObfsConn) WriteTo(w io.Writer) (int64, error) {
+	c.readM.Lock()
+	defer c.readM.Unlock()
+	var written int64
+	for {
+		if len(c.pending) == 0 {
+			err := c.readErr
+			if err == nil {
+				c.pending, err = c.readPayload()
+			}
+			if err == io.EOF {
+				return written, nil
+			}
+			if err != nil {
+				return written, err
+			}
+			continue
+		}
+		n, err := w.Write(c.pending)
+		written += int64(n)
+		c.pending = c.pending[n:]
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+}
+
+// readPayload reads frames until the next one of the stream, and returns its payload, which is only valid until the
+// next frame is read. Once the stream has been closed or has failed, it's readErr that is returned. readM must be held
+func (c *ObfsConn) readPayload() ([]byte, error) {
+	for {
+		f, err := c.fr.ReadFrame()
+		if err != nil {
+			if !isTimeout(err) {
+				c.readErr = err
+			}
+			return nil, err
+		}
+		if f.StreamID != c.streamID || f.IsPadding() || f.IsHandshake() || f.Closing&FlagControl != 0 {
+			continue
+		}
+		if f.Seq != c.nextRecvSeq {
+			c.readErr = fmt.Errorf("expecting Seq %v on stream %v, got %v", c.nextRecvSeq, c.streamID, f.Seq)
+			return nil, c.readErr
+		}
+		c.nextRecvSeq++
+		// the payloads of closing frames are dropped, as they are by a Session
+		switch {
+		case f.IsRst():
+			code, _ := f.ResetCode()
+			c.readErr = fmt.Errorf("%w with code %v", ErrStreamReset, code)
+			return nil, c.readErr
+		case f.ClosesStream() || f.ClosesSession():
+			c.readErr = io.EOF
+			return nil, c.readErr
+		}
+		return f.Payload, nil
+	}
+}
+
+// isTimeout returns whether err is a deadline being exceeded, after which the conn can still be read from
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Write sends b in frames of up to 16384 bytes of payload each, or fewer if the obfuscator's MaxFrameSize is shorter.
+// Once a Write fails, including by exceeding the write deadline, every later one fails the same way, as a frame may
+// have been left half written
+func (c *ObfsConn) Write(b []byte) (int, error) {
+	c.writeM.Lock()
+	defer c.writeM.Unlock()
+	if err := c.writable(); err != nil {
+		return 0, err
+	}
+	written := 0
+	for written < len(b) {
+		payloadLen := len(b) - written
+		if payloadLen > c.maxPayloadLen {
+			payloadLen = c.maxPayloadLen
+		}
+		if err := c.writePayload(b[written : written+payloadLen]); err != nil {
+			return written, err
+		}
+		written += payloadLen
+	}
+	return written, nil
+}
+
+// ReadFrom sends what is read from r until it returns io.EOF, each Read of up to as much as a frame carries in a frame
+// of its own, without it being buffered up first. Only errors other than io.EOF are returned, as with io.Copy. What
+// is read from r is always sent before an error reading from it is returned
+func (c *ObfsConn) ReadFrom(r io.Reader) (int64, error) {
+	c.writeM.Lock()
+	defer c.writeM.Unlock()
+	if err := c.writable(); err != nil {
+		return 0, err
+	}
+	if len(c.chunk) < c.maxPayloadLen {
+		c.chunk = make([]byte, c.maxPayloadLen)
+	}
+	var written int64
+	for {
+		n, readErr := r.Read(c.chunk[:c.maxPayloadLen])
+		if n > 0 {
+			if err := c.writePayload(c.chunk[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+		if readErr == io.EOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+}
+
+// writable returns the error writing fails with, if it does. writeM must be held
+func (c *ObfsConn) writable() error {
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+	if c.writeClosed {
+		return io.ErrClosedPipe
+	}
+	return nil
+}
+
+// writePayload sends payload in the next frame of the stream. writeM must be held
+func (c *ObfsConn) writePayload(payload []byte) error {
+	c.sendFrame = Frame{StreamID: c.streamID, Seq: c.nextSendSeq, Payload: payload}
+	err := c.fw.WriteFrame(&c.sendFrame)
+	c.sendFrame.Payload = nil
+	if err != nil {
+		c.writeErr = err
+		return err
+	}
+	c.nextSendSeq++
+	return nil
+}
+
+// CloseWrite tells the remote that nothing more will be written with a frame with FlagFin, after which the remote's
+// Read returns io.EOF. The conn can still be read from
+func (c *ObfsConn) CloseWrite() error {
+	c.writeM.Lock()
+	defer c.writeM.Unlock()
+	if c.writeClosed || c.writeErr != nil {
+		return c.writeErr
+	}
+	c.writeClosed = true
+	return c.fw.WriteFrame(&Frame{StreamID: c.streamID, Seq: c.nextSendSeq, Closing: FlagFin})
+}
+
+// Close closes the stream for writing if it hasn't been already, and then closes the underlying conn
+func (c *ObfsConn) Close() error {
+	err := c.CloseWrite()
+	if closeErr := c.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (c *ObfsConn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *ObfsConn) RemoteAddr() net.Addr               { return c.conn.RemoteAddr() }
+func (c *ObfsConn) SetDeadline(t time.Time) error      { return c.conn.SetDeadline(t) }
+func (c *ObfsConn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *ObfsConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
@@ -0,0 +1,261 @@
+package multiplex
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func makeObfsConnPair(t testing.TB, recordLayer RecordLayer) (*ObfsConn, *ObfsConn) {
+	return makeObfsConnPairWithConfig(t, ObfsConfig{RecordLayer: recordLayer})
+}
+
+func makeObfsConnPairWithConfig(t testing.TB, config ObfsConfig) (*ObfsConn, *ObfsConn) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	config.ProtocolVersion = PROTOCOL_V6
+	config.DirectionalKeys = true
+	config.Role = ROLE_CLIENT
+	clientObfuscator, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, config)
+	config.Role = ROLE_SERVER
+	serverObfuscator, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, config)
+
+	clientConn, serverConn := net.Pipe()
+	client, err := NewObfsConn(clientConn, clientObfuscator, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewObfsConn(serverConn, serverObfuscator, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestObfsConn(t *testing.T) {
+	for name, rl := range map[string]RecordLayer{
+		"tls":           TLSRecordLayer{},
+		"tls split":     TLSRecordLayer{MaxRecordLen: 4096},
+		"length prefix": LengthPrefixRecordLayer{Width: 4},
+	} {
+		client, server := makeObfsConnPair(t, rl)
+		sent := make([]byte, 100000)
+		rand.Read(sent)
+
+		go func() {
+			client.Write(sent[:10])
+			client.Write(sent[10:])
+			client.CloseWrite()
+		}()
+		received, err := ioutil.ReadAll(server)
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+		}
+		if !bytes.Equal(received, sent) {
+			t.Errorf("%v: received %v bytes that don't match the %v sent", name, len(received), len(sent))
+		}
+
+		// the other direction is still open after the half close
+		go server.Write([]byte("reply"))
+		reply := make([]byte, 5)
+		if _, err := io.ReadFull(client, reply); err != nil || string(reply) != "reply" {
+			t.Errorf("%v: expecting a reply after closing for writing, got %q: %v", name, reply, err)
+		}
+		if _, err := client.Write([]byte("more")); err != io.ErrClosedPipe {
+			t.Errorf("%v: expecting %v writing after CloseWrite, got %v", name, io.ErrClosedPipe, err)
+		}
+		go io.Copy(ioutil.Discard, client)
+		server.Close()
+	}
+}
+
+func TestObfsConnReadFrom(t *testing.T) {
+	for name, config := range map[string]ObfsConfig{
+		"default":        {RecordLayer: TLSRecordLayer{}},
+		"max frame size": {RecordLayer: TLSRecordLayer{}, MaxFrameSize: 1000},
+	} {
+		client, server := makeObfsConnPairWithConfig(t, config)
+		sent := make([]byte, 100000)
+		rand.Read(sent)
+
+		go func() {
+			// hides the WriterTo of bytes.Reader, which io.Copy would use instead
+			n, err := client.ReadFrom(struct{ io.Reader }{bytes.NewReader(sent)})
+			if err != nil || n != int64(len(sent)) {
+				t.Errorf("%v: expecting %v bytes to be sent, got %v: %v", name, len(sent), n, err)
+			}
+			client.CloseWrite()
+		}()
+		var received []byte
+		for {
+			f, err := server.fr.ReadFrame()
+			if err != nil {
+				t.Fatalf("%v: %v", name, err)
+			}
+			if f.IsFin() {
+				break
+			}
+			if config.MaxFrameSize > 0 && len(f.Payload) > config.MaxFrameSize {
+				t.Fatalf("%v: frame of %v bytes of payload exceeds the MaxFrameSize", name, len(f.Payload))
+			}
+			received = append(received, f.Payload...)
+		}
+		if !bytes.Equal(received, sent) {
+			t.Errorf("%v: received %v bytes that don't match the %v sent", name, len(received), len(sent))
+		}
+		go io.Copy(ioutil.Discard, client)
+		server.Close()
+	}
+
+	t.Run("read error", func(t *testing.T) {
+		client, server := makeObfsConnPair(t, TLSRecordLayer{})
+		readErr := errors.New("read error")
+		go io.Copy(ioutil.Discard, server)
+		src := io.MultiReader(bytes.NewReader([]byte("partial")), &errReader{readErr})
+		if n, err := client.ReadFrom(src); err != readErr || n != 7 {
+			t.Errorf("expecting 7 bytes sent and %v, got %v and %v", readErr, n, err)
+		}
+		client.Close()
+	})
+}
+
+func TestObfsConnWriteTo(t *testing.T) {
+	client, server := makeObfsConnPair(t, TLSRecordLayer{})
+	sent := make([]byte, 100000)
+	rand.Read(sent)
+	go func() {
+		client.Write(sent)
+		client.CloseWrite()
+	}()
+	var received bytes.Buffer
+	// hides the ReaderFrom of bytes.Buffer, which io.Copy would use instead
+	n, err := server.WriteTo(struct{ io.Writer }{&received})
+	if err != nil || n != int64(len(sent)) {
+		t.Errorf("expecting %v bytes to be received, got %v: %v", len(sent), n, err)
+	}
+	if !bytes.Equal(received.Bytes(), sent) {
+		t.Error("received bytes don't match the ones sent")
+	}
+	if n, err := server.WriteTo(&received); n != 0 || err != nil {
+		t.Errorf("expecting nothing more after the stream is closed, got %v bytes: %v", n, err)
+	}
+	go io.Copy(ioutil.Discard, client)
+	server.Close()
+
+	t.Run("reset", func(t *testing.T) {
+		client, server := makeObfsConnPair(t, TLSRecordLayer{})
+		go func() {
+			client.Write([]byte("partial"))
+			client.fw.WriteFrame(NewRstFrame(5, 1, RstCancel))
+		}()
+		var received bytes.Buffer
+		if n, err := server.WriteTo(&received); !errors.Is(err, ErrStreamReset) || n != 7 {
+			t.Errorf("expecting 7 bytes and %v, got %v and %v", ErrStreamReset, n, err)
+		}
+	})
+
+	t.Run("after a short read", func(t *testing.T) {
+		client, server := makeObfsConnPair(t, TLSRecordLayer{})
+		go func() {
+			client.Write([]byte("hello world"))
+			client.CloseWrite()
+		}()
+		buf := make([]byte, 5)
+		io.ReadFull(server, buf)
+		var rest bytes.Buffer
+		if _, err := server.WriteTo(&rest); err != nil || rest.String() != " world" {
+			t.Errorf("expecting what is left of the payload, got %q: %v", rest.String(), err)
+		}
+	})
+}
+
+type errReader struct{ err error }
+
+func (r *errReader) Read([]byte) (int, error) { return 0, r.err }
+
+// discardConn is a net.Conn that throws away everything written to it
+type discardConn struct{ net.Conn }
+
+func (discardConn) Write(b []byte) (int, error) { return len(b), nil }
+
+func benchmarkObfsConnSend(b *testing.B, send func(c *ObfsConn, src io.Reader)) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+	c, _ := NewObfsConn(discardConn{}, obfuscator, 1)
+	data := make([]byte, 1<<20)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		send(c, struct{ io.Reader }{bytes.NewReader(data)})
+	}
+}
+
+func BenchmarkObfsConn_Write(b *testing.B) {
+	// what io.Copy does without a ReaderFrom
+	buf := make([]byte, 32*1024)
+	benchmarkObfsConnSend(b, func(c *ObfsConn, src io.Reader) {
+		io.CopyBuffer(struct{ io.Writer }{c}, src, buf)
+	})
+}
+
+func BenchmarkObfsConn_ReadFrom(b *testing.B) {
+	benchmarkObfsConnSend(b, func(c *ObfsConn, src io.Reader) {
+		c.ReadFrom(src)
+	})
+}
+
+func TestObfsConnDeadline(t *testing.T) {
+	client, server := makeObfsConnPair(t, TLSRecordLayer{})
+	server.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := server.Read(make([]byte, 10))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expecting a timeout, got %v", err)
+	}
+
+	// the conn can still be read from once the deadline is lifted
+	server.SetReadDeadline(time.Time{})
+	go client.Write([]byte("late"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "late" {
+		t.Errorf("expecting to read after a timeout, got %q: %v", buf, err)
+	}
+}
+
+func TestObfsConnReset(t *testing.T) {
+	client, server := makeObfsConnPair(t, TLSRecordLayer{})
+	go client.fw.WriteFrame(NewRstFrame(5, 0, RstCancel))
+	if _, err := server.Read(make([]byte, 10)); !errors.Is(err, ErrStreamReset) {
+		t.Errorf("expecting %v, got %v", ErrStreamReset, err)
+	}
+}
+
+func TestObfsConnIgnoresHandshake(t *testing.T) {
+	client, server := makeObfsConnPair(t, TLSRecordLayer{})
+	client.streamID, server.streamID = HandshakeStreamID, HandshakeStreamID
+	go func() {
+		client.fw.WriteFrame(NewHandshakeFrame(100, []byte("hello")))
+		client.Write([]byte("data"))
+	}()
+	buf := make([]byte, 10)
+	n, err := server.Read(buf)
+	if err != nil || string(buf[:n]) != "data" {
+		t.Errorf("expecting the handshake frame to be skipped over, got %q: %v", buf[:n], err)
+	}
+}
+
+func TestObfsConnRecordLayerUnsupported(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(WebSocketRecordLayer{}))
+	conn, _ := net.Pipe()
+	if _, err := NewObfsConn(conn, obfuscator, 1); !errors.Is(err, ErrRecordLayerUnsupported) {
+		t.Errorf("expecting %v, got %v", ErrRecordLayerUnsupported, err)
+	}
+}
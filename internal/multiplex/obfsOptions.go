@@ -0,0 +1,113 @@
+package multiplex
+
+import "io"
+
+// ObfsOption sets one of the fields of the ObfsConfig an Obfuscator is made by GenerateObfs with. Options not covered
+// by one can be set through GenerateObfsWithConfig
+type ObfsOption func(*ObfsConfig)
+
+// WithConfig replaces the whole config, so it should come before any other option
+func WithConfig(config ObfsConfig) ObfsOption {
+	return func(c *ObfsConfig) { *c = config }
+}
+
+// WithRecordLayer sets ObfsConfig.RecordLayer
+func WithRecordLayer(recordLayer RecordLayer) ObfsOption {
+	return func(c *ObfsConfig) { c.RecordLayer = recordLayer }
+}
+
+// WithProtocolVersion sets ObfsConfig.ProtocolVersion, which from PROTOCOL_V3 also decides whether the keys are
+// derived with HKDF
+func WithProtocolVersion(version byte) ObfsOption {
+	return func(c *ObfsConfig) { c.ProtocolVersion = version }
+}
+
+// WithRandSource sets ObfsConfig.Rand
+func WithRandSource(random io.Reader) ObfsOption {
+	return func(c *ObfsConfig) { c.Rand = random }
+}
+
+// WithReplayWindow sets ObfsConfig.ReplayWindow
+func WithReplayWindow(size int) ObfsOption {
+	return func(c *ObfsConfig) { c.ReplayWindow = size }
+}
+
+// WithStrictSeq sets ObfsConfig.StrictSeq
+func WithStrictSeq() ObfsOption {
+	return func(c *ObfsConfig) { c.StrictSeq = true }
+}
+
+// WithRejectEmptyData sets ObfsConfig.RejectEmptyData
+func WithRejectEmptyData() ObfsOption {
+	return func(c *ObfsConfig) { c.RejectEmptyData = true }
+}
+
+// WithNoncePrefix sets ObfsConfig.NoncePrefix
+func WithNoncePrefix(prefix []byte) ObfsOption {
+	return func(c *ObfsConfig) { c.NoncePrefix = prefix }
+}
+
+// WithPadding sets ObfsConfig.Padding
+func WithPadding(policy PaddingPolicy) ObfsOption {
+	return func(c *ObfsConfig) { c.Padding = policy }
+}
+
+// WithRole sets ObfsConfig.Role
+func WithRole(role Role) ObfsOption {
+	return func(c *ObfsConfig) { c.Role = role }
+}
+
+// WithDirectionalKeys sets ObfsConfig.DirectionalKeys
+func WithDirectionalKeys() ObfsOption {
+	return func(c *ObfsConfig) { c.DirectionalKeys = true }
+}
+
+// WithMetrics sets ObfsConfig.Metrics
+func WithMetrics(metrics Metrics) ObfsOption {
+	return func(c *ObfsConfig) { c.Metrics = metrics }
+}
+
+// WithOnDeobfsError sets ObfsConfig.OnDeobfsError
+func WithOnDeobfsError(onError func(err error, inLen int, prefix []byte)) ObfsOption {
+	return func(c *ObfsConfig) { c.OnDeobfsError = onError }
+}
+
+// WithTap sets ObfsConfig.Tap
+func WithTap(tap func(direction TapDirection, raw []byte)) ObfsOption {
+	return func(c *ObfsConfig) { c.Tap = tap }
+}
+
+// WithTagLen sets ObfsConfig.TagLen
+func WithTagLen(tagLen int) ObfsOption {
+	return func(c *ObfsConfig) { c.TagLen = tagLen }
+}
+
+// WithRekeyAfter sets ObfsConfig.RekeyAfterBytes and RekeyAfterFrames. Either can be 0 to leave it unlimited
+func WithRekeyAfter(bytes, frames uint64) ObfsOption {
+	return func(c *ObfsConfig) {
+		c.RekeyAfterBytes = bytes
+		c.RekeyAfterFrames = frames
+	}
+}
+
+// WithHeaderCipher sets ObfsConfig.HeaderCipher
+func WithHeaderCipher(headerCipher HeaderCipher) ObfsOption {
+	return func(c *ObfsConfig) { c.HeaderCipher = headerCipher }
+}
+
+// WithHeaderEncryption(false) sets ObfsConfig.HeaderCipher to HEADER_CIPHER_NONE, which leaves headers in the clear
+// for debugging and is INSECURE. WithHeaderEncryption(true) sets it back to the default HEADER_CIPHER_SALSA20
+func WithHeaderEncryption(enabled bool) ObfsOption {
+	return func(c *ObfsConfig) {
+		if enabled {
+			c.HeaderCipher = HEADER_CIPHER_SALSA20
+		} else {
+			c.HeaderCipher = HEADER_CIPHER_NONE
+		}
+	}
+}
+
+// WithAdditionalData sets ObfsConfig.AdditionalData
+func WithAdditionalData(ad []byte) ObfsOption {
+	return func(c *ObfsConfig) { c.AdditionalData = ad }
+}
@@ -4,8 +4,14 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/salsa20"
+	"math"
 	"math/rand"
+	"net"
 	"reflect"
 	"testing"
 	"testing/quick"
@@ -20,6 +26,8 @@ func TestGenerateObfs(t *testing.T) {
 		f := &Frame{}
 		_testFrame, _ := quick.Value(reflect.TypeOf(f), rand.New(rand.NewSource(42)))
 		testFrame := _testFrame.Interface().(*Frame)
+		// only PROTOCOL_V8 headers have room for 64 bit StreamIDs
+		testFrame.StreamID &= math.MaxUint32
 		i, err := obfuscator.Obfs(testFrame, obfsBuf)
 		if err != nil {
 			ct.Error("failed to obfs ", err)
@@ -39,7 +47,7 @@ func TestGenerateObfs(t *testing.T) {
 	}
 
 	t.Run("plain", func(t *testing.T) {
-		obfuscator, err := GenerateObfs(E_METHOD_PLAIN, sessionKey, true)
+		obfuscator, err := GenerateObfs(E_METHOD_PLAIN, sessionKey, WithRecordLayer(TLSRecordLayer{}))
 		if err != nil {
 			t.Errorf("failed to generate obfuscator %v", err)
 		} else {
@@ -47,7 +55,7 @@ func TestGenerateObfs(t *testing.T) {
 		}
 	})
 	t.Run("plain no record layer", func(t *testing.T) {
-		obfuscator, err := GenerateObfs(E_METHOD_PLAIN, sessionKey, false)
+		obfuscator, err := GenerateObfs(E_METHOD_PLAIN, sessionKey, WithRecordLayer(NoRecordLayer{}))
 		if err != nil {
 			t.Errorf("failed to generate obfuscator %v", err)
 		} else {
@@ -55,7 +63,7 @@ func TestGenerateObfs(t *testing.T) {
 		}
 	})
 	t.Run("aes-gcm", func(t *testing.T) {
-		obfuscator, err := GenerateObfs(E_METHOD_AES_GCM, sessionKey, true)
+		obfuscator, err := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
 		if err != nil {
 			t.Errorf("failed to generate obfuscator %v", err)
 		} else {
@@ -63,7 +71,47 @@ func TestGenerateObfs(t *testing.T) {
 		}
 	})
 	t.Run("aes-gcm no record layer", func(t *testing.T) {
-		obfuscator, err := GenerateObfs(E_METHOD_AES_GCM, sessionKey, false)
+		obfuscator, err := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(NoRecordLayer{}))
+		if err != nil {
+			t.Errorf("failed to generate obfuscator %v", err)
+		} else {
+			run(obfuscator, t)
+		}
+	})
+	t.Run("aes-128-gcm", func(t *testing.T) {
+		obfuscator, err := GenerateObfs(E_METHOD_AES_128_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+		if err != nil {
+			t.Errorf("failed to generate obfuscator %v", err)
+		} else {
+			run(obfuscator, t)
+		}
+	})
+	t.Run("aes-192-gcm", func(t *testing.T) {
+		obfuscator, err := GenerateObfs(E_METHOD_AES_192_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+		if err != nil {
+			t.Errorf("failed to generate obfuscator %v", err)
+		} else {
+			run(obfuscator, t)
+		}
+	})
+	t.Run("aes-192-gcm 24 byte key", func(t *testing.T) {
+		obfuscator, err := GenerateObfs(E_METHOD_AES_192_GCM, sessionKey[:24], WithRecordLayer(TLSRecordLayer{}))
+		if err != nil {
+			t.Errorf("failed to generate obfuscator %v", err)
+		} else {
+			run(obfuscator, t)
+		}
+	})
+	t.Run("aes-192-gcm 24 byte key v3", func(t *testing.T) {
+		obfuscator, err := GenerateObfsWithConfig(E_METHOD_AES_192_GCM, sessionKey[:24], ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V3})
+		if err != nil {
+			t.Errorf("failed to generate obfuscator %v", err)
+		} else {
+			run(obfuscator, t)
+		}
+	})
+	t.Run("aes-gcm-siv", func(t *testing.T) {
+		obfuscator, err := GenerateObfs(E_METHOD_AES_GCM_SIV, sessionKey, WithRecordLayer(TLSRecordLayer{}))
 		if err != nil {
 			t.Errorf("failed to generate obfuscator %v", err)
 		} else {
@@ -71,7 +119,39 @@ func TestGenerateObfs(t *testing.T) {
 		}
 	})
 	t.Run("chacha20-poly1305", func(t *testing.T) {
-		obfuscator, err := GenerateObfs(E_METHOD_CHACHA20_POLY1305, sessionKey, true)
+		obfuscator, err := GenerateObfs(E_METHOD_CHACHA20_POLY1305, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+		if err != nil {
+			t.Errorf("failed to generate obfuscator %v", err)
+		} else {
+			run(obfuscator, t)
+		}
+	})
+	t.Run("xchacha20-poly1305", func(t *testing.T) {
+		obfuscator, err := GenerateObfs(E_METHOD_XCHACHA20_POLY1305, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+		if err != nil {
+			t.Errorf("failed to generate obfuscator %v", err)
+		} else {
+			run(obfuscator, t)
+		}
+	})
+	t.Run("xchacha20-poly1305 no record layer", func(t *testing.T) {
+		obfuscator, err := GenerateObfs(E_METHOD_XCHACHA20_POLY1305, sessionKey, WithRecordLayer(NoRecordLayer{}))
+		if err != nil {
+			t.Errorf("failed to generate obfuscator %v", err)
+		} else {
+			run(obfuscator, t)
+		}
+	})
+	t.Run("xchacha20-poly1305 v2", func(t *testing.T) {
+		obfuscator, err := GenerateObfsWithConfig(E_METHOD_XCHACHA20_POLY1305, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V2})
+		if err != nil {
+			t.Errorf("failed to generate obfuscator %v", err)
+		} else {
+			run(obfuscator, t)
+		}
+	})
+	t.Run("aes-128-gcm v3", func(t *testing.T) {
+		obfuscator, err := GenerateObfsWithConfig(E_METHOD_AES_128_GCM, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V3})
 		if err != nil {
 			t.Errorf("failed to generate obfuscator %v", err)
 		} else {
@@ -79,171 +159,1713 @@ func TestGenerateObfs(t *testing.T) {
 		}
 	})
 	t.Run("unknown encryption method", func(t *testing.T) {
-		_, err := GenerateObfs(0xff, sessionKey, true)
+		_, err := GenerateObfs(0xff, sessionKey, WithRecordLayer(TLSRecordLayer{}))
 		if err == nil {
 			t.Errorf("unknown encryption mehtod error expected")
 		}
 	})
 	t.Run("bad key length", func(t *testing.T) {
-		_, err := GenerateObfs(0xff, sessionKey[:31], true)
+		_, err := GenerateObfs(0xff, sessionKey[:31], WithRecordLayer(TLSRecordLayer{}))
 		if err == nil {
 			t.Errorf("bad key length error expected")
 		}
 	})
+	t.Run("short and long keys", func(t *testing.T) {
+		for _, keyLen := range []int{16, 64} {
+			key := make([]byte, keyLen)
+			rand.Read(key)
+			obfuscator, err := GenerateObfs(E_METHOD_AES_GCM, key, WithRecordLayer(TLSRecordLayer{}))
+			if err != ErrBadSessionKeySize {
+				t.Errorf("%v byte key: expecting error %v, got %v", keyLen, ErrBadSessionKeySize, err)
+			}
+			if obfuscator != nil {
+				t.Errorf("%v byte key: expecting nil obfuscator", keyLen)
+			}
+		}
+	})
 }
 
-func BenchmarkObfs(b *testing.B) {
-	testPayload := make([]byte, 1024)
-	rand.Read(testPayload)
+func TestAuthenticatedHeader(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
 	testFrame := &Frame{
-		1,
-		0,
-		0,
-		testPayload,
+		StreamID: 1,
+		Seq:      0,
+		Closing:  C_NOOP,
+		Payload:  []byte("authenticated header"),
+	}
+	obfsBuf := make([]byte, 512)
+
+	v1, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}})
+	v2, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V2})
+
+	for _, headerByte := range []int{12, 13} {
+		n, _ := v2.Obfs(testFrame, obfsBuf)
+		// salsa20 is a stream cipher so flipping a bit of the scrambled header flips the same bit of the plain header
+		obfsBuf[5+headerByte] ^= 0x01
+		if _, err := v2.Deobfs(obfsBuf[:n]); err == nil {
+			t.Errorf("tampering with header[%v] should fail deobfs in v2", headerByte)
+		}
+	}
+
+	n, _ := v1.Obfs(testFrame, obfsBuf)
+	if _, err := v2.Deobfs(obfsBuf[:n]); err == nil {
+		t.Error("v2 deobfser should not accept v1 frames")
+	}
+	n, _ = v2.Obfs(testFrame, obfsBuf)
+	resultFrame, err := v2.Deobfs(obfsBuf[:n])
+	if err != nil {
+		t.Errorf("v2 round trip failed: %v", err)
+	} else if !bytes.Equal(resultFrame.Payload, testFrame.Payload) || resultFrame.Closing != testFrame.Closing {
+		t.Error("expecting", testFrame, "got", resultFrame)
+	}
+
+	_, err = GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{ProtocolVersion: 0xff})
+	if err == nil {
+		t.Error("unknown protocol version error expected")
+	}
+}
+
+func TestPooledDeobfs(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfsBuf := make([]byte, 2048)
+
+	for _, method := range []Method{E_METHOD_PLAIN, E_METHOD_AES_GCM, E_METHOD_XCHACHA20_POLY1305} {
+		obfuscator, _ := GenerateObfsWithConfig(method, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, PooledDeobfs: true})
+		for _, payloadLen := range []int{1000, 0, 5, 1500, 200} {
+			testFrame := &Frame{
+				StreamID: 1,
+				Seq:      uint64(payloadLen),
+				Closing:  C_NOOP,
+				Payload:  make([]byte, payloadLen),
+			}
+			rand.Read(testFrame.Payload)
+			n, _ := obfuscator.Obfs(testFrame, obfsBuf)
+			resultFrame, err := obfuscator.Deobfs(obfsBuf[:n])
+			if err != nil {
+				t.Errorf("method %v: failed to deobfs: %v", method, err)
+				continue
+			}
+			if !bytes.Equal(resultFrame.Payload, testFrame.Payload) || resultFrame.Seq != testFrame.Seq {
+				t.Errorf("method %v: expecting %v, got %v", method, testFrame, resultFrame)
+			}
+			ReleaseFrame(resultFrame)
+		}
+
+		testFrame := &Frame{1, 0, 0, make([]byte, 1024)}
+		n, _ := obfuscator.Obfs(testFrame, obfsBuf)
+		allocs := testing.AllocsPerRun(100, func() {
+			f, _ := obfuscator.Deobfs(obfsBuf[:n])
+			ReleaseFrame(f)
+		})
+		if allocs != 0 {
+			t.Errorf("method %v: pooled deobfs should not allocate in steady state, got %v allocs", method, allocs)
+		}
 	}
+}
 
+func TestDeobfsInto(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
 	obfsBuf := make([]byte, 2048)
 
+	for _, version := range []byte{PROTOCOL_V1, PROTOCOL_V4} {
+		obfuscator, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: version})
+		f := AcquireFrame()
+		for _, payloadLen := range []int{1000, 0, 5, 1500, 200} {
+			testFrame := &Frame{StreamID: 1, Seq: uint64(payloadLen), Closing: FlagFin, Payload: make([]byte, payloadLen)}
+			rand.Read(testFrame.Payload)
+			n, _ := obfuscator.Obfs(testFrame, obfsBuf)
+			if err := obfuscator.DeobfsInto(obfsBuf[:n], f); err != nil {
+				t.Fatalf("v%v: failed to deobfs: %v", version+1, err)
+			}
+			if !bytes.Equal(f.Payload, testFrame.Payload) || f.Seq != testFrame.Seq || f.Closing != testFrame.Closing {
+				t.Errorf("v%v: expecting %v, got %v", version+1, testFrame, f)
+			}
+		}
+
+		n, _ := obfuscator.Obfs(&Frame{1, 0, 0, make([]byte, 1024)}, obfsBuf)
+		allocs := testing.AllocsPerRun(100, func() {
+			obfuscator.DeobfsInto(obfsBuf[:n], f)
+		})
+		if allocs != 0 {
+			t.Errorf("v%v: deobfsing into the same frame should not allocate, got %v allocs", version+1, allocs)
+		}
+		ReleaseFrame(f)
+	}
+}
+
+func TestDeobfsInPlace(t *testing.T) {
 	var key [32]byte
 	rand.Read(key[:])
-	b.Run("AES256GCM", func(b *testing.B) {
-		c, _ := aes.NewCipher(key[:])
-		payloadCipher, _ := cipher.NewGCM(c)
+	c, _ := aes.NewCipher(key[:])
+	aesGCM, _ := cipher.NewGCM(c)
+	xChaCha, _ := chacha20poly1305.NewX(key[:])
 
-		obfs := MakeObfs(key, payloadCipher, true)
-		b.ResetTimer()
-		for i := 0; i < b.N; i++ {
-			n, err := obfs(testFrame, obfsBuf)
+	ciphers := map[string]cipher.AEAD{
+		"plain":              nil,
+		"aes-gcm":            aesGCM,
+		"xchacha20-poly1305": xChaCha,
+	}
+	for name, payloadCipher := range ciphers {
+		for _, config := range []ObfsConfig{
+			{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V2},
+			{RecordLayer: NoRecordLayer{}, ProtocolVersion: PROTOCOL_V2},
+			{RecordLayer: WebSocketRecordLayer{Mask: true}, ProtocolVersion: PROTOCOL_V2},
+		} {
+			obfs := MakeObfs(key, payloadCipher, config)
+			deobfs := MakeDeobfsInPlace(key, payloadCipher, config)
+
+			testFrame := &Frame{
+				StreamID: 1,
+				Seq:      2,
+				Closing:  C_STREAM,
+				Payload:  []byte("in place"),
+			}
+			obfsBuf := make([]byte, 512)
+			n, _ := obfs(testFrame, obfsBuf)
+			resultFrame, err := deobfs(obfsBuf[:n])
 			if err != nil {
-				b.Error(err)
-				return
+				t.Errorf("%v: failed to deobfs in place: %v", name, err)
+				continue
+			}
+			if !bytes.Equal(resultFrame.Payload, testFrame.Payload) || resultFrame.Closing != testFrame.Closing {
+				t.Errorf("%v: expecting %v, got %v", name, testFrame, resultFrame)
+			}
+			// a slice of obfsBuf ends at the end of obfsBuf's backing array
+			pld := resultFrame.Payload
+			if &pld[:cap(pld)][cap(pld)-1] != &obfsBuf[len(obfsBuf)-1] {
+				t.Errorf("%v: payload should point into the input", name)
 			}
-			b.SetBytes(int64(n))
 		}
-	})
-	b.Run("AES128GCM", func(b *testing.B) {
-		c, _ := aes.NewCipher(key[:16])
-		payloadCipher, _ := cipher.NewGCM(c)
+	}
+}
 
-		obfs := MakeObfs(key, payloadCipher, true)
-		b.ResetTimer()
-		for i := 0; i < b.N; i++ {
-			n, err := obfs(testFrame, obfsBuf)
-			if err != nil {
-				b.Error(err)
-				return
+func TestObfsAliasedPayload(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	payload := make([]byte, 100)
+	rand.Read(payload)
+
+	for _, method := range []Method{E_METHOD_PLAIN, E_METHOD_AES_GCM, E_METHOD_CHACHA20_POLY1305, E_METHOD_XCHACHA20_POLY1305} {
+		for _, recordLayer := range []RecordLayer{TLSRecordLayer{}, NoRecordLayer{}} {
+			obfuscator, _ := GenerateObfs(method, sessionKey, WithRecordLayer(recordLayer))
+			rlLen := recordLayer.HeaderLen(0)
+			explicitNonceLen := 0
+			if method == E_METHOD_XCHACHA20_POLY1305 {
+				explicitNonceLen = chacha20poly1305.NonceSizeX
+			}
+			// at the very start of buf, overlapping the record layer and the header, and exactly where it will be
+			// encrypted
+			for _, offset := range []int{0, 3, rlLen + HEADER_LEN + explicitNonceLen} {
+				obfsBuf := make([]byte, 512)
+				copy(obfsBuf[offset:], payload)
+				testFrame := &Frame{
+					StreamID: 1,
+					Seq:      2,
+					Closing:  C_NOOP,
+					Payload:  obfsBuf[offset : offset+len(payload)],
+				}
+				n, err := obfuscator.Obfs(testFrame, obfsBuf)
+				if err != nil {
+					t.Errorf("method %v offset %v: failed to obfs: %v", method, offset, err)
+					continue
+				}
+				resultFrame, err := obfuscator.Deobfs(obfsBuf[:n])
+				if err != nil {
+					t.Errorf("method %v offset %v: failed to deobfs: %v", method, offset, err)
+					continue
+				}
+				if !bytes.Equal(resultFrame.Payload, payload) {
+					t.Errorf("method %v offset %v: payload mismatch", method, offset)
+				}
 			}
-			b.SetBytes(int64(n))
 		}
-	})
-	b.Run("plain", func(b *testing.B) {
-		obfs := MakeObfs(key, nil, true)
-		b.ResetTimer()
-		for i := 0; i < b.N; i++ {
-			n, err := obfs(testFrame, obfsBuf)
+	}
+}
+
+func TestMaxOverhead(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	for _, method := range SupportedMethods() {
+		for _, recordLayer := range []bool{false, true} {
+			config := ObfsConfig{}
+			if recordLayer {
+				config.RecordLayer = TLSRecordLayer{}
+			}
+			obfuscator, err := GenerateObfsWithConfig(method, sessionKey, config)
+			if err != nil {
+				t.Fatalf("%v: %v", method, err)
+			}
+			n, err := obfuscator.Obfs(&Frame{StreamID: 1}, make([]byte, 512))
 			if err != nil {
-				b.Error(err)
-				return
+				t.Fatalf("%v: %v", method, err)
+			}
+			if maxOverhead := MaxOverhead(method, recordLayer); maxOverhead != n {
+				t.Errorf("%v with record layer %v: expecting a max overhead of %v, got %v", method, recordLayer, n, maxOverhead)
+			}
+			for _, payloadLen := range []int{1, 8, 1000} {
+				n, _ := obfuscator.Obfs(&Frame{StreamID: 1, Payload: make([]byte, payloadLen)}, make([]byte, 2000))
+				if n > payloadLen+MaxOverhead(method, recordLayer) {
+					t.Errorf("%v: a payload of %v takes more than the max overhead, %v bytes", method, payloadLen, n)
+				}
+			}
+		}
+	}
+	if expected := 5 + HEADER_LEN + 16; MaxOverhead(E_METHOD_AES_GCM, true) != expected {
+		t.Errorf("expecting aes-gcm frames in TLS records to take %v bytes more, got %v", expected, MaxOverhead(E_METHOD_AES_GCM, true))
+	}
+	if MaxOverhead(Method(0xff), false) != -1 {
+		t.Error("expecting -1 for an unknown method")
+	}
+	// it's worked out without an Obfuscator, so without keys or ciphers being allocated
+	if allocs := testing.AllocsPerRun(10, func() { MaxOverhead(E_METHOD_AES_GCM, true) }); allocs != 0 {
+		t.Errorf("expecting no allocations, got %v", allocs)
+	}
+}
+
+func TestOverheadAndMaxPayload(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+
+	for _, method := range []Method{E_METHOD_PLAIN, E_METHOD_AES_GCM, E_METHOD_XCHACHA20_POLY1305} {
+		for _, recordLayer := range []RecordLayer{TLSRecordLayer{}, TLSRecordLayer{CCSProbability: 1}, NoRecordLayer{}, WebSocketRecordLayer{Mask: true}, LengthPrefixRecordLayer{Width: 4}} {
+			obfuscator, _ := GenerateObfsWithConfig(method, sessionKey, ObfsConfig{RecordLayer: recordLayer})
+			bufLen := 300
+			maxPayload := obfuscator.MaxPayload(bufLen)
+			if maxPayload+obfuscator.Overhead() != bufLen {
+				t.Errorf("method %v: max payload %v and overhead %v don't add up to %v", method, maxPayload, obfuscator.Overhead(), bufLen)
+			}
+
+			buf := make([]byte, bufLen)
+			n, err := obfuscator.Obfs(&Frame{Payload: make([]byte, maxPayload)}, buf)
+			if err != nil || n != bufLen {
+				t.Errorf("method %v: a frame with the max payload should fill the buffer exactly, got %v %v", method, n, err)
+			}
+			_, err = obfuscator.Obfs(&Frame{Payload: make([]byte, maxPayload+1)}, buf)
+			if err == nil {
+				t.Errorf("method %v: a frame with a payload larger than max payload should not fit", method)
+			}
+
+			if obfuscator.MaxPayload(obfuscator.Overhead()-1) != -1 {
+				t.Errorf("method %v: a buffer smaller than the overhead should not fit any frame", method)
+			}
+		}
+	}
+
+	t.Run("plain padding", func(t *testing.T) {
+		obfuscator, _ := GenerateObfs(E_METHOD_PLAIN, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+		buf := make([]byte, 100)
+		for payloadLen := 0; payloadLen < 8; payloadLen++ {
+			n, _ := obfuscator.Obfs(&Frame{Payload: make([]byte, payloadLen)}, buf)
+			if n != obfuscator.Overhead()+8 {
+				t.Errorf("a %v byte payload should be padded to 8 bytes, got frame of %v bytes", payloadLen, n)
+			}
+		}
+		// an empty payload still needs 8 bytes of padding
+		for bufLen := obfuscator.Overhead(); bufLen < obfuscator.Overhead()+8; bufLen++ {
+			if obfuscator.MaxPayload(bufLen) != -1 {
+				t.Errorf("a %v byte buffer cannot hold even a padded empty payload", bufLen)
 			}
-			b.SetBytes(int64(n))
+		}
+		if obfuscator.MaxPayload(obfuscator.Overhead()+8) != 8 {
+			t.Errorf("expecting max payload 8, got %v", obfuscator.MaxPayload(obfuscator.Overhead()+8))
 		}
 	})
-	b.Run("chacha20Poly1305", func(b *testing.B) {
-		payloadCipher, _ := chacha20poly1305.New(key[:16])
 
-		obfs := MakeObfs(key, payloadCipher, true)
-		b.ResetTimer()
-		for i := 0; i < b.N; i++ {
-			n, err := obfs(testFrame, obfsBuf)
+	t.Run("plain trailers", func(t *testing.T) {
+		for _, c := range []struct {
+			name   string
+			config ObfsConfig
+		}{
+			{"checksum", ObfsConfig{PlainChecksum: true}},
+			{"mac", ObfsConfig{PlainMAC: true}},
+			{"header nonce", ObfsConfig{ProtocolVersion: PROTOCOL_V5}},
+			{"checksum and header nonce", ObfsConfig{PlainChecksum: true, ProtocolVersion: PROTOCOL_V5}},
+		} {
+			c.config.RecordLayer = TLSRecordLayer{}
+			obfuscator, err := GenerateObfsWithConfig(E_METHOD_PLAIN, sessionKey, c.config)
 			if err != nil {
-				b.Error(err)
-				return
+				t.Fatalf("%v: %v", c.name, err)
+			}
+			buf := make([]byte, 100)
+			for bufLen := obfuscator.Overhead() - 1; bufLen < obfuscator.Overhead()+12; bufLen++ {
+				maxPayload := obfuscator.MaxPayload(bufLen)
+				if maxPayload == -1 {
+					if _, err := obfuscator.Obfs(&Frame{}, buf[:bufLen]); err == nil {
+						t.Errorf("%v: an empty payload fits in %v bytes, but max payload is -1", c.name, bufLen)
+					}
+					continue
+				}
+				if n, err := obfuscator.Obfs(&Frame{Payload: make([]byte, maxPayload)}, buf[:bufLen]); err != nil || n > bufLen {
+					t.Errorf("%v: max payload %v doesn't fit in %v bytes: %v", c.name, maxPayload, bufLen, err)
+				}
+				if _, err := obfuscator.Obfs(&Frame{Payload: make([]byte, maxPayload+1)}, buf[:bufLen]); err == nil {
+					t.Errorf("%v: a payload longer than max payload %v fits in %v bytes", c.name, maxPayload, bufLen)
+				}
 			}
-			b.SetBytes(int64(n))
 		}
 	})
 }
 
-func BenchmarkDeobfs(b *testing.B) {
-	testPayload := make([]byte, 1024)
-	rand.Read(testPayload)
+func TestObfsErrors(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
 	testFrame := &Frame{
-		1,
-		0,
-		0,
-		testPayload,
+		StreamID: 1,
+		Seq:      0,
+		Closing:  C_NOOP,
+		Payload:  make([]byte, 20),
 	}
+	obfsBuf := make([]byte, 512)
 
-	obfsBuf := make([]byte, 2048)
+	plain, _ := GenerateObfs(E_METHOD_PLAIN, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+	aesGCM, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+
+	if _, err := aesGCM.Obfs(testFrame, obfsBuf[:20]); !errors.Is(err, ErrBufferTooSmall) {
+		t.Errorf("expecting %v, got %v", ErrBufferTooSmall, err)
+	}
+
+	if _, err := aesGCM.Deobfs(obfsBuf[:10]); !errors.Is(err, ErrInputTooShort) {
+		t.Errorf("expecting %v, got %v", ErrInputTooShort, err)
+	}
+
+	n, _ := plain.Obfs(testFrame, obfsBuf)
+	// flipping the scrambled extraLen flips the plain one
+	obfsBuf[5+13] ^= 0xff
+	if _, err := plain.Deobfs(obfsBuf[:n]); !errors.Is(err, ErrExtraLenTooLarge) {
+		t.Errorf("expecting %v, got %v", ErrExtraLenTooLarge, err)
+	}
+
+	n, _ = aesGCM.Obfs(testFrame, obfsBuf)
+	obfsBuf[5+HEADER_LEN] ^= 0xff
+	_, err := aesGCM.Deobfs(obfsBuf[:n])
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("expecting %v, got %v", ErrAuthFailed, err)
+	}
+	var authErr *AuthFailedError
+	if !errors.As(err, &authErr) {
+		t.Errorf("expecting an AuthFailedError, got %v", err)
+	} else if authErr.StreamID != testFrame.StreamID || authErr.Seq != testFrame.Seq {
+		t.Errorf("expecting auth failure on stream %v seq %v, got stream %v seq %v",
+			testFrame.StreamID, testFrame.Seq, authErr.StreamID, authErr.Seq)
+	}
+	if errors.Is(err, ErrInputTooShort) || errors.Is(err, ErrExtraLenTooLarge) {
+		t.Errorf("auth failure should not look like a framing error")
+	}
+
+	if _, err := GenerateObfs(0xff, sessionKey, WithRecordLayer(TLSRecordLayer{})); !errors.Is(err, ErrUnknownMethod) {
+		t.Errorf("expecting %v, got %v", ErrUnknownMethod, err)
+	}
+}
 
+// boundsRecordLayer claims whatever offset and length it's told to, as a broken RecordLayer from outside the package
+// might
+type boundsRecordLayer struct{ offset, length int }
+
+func (boundsRecordLayer) HeaderLen(int) int    { return 0 }
+func (boundsRecordLayer) Wrap([]byte, int) int { return 0 }
+func (b boundsRecordLayer) Unwrap([]byte) (offset, length int, err error) {
+	return b.offset, b.length, nil
+}
+
+func TestDeobfsBoundaries(t *testing.T) {
 	var key [32]byte
 	rand.Read(key[:])
-	b.Run("AES256GCM", func(b *testing.B) {
-		c, _ := aes.NewCipher(key[:])
-		payloadCipher, _ := cipher.NewGCM(c)
+	recordLayers := []RecordLayer{
+		NoRecordLayer{},
+		TLSRecordLayer{},
+		WebSocketRecordLayer{Mask: true},
+		LengthPrefixRecordLayer{Width: 4},
+		DatagramRecordLayer{},
+	}
+	for _, method := range []Method{E_METHOD_PLAIN, E_METHOD_AES_GCM, E_METHOD_XCHACHA20_POLY1305} {
+		for _, version := range []byte{PROTOCOL_V1, PROTOCOL_V6, PROTOCOL_V9} {
+			for _, recordLayer := range recordLayers {
+				config := ObfsConfig{RecordLayer: recordLayer, ProtocolVersion: version, PlainMAC: version >= PROTOCOL_V6}
+				obfuscator, err := GenerateObfsWithConfig(method, key[:], config)
+				if err != nil {
+					t.Fatal(err)
+				}
+				payloadCipher, _ := makePayloadCipher(method, key[:])
+				deobfsInPlace := MakeDeobfsInPlace(key, payloadCipher, config)
+				for _, trailing := range []int{7, 8, 9} {
+					frameLen := config.headerLen() + trailing
+					rlLen := recordLayer.HeaderLen(frameLen)
+					in := make([]byte, rlLen+frameLen)
+					for i := 0; i < 100; i++ {
+						rand.Read(in[rlLen:])
+						recordLayer.Wrap(in[:rlLen], frameLen)
+						_, err := obfuscator.Deobfs(in)
+						if trailing < 8 && !errors.Is(err, ErrInputTooShort) {
+							t.Fatalf("%v v%v %T: expecting %v for a frame of header+%v bytes, got %v", method, version, recordLayer, ErrInputTooShort, trailing, err)
+						}
+						deobfsInPlace(in)
+						// every prefix and extension of it as well
+						obfuscator.Deobfs(in[:len(in)-1])
+						obfuscator.Deobfs(append(in, 0))
+					}
+				}
+			}
+		}
+	}
+
+	obfuscator, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, key[:], ObfsConfig{})
+	in := make([]byte, 100)
+	for _, claimed := range []boundsRecordLayer{{-1, 10}, {10, -1}, {101, 0}, {50, 51}, {0, 101}} {
+		obfuscator.config.RecordLayer = claimed
+		deobfs := MakeDeobfs(key, obfuscator.payloadCipher, obfuscator.config)
+		if _, err := deobfs(in); !errors.Is(err, ErrBadRecordLayer) {
+			t.Errorf("record layer claiming %v bytes from %v: expecting %v, got %v", claimed.length, claimed.offset, ErrBadRecordLayer, err)
+		}
+	}
+}
 
-		obfs := MakeObfs(key, payloadCipher, true)
-		n, _ := obfs(testFrame, obfsBuf)
-		deobfs := MakeDeobfs(key, payloadCipher, true)
+func TestStrictRecordLayer(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{Strict: true}})
+	testFrame := &Frame{StreamID: 1, Payload: make([]byte, 100)}
+	obfsBuf := make([]byte, 512)
+	n, _ := obfuscator.Obfs(testFrame, obfsBuf)
 
-		b.ResetTimer()
-		for i := 0; i < b.N; i++ {
-			_, err := deobfs(obfsBuf[:n])
-			if err != nil {
-				b.Error(err)
-				return
-			}
-			b.SetBytes(int64(n))
+	if _, err := obfuscator.Deobfs(obfsBuf[:n]); err != nil {
+		t.Errorf("failed to deobfs a well formed record: %v", err)
+	}
+
+	tamper := func(i int, b byte) []byte {
+		in := make([]byte, n)
+		copy(in, obfsBuf[:n])
+		in[i] = b
+		return in
+	}
+	cases := map[string][]byte{
+		"content type":        tamper(0, 0x16),
+		"major version":       tamper(1, 0x02),
+		"minor version":       tamper(2, 0x01),
+		"length too long":     tamper(4, obfsBuf[4]+1),
+		"length too short":    tamper(4, obfsBuf[4]-1),
+		"truncated":           obfsBuf[:n-1],
+		"coalesced with more": append(append([]byte{}, obfsBuf[:n]...), obfsBuf[:n]...),
+	}
+	for name, in := range cases {
+		if _, err := obfuscator.Deobfs(in); !errors.Is(err, ErrBadRecordLayer) {
+			t.Errorf("%v: expecting %v, got %v", name, ErrBadRecordLayer, err)
 		}
-	})
-	b.Run("AES128GCM", func(b *testing.B) {
-		c, _ := aes.NewCipher(key[:16])
-		payloadCipher, _ := cipher.NewGCM(c)
+	}
+}
 
-		obfs := MakeObfs(key, payloadCipher, true)
-		n, _ := obfs(testFrame, obfsBuf)
-		deobfs := MakeDeobfs(key, payloadCipher, true)
+func TestDeriveSubkey(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	for i := range sessionKey {
+		sessionKey[i] = byte(i)
+	}
+	vectors := map[string]string{
+		headerKeyInfo:  "9f9b8b8363f2af4ab5b0c980a645460d843130b92f132fd64e24e3a4ef9158c8",
+		payloadKeyInfo: "cf23f7a74cc2e3cab26b502071d5de262819aaf5cf5866a41f9eaa7048d8e160",
+	}
+	deriver := newSubkeyDeriver(sessionKey)
+	for info, expected := range vectors {
+		subkey := deriveSubkey(sessionKey, info)
+		if hex.EncodeToString(subkey[:]) != expected {
+			t.Errorf("%v: expecting subkey %v, got %x", info, expected, subkey)
+		}
+		if subkey := deriver.derive(info); hex.EncodeToString(subkey[:]) != expected {
+			t.Errorf("%v: expecting subkey %v from an extracted key, got %x", info, expected, subkey)
+		}
+	}
+
+	testFrame := &Frame{StreamID: 1, Payload: []byte("derived keys")}
+	obfsBuf := make([]byte, 512)
+	v2, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V2})
+	v3, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V3})
+	n, _ := v3.Obfs(testFrame, obfsBuf)
+	if _, err := v2.Deobfs(obfsBuf[:n]); err == nil {
+		t.Error("v2 deobfser should not accept v3 frames")
+	}
+	resultFrame, err := v3.Deobfs(obfsBuf[:n])
+	if err != nil {
+		t.Errorf("v3 round trip failed: %v", err)
+	} else if !bytes.Equal(resultFrame.Payload, testFrame.Payload) {
+		t.Error("expecting", testFrame, "got", resultFrame)
+	}
+}
+
+// benchMethods and benchPayloadSizes are what the obfs and deobfs benchmarks are run with, with and without the record
+// layer
+var benchMethods = []struct {
+	name   string
+	method Method
+}{
+	{"plain", E_METHOD_PLAIN},
+	{"AES256GCM", E_METHOD_AES_GCM},
+	{"AES128GCM", E_METHOD_AES_128_GCM},
+	{"AES192GCM", E_METHOD_AES_192_GCM},
+	{"chacha20Poly1305", E_METHOD_CHACHA20_POLY1305},
+	{"AEGIS128L", E_METHOD_AEGIS_128L},
+}
+var benchPayloadSizes = []int{64, 1024, 16384}
+
+func runObfsBenchmarks(b *testing.B, bench func(b *testing.B, obfuscator *Obfuscator, testFrame *Frame)) {
+	var key [32]byte
+	rand.Read(key[:])
+	for _, m := range benchMethods {
+		for _, recordLayer := range []RecordLayer{TLSRecordLayer{}, NoRecordLayer{}} {
+			for _, size := range benchPayloadSizes {
+				name := fmt.Sprintf("%v/%T/%v", m.name, recordLayer, size)
+				b.Run(name, func(b *testing.B) {
+					obfuscator, err := GenerateObfs(m.method, key[:], WithRecordLayer(recordLayer))
+					if err != nil {
+						b.Fatal(err)
+					}
+					testPayload := make([]byte, size)
+					rand.Read(testPayload)
+					testFrame := &Frame{StreamID: 1, Payload: testPayload}
+					b.ReportAllocs()
+					bench(b, obfuscator, testFrame)
+				})
+			}
+		}
+	}
+}
 
+func BenchmarkObfs(b *testing.B) {
+	runObfsBenchmarks(b, func(b *testing.B, obfuscator *Obfuscator, testFrame *Frame) {
+		obfsBuf := make([]byte, obfuscator.frameLen(len(testFrame.Payload)))
+		b.SetBytes(int64(len(testFrame.Payload)))
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
-			_, err := deobfs(obfsBuf[:n])
+			_, err := obfuscator.Obfs(testFrame, obfsBuf)
 			if err != nil {
-				b.Error(err)
-				return
+				b.Fatal(err)
 			}
-			b.SetBytes(int64(n))
 		}
 	})
-	b.Run("plain", func(b *testing.B) {
-		obfs := MakeObfs(key, nil, true)
-		n, _ := obfs(testFrame, obfsBuf)
-		deobfs := MakeDeobfs(key, nil, true)
+}
 
+func BenchmarkDeobfs(b *testing.B) {
+	runObfsBenchmarks(b, func(b *testing.B, obfuscator *Obfuscator, testFrame *Frame) {
+		obfsBuf := make([]byte, obfuscator.frameLen(len(testFrame.Payload)))
+		n, _ := obfuscator.Obfs(testFrame, obfsBuf)
+		b.SetBytes(int64(len(testFrame.Payload)))
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
-			_, err := deobfs(obfsBuf[:n])
+			_, err := obfuscator.Deobfs(obfsBuf[:n])
 			if err != nil {
-				b.Error(err)
-				return
+				b.Fatal(err)
 			}
-			b.SetBytes(int64(n))
 		}
 	})
-	b.Run("chacha20Poly1305", func(b *testing.B) {
-		payloadCipher, _ := chacha20poly1305.New(key[:16])
-
-		obfs := MakeObfs(key, payloadCipher, true)
-		n, _ := obfs(testFrame, obfsBuf)
-		deobfs := MakeDeobfs(key, payloadCipher, true)
+}
 
+func BenchmarkDeobfsInto(b *testing.B) {
+	runObfsBenchmarks(b, func(b *testing.B, obfuscator *Obfuscator, testFrame *Frame) {
+		obfsBuf := make([]byte, obfuscator.frameLen(len(testFrame.Payload)))
+		n, _ := obfuscator.Obfs(testFrame, obfsBuf)
+		f := AcquireFrame()
+		defer ReleaseFrame(f)
+		b.SetBytes(int64(len(testFrame.Payload)))
+		b.ReportAllocs()
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
-			_, err := deobfs(obfsBuf[:n])
-			if err != nil {
-				b.Error(err)
-				return
+			if err := obfuscator.DeobfsInto(obfsBuf[:n], f); err != nil {
+				b.Fatal(err)
 			}
-			b.SetBytes(int64(n))
 		}
 	})
 }
+
+func BenchmarkPooledDeobfs(b *testing.B) {
+	testPayload := make([]byte, 1024)
+	rand.Read(testPayload)
+	testFrame := &Frame{
+		1,
+		0,
+		0,
+		testPayload,
+	}
+
+	obfsBuf := make([]byte, 2048)
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	for _, pooled := range []bool{false, true} {
+		obfuscator, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, key, ObfsConfig{RecordLayer: TLSRecordLayer{}, PooledDeobfs: pooled})
+		n, _ := obfuscator.Obfs(testFrame, obfsBuf)
+		b.Run(fmt.Sprintf("pooled=%v", pooled), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				f, err := obfuscator.Deobfs(obfsBuf[:n])
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				if pooled {
+					ReleaseFrame(f)
+				}
+				b.SetBytes(int64(n))
+			}
+		})
+	}
+}
+
+// BenchmarkGenerateObfs makes and closes 10000 obfuscators, each with a session key of its own, for every op, as a
+// server does for a storm of short lived connections
+func BenchmarkGenerateObfs(b *testing.B) {
+	const storm = 10000
+	sessionKeys := make([][]byte, storm)
+	for i := range sessionKeys {
+		sessionKeys[i] = make([]byte, 32)
+		rand.Read(sessionKeys[i])
+	}
+	for _, c := range []struct {
+		name   string
+		method Method
+		opts   []ObfsOption
+	}{
+		{"aes-gcm", E_METHOD_AES_GCM, nil},
+		{"chacha20-poly1305", E_METHOD_CHACHA20_POLY1305, nil},
+		{"plain", E_METHOD_PLAIN, nil},
+		{"directional keys", E_METHOD_AES_GCM, []ObfsOption{WithRole(ROLE_SERVER), WithDirectionalKeys()}},
+	} {
+		method := c.method
+		opts := append([]ObfsOption{WithRecordLayer(TLSRecordLayer{}), WithProtocolVersion(PROTOCOL_V6)}, c.opts...)
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for _, sessionKey := range sessionKeys {
+					obfuscator, err := GenerateObfs(method, sessionKey, opts...)
+					if err != nil {
+						b.Fatal(err)
+					}
+					obfuscator.Close()
+				}
+			}
+		})
+	}
+}
+
+func TestUniqueHeaderNonce(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+
+	// the payloads differ but have the same 8 byte tail, with the headers otherwise identical
+	frameA := &Frame{StreamID: 1, Seq: 1, Payload: []byte("aaaaaaaa-same-tail")}
+	frameB := &Frame{StreamID: 1, Seq: 1, Payload: []byte("bbbbbbbb-same-tail")}
+	scrambledHeaders := func(config ObfsConfig) ([]byte, []byte) {
+		obfuscator, _ := GenerateObfsWithConfig(E_METHOD_PLAIN, sessionKey, config)
+		bufA := make([]byte, 512)
+		bufB := make([]byte, 512)
+		nA, _ := obfuscator.Obfs(frameA, bufA)
+		nB, _ := obfuscator.Obfs(frameB, bufB)
+		for _, in := range [][]byte{bufA[:nA], bufB[:nB]} {
+			if _, err := obfuscator.Deobfs(in); err != nil {
+				t.Fatalf("failed to deobfs: %v", err)
+			}
+		}
+		headerLen := config.headerLen()
+		return bufA[5 : 5+headerLen], bufB[5 : 5+headerLen]
+	}
+
+	a, b := scrambledHeaders(ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V4})
+	if !bytes.Equal(a, b) {
+		t.Error("expecting the headers to be scrambled with the same keystream before protocol v5")
+	}
+	for _, plainMAC := range []bool{false, true} {
+		a, b = scrambledHeaders(ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V5, PlainMAC: plainMAC})
+		if bytes.Equal(a, b) {
+			t.Errorf("PlainMAC %v: headers are scrambled with the same keystream", plainMAC)
+		}
+	}
+}
+
+func TestObfsVectored(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+
+	fragments := [][]byte{[]byte("header"), {}, []byte("and a body")}
+	joined := bytes.Join(fragments, nil)
+	for _, method := range []Method{E_METHOD_PLAIN, E_METHOD_AES_GCM, E_METHOD_XCHACHA20_POLY1305} {
+		for _, version := range []byte{PROTOCOL_V1, PROTOCOL_V4} {
+			obfuscator, _ := GenerateObfsWithConfig(method, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: version})
+			testFrame := &Frame{StreamID: 1, Seq: 1}
+			obfsBuf := make([]byte, 512)
+			n, err := obfuscator.ObfsVectored(testFrame, fragments, obfsBuf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != obfuscator.frameLen(len(joined)) {
+				t.Errorf("method %v version %v: expecting %v bytes, got %v", method, version, obfuscator.frameLen(len(joined)), n)
+			}
+			f, err := obfuscator.Deobfs(obfsBuf[:n])
+			if err != nil {
+				t.Fatalf("method %v version %v: failed to deobfs: %v", method, version, err)
+			}
+			if !bytes.Equal(f.Payload, joined) {
+				t.Errorf("method %v version %v: expecting %q, got %q", method, version, joined, f.Payload)
+			}
+		}
+	}
+
+	obfuscator, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}})
+	testFrame := &Frame{StreamID: 1, Seq: 1}
+	obfsBuf := make([]byte, 512)
+	allocs := testing.AllocsPerRun(100, func() {
+		obfuscator.ObfsVectored(testFrame, fragments, obfsBuf)
+	})
+	if allocs != 0 {
+		t.Errorf("expecting no allocations, got %v", allocs)
+	}
+}
+
+func TestAuthenticatedRecordLength(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	testFrame := &Frame{StreamID: 1, Seq: 1, Payload: make([]byte, 100)}
+
+	for _, method := range []Method{E_METHOD_PLAIN, E_METHOD_AES_GCM, E_METHOD_XCHACHA20_POLY1305} {
+		for _, version := range []byte{PROTOCOL_V5, PROTOCOL_V6} {
+			obfuscator, _ := GenerateObfsWithConfig(method, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: version, PlainMAC: true})
+			obfsBuf := make([]byte, 512)
+			n, _ := obfuscator.Obfs(testFrame, obfsBuf)
+			if _, err := obfuscator.Deobfs(obfsBuf[:n]); err != nil {
+				t.Fatalf("%v v%v: failed to deobfs: %v", method, version, err)
+			}
+
+			obfsBuf[4] ^= 0x01
+			_, err := obfuscator.Deobfs(obfsBuf[:n])
+			if version >= PROTOCOL_V6 && !errors.Is(err, ErrAuthFailed) {
+				t.Errorf("%v v%v: expecting %v with a rewritten record length, got %v", method, version, ErrAuthFailed, err)
+			}
+			if version < PROTOCOL_V6 && err != nil {
+				t.Errorf("%v v%v: record length isn't authenticated, but got %v", method, version, err)
+			}
+		}
+	}
+}
+
+func TestObfsBuffers(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+
+	configs := map[string]ObfsConfig{
+		"v1":                         {RecordLayer: TLSRecordLayer{}},
+		"v1 without record layer":    {},
+		"v6 with plain mac":          {RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V6, PlainMAC: true},
+		"v6 without record layer":    {ProtocolVersion: PROTOCOL_V6},
+		"v2 with padding":            {RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V2, Padding: UniformPadding(100)},
+		"v6 with mac and padding":    {RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V6, PlainMAC: true, Padding: UniformPadding(100)},
+		"v4 for key epochs":          {RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V4},
+		"v2 without header nonce":    {RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V2},
+		"v5 with header nonce":       {RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V5},
+		"v5 with mac but no padding": {RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V5, PlainMAC: true},
+		"masked websocket":           {RecordLayer: WebSocketRecordLayer{Mask: true}, ProtocolVersion: PROTOCOL_V6, PlainMAC: true},
+		"v7 with wide flags":         {RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V7, PlainMAC: true},
+		"v2 with checksum":           {RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V2, PlainChecksum: true},
+		"v6 with mac and checksum":   {RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V6, PlainMAC: true, PlainChecksum: true},
+	}
+	for name, config := range configs {
+		for _, method := range []Method{E_METHOD_PLAIN, E_METHOD_AES_GCM, E_METHOD_XCHACHA20_POLY1305} {
+			obfuscator, _ := GenerateObfsWithConfig(method, sessionKey, config)
+			for _, pldLen := range []int{0, 3, 100} {
+				testFrame := &Frame{StreamID: 1, Seq: 1, Payload: make([]byte, pldLen)}
+				rand.Read(testFrame.Payload)
+				buf := make([]byte, 1024)
+				segments, err := obfuscator.ObfsBuffers(testFrame, buf, nil)
+				if err != nil {
+					t.Fatalf("%v %v %v: %v", name, method, pldLen, err)
+				}
+				if len(segments) < 3 {
+					t.Errorf("%v %v %v: expecting at least 3 segments, got %v", name, method, pldLen, len(segments))
+				}
+				joined := bytes.Join(segments, nil)
+				f, err := obfuscator.Deobfs(joined)
+				if err != nil {
+					t.Fatalf("%v %v %v: failed to deobfs: %v", name, method, pldLen, err)
+				}
+				if !bytes.Equal(f.Payload, testFrame.Payload) {
+					t.Errorf("%v %v %v: payload mismatch", name, method, pldLen)
+				}
+
+				// masked payloads can't be referenced
+				if m, ok := config.RecordLayer.(masker); method != E_METHOD_PLAIN || pldLen == 0 || ok && m.masks() {
+					continue
+				}
+				referenced := false
+				for _, segment := range segments {
+					if len(segment) == pldLen && &segment[0] == &testFrame.Payload[0] {
+						referenced = true
+					}
+				}
+				if !referenced {
+					t.Errorf("%v %v %v: plain payload is copied rather than referenced", name, method, pldLen)
+				}
+			}
+		}
+	}
+
+	obfuscator, _ := GenerateObfsWithConfig(E_METHOD_PLAIN, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}})
+	testFrame := &Frame{StreamID: 1, Seq: 1, Payload: make([]byte, 16384)}
+	buf := make([]byte, obfuscator.Overhead())
+	segments := make(net.Buffers, 0, 4)
+	if _, err := obfuscator.ObfsBuffers(testFrame, buf, segments); err != nil {
+		t.Errorf("buffer for everything apart from the plain payload should be enough: %v", err)
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		obfuscator.ObfsBuffers(testFrame, buf, segments[:0])
+	})
+	if allocs != 0 {
+		t.Errorf("expecting no allocations, got %v", allocs)
+	}
+}
+
+// TestObfsAllocs pins the steady state number of allocations per frame, so that regressions on the hot paths are caught
+func TestObfsAllocs(t *testing.T) {
+	var key [32]byte
+	rand.Read(key[:])
+	for _, m := range benchMethods {
+		for _, pooled := range []bool{false, true} {
+			obfuscator, _ := GenerateObfsWithConfig(m.method, key[:], ObfsConfig{RecordLayer: TLSRecordLayer{}, PooledDeobfs: pooled})
+			testFrame := &Frame{StreamID: 1, Payload: make([]byte, 1024)}
+			obfsBuf := make([]byte, obfuscator.frameLen(len(testFrame.Payload)))
+			n, _ := obfuscator.Obfs(testFrame, obfsBuf)
+
+			if allocs := testing.AllocsPerRun(100, func() { obfuscator.Obfs(testFrame, obfsBuf) }); allocs != 0 {
+				t.Errorf("%v: expecting obfs not to allocate, got %v", m.name, allocs)
+			}
+
+			// a frame and the buffer backing its payload, unless they are reused from the pool
+			expected := 2.0
+			if pooled {
+				expected = 0
+			}
+			allocs := testing.AllocsPerRun(100, func() {
+				f, _ := obfuscator.Deobfs(obfsBuf[:n])
+				if pooled {
+					ReleaseFrame(f)
+				}
+			})
+			if allocs != expected {
+				t.Errorf("%v pooled=%v: expecting %v allocations per deobfs, got %v", m.name, pooled, expected, allocs)
+			}
+		}
+	}
+}
+
+func FuzzDeobfs(f *testing.F) {
+	var key [32]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+	var obfuscators []*Obfuscator
+	for _, m := range []Method{E_METHOD_PLAIN, E_METHOD_AES_GCM, E_METHOD_CHACHA20_POLY1305, E_METHOD_XCHACHA20_POLY1305} {
+		for _, recordLayer := range []RecordLayer{TLSRecordLayer{}, NoRecordLayer{}, WebSocketRecordLayer{}} {
+			obfuscator, _ := GenerateObfsWithConfig(m, key[:], ObfsConfig{RecordLayer: recordLayer})
+			obfuscators = append(obfuscators, obfuscator)
+		}
+	}
+
+	for _, obfuscator := range obfuscators {
+		for _, pldLen := range []int{0, 7, 8, 100} {
+			buf := make([]byte, 512)
+			n, _ := obfuscator.Obfs(&Frame{StreamID: 1, Seq: 2, Closing: C_STREAM, Payload: make([]byte, pldLen)}, buf)
+			f.Add(buf[:n])
+		}
+	}
+	// the shortest input that gets past the length check, and a plain frame claiming 255 extra bytes
+	f.Add(make([]byte, 5+HEADER_LEN+8))
+	f.Add(make([]byte, HEADER_LEN+8))
+	extraLen255 := make([]byte, 5+HEADER_LEN+8)
+	salsa20.XORKeyStream(extraLen255[5:5+HEADER_LEN], extraLen255[5:5+HEADER_LEN], extraLen255[len(extraLen255)-8:], &key)
+	extraLen255[5+13] ^= 0xff
+	f.Add(extraLen255)
+
+	f.Fuzz(func(t *testing.T, in []byte) {
+		for _, obfuscator := range obfuscators {
+			frame, err := obfuscator.Deobfs(in)
+			if err != nil {
+				continue
+			}
+			buf := make([]byte, obfuscator.frameLen(len(frame.Payload)))
+			n, err := obfuscator.Obfs(frame, buf)
+			if err != nil {
+				t.Fatalf("failed to obfs a frame that has been deobfsed: %v", err)
+			}
+			reobfsed := buf[:n]
+
+			again, err := obfuscator.Deobfs(reobfsed)
+			if err != nil {
+				t.Fatalf("failed to deobfs a reobfsed frame: %v", err)
+			}
+			if again.StreamID != frame.StreamID || again.Seq != frame.Seq || again.Closing != frame.Closing || !bytes.Equal(again.Payload, frame.Payload) {
+				t.Fatalf("frame changed after reobfsing: %v, %v", frame, again)
+			}
+
+			// Without random nonces or random padding, obfsing is deterministic and a frame that was accepted must be
+			// reproduced byte for byte, apart from a record layer that isn't checked
+			deterministic := obfuscator.encryptionMethod != E_METHOD_XCHACHA20_POLY1305 &&
+				(obfuscator.encryptionMethod != E_METHOD_PLAIN || len(frame.Payload) >= 8)
+			rlLen, _, _ := obfuscator.config.recordLayer().Unwrap(in)
+			if deterministic && len(reobfsed) == len(in) && !bytes.Equal(reobfsed[rlLen:], in[rlLen:]) {
+				t.Fatalf("accepted frame %x is reobfsed into %x", in, reobfsed)
+			}
+		}
+	})
+}
+
+// repeatingReader endlessly reads the same byte, for reproducible obfs output
+type repeatingReader byte
+
+func (r repeatingReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+func TestObfsRand(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	testFrame := &Frame{StreamID: 1, Seq: 1, Payload: []byte("short")}
+
+	for _, method := range []Method{E_METHOD_PLAIN, E_METHOD_XCHACHA20_POLY1305} {
+		var outputs [][]byte
+		for i := 0; i < 2; i++ {
+			obfuscator, _ := GenerateObfsWithConfig(method, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, Rand: repeatingReader(0x42)})
+			buf := make([]byte, 512)
+			n, err := obfuscator.Obfs(testFrame, buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputs = append(outputs, buf[:n])
+		}
+		if !bytes.Equal(outputs[0], outputs[1]) {
+			t.Errorf("%v: expecting the same output from the same randomness", method)
+		}
+
+		obfuscator, _ := GenerateObfsWithConfig(method, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, Rand: bytes.NewReader(nil)})
+		if _, err := obfuscator.Obfs(testFrame, make([]byte, 512)); err == nil {
+			t.Errorf("%v: expecting an error when randomness runs out", method)
+		}
+	}
+}
+
+// TestGoldenVectors pins the bytes on the wire for each method, so that layout changes which would break interop
+// with the other end don't go unnoticed
+func TestGoldenVectors(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	for i := range sessionKey {
+		sessionKey[i] = byte(i)
+	}
+	testFrame := &Frame{StreamID: 0x01020304, Seq: 0x05060708090a0b0c, Closing: C_STREAM, Payload: []byte("golden vector payload")}
+
+	// explicit nonces are read from Rand, which is the nonce given if there is one
+	vectors := []struct {
+		method      Method
+		recordLayer RecordLayer
+		nonce       string
+		obfsed      string
+	}{
+		{E_METHOD_PLAIN, TLSRecordLayer{}, "", "1703030023d8e72e0ddeae40a67176a79c7d08676f6c64656e20766563746f72207061796c6f6164"},
+		{E_METHOD_PLAIN, NoRecordLayer{}, "", "d8e72e0ddeae40a67176a79c7d08676f6c64656e20766563746f72207061796c6f6164"},
+		{E_METHOD_AES_GCM, TLSRecordLayer{}, "", "1703030033a23673430e412546476e74ba9c15628536b189fad0f029c1172862339a493b2f8e9ff3aeaa76d4d7a952d150e5c415179a13f4"},
+		{E_METHOD_AES_GCM, NoRecordLayer{}, "", "a23673430e412546476e74ba9c15628536b189fad0f029c1172862339a493b2f8e9ff3aeaa76d4d7a952d150e5c415179a13f4"},
+		{E_METHOD_CHACHA20_POLY1305, TLSRecordLayer{}, "", "1703030033a8b7c88db283116cb75473771f3803e7280e6c3c84c52d8a3128a681fc6fc790fcff22b8910f3a633b33a28e50742516f820d9"},
+		{E_METHOD_CHACHA20_POLY1305, NoRecordLayer{}, "", "a8b7c88db283116cb75473771f3803e7280e6c3c84c52d8a3128a681fc6fc790fcff22b8910f3a633b33a28e50742516f820d9"},
+		{E_METHOD_ASCON_128, TLSRecordLayer{}, "000102030405060708090a0b0c0d0e0f", "17030300430051c89f12f19c0fea3b9343a060000102030405060708090a0b0c0d0e0f8d92483e4a46feeb3179967b4ca4734f20afa2a1d4ea0e0fb237a961a4e5e9fd4fdf73bade"},
+		{E_METHOD_ASCON_128, NoRecordLayer{}, "000102030405060708090a0b0c0d0e0f", "0051c89f12f19c0fea3b9343a060000102030405060708090a0b0c0d0e0f8d92483e4a46feeb3179967b4ca4734f20afa2a1d4ea0e0fb237a961a4e5e9fd4fdf73bade"},
+	}
+	for _, v := range vectors {
+		name := fmt.Sprintf("%v %T", v.method, v.recordLayer)
+		opts := []ObfsOption{WithRecordLayer(v.recordLayer)}
+		if v.nonce != "" {
+			nonce, _ := hex.DecodeString(v.nonce)
+			opts = append(opts, WithRandSource(bytes.NewReader(nonce)))
+		}
+		obfuscator, err := GenerateObfs(v.method, sessionKey, opts...)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		buf := make([]byte, 512)
+		n, err := obfuscator.Obfs(testFrame, buf)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if obfsed := hex.EncodeToString(buf[:n]); obfsed != v.obfsed {
+			t.Errorf("%v: expecting\n%v\ngot\n%v", name, v.obfsed, obfsed)
+		}
+
+		expected, _ := hex.DecodeString(v.obfsed)
+		f, err := obfuscator.Deobfs(expected)
+		if err != nil {
+			t.Fatalf("%v: failed to deobfs: %v", name, err)
+		}
+		if f.StreamID != testFrame.StreamID || f.Seq != testFrame.Seq || f.Closing != testFrame.Closing || !bytes.Equal(f.Payload, testFrame.Payload) {
+			t.Errorf("%v: expecting %v, got %v", name, testFrame, f)
+		}
+	}
+}
+
+func TestSeqLimit(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfsBuf := make([]byte, 512)
+
+	limited, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, SeqLimit: 10})
+	if _, err := limited.Obfs(&Frame{StreamID: 1, Seq: 9}, obfsBuf); err != nil {
+		t.Errorf("seq below the limit: %v", err)
+	}
+	if _, err := limited.Obfs(&Frame{StreamID: 1, Seq: 10}, obfsBuf); err != ErrSeqExhausted {
+		t.Errorf("expecting %v, got %v", ErrSeqExhausted, err)
+	}
+
+	for _, method := range []Method{E_METHOD_PLAIN, E_METHOD_AES_GCM, E_METHOD_XCHACHA20_POLY1305} {
+		unlimited, _ := GenerateObfsWithConfig(method, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}})
+		if _, err := unlimited.Obfs(&Frame{StreamID: 1, Seq: math.MaxUint64 - 1}, obfsBuf); err != nil {
+			t.Errorf("%v: %v", method, err)
+		}
+		if _, err := unlimited.Obfs(&Frame{StreamID: 1, Seq: math.MaxUint64}, obfsBuf); err != ErrSeqExhausted {
+			t.Errorf("%v: expecting %v, got %v", method, ErrSeqExhausted, err)
+		}
+	}
+}
+
+func TestUninitialisedObfuscator(t *testing.T) {
+	for _, obfuscator := range []*Obfuscator{nil, {}} {
+		if _, err := obfuscator.Obfs(&Frame{}, make([]byte, 100)); err != ErrUninitialisedObfuscator {
+			t.Errorf("expecting %v, got %v", ErrUninitialisedObfuscator, err)
+		}
+		if _, err := obfuscator.Deobfs(make([]byte, 100)); err != ErrUninitialisedObfuscator {
+			t.Errorf("expecting %v, got %v", ErrUninitialisedObfuscator, err)
+		}
+	}
+}
+
+func TestObfsOptions(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	random := bytes.NewReader(nil)
+	obfuscator, err := GenerateObfs(E_METHOD_AES_GCM, sessionKey,
+		WithConfig(ObfsConfig{ProtocolVersion: PROTOCOL_V2}),
+		WithRecordLayer(TLSRecordLayer{}),
+		WithProtocolVersion(PROTOCOL_V5),
+		WithRandSource(random),
+		WithReplayWindow(64),
+		WithPadding(UniformPadding(16)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V5, Rand: random, ReplayWindow: 64, Padding: UniformPadding(16), method: E_METHOD_AES_GCM}
+	if !reflect.DeepEqual(obfuscator.config, expected) {
+		t.Errorf("expecting config %+v, got %+v", expected, obfuscator.config)
+	}
+}
+
+func TestOnDeobfsError(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	type report struct {
+		err    error
+		inLen  int
+		prefix []byte
+	}
+	var reports []report
+	obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{CCSProbability: 1}),
+		WithOnDeobfsError(func(err error, inLen int, prefix []byte) {
+			reports = append(reports, report{err, inLen, append([]byte(nil), prefix...)})
+		}))
+
+	obfsBuf := make([]byte, 200)
+	n, _ := obfuscator.Obfs(&Frame{StreamID: 1, Payload: make([]byte, 50)}, obfsBuf)
+	if _, err := obfuscator.Deobfs(obfsBuf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	// the change_cipher_spec record on its own
+	obfuscator.Deobfs(obfsBuf[:ccsRecordLen])
+	if len(reports) != 0 {
+		t.Fatalf("expecting nothing to be reported for good frames and dummy records, got %v", reports)
+	}
+
+	obfsBuf[n-1] ^= 0xff
+	_, authErr := obfuscator.Deobfs(obfsBuf[:n])
+	_, shortErr := obfuscator.Deobfs(obfsBuf[:3])
+	if len(reports) != 2 {
+		t.Fatalf("expecting 2 errors to be reported, got %v", len(reports))
+	}
+	if reports[0].err != authErr || reports[0].inLen != n || !bytes.Equal(reports[0].prefix, obfsBuf[:deobfsErrorPrefixLen]) {
+		t.Errorf("expecting %v for %v bytes starting with %x, got %+v", authErr, n, obfsBuf[:deobfsErrorPrefixLen], reports[0])
+	}
+	if reports[1].err != shortErr || reports[1].inLen != 3 || !bytes.Equal(reports[1].prefix, obfsBuf[:3]) {
+		t.Errorf("expecting %v for 3 bytes, got %+v", shortErr, reports[1])
+	}
+}
+
+func TestClone(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	newKey := make([]byte, 32)
+	rand.Read(newKey)
+
+	config := ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V4, Padding: BucketPadding{200}, ReplayWindow: 64}
+	original, _ := GenerateObfsWithConfig(E_METHOD_CHACHA20_POLY1305, sessionKey, config)
+	original.Rekey(sessionKey)
+	clone, err := original.Clone(newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := original.config
+	expected.keyEpoch = 0
+	if clone.encryptionMethod != E_METHOD_CHACHA20_POLY1305 || !reflect.DeepEqual(clone.config, expected) {
+		t.Errorf("clone has method %v and config %+v", clone.encryptionMethod, clone.config)
+	}
+
+	fresh, _ := GenerateObfsWithConfig(E_METHOD_CHACHA20_POLY1305, newKey, config)
+	testFrame := &Frame{StreamID: 1, Seq: 1, Payload: []byte("cloned")}
+	buf := make([]byte, 512)
+	n, _ := clone.Obfs(testFrame, buf)
+	if n != 200 {
+		t.Errorf("expecting the clone to pad frames to 200 bytes, got %v", n)
+	}
+	if _, err := original.Deobfs(buf[:n]); err == nil {
+		t.Error("the original deobfsed a frame of the clone's key")
+	}
+	f, err := fresh.Deobfs(buf[:n])
+	if err != nil {
+		t.Fatalf("failed to deobfs a frame of the clone: %v", err)
+	}
+	if !bytes.Equal(f.Payload, testFrame.Payload) {
+		t.Error("payload mismatch")
+	}
+
+	original.Close()
+	if _, err := original.Clone(newKey); !errors.Is(err, ErrObfuscatorClosed) {
+		t.Errorf("expecting %v, got %v", ErrObfuscatorClosed, err)
+	}
+	if _, err := clone.Obfs(testFrame, buf); err != nil {
+		t.Errorf("closing the original closed the clone: %v", err)
+	}
+	if _, err := (&Obfuscator{}).Clone(newKey); !errors.Is(err, ErrUninitialisedObfuscator) {
+		t.Errorf("expecting %v, got %v", ErrUninitialisedObfuscator, err)
+	}
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	config := ObfsConfig{RecordLayer: NoRecordLayer{}, ProtocolVersion: PROTOCOL_V9, Padding: BucketPadding{1000}, MaxFrameSize: 500}
+	obfuscator, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, config)
+	buf := make([]byte, 2000)
+
+	n, err := obfuscator.Obfs(&Frame{StreamID: 1, Seq: 1, Payload: make([]byte, 100)}, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 500 {
+		t.Errorf("expecting padding to be cut short at 500 bytes, got %v", n)
+	}
+	if _, err := obfuscator.Deobfs(buf[:n]); err != nil {
+		t.Errorf("failed to deobfs a frame of the maximum size: %v", err)
+	}
+
+	if _, err := obfuscator.Obfs(&Frame{StreamID: 1, Seq: 2, Payload: make([]byte, 500)}, buf); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("expecting %v, got %v", ErrFrameTooLarge, err)
+	}
+
+	unlimited := config
+	unlimited.MaxFrameSize = 0
+	sender, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, unlimited)
+	n, _ = sender.Obfs(&Frame{StreamID: 1, Seq: 3, Payload: make([]byte, 500)}, buf)
+	if _, err := obfuscator.Deobfs(buf[:n]); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("expecting %v deobfsing a frame of %v bytes, got %v", ErrFrameTooLarge, n, err)
+	}
+}
+
+func TestAES192GCMSessionKey(t *testing.T) {
+	sessionKey := make([]byte, 24)
+	rand.Read(sessionKey)
+
+	for _, method := range []Method{E_METHOD_AES_GCM, E_METHOD_CHACHA20_POLY1305, E_METHOD_AES_128_GCM} {
+		if _, err := GenerateObfs(method, sessionKey); err != ErrBadSessionKeySize {
+			t.Errorf("%v: expecting %v for a 24 byte key, got %v", method, ErrBadSessionKeySize, err)
+		}
+	}
+	for _, keyLen := range []int{16, 31} {
+		if _, err := GenerateObfs(E_METHOD_AES_192_GCM, make([]byte, keyLen)); err != ErrBadSessionKeySize {
+			t.Errorf("%v byte key: expecting %v, got %v", keyLen, ErrBadSessionKeySize, err)
+		}
+	}
+
+	obfuscator, err := GenerateObfs(E_METHOD_AES_192_GCM, sessionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// salsa20 takes a 32 byte key, which mustn't be the session key padded with zeros
+	if obfuscator.keys.salsaKey != deriveSubkey(sessionKey, headerKeyInfo) {
+		t.Error("expecting the header key to be derived from the 24 byte session key")
+	}
+
+	testFrame := &Frame{StreamID: 1, Seq: 1, Payload: []byte("aes-192")}
+	buf := make([]byte, 512)
+	n, err := obfuscator.Obfs(testFrame, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, _ := GenerateObfs(E_METHOD_AES_192_GCM, sessionKey)
+	f, err := peer.Deobfs(buf[:n])
+	if err != nil {
+		t.Fatalf("failed to deobfs: %v", err)
+	}
+	if !bytes.Equal(f.Payload, testFrame.Payload) {
+		t.Error("payload mismatch")
+	}
+}
+
+func TestDeobfsAll(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	recordLayers := map[string]RecordLayer{
+		"tls":           TLSRecordLayer{Strict: true, CCSProbability: 0.5},
+		"tls split":     TLSRecordLayer{MaxRecordLen: 1000},
+		"websocket":     WebSocketRecordLayer{Mask: true},
+		"length prefix": LengthPrefixRecordLayer{Width: 4},
+		"datagram":      DatagramRecordLayer{},
+	}
+	for name, rl := range recordLayers {
+		obfuscator, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: rl, ProtocolVersion: PROTOCOL_V6})
+		var stream []byte
+		var payloads [][]byte
+		buf := make([]byte, 10000)
+		for i := 0; i < 10; i++ {
+			payload := make([]byte, rand.Intn(3000))
+			rand.Read(payload)
+			n, err := obfuscator.Obfs(&Frame{StreamID: 1, Seq: uint64(i), Payload: payload}, buf)
+			if err != nil {
+				t.Fatalf("%v: %v", name, err)
+			}
+			stream = append(stream, buf[:n]...)
+			payloads = append(payloads, payload)
+		}
+
+		// the last record is cut short, and only read once the rest of it has arrived
+		cut := len(stream) - 3
+		frames, n, err := obfuscator.DeobfsAll(append([]byte{}, stream[:cut]...))
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		if len(frames) != len(payloads)-1 {
+			t.Errorf("%v: expecting %v frames, got %v", name, len(payloads)-1, len(frames))
+			continue
+		}
+		rest, m, err := obfuscator.DeobfsAll(append([]byte{}, stream[n:]...))
+		if err != nil || m != len(stream)-n {
+			t.Errorf("%v: expecting %v bytes of the last record to be read, got %v: %v", name, len(stream)-n, m, err)
+			continue
+		}
+		frames = append(frames, rest...)
+		for i, f := range frames {
+			if f.Seq != uint64(i) || !bytes.Equal(f.Payload, payloads[i]) {
+				t.Errorf("%v: frame %v mismatch", name, i)
+			}
+		}
+	}
+
+	t.Run("no record layer", func(t *testing.T) {
+		obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(NoRecordLayer{}))
+		buf := make([]byte, 512)
+		n, _ := obfuscator.Obfs(&Frame{StreamID: 1, Seq: 1, Payload: []byte("whole")}, buf)
+		frames, read, err := obfuscator.DeobfsAll(buf[:n])
+		if err != nil || read != n || len(frames) != 1 || string(frames[0].Payload) != "whole" {
+			t.Errorf("expecting the whole input to be deobfsed as one frame, got %v frames of %v bytes: %v", len(frames), read, err)
+		}
+	})
+
+	t.Run("bad record", func(t *testing.T) {
+		obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+		buf := make([]byte, 512)
+		n, _ := obfuscator.Obfs(&Frame{StreamID: 1, Seq: 1, Payload: []byte("good")}, buf)
+		stream := append([]byte{}, buf[:n]...)
+		n, _ = obfuscator.Obfs(&Frame{StreamID: 1, Seq: 2, Payload: []byte("bad")}, buf)
+		buf[n-1] ^= 1
+		stream = append(stream, buf[:n]...)
+		good := len(stream) - n
+		frames, read, err := obfuscator.DeobfsAll(stream)
+		if err == nil || len(frames) != 1 || read != good {
+			t.Errorf("expecting the first frame and an error at %v, got %v frames, %v bytes and %v", good, len(frames), read, err)
+		}
+	})
+
+	t.Run("max frame size", func(t *testing.T) {
+		obfuscator, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, MaxFrameSize: DefaultMaxFrameSize})
+		// a record header claiming 65535 bytes is refused before the rest of it arrives
+		_, read, err := obfuscator.DeobfsAll([]byte{0x17, 0x03, 0x03, 0xff, 0xff})
+		if !errors.Is(err, ErrFrameTooLarge) || read != 0 {
+			t.Errorf("expecting %v, got %v after %v bytes", ErrFrameTooLarge, err, read)
+		}
+	})
+}
+
+func TestLayout(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	payload := []byte("laid out where Layout says")
+	buf := make([]byte, 512)
+
+	t.Run("plain", func(t *testing.T) {
+		obfuscator, _ := GenerateObfsWithConfig(E_METHOD_PLAIN, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V5, PlainMAC: true, HeaderCipher: HEADER_CIPHER_NONE})
+		n, _ := obfuscator.Obfs(&Frame{StreamID: 7, Seq: 1, Payload: payload}, buf)
+		l := obfuscator.Layout(len(payload))
+		if l.End != n {
+			t.Fatalf("expecting a frame of %v bytes, got %v", l.End, n)
+		}
+		if l.Header != recordHeaderLen || l.ExplicitNonce != l.Header+HEADER_LEN+1 || l.Payload != l.ExplicitNonce {
+			t.Errorf("unexpected layout %+v", l)
+		}
+		if u32(buf[l.Header:]) != 7 {
+			t.Errorf("expecting the clear header at %v", l.Header)
+		}
+		if !bytes.Equal(buf[l.Payload:l.Tag], payload) || l.Tag != l.Trailer || l.End-l.Trailer != plainMACLen+8 {
+			t.Errorf("expecting the payload followed by the trailer in %+v", l)
+		}
+	})
+
+	t.Run("explicit nonce", func(t *testing.T) {
+		obfuscator, _ := GenerateObfs(E_METHOD_XCHACHA20_POLY1305, sessionKey, WithRecordLayer(WebSocketRecordLayer{}),
+			WithHeaderCipher(HEADER_CIPHER_NONE))
+		n, _ := obfuscator.Obfs(&Frame{StreamID: 7, Seq: 1, Payload: payload}, buf)
+		l := obfuscator.Layout(len(payload))
+		if l.End != n {
+			t.Fatalf("expecting a frame of %v bytes, got %v", l.End, n)
+		}
+		// below PROTOCOL_V6 the additional data of an explicit nonce is the whole header, which is left in the clear
+		opened, err := obfuscator.payloadCipher.Open(nil, buf[l.ExplicitNonce:l.Payload], buf[l.Payload:l.Trailer], buf[l.Header:l.ExplicitNonce])
+		if err != nil || !bytes.Equal(opened, payload) {
+			t.Errorf("failed to open the payload at %+v: %v", l, err)
+		}
+		if l.Trailer != l.End {
+			t.Errorf("expecting no trailer, got %+v", l)
+		}
+	})
+}
+
+func TestAdditionalData(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	testFrame := &Frame{StreamID: 1, Seq: 1, Payload: []byte("bound")}
+	buf := make([]byte, 512)
+
+	for _, method := range []Method{E_METHOD_AES_GCM, E_METHOD_XCHACHA20_POLY1305} {
+		for _, version := range []byte{PROTOCOL_V1, PROTOCOL_V6} {
+			sender, _ := GenerateObfs(method, sessionKey, WithProtocolVersion(version), WithAdditionalData([]byte("exporter value")))
+			n, err := sender.Obfs(testFrame, buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			frame := append([]byte{}, buf[:n]...)
+
+			receiver, _ := GenerateObfs(method, sessionKey, WithProtocolVersion(version), WithAdditionalData([]byte("exporter value")))
+			f, err := receiver.Deobfs(append([]byte{}, frame...))
+			if err != nil || !bytes.Equal(f.Payload, testFrame.Payload) {
+				t.Errorf("%v v%v: failed to deobfs with the same additional data: %v", method, version+1, err)
+			}
+			for _, ad := range [][]byte{[]byte("another value"), nil} {
+				mismatched, _ := GenerateObfs(method, sessionKey, WithProtocolVersion(version), WithAdditionalData(ad))
+				if _, err := mismatched.Deobfs(append([]byte{}, frame...)); !errors.Is(err, ErrAuthFailed) {
+					t.Errorf("%v v%v: expecting %v with additional data %q, got %v", method, version+1, ErrAuthFailed, ad, err)
+				}
+			}
+		}
+	}
+}
+
+// recordingAEAD is an AEAD of any nonce size that remembers the nonces it was given
+type recordingAEAD struct {
+	cipher.AEAD
+	sealed, opened [][]byte
+}
+
+func (r *recordingAEAD) Seal(dst, nonce, plaintext, ad []byte) []byte {
+	r.sealed = append(r.sealed, append([]byte{}, nonce...))
+	return r.AEAD.Seal(dst, nonce, plaintext, ad)
+}
+
+func (r *recordingAEAD) Open(dst, nonce, ciphertext, ad []byte) ([]byte, error) {
+	r.opened = append(r.opened, append([]byte{}, nonce...))
+	return r.AEAD.Open(dst, nonce, ciphertext, ad)
+}
+
+func TestStreamIDAndSeqAuthenticated(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	buf := make([]byte, 200)
+	for _, method := range []Method{E_METHOD_AES_GCM, E_METHOD_CHACHA20_POLY1305, E_METHOD_XCHACHA20_POLY1305,
+		E_METHOD_AES_GCM_SIV, E_METHOD_AEGIS_128L, E_METHOD_ASCON_128} {
+		for _, version := range []byte{PROTOCOL_V1, PROTOCOL_V2, PROTOCOL_V5, PROTOCOL_V6} {
+			obfuscator, err := GenerateObfs(method, sessionKey, WithProtocolVersion(version))
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, _ := obfuscator.Obfs(&Frame{StreamID: 1, Seq: 5, Payload: []byte("authenticated")}, buf)
+			// the header is XORed with a keystream, so flipping bits of it flips the same bits of StreamID and Seq
+			buf[0] ^= 0x80
+			buf[11] ^= 0x01
+			if f, err := obfuscator.Deobfs(buf[:n]); !errors.Is(err, ErrAuthFailed) {
+				t.Errorf("%v v%v: expecting %v for a tampered StreamID and Seq, got %v: %v", method, version+1, ErrAuthFailed, f, err)
+			}
+		}
+	}
+}
+
+func TestExplicitNonce(t *testing.T) {
+	var salsaKey [32]byte
+	rand.Read(salsaKey[:])
+	block, _ := aes.NewCipher(salsaKey[:])
+
+	for _, nonceSize := range []int{16, 24} {
+		gcm, _ := cipher.NewGCMWithNonceSize(block, nonceSize)
+		aead := &recordingAEAD{AEAD: gcm}
+		config := ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V6}
+		obfs := MakeObfs(salsaKey, aead, config)
+		deobfs := MakeDeobfs(salsaKey, aead, config)
+		nonceStart := recordHeaderLen + config.headerLen()
+
+		obfsBuf := make([]byte, 512)
+		var frames [][]byte
+		for seq := uint64(0); seq < 2; seq++ {
+			testFrame := &Frame{StreamID: 1, Seq: seq, Payload: []byte("explicit nonce")}
+			n, err := obfs(testFrame, obfsBuf)
+			if err != nil {
+				t.Fatalf("%v byte nonce: %v", nonceSize, err)
+			}
+			if expected := nonceStart + nonceSize + len(testFrame.Payload) + gcm.Overhead(); n != expected {
+				t.Errorf("%v byte nonce: expecting a %v byte frame, got %v", nonceSize, expected, n)
+			}
+			frame := append([]byte{}, obfsBuf[:n]...)
+			frames = append(frames, frame)
+			// the whole nonce is carried between the header and the ciphertext
+			explicitNonce := frame[nonceStart : nonceStart+nonceSize]
+			if !bytes.Equal(aead.sealed[seq], explicitNonce) {
+				t.Errorf("%v byte nonce: sealed with %x rather than the %x carried in the frame", nonceSize, aead.sealed[seq], explicitNonce)
+			}
+
+			f, err := deobfs(frame)
+			if err != nil {
+				t.Fatalf("%v byte nonce: failed to deobfs: %v", nonceSize, err)
+			}
+			if !f.Equal(testFrame) {
+				t.Errorf("%v byte nonce: expecting %v, got %v", nonceSize, testFrame, f)
+			}
+			if !bytes.Equal(aead.opened[len(aead.opened)-1], explicitNonce) {
+				t.Errorf("%v byte nonce: opened with %x rather than %x", nonceSize, aead.opened[len(aead.opened)-1], explicitNonce)
+			}
+		}
+		if bytes.Equal(aead.sealed[0], aead.sealed[1]) {
+			t.Errorf("%v byte nonce: the same nonce was used twice", nonceSize)
+		}
+
+		tampered := frames[0]
+		tampered[nonceStart] ^= 0x01
+		if _, err := deobfs(tampered); !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("%v byte nonce: expecting %v for a tampered nonce, got %v", nonceSize, ErrAuthFailed, err)
+		}
+	}
+}
+
+func TestGenerateObfsWithAEAD(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	block, _ := aes.NewCipher(sessionKey)
+	gcm, _ := cipher.NewGCM(block)
+	obfsBuf := make([]byte, 512)
+
+	// below PROTOCOL_V3 the session key is both the header key and the AES key, so an AES-GCM AEAD made from it
+	// interoperates with E_METHOD_AES_GCM
+	external, err := GenerateObfsWithAEAD(sessionKey, gcm, WithRecordLayer(TLSRecordLayer{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	builtin, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+	testFrame := &Frame{StreamID: 1, Seq: 2, Closing: FlagFin, Payload: []byte("external")}
+	for _, pair := range [][2]*Obfuscator{{external, builtin}, {builtin, external}} {
+		n, err := pair[0].Obfs(testFrame, obfsBuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := pair[1].Deobfs(obfsBuf[:n])
+		if err != nil {
+			t.Fatalf("failed to deobfs: %v", err)
+		}
+		if !f.Equal(testFrame) {
+			t.Errorf("expecting %v, got %v", testFrame, f)
+		}
+	}
+
+	t.Run("explicit nonce", func(t *testing.T) {
+		xchacha, _ := chacha20poly1305.NewX(sessionKey)
+		headerKey := make([]byte, 32)
+		rand.Read(headerKey)
+		obfuscator, err := GenerateObfsWithAEAD(headerKey, xchacha, WithProtocolVersion(PROTOCOL_V9))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := obfuscator.Obfs(testFrame, obfsBuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != obfuscator.frameLen(len(testFrame.Payload)) {
+			t.Errorf("expecting a %v byte frame, got %v", obfuscator.frameLen(len(testFrame.Payload)), n)
+		}
+		if f, err := obfuscator.Deobfs(obfsBuf[:n]); err != nil || !f.Equal(testFrame) {
+			t.Errorf("failed to round trip: %v", err)
+		}
+		rand.Read(headerKey)
+		otherHeaderKey, _ := GenerateObfsWithAEAD(headerKey, xchacha, WithProtocolVersion(PROTOCOL_V9))
+		if _, err := otherHeaderKey.Deobfs(obfsBuf[:n]); err == nil {
+			t.Error("deobfsed a frame with another header key")
+		}
+
+		if err := obfuscator.Rekey(sessionKey); !errors.Is(err, ErrExternalAEADUnsupported) {
+			t.Errorf("expecting %v from Rekey, got %v", ErrExternalAEADUnsupported, err)
+		}
+		if _, err := obfuscator.Clone(sessionKey); !errors.Is(err, ErrExternalAEADUnsupported) {
+			t.Errorf("expecting %v from Clone, got %v", ErrExternalAEADUnsupported, err)
+		}
+		obfuscator.Close()
+		if _, err := obfuscator.Obfs(testFrame, obfsBuf); err != ErrObfuscatorClosed {
+			t.Errorf("expecting %v once closed, got %v", ErrObfuscatorClosed, err)
+		}
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		if _, err := GenerateObfsWithAEAD(sessionKey[:16], gcm); err != ErrBadHeaderKeySize {
+			t.Errorf("expecting %v for a 16 byte header key, got %v", ErrBadHeaderKeySize, err)
+		}
+		for name, opts := range map[string][]ObfsOption{
+			"nil AEAD":         nil,
+			"directional keys": {WithProtocolVersion(PROTOCOL_V3), WithRole(ROLE_CLIENT), WithDirectionalKeys()},
+		} {
+			aead := cipher.AEAD(gcm)
+			if opts == nil {
+				aead = nil
+			}
+			if _, err := GenerateObfsWithAEAD(sessionKey, aead, opts...); !errors.Is(err, ErrExternalAEADUnsupported) {
+				t.Errorf("%v: expecting %v, got %v", name, ErrExternalAEADUnsupported, err)
+			}
+		}
+		if _, err := GenerateObfsWithAEAD(sessionKey, gcm, WithTagLen(12)); err != ErrTagTruncationUnsupported {
+			t.Errorf("expecting %v, got %v", ErrTagTruncationUnsupported, err)
+		}
+	})
+
+	if E_METHOD_EXTERNAL.Valid() || E_METHOD_EXTERNAL.String() != "external" {
+		t.Errorf("expecting E_METHOD_EXTERNAL to be named external and not to be valid")
+	}
+}
+
+func TestObfsNoRecordLayerInPlace(t *testing.T) {
+	var key [32]byte
+	rand.Read(key[:])
+	payload := make([]byte, 1024)
+	rand.Read(payload)
+	for _, m := range benchMethods {
+		obfuscator, _ := GenerateObfs(m.method, key[:], WithRecordLayer(NoRecordLayer{}))
+		obfsBuf := make([]byte, obfuscator.frameLen(len(payload)))
+		layout := obfuscator.Layout(len(payload))
+		// the payload is sealed straight into the output buffer, even when it's already where it's sealed to
+		for _, offset := range []int{layout.Payload, 0, 5} {
+			testFrame := &Frame{StreamID: 1, Seq: 2, Payload: obfsBuf[offset : offset+len(payload)]}
+			if allocs := testing.AllocsPerRun(1, func() {
+				// AllocsPerRun runs it more than once, and each time the payload is overwritten
+				copy(obfsBuf[offset:], payload)
+				n, err := obfuscator.Obfs(testFrame, obfsBuf)
+				if err != nil || n != layout.End {
+					t.Errorf("%v offset %v: obfsed into %v bytes rather than %v: %v", m.name, offset, n, layout.End, err)
+				}
+			}); allocs != 0 {
+				t.Errorf("%v offset %v: expecting obfs not to allocate, got %v", m.name, offset, allocs)
+			}
+			f, err := obfuscator.Deobfs(obfsBuf[:layout.End])
+			if err != nil || !bytes.Equal(f.Payload, payload) {
+				t.Errorf("%v offset %v: payload aliasing the output doesn't round trip: %v", m.name, offset, err)
+			}
+		}
+	}
+}
+
+func TestDeobfsTo(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+	obfsBuf := make([]byte, 512)
+	testFrame := &Frame{StreamID: 3, Seq: 4, Closing: FlagFin, Payload: []byte("owned by the caller")}
+	n, _ := obfuscator.Obfs(testFrame, obfsBuf)
+
+	dst := make([]byte, n)
+	written, f, err := obfuscator.DeobfsTo(obfsBuf[:n], dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.StreamID != 3 || f.Seq != 4 || f.Closing != FlagFin || f.Payload != nil {
+		t.Errorf("unexpected frame %v", &f)
+	}
+	if !bytes.Equal(dst[:written], testFrame.Payload) {
+		t.Errorf("expecting %q, got %q", testFrame.Payload, dst[:written])
+	}
+
+	// the payload stays as it is through later calls
+	other := &Frame{StreamID: 3, Seq: 5, Payload: []byte("a different payload")}
+	m, _ := obfuscator.Obfs(other, obfsBuf)
+	if _, _, err := obfuscator.DeobfsTo(obfsBuf[:m], make([]byte, m)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dst[:written], testFrame.Payload) {
+		t.Error("payload was overwritten by a later call")
+	}
+
+	if _, _, err := obfuscator.DeobfsTo(obfsBuf[:m], make([]byte, 5)); !errors.Is(err, ErrBufferTooSmall) {
+		t.Errorf("expecting %v, got %v", ErrBufferTooSmall, err)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { obfuscator.DeobfsTo(obfsBuf[:m], dst) }); allocs != 0 {
+		t.Errorf("expecting no allocations once the pool is warm, got %v", allocs)
+	}
+}
+
+func TestRejectEmptyData(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	strict, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}), WithRejectEmptyData())
+	lax, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+	buf := make([]byte, 200)
+
+	empty := &Frame{StreamID: 1, Seq: 0}
+	if _, err := strict.Obfs(empty, buf); err != ErrEmptyDataFrame {
+		t.Errorf("expecting %v sending an empty data frame, got %v", ErrEmptyDataFrame, err)
+	}
+	n, _ := lax.Obfs(empty, buf)
+	if _, err := strict.Deobfs(buf[:n]); !errors.Is(err, ErrEmptyDataFrame) {
+		t.Errorf("expecting %v receiving an empty data frame, got %v", ErrEmptyDataFrame, err)
+	}
+	if _, err := lax.Deobfs(buf[:n]); err != nil {
+		t.Errorf("expecting empty data frames to be accepted by default, got %v", err)
+	}
+
+	for _, f := range []*Frame{
+		{StreamID: 1, Seq: 1, Closing: FlagFin},
+		{StreamID: 1, Seq: 1, Closing: FlagRst},
+		{StreamID: 0xffffffff, Closing: C_SESSION},
+		{StreamID: 0, Closing: FlagPadding},
+		{StreamID: 0, Closing: FlagControl},
+		{StreamID: HandshakeStreamID, Closing: FlagHandshake},
+		{StreamID: 1, Seq: 1, Payload: []byte("data")},
+	} {
+		n, err := strict.Obfs(f, buf)
+		if err != nil {
+			t.Errorf("%v: %v", f, err)
+			continue
+		}
+		if _, err := strict.Deobfs(buf[:n]); err != nil {
+			t.Errorf("%v: %v", f, err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package multiplex
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// PaddingPolicy decides how much random padding is added to each frame, so that the length of a record on the wire
+// doesn't give away the length of the payload it carries.
+//
+// Padding is recorded in the header's extraLen on top of the AEAD overhead, so no more than 255 bytes of overhead
+// and padding can be added to a frame altogether, or 65535 bytes from PROTOCOL_V9, and padding is cut short if it
+// doesn't fit into the buffer given to the Obfser. AEAD frames can only be padded from PROTOCOL_V2, where extraLen
+// is authenticated, and a PROTOCOL_V1 Deobfser refuses AEAD frames whose extraLen isn't exactly the overhead. The
+// receiving end strips padding through extraLen, so it needs no padding policy of its own.
+type PaddingPolicy interface {
+	// PaddingLen returns how many bytes should be added to a frame that would be frameLen bytes long on the wire
+	// without padding
+	PaddingLen(frameLen int) int
+}
+
+// BucketPadding pads each frame up to the smallest of the bucket lengths it fits into. Frames longer than the
+// largest bucket, or ones that would need more padding than a frame can carry, are left as they are. The buckets
+// must be sorted in ascending order
+type BucketPadding []int
+
+func (b BucketPadding) PaddingLen(frameLen int) int {
+	i := sort.SearchInts(b, frameLen)
+	if i == len(b) {
+		return 0
+	}
+	return b[i] - frameLen
+}
+
+// UniformPadding adds between 0 and UniformPadding bytes of padding to each frame, chosen uniformly at random
+type UniformPadding int
+
+func (u UniformPadding) PaddingLen(int) int {
+	if u <= 0 {
+		return 0
+	}
+	return rand.Intn(int(u) + 1)
+}
+
+// SampledPadding pads each frame up to a length drawn at random from a sample of record lengths, such as those
+// observed in real HTTPS traffic. Only lengths that are no shorter than the frame are drawn from, so the
+// distribution of frame lengths follows that of the sample above the length of the frame. Frames longer than all of
+// the sample are left as they are. The sample must be sorted in ascending order
+type SampledPadding []int
+
+func (s SampledPadding) PaddingLen(frameLen int) int {
+	i := sort.SearchInts(s, frameLen)
+	if i == len(s) {
+		return 0
+	}
+	return s[i+rand.Intn(len(s)-i)] - frameLen
+}
+
+// ProfilePadding pads frames to follow a sequence of record lengths, such as the one a browser produces at the start of
+// a TLS session. The nth frame padded is padded up to Lengths[n], and once the sequence runs out the padding of the
+// rest of the frames is decided by Tail, if it isn't nil. A frame longer than its length in the sequence is left as it
+// is, and still takes that place in it. Splitting frames that are too long is up to the sender, which chooses the
+// payload of each frame. A ProfilePadding keeps count of the frames padded, so each session needs one of its own, as
+// returned by NewProfilePadding, ChromeRecordProfile or FirefoxRecordProfile. It's safe for concurrent use.
+//
+// Most lengths of the built-in profiles are more than 255 bytes above a frame of a small payload, so they can only be
+// padded up to from PROTOCOL_V9, where extraLen is 16 bits wide. Before that the padding is cut short.
+type ProfilePadding struct {
+	Lengths []int
+	Tail    PaddingPolicy
+
+	mu   sync.Mutex
+	next int
+}
+
+func NewProfilePadding(lengths []int, tail PaddingPolicy) *ProfilePadding {
+	return &ProfilePadding{Lengths: lengths, Tail: tail}
+}
+
+func (p *ProfilePadding) PaddingLen(frameLen int) int {
+	p.mu.Lock()
+	if p.next == len(p.Lengths) {
+		p.mu.Unlock()
+		if p.Tail == nil {
+			return 0
+		}
+		return p.Tail.PaddingLen(frameLen)
+	}
+	target := p.Lengths[p.next]
+	p.next++
+	p.mu.Unlock()
+	if target <= frameLen {
+		return 0
+	}
+	return target - frameLen
+}
+
+// The lengths of the records TLS 1.3 sessions of browsers start with, including the 5 byte record header: a large first
+// one carrying the HTTP/2 preface, SETTINGS and the HEADERS of the first requests, followed by a run of records cut
+// to fit a TCP segment. Full records of 16384 bytes of plaintext are 16406 bytes long
+var (
+	chromeRecordLengths  = []int{1257, 1440, 1440, 1440, 1440, 1440, 1440, 1440}
+	firefoxRecordLengths = []int{865, 1389, 1389, 1389, 1389, 1389, 1389}
+)
+
+// ChromeRecordProfile returns a ProfilePadding after the records sent by Chrome, padding the rest of the frames up to
+// a segment sized or a full record
+func ChromeRecordProfile() *ProfilePadding {
+	return NewProfilePadding(chromeRecordLengths, BucketPadding{1440, 16406})
+}
+
+// FirefoxRecordProfile returns a ProfilePadding after the records sent by Firefox, padding the rest of the frames up to
+// a segment sized or a full record
+func FirefoxRecordProfile() *ProfilePadding {
+	return NewProfilePadding(firefoxRecordLengths, BucketPadding{1389, 16406})
+}
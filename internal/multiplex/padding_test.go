@@ -0,0 +1,203 @@
+package multiplex
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestPaddingPolicies(t *testing.T) {
+	t.Run("bucket", func(t *testing.T) {
+		b := BucketPadding{100, 500, 1000}
+		cases := map[int]int{50: 50, 100: 0, 101: 399, 1000: 0, 1001: 0}
+		for frameLen, expected := range cases {
+			if p := b.PaddingLen(frameLen); p != expected {
+				t.Errorf("frame of %v: expecting %v bytes of padding, got %v", frameLen, expected, p)
+			}
+		}
+	})
+	t.Run("uniform", func(t *testing.T) {
+		u := UniformPadding(10)
+		seen := make(map[int]bool)
+		for i := 0; i < 1000; i++ {
+			p := u.PaddingLen(100)
+			if p < 0 || p > 10 {
+				t.Fatalf("padding %v out of range", p)
+			}
+			seen[p] = true
+		}
+		if len(seen) != 11 {
+			t.Errorf("expecting all 11 padding lengths, got %v", len(seen))
+		}
+		if p := UniformPadding(0).PaddingLen(100); p != 0 {
+			t.Errorf("expecting no padding, got %v", p)
+		}
+	})
+	t.Run("sampled", func(t *testing.T) {
+		s := SampledPadding{100, 200, 300}
+		for i := 0; i < 100; i++ {
+			p := s.PaddingLen(150)
+			if p != 50 && p != 150 {
+				t.Fatalf("frame of 150 padded by %v, which isn't up to a sampled length above it", p)
+			}
+		}
+		if p := s.PaddingLen(301); p != 0 {
+			t.Errorf("expecting no padding, got %v", p)
+		}
+	})
+	t.Run("profile", func(t *testing.T) {
+		p := NewProfilePadding([]int{500, 100, 300}, BucketPadding{1000})
+		for i, c := range []struct{ frameLen, expected int }{
+			{200, 300},
+			// a frame longer than its place in the profile still takes it
+			{150, 0},
+			{100, 200},
+			{100, 900},
+			{100, 900},
+		} {
+			if padding := p.PaddingLen(c.frameLen); padding != c.expected {
+				t.Errorf("frame %v of %v: expecting %v bytes of padding, got %v", i, c.frameLen, c.expected, padding)
+			}
+		}
+		if padding := NewProfilePadding([]int{500}, nil); padding.PaddingLen(100) != 400 || padding.PaddingLen(100) != 0 {
+			t.Error("expecting no padding once a profile without a tail runs out")
+		}
+	})
+}
+
+func TestObfsWithPadding(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+
+	methods := map[string]Method{
+		"plain":              E_METHOD_PLAIN,
+		"aes-gcm":            E_METHOD_AES_GCM,
+		"chacha20-poly1305":  E_METHOD_CHACHA20_POLY1305,
+		"xchacha20-poly1305": E_METHOD_XCHACHA20_POLY1305,
+	}
+	for name, method := range methods {
+		t.Run(name, func(t *testing.T) {
+			sender, _ := GenerateObfsWithConfig(method, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V2, Padding: BucketPadding{300}})
+			receiver, _ := GenerateObfsWithConfig(method, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V2})
+
+			testFrame := &Frame{StreamID: 1, Seq: 1, Payload: make([]byte, 100)}
+			rand.Read(testFrame.Payload)
+			obfsBuf := make([]byte, 512)
+			n, err := sender.Obfs(testFrame, obfsBuf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 300 {
+				t.Errorf("expecting a frame of 300 bytes, got %v", n)
+			}
+			f, err := receiver.Deobfs(obfsBuf[:n])
+			if err != nil {
+				t.Fatalf("failed to deobfs: %v", err)
+			}
+			if !bytes.Equal(f.Payload, testFrame.Payload) {
+				t.Error("payload mismatch")
+			}
+		})
+	}
+
+	t.Run("limited by extraLen", func(t *testing.T) {
+		obfuscator, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V2, Padding: UniformPadding(1000)})
+		testFrame := &Frame{StreamID: 1, Payload: make([]byte, 100)}
+		obfsBuf := make([]byte, 2000)
+		for i := 0; i < 100; i++ {
+			n, _ := obfuscator.Obfs(testFrame, obfsBuf)
+			if n > obfuscator.frameLen(100)+255-16 {
+				t.Fatalf("frame of %v bytes carries more than 255 bytes of extra", n)
+			}
+			if _, err := obfuscator.Deobfs(obfsBuf[:n]); err != nil {
+				t.Fatalf("failed to deobfs: %v", err)
+			}
+		}
+	})
+
+	t.Run("wide extraLen", func(t *testing.T) {
+		buckets := BucketPadding{512, 1024, 1460, 16384}
+		obfuscator, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V9, Padding: buckets})
+		obfsBuf := make([]byte, 20000)
+		for pldLen, expected := range map[int]int{10: 512, 600: 1024, 1100: 1460, 1500: 16384} {
+			testFrame := &Frame{StreamID: 1, Payload: make([]byte, pldLen)}
+			rand.Read(testFrame.Payload)
+			n, err := obfuscator.Obfs(testFrame, obfsBuf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != expected {
+				t.Errorf("payload of %v: expecting a frame of %v bytes, got %v", pldLen, expected, n)
+			}
+			f, err := obfuscator.Deobfs(obfsBuf[:n])
+			if err != nil {
+				t.Fatalf("payload of %v: failed to deobfs: %v", pldLen, err)
+			}
+			if !bytes.Equal(f.Payload, testFrame.Payload) {
+				t.Errorf("payload of %v: payload mismatch", pldLen)
+			}
+		}
+	})
+
+	t.Run("browser profile", func(t *testing.T) {
+		for name, profile := range map[string]*ProfilePadding{"chrome": ChromeRecordProfile(), "firefox": FirefoxRecordProfile()} {
+			obfuscator, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V9, Padding: profile})
+			obfsBuf := make([]byte, 20000)
+			for i, expected := range append(append([]int{}, profile.Lengths...), profile.Tail.(BucketPadding)...) {
+				testFrame := &Frame{StreamID: 1, Seq: uint64(i), Payload: make([]byte, 100)}
+				if i == len(profile.Lengths)+1 {
+					// a frame too long for the segment sized bucket is padded up to a full record
+					testFrame.Payload = make([]byte, 2000)
+				}
+				n, err := obfuscator.Obfs(testFrame, obfsBuf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != expected {
+					t.Errorf("%v: expecting frame %v to be %v bytes, got %v", name, i, expected, n)
+				}
+				if _, err := obfuscator.Deobfs(obfsBuf[:n]); err != nil {
+					t.Fatalf("%v: failed to deobfs frame %v: %v", name, i, err)
+				}
+			}
+		}
+	})
+
+	t.Run("limited by buffer", func(t *testing.T) {
+		obfuscator, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V2, Padding: BucketPadding{1000}})
+		testFrame := &Frame{StreamID: 1, Payload: make([]byte, 100)}
+		obfsBuf := make([]byte, obfuscator.frameLen(100)+10)
+		n, err := obfuscator.Obfs(testFrame, obfsBuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(obfsBuf) {
+			t.Errorf("expecting padding to fill the %v byte buffer, got %v", len(obfsBuf), n)
+		}
+	})
+}
+
+func TestPaddingNeedsAuthenticatedExtraLen(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	if _, err := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{Padding: UniformPadding(10)}); !errors.Is(err, ErrPaddingUnsupported) {
+		t.Errorf("expecting %v, got %v", ErrPaddingUnsupported, err)
+	}
+	if _, err := GenerateObfsWithConfig(E_METHOD_PLAIN, sessionKey, ObfsConfig{Padding: UniformPadding(10)}); err != nil {
+		t.Errorf("plain frames can be padded in PROTOCOL_V1, got %v", err)
+	}
+
+	// a PROTOCOL_V2 header only differs in what it authenticates, so a padded frame parses as a PROTOCOL_V1 one
+	sender, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V2, Padding: BucketPadding{300}})
+	receiver, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}})
+	obfsBuf := make([]byte, 512)
+	n, _ := sender.Obfs(&Frame{StreamID: 1, Payload: make([]byte, 100)}, obfsBuf)
+	if _, err := receiver.Deobfs(obfsBuf[:n]); !errors.Is(err, ErrExtraLenMismatch) {
+		t.Errorf("expecting %v, got %v", ErrExtraLenMismatch, err)
+	}
+	n, _ = receiver.Obfs(&Frame{StreamID: 1, Payload: make([]byte, 100)}, obfsBuf)
+	if _, err := receiver.Deobfs(obfsBuf[:n]); err != nil {
+		t.Errorf("failed to deobfs an unpadded frame: %v", err)
+	}
+}
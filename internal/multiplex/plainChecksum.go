@@ -0,0 +1,31 @@
+package multiplex
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// plainChecksumLen is the length of the CRC32C appended when ObfsConfig.PlainChecksum is used
+const plainChecksumLen = 4
+
+// ErrChecksumMismatch is returned by a Deobfser when the CRC32C of ObfsConfig.PlainChecksum doesn't match the frame,
+// which means it was corrupted on the way
+var ErrChecksumMismatch = errors.New("plain frame checksum mismatch")
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// putPlainChecksum writes the CRC32C of header and body into dst, which must be plainChecksumLen long. The body may be
+// given in fragments
+func putPlainChecksum(dst, header []byte, body ...[]byte) {
+	crc := crc32.Update(0, castagnoliTable, header)
+	for _, fragment := range body {
+		crc = crc32.Update(crc, castagnoliTable, fragment)
+	}
+	binary.BigEndian.PutUint32(dst, crc)
+}
+
+func verifyPlainChecksum(checksum, header, body []byte) bool {
+	crc := crc32.Update(crc32.Update(0, castagnoliTable, header), castagnoliTable, body)
+	return binary.BigEndian.Uint32(checksum) == crc
+}
@@ -0,0 +1,107 @@
+package multiplex
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestPlainChecksum(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfsBuf := make([]byte, 512)
+
+	configs := map[string]ObfsConfig{
+		"v1":           {RecordLayer: TLSRecordLayer{}, PlainChecksum: true},
+		"v5":           {RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V5, PlainChecksum: true},
+		"v6 with mac":  {RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V6, PlainChecksum: true, PlainMAC: true},
+		"v6 padded":    {RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V6, PlainChecksum: true, Padding: UniformPadding(50)},
+		"no rl, v9":    {ProtocolVersion: PROTOCOL_V9, PlainChecksum: true},
+		"websocket v6": {RecordLayer: WebSocketRecordLayer{Mask: true}, ProtocolVersion: PROTOCOL_V6, PlainChecksum: true},
+	}
+	for name, config := range configs {
+		obfuscator, err := GenerateObfsWithConfig(E_METHOD_PLAIN, sessionKey, config)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		withoutChecksum := config
+		withoutChecksum.PlainChecksum = false
+		unchecked, _ := GenerateObfsWithConfig(E_METHOD_PLAIN, sessionKey, withoutChecksum)
+		if config.Padding == nil && obfuscator.Overhead() != unchecked.Overhead()+plainChecksumLen {
+			t.Errorf("%v: expecting the checksum to add %v bytes of overhead, got %v", name, plainChecksumLen, obfuscator.Overhead()-unchecked.Overhead())
+		}
+
+		for _, pldLen := range []int{0, 1, 4, 7, 8, 100} {
+			testFrame := &Frame{StreamID: 1, Seq: 1, Closing: FlagFin, Payload: make([]byte, pldLen)}
+			rand.Read(testFrame.Payload)
+			n, err := obfuscator.Obfs(testFrame, obfsBuf)
+			if err != nil {
+				t.Fatalf("%v %v: %v", name, pldLen, err)
+			}
+			if config.Padding == nil && n != obfuscator.frameLen(pldLen) {
+				t.Errorf("%v %v: expecting a %v byte frame, got %v", name, pldLen, obfuscator.frameLen(pldLen), n)
+			}
+			f, err := obfuscator.Deobfs(obfsBuf[:n])
+			if err != nil {
+				t.Fatalf("%v %v: failed to deobfs: %v", name, pldLen, err)
+			}
+			if !bytes.Equal(f.Payload, testFrame.Payload) || f.Closing != testFrame.Closing {
+				t.Errorf("%v %v: frame mismatch", name, pldLen)
+			}
+		}
+	}
+
+	t.Run("corruption", func(t *testing.T) {
+		obfuscator, _ := GenerateObfsWithConfig(E_METHOD_PLAIN, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V6, PlainChecksum: true})
+		testFrame := &Frame{StreamID: 1, Seq: 1, Payload: make([]byte, 100)}
+		n, _ := obfuscator.Obfs(testFrame, obfsBuf)
+		// the record length, the header, the payload, the checksum and the header nonce
+		for _, i := range []int{4, recordHeaderLen + 3, recordHeaderLen + HEADER_LEN + 50, n - 9, n - 1} {
+			corrupted := append([]byte{}, obfsBuf[:n]...)
+			corrupted[i] ^= 0x10
+			if _, err := obfuscator.Deobfs(corrupted); !errors.Is(err, ErrChecksumMismatch) {
+				t.Errorf("byte %v corrupted: expecting %v, got %v", i, ErrChecksumMismatch, err)
+			}
+		}
+	})
+
+	t.Run("stripped as extra", func(t *testing.T) {
+		obfuscator, _ := GenerateObfsWithConfig(E_METHOD_PLAIN, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, PlainChecksum: true})
+		withoutChecksum, _ := GenerateObfsWithConfig(E_METHOD_PLAIN, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}})
+		n, _ := obfuscator.Obfs(&Frame{StreamID: 1, Seq: 1, Payload: make([]byte, 100)}, obfsBuf)
+		f, err := withoutChecksum.Deobfs(obfsBuf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(f.Payload) != 100 {
+			t.Errorf("expecting the checksum to be stripped as extra, got a payload of %v", len(f.Payload))
+		}
+	})
+
+	t.Run("no effect with AEAD", func(t *testing.T) {
+		with, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, PlainChecksum: true})
+		without, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}})
+		if with.Overhead() != without.Overhead() {
+			t.Errorf("expecting no checksum on AEAD frames")
+		}
+	})
+}
+
+func TestPlainChecksumAllocs(t *testing.T) {
+	var key [32]byte
+	rand.Read(key[:])
+	obfuscator, _ := GenerateObfsWithConfig(E_METHOD_PLAIN, key[:], ObfsConfig{RecordLayer: TLSRecordLayer{}, PlainChecksum: true, PooledDeobfs: true})
+	testFrame := &Frame{StreamID: 1, Payload: make([]byte, 1024)}
+	obfsBuf := make([]byte, obfuscator.frameLen(len(testFrame.Payload)))
+	n, _ := obfuscator.Obfs(testFrame, obfsBuf)
+	if allocs := testing.AllocsPerRun(100, func() { obfuscator.Obfs(testFrame, obfsBuf) }); allocs != 0 {
+		t.Errorf("expecting obfs not to allocate, got %v", allocs)
+	}
+	if allocs := testing.AllocsPerRun(100, func() {
+		f, _ := obfuscator.Deobfs(obfsBuf[:n])
+		ReleaseFrame(f)
+	}); allocs != 0 {
+		t.Errorf("expecting pooled deobfs not to allocate, got %v", allocs)
+	}
+}
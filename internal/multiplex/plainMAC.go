@@ -0,0 +1,61 @@
+package multiplex
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"sync"
+)
+
+// plainMACLen is the length HMAC-SHA256 is truncated to when ObfsConfig.PlainMAC is used
+const plainMACLen = 16
+
+var errPlainMACMismatch = errors.New("plain frame MAC mismatch")
+
+// plainMAC authenticates the header and payload of E_METHOD_PLAIN frames, which otherwise have no integrity at all.
+// The key is derived from the header key, so no key needs to be passed around separately
+type plainMAC struct {
+	key  [32]byte
+	pool sync.Pool // *macState
+}
+
+type macState struct {
+	h   hash.Hash
+	sum [sha256.Size]byte
+}
+
+func newPlainMAC(salsaKey [32]byte) *plainMAC {
+	m := &plainMAC{key: deriveSubkey(salsaKey[:], plainMACKeyInfo)}
+	m.pool.New = func() interface{} {
+		return &macState{h: hmac.New(sha256.New, m.key[:])}
+	}
+	return m
+}
+
+// wipe zeroes the key. HMAC states already in the pool keep what they derived from it
+func (m *plainMAC) wipe() {
+	m.key = [32]byte{}
+}
+
+// sum writes the MAC of header and body into dst, which must be plainMACLen long. The body may be given in fragments
+func (m *plainMAC) sum(dst, header []byte, body ...[]byte) {
+	s := m.pool.Get().(*macState)
+	s.h.Reset()
+	s.h.Write(header)
+	for _, fragment := range body {
+		s.h.Write(fragment)
+	}
+	copy(dst, s.h.Sum(s.sum[:0]))
+	m.pool.Put(s)
+}
+
+func (m *plainMAC) verify(mac, header, body []byte) bool {
+	s := m.pool.Get().(*macState)
+	s.h.Reset()
+	s.h.Write(header)
+	s.h.Write(body)
+	ok := hmac.Equal(mac, s.h.Sum(s.sum[:0])[:plainMACLen])
+	m.pool.Put(s)
+	return ok
+}
@@ -0,0 +1,63 @@
+package multiplex
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestPlainMAC(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfsWithConfig(E_METHOD_PLAIN, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, PlainMAC: true})
+
+	obfsBuf := make([]byte, 512)
+	for _, pldLen := range []int{0, 1, 7, 8, 100} {
+		testFrame := &Frame{StreamID: 1, Seq: 1, Payload: make([]byte, pldLen)}
+		rand.Read(testFrame.Payload)
+		n, err := obfuscator.Obfs(testFrame, obfsBuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != obfuscator.Overhead()+pldLen {
+			t.Errorf("payload of %v: expecting frame of %v bytes, got %v", pldLen, obfuscator.Overhead()+pldLen, n)
+		}
+		f, err := obfuscator.Deobfs(obfsBuf[:n])
+		if err != nil {
+			t.Fatalf("payload of %v: failed to deobfs: %v", pldLen, err)
+		}
+		if !bytes.Equal(f.Payload, testFrame.Payload) {
+			t.Errorf("payload of %v: payload mismatch", pldLen)
+		}
+	}
+
+	testFrame := &Frame{StreamID: 1, Seq: 1, Payload: make([]byte, 100)}
+	n, _ := obfuscator.Obfs(testFrame, obfsBuf)
+	tamper := func(i int) []byte {
+		tampered := make([]byte, n)
+		copy(tampered, obfsBuf[:n])
+		tampered[i] ^= 0x01
+		return tampered
+	}
+	// closing byte and payload
+	for _, i := range []int{5 + 12, 5 + HEADER_LEN + 50} {
+		if _, err := obfuscator.Deobfs(tamper(i)); !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("byte %v tampered: expecting %v, got %v", i, ErrAuthFailed, err)
+		}
+	}
+	// the end of the MAC is also the header's salsa20 nonce, so the header may come out garbled enough to be
+	// rejected before the MAC is even checked
+	if _, err := obfuscator.Deobfs(tamper(n - 1)); err == nil {
+		t.Error("frame with a tampered MAC accepted")
+	}
+
+	withoutMAC, _ := GenerateObfsWithConfig(E_METHOD_PLAIN, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}})
+	f, err := withoutMAC.Deobfs(obfsBuf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Payload) != 100 {
+		t.Errorf("expecting the MAC to be stripped as extra, got a payload of %v", len(f.Payload))
+	}
+}
@@ -0,0 +1,743 @@
+package multiplex
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	prand "math/rand"
+)
+
+// RecordLayer is the framing obfsed frames are wrapped in on the wire, so that they look like the records of another
+// protocol. Unlike the frames they carry, record layers are neither encrypted nor, for the most part, authenticated.
+type RecordLayer interface {
+	// HeaderLen returns the length of the header in front of a frame of frameLen bytes. It's given the length
+	// because some headers, such as WebSocket's, encode it in a varying number of bytes
+	HeaderLen(frameLen int) int
+	// Wrap writes the header of a record carrying a frame of frameLen bytes into dst, which is HeaderLen(frameLen)
+	// bytes long, and returns the number of bytes written. It's only given the length as the frame may not be
+	// contiguous in memory, such as when E_METHOD_PLAIN payloads are referenced by Obfuscator.ObfsBuffers
+	Wrap(dst []byte, frameLen int) int
+	// Unwrap finds the frame carried by the record in, which is in[offset:offset+length]. It must not modify in
+	Unwrap(in []byte) (offset, length int, err error)
+}
+
+// masker is implemented by record layers that may mask the frame they carry by XORing it with a 4 byte key, which is
+// done to the whole frame once it has been obfsed, and undone before it's deobfsed
+type masker interface {
+	// masks returns whether the frames written by Wrap should be masked
+	masks() bool
+	// maskKey returns the key a record written by Wrap or accepted by Unwrap is masked with, or nil if it isn't
+	maskKey(record []byte) []byte
+}
+
+// dummyRecorder is implemented by record layers that may send a dummy record of their own in front of the record
+// carrying a frame. Unwrap skips over such records, and returns ErrDummyRecord if there's nothing but them
+type dummyRecorder interface {
+	// maxDummyLen is the length of the longest dummy record, or 0 if none is ever sent
+	maxDummyLen() int
+	// dummyLen decides whether a dummy record is sent in front of the next frame, and returns its length or 0
+	dummyLen() int
+	// putDummy writes a dummy record of dummyLen bytes into dst
+	putDummy(dst []byte)
+}
+
+// recordSplitter is implemented by record layers that limit the length of a record, and may split frames that are too
+// long for one across several records
+type recordSplitter interface {
+	// maxFrameLen is the length of the longest frame that can be sent
+	maxFrameLen() int
+	// splitLen is the length of the records frames of at least splitLen bytes are split into, or 0 if frames aren't
+	// split
+	splitLen() int
+	// split rearranges the HeaderLen(frameLen) bytes written by Wrap and the frameLen bytes following them into the
+	// records the frame is split across
+	split(records []byte, frameLen int)
+}
+
+// lengthAuthenticator is implemented by record layers whose header ends with a length field that is authenticated
+// along with the frame header from PROTOCOL_V6
+type lengthAuthenticator interface {
+	authenticatedLen() int
+}
+
+// recordDelimiter is implemented by record layers whose headers say how long the record is, so that
+// Obfuscator.DeobfsAll can find where each of several records received together ends
+type recordDelimiter interface {
+	// recordLen returns the length of the record at the start of in, header included, or 0 if in is too short to
+	// tell where it ends. It returns the error of checkFrameLen if the record carries a frame that is too long
+	recordLen(in []byte, maxFrameSize int) (int, error)
+}
+
+// NoRecordLayer sends frames as they are. The transport has to find their boundaries by itself
+type NoRecordLayer struct{}
+
+func (NoRecordLayer) HeaderLen(int) int                  { return 0 }
+func (NoRecordLayer) Wrap([]byte, int) int               { return 0 }
+func (NoRecordLayer) Unwrap(in []byte) (int, int, error) { return 0, len(in), nil }
+
+const (
+	// maxSplitFrameLen is the length of the longest frame TLSRecordLayer splits across records, and that FrameReader
+	// joins records into. It's also the longest frame sent with a 4 byte LengthPrefixRecordLayer
+	maxSplitFrameLen = 1 << 20
+
+	tlsApplicationData  = 0x17
+	tlsChangeCipherSpec = 0x14
+	// TLS 1.2, which is also the legacy version TLS 1.3 records carry
+	tlsVersion12 = 0x0303
+	// a change_cipher_spec record carries the single byte 1
+	ccsRecordLen = recordHeaderLen + 1
+)
+
+// TLSRecordLayer prepends the 5 byte header of a TLS application data record
+type TLSRecordLayer struct {
+	// Strict makes Unwrap check that the record is an application data record of one of Versions, that any records in
+	// front of it are change_cipher_spec records this TLSRecordLayer could have sent, and that the length fields match
+	// the length of the input. Misframed input is then rejected with ErrBadRecordLayer before any decryption is
+	// attempted. Otherwise change_cipher_spec, alert and handshake records in front of the frame are skipped over
+	// without looking into them, and the header of the record carrying the frame is skipped over as well
+	Strict bool
+	// Versions are the legacy versions records are written with, one of them picked at random for each record. Records
+	// are written as TLS 1.2 if it's empty
+	Versions []uint16
+	// CCSProbability is how likely, between 0 and 1, a dummy change_cipher_spec record is sent in front of a record
+	CCSProbability float64
+	// MaxRecordLen splits frames across several records of MaxRecordLen bytes, followed by one that is shorter (and
+	// may be empty) to mark the end of the frame. Such frames can only be deobfsed after being read by a FrameReader
+	// with the same MaxRecordLen, and frames can then be up to maxSplitFrameLen bytes long. Without it, frames longer
+	// than a 16 bit record length are refused with ErrRecordTooLarge. Real TLS records are at most 16384 bytes long,
+	// and MaxRecordLen can't be more than 65535, the longest a record length can be
+	MaxRecordLen int
+}
+
+// records is the number of records a frame of frameLen bytes is sent in
+func (t TLSRecordLayer) records(frameLen int) int {
+	if t.MaxRecordLen <= 0 {
+		return 1
+	}
+	return frameLen/t.MaxRecordLen + 1
+}
+
+func (t TLSRecordLayer) HeaderLen(frameLen int) int { return t.records(frameLen) * recordHeaderLen }
+func (TLSRecordLayer) authenticatedLen() int        { return 2 }
+
+func (t TLSRecordLayer) maxFrameLen() int {
+	if t.MaxRecordLen > 0 {
+		return maxSplitFrameLen
+	}
+	return math.MaxUint16
+}
+
+func (t TLSRecordLayer) splitLen() int {
+	if t.MaxRecordLen > 0 {
+		return t.MaxRecordLen
+	}
+	return 0
+}
+
+// split moves the header written by Wrap and the frame following it into records of MaxRecordLen bytes, each with a
+// header of the same version. The records are laid out from the front of records, so each part of the frame is
+// moved towards the front before anything overwrites it
+func (t TLSRecordLayer) split(records []byte, frameLen int) {
+	n := t.records(frameLen)
+	if n == 1 {
+		return
+	}
+	first := records[(n-1)*recordHeaderLen:]
+	version := binary.BigEndian.Uint16(first[1:3])
+	frame := first[recordHeaderLen : recordHeaderLen+frameLen]
+	// the first header is moved along with the first part of the frame, which it authenticates the length of
+	i := copy(records, first[:recordHeaderLen+t.MaxRecordLen])
+	for read := t.MaxRecordLen; read <= frameLen; read += t.MaxRecordLen {
+		recordLen := frameLen - read
+		if recordLen > t.MaxRecordLen {
+			recordLen = t.MaxRecordLen
+		}
+		record := records[i : i+recordHeaderLen+recordLen]
+		record[0] = tlsApplicationData
+		binary.BigEndian.PutUint16(record[1:3], version)
+		binary.BigEndian.PutUint16(record[3:5], uint16(recordLen))
+		copy(record[recordHeaderLen:], frame[read:read+recordLen])
+		i += len(record)
+	}
+}
+
+// recordLen returns the length of the record at the start of in. A full length record of a split frame is followed by
+// the rest of the frame's records, which are all included up to the shorter one that ends it
+func (t TLSRecordLayer) recordLen(in []byte, maxFrameSize int) (int, error) {
+	n, frameLen := 0, 0
+	for {
+		if len(in)-n < recordHeaderLen {
+			return 0, nil
+		}
+		record := in[n:]
+		recordLen := int(binary.BigEndian.Uint16(record[3:5]))
+		n += recordHeaderLen + recordLen
+		frameLen += recordLen
+		if err := checkFrameLen(frameLen, maxFrameSize); err != nil {
+			return 0, err
+		}
+		if t.MaxRecordLen <= 0 || recordLen != t.MaxRecordLen || record[0] != tlsApplicationData {
+			return n, nil
+		}
+	}
+}
+
+// join strips the headers of all but the first of the records of a split frame in place, as a FrameReader with the
+// same MaxRecordLen does, and returns the one record carrying the whole frame
+func (t TLSRecordLayer) join(records []byte) []byte {
+	if t.MaxRecordLen <= 0 || len(records) <= recordHeaderLen+t.MaxRecordLen {
+		return records
+	}
+	joined := recordHeaderLen + t.MaxRecordLen
+	for read := joined; read < len(records); {
+		recordLen := int(binary.BigEndian.Uint16(records[read+3 : read+5]))
+		joined += copy(records[joined:], records[read+recordHeaderLen:read+recordHeaderLen+recordLen])
+		read += recordHeaderLen + recordLen
+	}
+	return records[:joined]
+}
+
+func (t TLSRecordLayer) version() uint16 {
+	switch len(t.Versions) {
+	case 0:
+		return tlsVersion12
+	case 1:
+		return t.Versions[0]
+	default:
+		return t.Versions[prand.Intn(len(t.Versions))]
+	}
+}
+
+func (t TLSRecordLayer) acceptsVersion(version uint16) bool {
+	if len(t.Versions) == 0 {
+		return version == tlsVersion12
+	}
+	for _, v := range t.Versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap writes the header of the first record the frame is sent in. If the frame is split, the header is written at
+// the end of dst, right in front of the frame, so that its length can be authenticated along with the frame header.
+// The frame is then split into records by split once it's been obfsed
+func (t TLSRecordLayer) Wrap(dst []byte, frameLen int) int {
+	recordLen := frameLen
+	if t.records(frameLen) > 1 {
+		recordLen = t.MaxRecordLen
+	}
+	// We don't use util.AddRecordLayer here to avoid unnecessary malloc
+	header := dst[len(dst)-recordHeaderLen:]
+	header[0] = tlsApplicationData
+	binary.BigEndian.PutUint16(header[1:3], t.version())
+	binary.BigEndian.PutUint16(header[3:5], uint16(recordLen))
+	return len(dst)
+}
+
+func (t TLSRecordLayer) maxDummyLen() int {
+	if t.CCSProbability > 0 {
+		return ccsRecordLen
+	}
+	return 0
+}
+
+func (t TLSRecordLayer) dummyLen() int {
+	if t.CCSProbability > 0 && prand.Float64() < t.CCSProbability {
+		return ccsRecordLen
+	}
+	return 0
+}
+
+func (t TLSRecordLayer) putDummy(dst []byte) {
+	dst[0] = tlsChangeCipherSpec
+	binary.BigEndian.PutUint16(dst[1:3], t.version())
+	binary.BigEndian.PutUint16(dst[3:5], 1)
+	dst[5] = 1
+}
+
+// isDummy returns whether record starts with a change_cipher_spec record that could have been sent by putDummy
+func (t TLSRecordLayer) isDummy(record []byte) bool {
+	return t.CCSProbability > 0 && len(record) >= ccsRecordLen &&
+		record[0] == tlsChangeCipherSpec && t.acceptsVersion(binary.BigEndian.Uint16(record[1:3])) &&
+		binary.BigEndian.Uint16(record[3:5]) == 1 && record[5] == 1
+}
+
+func (t TLSRecordLayer) Unwrap(in []byte) (offset, length int, err error) {
+	for {
+		record := in[offset:]
+		if len(record) < recordHeaderLen {
+			return 0, 0, fmt.Errorf("%w: cannot be shorter than a TLS record layer", ErrInputTooShort)
+		}
+		if t.Strict {
+			if record[0] == tlsApplicationData {
+				break
+			}
+			if !t.isDummy(record) {
+				return 0, 0, fmt.Errorf("%w: unexpected content type or version %x", ErrBadRecordLayer, record[:3])
+			}
+		} else if record[0] < tlsChangeCipherSpec || record[0] >= tlsApplicationData {
+			// anything that isn't change_cipher_spec, alert or handshake is taken to be carrying the frame
+			break
+		}
+		recordLen := recordHeaderLen + int(binary.BigEndian.Uint16(record[3:5]))
+		if recordLen > len(record) {
+			return 0, 0, fmt.Errorf("%w: record of content type %x is cut short", ErrBadRecordLayer, record[0])
+		}
+		offset += recordLen
+		if offset == len(in) {
+			return 0, 0, ErrDummyRecord
+		}
+	}
+	record := in[offset:]
+	if t.Strict {
+		if !t.acceptsVersion(binary.BigEndian.Uint16(record[1:3])) {
+			return 0, 0, fmt.Errorf("%w: unexpected content type or version %x", ErrBadRecordLayer, record[:3])
+		}
+		recordLen := int(binary.BigEndian.Uint16(record[3:5]))
+		// records joined by a FrameReader keep the header of the first one
+		joined := t.MaxRecordLen > 0 && recordLen == t.MaxRecordLen && len(record)-recordHeaderLen > recordLen
+		if recordLen != len(record)-recordHeaderLen && !joined {
+			return 0, 0, fmt.Errorf("%w: record length %v doesn't match the %v bytes received", ErrBadRecordLayer, recordLen, len(record)-recordHeaderLen)
+		}
+	}
+	return offset + recordHeaderLen, len(record) - recordHeaderLen, nil
+}
+
+const (
+	// FIN bit and the binary opcode
+	wsBinaryFrame = 0x82
+	wsMaskBit     = 0x80
+	wsMaskKeyLen  = 4
+)
+
+// WebSocketRecordLayer prepends the header of an RFC 6455 binary frame, with the length in 7, 16 or 64 bits as the
+// frame requires. Unwrap always checks the length against the input, since it's needed to find where the header
+// ends anyway. Deobfsers unmask the frames that are masked regardless of Mask
+type WebSocketRecordLayer struct {
+	// Mask masks frames with a random key, as RFC 6455 requires of frames sent by a client
+	Mask bool
+	// Strict makes Unwrap reject anything but a final binary frame with ErrBadRecordLayer
+	Strict bool
+	// Rand is where masking keys are read from. crypto/rand.Reader is used if it's nil
+	Rand io.Reader
+}
+
+func (w WebSocketRecordLayer) HeaderLen(frameLen int) int {
+	headerLen := 2
+	if frameLen > math.MaxUint16 {
+		headerLen += 8
+	} else if frameLen > 125 {
+		headerLen += 2
+	}
+	if w.Mask {
+		headerLen += wsMaskKeyLen
+	}
+	return headerLen
+}
+
+func (w WebSocketRecordLayer) masks() bool { return w.Mask }
+
+func (w WebSocketRecordLayer) Wrap(dst []byte, frameLen int) int {
+	dst[0] = wsBinaryFrame
+	headerLen := 2
+	if frameLen > math.MaxUint16 {
+		dst[1] = 127
+		putU64(dst[2:10], uint64(frameLen))
+		headerLen = 10
+	} else if frameLen > 125 {
+		dst[1] = 126
+		binary.BigEndian.PutUint16(dst[2:4], uint16(frameLen))
+		headerLen = 4
+	} else {
+		dst[1] = byte(frameLen)
+	}
+	if w.Mask {
+		dst[1] |= wsMaskBit
+		maskKey := dst[headerLen : headerLen+wsMaskKeyLen]
+		random := w.Rand
+		if random == nil {
+			random = rand.Reader
+		}
+		// an all zero key if this fails still produces a valid frame
+		io.ReadFull(random, maskKey)
+		headerLen += wsMaskKeyLen
+	}
+	return headerLen
+}
+
+func (w WebSocketRecordLayer) Unwrap(in []byte) (offset, length int, err error) {
+	if len(in) < 2 {
+		return 0, 0, fmt.Errorf("%w: cannot be shorter than a WebSocket frame header", ErrInputTooShort)
+	}
+	if w.Strict && in[0] != wsBinaryFrame {
+		return 0, 0, fmt.Errorf("%w: not a final binary WebSocket frame %x", ErrBadRecordLayer, in[0])
+	}
+	offset = 2
+	var frameLen uint64
+	switch len7 := in[1] &^ wsMaskBit; len7 {
+	case 126:
+		offset += 2
+		if len(in) >= offset {
+			frameLen = uint64(binary.BigEndian.Uint16(in[2:4]))
+		}
+	case 127:
+		offset += 8
+		if len(in) >= offset {
+			frameLen = u64(in[2:10])
+		}
+	default:
+		frameLen = uint64(len7)
+	}
+	if in[1]&wsMaskBit != 0 {
+		offset += wsMaskKeyLen
+	}
+	if len(in) < offset {
+		return 0, 0, fmt.Errorf("%w: WebSocket frame header is cut short", ErrInputTooShort)
+	}
+	if frameLen != uint64(len(in)-offset) {
+		return 0, 0, fmt.Errorf("%w: WebSocket frame length %v doesn't match the %v bytes received", ErrBadRecordLayer, frameLen, len(in)-offset)
+	}
+	return offset, len(in) - offset, nil
+}
+
+func (w WebSocketRecordLayer) recordLen(in []byte, maxFrameSize int) (int, error) {
+	if len(in) < 2 {
+		return 0, nil
+	}
+	headerLen := 2
+	var frameLen uint64
+	switch len7 := in[1] &^ wsMaskBit; len7 {
+	case 126:
+		headerLen += 2
+		if len(in) < headerLen {
+			return 0, nil
+		}
+		frameLen = uint64(binary.BigEndian.Uint16(in[2:4]))
+	case 127:
+		headerLen += 8
+		if len(in) < headerLen {
+			return 0, nil
+		}
+		frameLen = u64(in[2:10])
+	default:
+		frameLen = uint64(len7)
+	}
+	if in[1]&wsMaskBit != 0 {
+		headerLen += wsMaskKeyLen
+	}
+	if frameLen > maxSplitFrameLen {
+		// checked before converting, as it may not fit in an int on 32 bit platforms
+		return 0, ErrRecordTooLarge
+	}
+	if err := checkFrameLen(int(frameLen), maxFrameSize); err != nil {
+		return 0, err
+	}
+	return headerLen + int(frameLen), nil
+}
+
+func (w WebSocketRecordLayer) maskKey(record []byte) []byte {
+	if record[1]&wsMaskBit == 0 {
+		return nil
+	}
+	// the key comes right after the length
+	keyStart := 2
+	switch record[1] &^ wsMaskBit {
+	case 126:
+		keyStart += 2
+	case 127:
+		keyStart += 8
+	}
+	return record[keyStart : keyStart+wsMaskKeyLen]
+}
+
+// LengthPrefixRecordLayer prepends the length of the frame in big endian, which is all a reader of a byte stream needs
+// to find where each frame ends, for transports that don't need to look like anything, such as one tunnelled through
+// something that is already obfuscated. FrameReader reads them with its LengthPrefix set to the same Width. Unwrap
+// rejects a record whose length doesn't match the one in its prefix with ErrBadRecordLayer.
+//
+// This is what makes frames self-delimiting without a record layer to look like. The length can't be carried in the
+// frame header instead: the header is scrambled with a nonce taken from the end of the frame, so it can only be read
+// once the end of the frame has already been found. The prefix is left in the clear for that, and from PROTOCOL_V6 it's
+// authenticated along with the header, by the AEAD or by the MAC of ObfsConfig.PlainMAC, so that a frame read with a
+// rewritten prefix is refused
+type LengthPrefixRecordLayer struct {
+	// Width is the length of the prefix, which is 2 or 4 bytes. 0 means 2. Frames sent with a 2 byte prefix can be
+	// up to 65535 bytes long, and ones sent with a 4 byte prefix up to 1MiB
+	Width int
+}
+
+func (l LengthPrefixRecordLayer) width() int {
+	if l.Width == 0 {
+		return 2
+	}
+	return l.Width
+}
+
+func (l LengthPrefixRecordLayer) HeaderLen(int) int     { return l.width() }
+func (l LengthPrefixRecordLayer) authenticatedLen() int { return l.width() }
+func (LengthPrefixRecordLayer) splitLen() int           { return 0 }
+func (LengthPrefixRecordLayer) split([]byte, int)       {}
+
+func (l LengthPrefixRecordLayer) maxFrameLen() int {
+	if l.width() == 2 {
+		return math.MaxUint16
+	}
+	return maxSplitFrameLen
+}
+
+func (l LengthPrefixRecordLayer) Wrap(dst []byte, frameLen int) int {
+	putLengthPrefix(dst[:l.width()], frameLen)
+	return l.width()
+}
+
+func (l LengthPrefixRecordLayer) Unwrap(in []byte) (offset, length int, err error) {
+	width := l.width()
+	if len(in) < width {
+		return 0, 0, fmt.Errorf("%w: cannot be shorter than a length prefix", ErrInputTooShort)
+	}
+	frameLen := lengthPrefix(in[:width])
+	if frameLen != len(in)-width {
+		return 0, 0, fmt.Errorf("%w: length prefix %v doesn't match the %v bytes received", ErrBadRecordLayer, frameLen, len(in)-width)
+	}
+	return width, frameLen, nil
+}
+
+func (l LengthPrefixRecordLayer) recordLen(in []byte, maxFrameSize int) (int, error) {
+	if len(in) < l.width() {
+		return 0, nil
+	}
+	frameLen := lengthPrefix(in[:l.width()])
+	if err := checkFrameLen(frameLen, maxFrameSize); err != nil {
+		return 0, err
+	}
+	return l.width() + frameLen, nil
+}
+
+// lengthPrefix reads a 2 or 4 byte big endian length
+func lengthPrefix(prefix []byte) int {
+	if len(prefix) == 2 {
+		return int(binary.BigEndian.Uint16(prefix))
+	}
+	return int(binary.BigEndian.Uint32(prefix))
+}
+
+func putLengthPrefix(prefix []byte, frameLen int) {
+	if len(prefix) == 2 {
+		binary.BigEndian.PutUint16(prefix, uint16(frameLen))
+	} else {
+		binary.BigEndian.PutUint32(prefix, uint32(frameLen))
+	}
+}
+
+const datagramHeaderLen = 2
+
+// DatagramRecordLayer prepends the length of the frame in 16 bits big endian, as LengthPrefixRecordLayer does, so that
+// each datagram delivered by an unreliable transport can be checked to be a whole record on its own. Unwrap rejects a
+// datagram that was truncated with ErrBadRecordLayer. It's best paired with datagram streams
+// (Session.OpenDatagramStream) or SessionConfig.Unordered
+type DatagramRecordLayer struct{}
+
+var datagramPrefix = LengthPrefixRecordLayer{Width: datagramHeaderLen}
+
+func (DatagramRecordLayer) HeaderLen(int) int     { return datagramHeaderLen }
+func (DatagramRecordLayer) authenticatedLen() int { return datagramHeaderLen }
+func (DatagramRecordLayer) maxFrameLen() int      { return math.MaxUint16 }
+func (DatagramRecordLayer) splitLen() int         { return 0 }
+func (DatagramRecordLayer) split([]byte, int)     {}
+func (DatagramRecordLayer) Wrap(dst []byte, frameLen int) int {
+	return datagramPrefix.Wrap(dst, frameLen)
+}
+func (DatagramRecordLayer) Unwrap(in []byte) (int, int, error) {
+	return datagramPrefix.Unwrap(in)
+}
+func (DatagramRecordLayer) recordLen(in []byte, maxFrameSize int) (int, error) {
+	return datagramPrefix.recordLen(in, maxFrameSize)
+}
+
+const (
+	// the header form bit, clear in a short header, and the fixed bit, which is always set
+	quicLongHeader = 0x80
+	quicFixedBit   = 0x40
+	// the low bits of the first byte encode the length of the packet number, less 1
+	quicPacketNumberLenMask = 0x03
+	quicMaxConnectionIDLen  = 20
+)
+
+// QUICRecordLayer prepends a header that looks like that of an RFC 9000 1-RTT packet, with a short header: a byte
+// with the fixed bit set, the destination connection ID and a packet number. It doesn't make a QUIC connection, but
+// captured datagrams look like the packets of one. Everything in the first byte but the header form and the fixed
+// bit, and the packet number, are random, as they are protected in real QUIC packets, except that the lowest two bits
+// of the first byte give the length of the packet number. The header has no length, so the whole datagram has to be
+// given to Deobfs, and one that was truncated fails to be decrypted. It's best paired with datagram streams
+// (Session.OpenDatagramStream) or SessionConfig.Unordered
+type QUICRecordLayer struct {
+	// ConnectionID is the destination connection ID sent in every packet, of up to 20 bytes. Both ends have to agree
+	// on its length, as it isn't sent
+	ConnectionID []byte
+	// PacketNumberLen is the length of the packet number, from 1 to 4 bytes. 0 means 2
+	PacketNumberLen int
+	// Strict makes Unwrap reject anything but a short header with the fixed bit set and ConnectionID with
+	// ErrBadRecordLayer
+	Strict bool
+}
+
+func (q QUICRecordLayer) packetNumberLen() int {
+	if q.PacketNumberLen == 0 {
+		return 2
+	}
+	return q.PacketNumberLen
+}
+
+func (q QUICRecordLayer) valid() bool {
+	return len(q.ConnectionID) <= quicMaxConnectionIDLen && q.packetNumberLen() >= 1 && q.packetNumberLen() <= 4
+}
+
+func (q QUICRecordLayer) HeaderLen(int) int { return 1 + len(q.ConnectionID) + q.packetNumberLen() }
+
+// maxFrameLen keeps the datagram within the 65535 bytes UDP can carry
+func (q QUICRecordLayer) maxFrameLen() int { return math.MaxUint16 - q.HeaderLen(0) }
+func (QUICRecordLayer) splitLen() int      { return 0 }
+func (QUICRecordLayer) split([]byte, int)  {}
+
+func (q QUICRecordLayer) Wrap(dst []byte, frameLen int) int {
+	pnLen := q.packetNumberLen()
+	random := prand.Uint64()
+	dst[0] = quicFixedBit | byte(random)&^(quicLongHeader|quicFixedBit|quicPacketNumberLenMask) | byte(pnLen-1)
+	i := 1 + copy(dst[1:], q.ConnectionID)
+	for j := 0; j < pnLen; j++ {
+		dst[i+j] = byte(random >> uint(8*(j+1)))
+	}
+	return i + pnLen
+}
+
+func (q QUICRecordLayer) Unwrap(in []byte) (offset, length int, err error) {
+	if len(in) < 1+len(q.ConnectionID) {
+		return 0, 0, fmt.Errorf("%w: cannot be shorter than a QUIC short header", ErrInputTooShort)
+	}
+	if q.Strict {
+		if in[0]&(quicLongHeader|quicFixedBit) != quicFixedBit {
+			return 0, 0, fmt.Errorf("%w: not a QUIC short header %x", ErrBadRecordLayer, in[0])
+		}
+		if !bytes.Equal(in[1:1+len(q.ConnectionID)], q.ConnectionID) {
+			return 0, 0, fmt.Errorf("%w: unexpected QUIC connection ID %x", ErrBadRecordLayer, in[1:1+len(q.ConnectionID)])
+		}
+	}
+	offset = 1 + len(q.ConnectionID) + int(in[0]&quicPacketNumberLenMask) + 1
+	if len(in) < offset {
+		return 0, 0, fmt.Errorf("%w: QUIC short header is cut short", ErrInputTooShort)
+	}
+	return offset, len(in) - offset, nil
+}
+
+const (
+	h2FrameHeaderLen = 9
+	h2FrameData      = 0x0
+	h2FlagPadded     = 0x8
+	// the top bit of the stream identifier is reserved
+	h2StreamIDMask = 1<<31 - 1
+	// the largest SETTINGS_MAX_FRAME_SIZE a peer can advertise
+	h2MaxFrameLen = 1<<24 - 1
+)
+
+// HTTP2DataRecordLayer prepends the 9 byte header of an RFC 7540 DATA frame, with the length in 24 bits, no flags and a
+// fixed stream identifier, for deployments fronted by a CDN that speaks HTTP/2 to the origin. Frames can be up to
+// 16777215 bytes long, as that is the most the length field holds, but peers only accept DATA frames longer than
+// 16384 bytes once they have raised their SETTINGS_MAX_FRAME_SIZE. Unwrap always checks the length against the input,
+// and takes away the padding of DATA frames with the PADDED flag, which an intermediary may have added
+type HTTP2DataRecordLayer struct {
+	// StreamID is the HTTP/2 stream the DATA frames are sent on. 0, which DATA frames can't be sent on, means 1
+	StreamID uint32
+	// Strict makes Unwrap reject anything but a DATA frame on StreamID with ErrBadRecordLayer
+	Strict bool
+}
+
+func (h HTTP2DataRecordLayer) streamID() uint32 {
+	if h.StreamID&h2StreamIDMask == 0 {
+		return 1
+	}
+	return h.StreamID & h2StreamIDMask
+}
+
+// u24 reads the 24 bit big endian length of an HTTP/2 frame
+func u24(b []byte) int { return int(b[0])<<16 | int(b[1])<<8 | int(b[2]) }
+
+func putU24(b []byte, v int) { b[0], b[1], b[2] = byte(v>>16), byte(v>>8), byte(v) }
+
+func (HTTP2DataRecordLayer) HeaderLen(int) int { return h2FrameHeaderLen }
+func (HTTP2DataRecordLayer) maxFrameLen() int  { return h2MaxFrameLen }
+func (HTTP2DataRecordLayer) splitLen() int     { return 0 }
+func (HTTP2DataRecordLayer) split([]byte, int) {}
+
+func (h HTTP2DataRecordLayer) Wrap(dst []byte, frameLen int) int {
+	putU24(dst[0:3], frameLen)
+	dst[3] = h2FrameData
+	dst[4] = 0
+	binary.BigEndian.PutUint32(dst[5:9], h.streamID())
+	return h2FrameHeaderLen
+}
+
+func (h HTTP2DataRecordLayer) Unwrap(in []byte) (offset, length int, err error) {
+	if len(in) < h2FrameHeaderLen {
+		return 0, 0, fmt.Errorf("%w: cannot be shorter than an HTTP/2 frame header", ErrInputTooShort)
+	}
+	if h.Strict {
+		if in[3] != h2FrameData {
+			return 0, 0, fmt.Errorf("%w: HTTP/2 frame of type %x isn't DATA", ErrBadRecordLayer, in[3])
+		}
+		if streamID := binary.BigEndian.Uint32(in[5:9]) & h2StreamIDMask; streamID != h.streamID() {
+			return 0, 0, fmt.Errorf("%w: DATA frame on stream %v rather than %v", ErrBadRecordLayer, streamID, h.streamID())
+		}
+	}
+	length = u24(in[0:3])
+	if length != len(in)-h2FrameHeaderLen {
+		return 0, 0, fmt.Errorf("%w: HTTP/2 frame length %v doesn't match the %v bytes received", ErrBadRecordLayer, length, len(in)-h2FrameHeaderLen)
+	}
+	offset = h2FrameHeaderLen
+	if in[4]&h2FlagPadded != 0 {
+		if length < 1 || int(in[offset]) > length-1 {
+			return 0, 0, fmt.Errorf("%w: DATA frame padding is longer than the frame", ErrBadRecordLayer)
+		}
+		length -= 1 + int(in[offset])
+		offset++
+	}
+	return offset, length, nil
+}
+
+func (HTTP2DataRecordLayer) recordLen(in []byte, maxFrameSize int) (int, error) {
+	if len(in) < h2FrameHeaderLen {
+		return 0, nil
+	}
+	frameLen := u24(in[0:3])
+	if err := checkFrameLen(frameLen, maxFrameSize); err != nil {
+		return 0, err
+	}
+	return h2FrameHeaderLen + frameLen, nil
+}
+
+// xorMask masks or unmasks a frame in place with the 4 byte key of a masker
+func xorMask(frame []byte, maskKey []byte) {
+	for i := range frame {
+		frame[i] ^= maskKey[i%len(maskKey)]
+	}
+}
+
+// recordLayer returns the RecordLayer of the config. A nil RecordLayer is NoRecordLayer
+func (c ObfsConfig) recordLayer() RecordLayer {
+	if c.RecordLayer == nil {
+		return NoRecordLayer{}
+	}
+	return c.RecordLayer
+}
+
+// maxDummyLen is the length of the longest dummy record the record layer of the config may send in front of a frame
+func (c ObfsConfig) maxDummyLen() int {
+	if d, ok := c.RecordLayer.(dummyRecorder); ok {
+		return d.maxDummyLen()
+	}
+	return 0
+}
@@ -0,0 +1,546 @@
+package multiplex
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestWebSocketRecordLayer(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfsBuf := make([]byte, 70200)
+
+	// payloads whose frames need a 7, 16 and 64 bit length
+	for _, pldLen := range []int{10, 1000, 70000} {
+		for _, masked := range []bool{false, true} {
+			for _, method := range []Method{E_METHOD_PLAIN, E_METHOD_AES_GCM} {
+				config := ObfsConfig{RecordLayer: WebSocketRecordLayer{Mask: masked}, ProtocolVersion: PROTOCOL_V6}
+				obfuscator, _ := GenerateObfsWithConfig(method, sessionKey, config)
+				testFrame := &Frame{StreamID: 1, Seq: 2, Closing: FlagFin, Payload: make([]byte, pldLen)}
+				rand.Read(testFrame.Payload)
+
+				n, err := obfuscator.Obfs(testFrame, obfsBuf)
+				if err != nil {
+					t.Fatalf("%v %v %v: %v", method, pldLen, masked, err)
+				}
+				if n != obfuscator.frameLen(pldLen) {
+					t.Errorf("%v %v %v: expecting a %v byte frame, got %v", method, pldLen, masked, obfuscator.frameLen(pldLen), n)
+				}
+				in := obfsBuf[:n]
+				if in[0] != wsBinaryFrame {
+					t.Errorf("%v %v %v: expecting a final binary frame, got %x", method, pldLen, masked, in[0])
+				}
+				if (in[1]&wsMaskBit != 0) != masked {
+					t.Errorf("%v %v %v: wrong mask bit", method, pldLen, masked)
+				}
+				var expectedLen7 byte
+				switch {
+				case pldLen < 100:
+					expectedLen7 = byte(n - 2)
+					if masked {
+						expectedLen7 -= wsMaskKeyLen
+					}
+				case pldLen < 65536:
+					expectedLen7 = 126
+				default:
+					expectedLen7 = 127
+				}
+				if len7 := in[1] &^ wsMaskBit; len7 != expectedLen7 {
+					t.Errorf("%v %v %v: expecting length field %v, got %v", method, pldLen, masked, expectedLen7, len7)
+				}
+
+				original := append([]byte(nil), in...)
+				resultFrame, err := obfuscator.Deobfs(in)
+				if err != nil {
+					t.Fatalf("%v %v %v: failed to deobfs: %v", method, pldLen, masked, err)
+				}
+				if !bytes.Equal(resultFrame.Payload, testFrame.Payload) || resultFrame.Closing != testFrame.Closing {
+					t.Errorf("%v %v %v: payload mismatch", method, pldLen, masked)
+				}
+				if !bytes.Equal(in, original) {
+					t.Errorf("%v %v %v: deobfs modified its input", method, pldLen, masked)
+				}
+
+				if _, err := obfuscator.Deobfs(in[:n-1]); !errors.Is(err, ErrBadRecordLayer) {
+					t.Errorf("%v %v %v: expecting %v for a truncated frame, got %v", method, pldLen, masked, ErrBadRecordLayer, err)
+				}
+			}
+		}
+	}
+}
+
+func TestWebSocketMaskingKey(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	testFrame := &Frame{StreamID: 1, Payload: []byte("masked")}
+
+	unmasked, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: WebSocketRecordLayer{}, Rand: repeatingReader(0)})
+	masked, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: WebSocketRecordLayer{Mask: true, Rand: repeatingReader(0x5a)}})
+	unmaskedBuf := make([]byte, 100)
+	maskedBuf := make([]byte, 100)
+	n, _ := unmasked.Obfs(testFrame, unmaskedBuf)
+	m, _ := masked.Obfs(testFrame, maskedBuf)
+	if m != n+wsMaskKeyLen {
+		t.Fatalf("a masked frame should be %v bytes longer, got %v and %v", wsMaskKeyLen, n, m)
+	}
+	if !bytes.Equal(maskedBuf[2:6], []byte{0x5a, 0x5a, 0x5a, 0x5a}) {
+		t.Errorf("masking key isn't read from Rand: %x", maskedBuf[2:6])
+	}
+	for i := 2; i < n; i++ {
+		if maskedBuf[i+wsMaskKeyLen] != unmaskedBuf[i]^0x5a {
+			t.Fatalf("byte %v of the frame isn't masked", i-2)
+		}
+	}
+
+	// either end can deobfs both
+	if _, err := unmasked.Deobfs(maskedBuf[:m]); err != nil {
+		t.Errorf("failed to deobfs a masked frame: %v", err)
+	}
+	if _, err := masked.Deobfs(unmaskedBuf[:n]); err != nil {
+		t.Errorf("failed to deobfs an unmasked frame: %v", err)
+	}
+}
+
+func TestStrictWebSocketRecordLayer(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: WebSocketRecordLayer{Strict: true}})
+	obfsBuf := make([]byte, 100)
+	n, _ := obfuscator.Obfs(&Frame{StreamID: 1, Payload: []byte("text frame")}, obfsBuf)
+	// a text frame
+	obfsBuf[0] = 0x81
+	if _, err := obfuscator.Deobfs(obfsBuf[:n]); !errors.Is(err, ErrBadRecordLayer) {
+		t.Errorf("expecting %v, got %v", ErrBadRecordLayer, err)
+	}
+}
+
+func TestWebSocketPaddingAcrossLengthBoundary(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	// the padded frame needs a 16 bit length field when the unpadded one doesn't
+	config := ObfsConfig{RecordLayer: WebSocketRecordLayer{}, ProtocolVersion: PROTOCOL_V6, Padding: BucketPadding{200}}
+	obfuscator, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, config)
+	testFrame := &Frame{StreamID: 1, Payload: make([]byte, 50)}
+
+	for _, bufLen := range []int{200, 198, 150} {
+		buf := make([]byte, bufLen)
+		n, err := obfuscator.Obfs(testFrame, buf)
+		if err != nil {
+			t.Fatalf("%v byte buffer: %v", bufLen, err)
+		}
+		if n != bufLen {
+			t.Errorf("%v byte buffer: padding should fill the buffer, got a %v byte frame", bufLen, n)
+		}
+		resultFrame, err := obfuscator.Deobfs(buf[:n])
+		if err != nil {
+			t.Fatalf("%v byte buffer: failed to deobfs: %v", bufLen, err)
+		}
+		if !bytes.Equal(resultFrame.Payload, testFrame.Payload) {
+			t.Errorf("%v byte buffer: payload mismatch", bufLen)
+		}
+	}
+}
+
+// lengthPrefixed is a minimal RecordLayer that prefixes frames with a 3 byte big-endian length
+type lengthPrefixed struct{}
+
+func (lengthPrefixed) HeaderLen(int) int { return 3 }
+
+func (lengthPrefixed) Wrap(dst []byte, frameLen int) int {
+	dst[0], dst[1], dst[2] = byte(frameLen>>16), byte(frameLen>>8), byte(frameLen)
+	return 3
+}
+
+func (lengthPrefixed) Unwrap(in []byte) (int, int, error) {
+	if len(in) < 3 {
+		return 0, 0, ErrInputTooShort
+	}
+	if frameLen := int(in[0])<<16 | int(in[1])<<8 | int(in[2]); frameLen != len(in)-3 {
+		return 0, 0, ErrBadRecordLayer
+	}
+	return 3, len(in) - 3, nil
+}
+
+func TestCustomRecordLayer(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfsBuf := make([]byte, 1000)
+	for _, method := range []Method{E_METHOD_PLAIN, E_METHOD_AES_GCM} {
+		obfuscator, _ := GenerateObfs(method, sessionKey, WithRecordLayer(lengthPrefixed{}))
+		testFrame := &Frame{StreamID: 1, Seq: 2, Payload: make([]byte, 500)}
+		rand.Read(testFrame.Payload)
+
+		n, err := obfuscator.Obfs(testFrame, obfsBuf)
+		if err != nil {
+			t.Fatalf("%v: %v", method, err)
+		}
+		if frameLen := int(obfsBuf[0])<<16 | int(obfsBuf[1])<<8 | int(obfsBuf[2]); frameLen != n-3 {
+			t.Errorf("%v: record length %v doesn't match the %v byte frame", method, frameLen, n-3)
+		}
+		resultFrame, err := obfuscator.Deobfs(obfsBuf[:n])
+		if err != nil {
+			t.Fatalf("%v: failed to deobfs: %v", method, err)
+		}
+		if !bytes.Equal(resultFrame.Payload, testFrame.Payload) {
+			t.Errorf("%v: payload mismatch", method)
+		}
+		if _, err := obfuscator.Deobfs(obfsBuf[:n-1]); !errors.Is(err, ErrBadRecordLayer) {
+			t.Errorf("%v: a record cut short should be rejected by Unwrap, got %v", method, err)
+		}
+	}
+}
+
+func TestTLSRecordVersions(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	versions := []uint16{0x0301, 0x0303}
+	obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{Strict: true, Versions: versions}))
+	obfsBuf := make([]byte, 200)
+	seen := make(map[uint16]bool)
+	for i := 0; i < 100; i++ {
+		n, _ := obfuscator.Obfs(&Frame{StreamID: 1, Seq: uint64(i), Payload: make([]byte, 10)}, obfsBuf)
+		version := uint16(obfsBuf[1])<<8 | uint16(obfsBuf[2])
+		if version != 0x0301 && version != 0x0303 {
+			t.Fatalf("record written with version %x", version)
+		}
+		seen[version] = true
+		if _, err := obfuscator.Deobfs(obfsBuf[:n]); err != nil {
+			t.Fatalf("failed to deobfs a record of version %x: %v", version, err)
+		}
+	}
+	if len(seen) != len(versions) {
+		t.Errorf("not all versions are used: %v", seen)
+	}
+
+	n, _ := obfuscator.Obfs(&Frame{StreamID: 1, Payload: make([]byte, 10)}, obfsBuf)
+	obfsBuf[2] = 0x02
+	if _, err := obfuscator.Deobfs(obfsBuf[:n]); !errors.Is(err, ErrBadRecordLayer) {
+		t.Errorf("a version that isn't one of Versions should be rejected, got %v", err)
+	}
+}
+
+func TestChangeCipherSpecInjection(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	ccs := []byte{0x14, 0x03, 0x03, 0x00, 0x01, 0x01}
+	testFrame := &Frame{StreamID: 1, Payload: []byte("after a change_cipher_spec")}
+	obfsBuf := make([]byte, 200)
+
+	injecting, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{CCSProbability: 1}))
+	n, err := injecting.Obfs(testFrame, obfsBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(obfsBuf[:len(ccs)], ccs) {
+		t.Fatalf("expecting a change_cipher_spec record in front, got %x", obfsBuf[:len(ccs)])
+	}
+	if n != injecting.frameLen(len(testFrame.Payload)) {
+		t.Errorf("expecting a %v byte frame, got %v", injecting.frameLen(len(testFrame.Payload)), n)
+	}
+
+	for name, rl := range map[string]TLSRecordLayer{
+		"tolerant": {},
+		"strict":   {Strict: true, CCSProbability: 0.1},
+	} {
+		obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(rl))
+		f, err := obfuscator.Deobfs(obfsBuf[:n])
+		if err != nil {
+			t.Fatalf("%v: failed to deobfs a record behind a change_cipher_spec: %v", name, err)
+		}
+		if !bytes.Equal(f.Payload, testFrame.Payload) {
+			t.Errorf("%v: payload mismatch", name)
+		}
+		if _, err := obfuscator.Deobfs(ccs); !errors.Is(err, ErrDummyRecord) {
+			t.Errorf("%v: expecting %v for a lone change_cipher_spec, got %v", name, ErrDummyRecord, err)
+		}
+	}
+
+	strict, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{Strict: true}))
+	if _, err := strict.Deobfs(obfsBuf[:n]); !errors.Is(err, ErrBadRecordLayer) {
+		t.Errorf("a strict record layer that doesn't send change_cipher_spec should reject it, got %v", err)
+	}
+}
+
+func TestTLSRecordSplitting(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	const maxRecordLen = 1000
+	for _, method := range []Method{E_METHOD_PLAIN, E_METHOD_AES_GCM} {
+		config := ObfsConfig{RecordLayer: TLSRecordLayer{Strict: true, MaxRecordLen: maxRecordLen}, ProtocolVersion: PROTOCOL_V6}
+		obfuscator, _ := GenerateObfsWithConfig(method, sessionKey, config)
+		overhead := obfuscator.Overhead() - config.RecordLayer.HeaderLen(math.MaxUint16)
+		// frames that fit in a record, fill one exactly, and are split across several
+		for _, frameLen := range []int{maxRecordLen - 1, maxRecordLen, maxRecordLen + 1, 3 * maxRecordLen, 70000} {
+			testFrame := &Frame{StreamID: 1, Seq: 2, Payload: make([]byte, frameLen-overhead)}
+			rand.Read(testFrame.Payload)
+			obfsBuf := make([]byte, obfuscator.frameLen(len(testFrame.Payload)))
+			n, err := obfuscator.Obfs(testFrame, obfsBuf)
+			if err != nil {
+				t.Fatalf("%v %v: %v", method, frameLen, err)
+			}
+			if n != len(obfsBuf) {
+				t.Errorf("%v %v: expecting %v bytes, got %v", method, frameLen, len(obfsBuf), n)
+			}
+
+			records := 0
+			for rest := obfsBuf[:n]; len(rest) > 0; records++ {
+				recordLen := int(rest[3])<<8 | int(rest[4])
+				if rest[0] != 0x17 || recordLen > maxRecordLen {
+					t.Fatalf("%v %v: bad record header %x", method, frameLen, rest[:5])
+				}
+				rest = rest[recordHeaderLen+recordLen:]
+				if recordLen != maxRecordLen && len(rest) != 0 {
+					t.Fatalf("%v %v: a short record isn't the last one", method, frameLen)
+				}
+			}
+			if records != frameLen/maxRecordLen+1 {
+				t.Errorf("%v %v: expecting %v records, got %v", method, frameLen, frameLen/maxRecordLen+1, records)
+			}
+
+			fr := NewFrameReader(bytes.NewReader(obfsBuf[:n]), obfuscator.Deobfs)
+			fr.MaxRecordLen = maxRecordLen
+			fr.MaxFrameSize = 0
+			f, err := fr.ReadFrame()
+			if err != nil {
+				t.Fatalf("%v %v: failed to read a split frame: %v", method, frameLen, err)
+			}
+			if !bytes.Equal(f.Payload, testFrame.Payload) {
+				t.Errorf("%v %v: payload mismatch", method, frameLen)
+			}
+
+			segments, err := obfuscator.ObfsBuffers(testFrame, make([]byte, n), nil)
+			if err != nil {
+				t.Fatalf("%v %v: %v", method, frameLen, err)
+			}
+			fr = NewFrameReader(bytes.NewReader(bytes.Join(segments, nil)), obfuscator.Deobfs)
+			fr.MaxRecordLen = maxRecordLen
+			fr.MaxFrameSize = 0
+			if f, err := fr.ReadFrame(); err != nil || !bytes.Equal(f.Payload, testFrame.Payload) {
+				t.Errorf("%v %v: failed to read a frame split into segments: %v", method, frameLen, err)
+			}
+		}
+	}
+}
+
+func TestTLSRecordTooLarge(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+	obfsBuf := make([]byte, 70000)
+	if _, err := obfuscator.Obfs(&Frame{StreamID: 1, Payload: make([]byte, 66000)}, obfsBuf); !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("expecting %v for a frame too long for a record, got %v", ErrRecordTooLarge, err)
+	}
+
+	// full length records that never end
+	record := append([]byte{0x17, 0x03, 0x03, 0x00, 100}, make([]byte, 100)...)
+	fr := NewFrameReader(bytes.NewReader(bytes.Repeat(record, maxSplitFrameLen/100+2)), obfuscator.Deobfs)
+	fr.MaxRecordLen = 100
+	fr.MaxFrameSize = 0
+	if _, err := fr.ReadFrame(); !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("expecting %v for records joined into too long a frame, got %v", ErrRecordTooLarge, err)
+	}
+}
+
+func TestTLSMaxRecordLenRange(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	for _, maxRecordLen := range []int{-1, math.MaxUint16 + 1, 1 << 20} {
+		if _, err := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{MaxRecordLen: maxRecordLen})); err == nil {
+			t.Errorf("a max record length of %v should be refused", maxRecordLen)
+		}
+	}
+
+	obfuscator, err := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{MaxRecordLen: math.MaxUint16}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := &Frame{StreamID: 1, Payload: make([]byte, 100000)}
+	rand.Read(frame.Payload)
+	obfsBuf := make([]byte, 110000)
+	n, err := obfuscator.Obfs(frame, obfsBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := NewFrameReader(bytes.NewReader(obfsBuf[:n]), obfuscator.Deobfs)
+	fr.MaxRecordLen = math.MaxUint16
+	fr.MaxFrameSize = 0
+	if f, err := fr.ReadFrame(); err != nil || !bytes.Equal(f.Payload, frame.Payload) {
+		t.Errorf("failed to read a frame split into records of %v bytes: %v", math.MaxUint16, err)
+	}
+}
+
+func TestLengthPrefixWidth(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	if _, err := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: LengthPrefixRecordLayer{Width: 3}}); err == nil {
+		t.Error("a 3 byte length prefix should be refused")
+	}
+	obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(LengthPrefixRecordLayer{}))
+	if _, err := obfuscator.Obfs(&Frame{Payload: make([]byte, math.MaxUint16)}, make([]byte, 70000)); !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("expecting %v for a frame too long for a 2 byte prefix, got %v", ErrRecordTooLarge, err)
+	}
+}
+
+func TestHTTP2DataRecordLayer(t *testing.T) {
+	// the length is 24 bits big endian, followed by the DATA type, no flags and the stream identifier
+	header := make([]byte, h2FrameHeaderLen)
+	HTTP2DataRecordLayer{StreamID: 3}.Wrap(header, 0x012345)
+	if expected := []byte{0x01, 0x23, 0x45, 0x00, 0x00, 0, 0, 0, 3}; !bytes.Equal(header, expected) {
+		t.Errorf("expecting header %x, got %x", expected, header)
+	}
+	HTTP2DataRecordLayer{}.Wrap(header, 16384)
+	if expected := []byte{0x00, 0x40, 0x00, 0x00, 0x00, 0, 0, 0, 1}; !bytes.Equal(header, expected) {
+		t.Errorf("expecting a 16384 byte DATA frame on stream 1 by default, got %x", header)
+	}
+
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfsBuf := make([]byte, 70200)
+	for _, pldLen := range []int{0, 1000, 70000} {
+		obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(HTTP2DataRecordLayer{StreamID: 5, Strict: true}))
+		testFrame := &Frame{StreamID: 1, Seq: 2, Payload: make([]byte, pldLen)}
+		rand.Read(testFrame.Payload)
+		n, err := obfuscator.Obfs(testFrame, obfsBuf)
+		if err != nil {
+			t.Fatalf("%v: %v", pldLen, err)
+		}
+		in := obfsBuf[:n]
+		if got := int(in[0])<<16 | int(in[1])<<8 | int(in[2]); got != n-h2FrameHeaderLen {
+			t.Errorf("%v: expecting length %v, got %v", pldLen, n-h2FrameHeaderLen, got)
+		}
+		resultFrame, err := obfuscator.Deobfs(in)
+		if err != nil {
+			t.Fatalf("%v: failed to deobfs: %v", pldLen, err)
+		}
+		if !bytes.Equal(resultFrame.Payload, testFrame.Payload) {
+			t.Errorf("%v: payload mismatch", pldLen)
+		}
+		if _, err := obfuscator.Deobfs(in[:n-1]); !errors.Is(err, ErrBadRecordLayer) {
+			t.Errorf("%v: expecting %v for a truncated frame, got %v", pldLen, ErrBadRecordLayer, err)
+		}
+	}
+
+	t.Run("padded", func(t *testing.T) {
+		obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(HTTP2DataRecordLayer{}))
+		testFrame := &Frame{StreamID: 1, Seq: 2, Payload: []byte("padded")}
+		n, _ := obfuscator.Obfs(testFrame, obfsBuf)
+		// an intermediary pads the DATA frame with 10 bytes
+		frame := obfsBuf[h2FrameHeaderLen:n]
+		padded := make([]byte, h2FrameHeaderLen+1+len(frame)+10)
+		copy(padded, obfsBuf[:h2FrameHeaderLen])
+		padded[0], padded[1], padded[2] = 0, 0, byte(len(padded)-h2FrameHeaderLen)
+		padded[4] = h2FlagPadded
+		padded[h2FrameHeaderLen] = 10
+		copy(padded[h2FrameHeaderLen+1:], frame)
+		resultFrame, err := obfuscator.Deobfs(padded)
+		if err != nil || !bytes.Equal(resultFrame.Payload, testFrame.Payload) {
+			t.Errorf("failed to deobfs a padded DATA frame: %v", err)
+		}
+		padded[h2FrameHeaderLen] = byte(len(padded))
+		if _, err := obfuscator.Deobfs(padded); !errors.Is(err, ErrBadRecordLayer) {
+			t.Errorf("expecting %v for padding longer than the frame, got %v", ErrBadRecordLayer, err)
+		}
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		strict := HTTP2DataRecordLayer{StreamID: 5, Strict: true}
+		for name, header := range map[string][]byte{
+			"headers frame": {0, 0, 0, 0x1, 0, 0, 0, 0, 5},
+			"other stream":  {0, 0, 0, 0x0, 0, 0, 0, 0, 7},
+		} {
+			if _, _, err := strict.Unwrap(header); !errors.Is(err, ErrBadRecordLayer) {
+				t.Errorf("%v: expecting %v, got %v", name, ErrBadRecordLayer, err)
+			}
+		}
+		// the reserved bit isn't part of the stream identifier
+		if _, _, err := strict.Unwrap([]byte{0, 0, 0, 0x0, 0, 0x80, 0, 0, 5}); err != nil {
+			t.Errorf("expecting the reserved bit to be ignored, got %v", err)
+		}
+	})
+
+	t.Run("deobfs all", func(t *testing.T) {
+		obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(HTTP2DataRecordLayer{}))
+		var stream []byte
+		for i := 0; i < 3; i++ {
+			n, _ := obfuscator.Obfs(&Frame{StreamID: 1, Seq: uint64(i), Payload: make([]byte, 100*i)}, obfsBuf)
+			stream = append(stream, obfsBuf[:n]...)
+		}
+		frames, n, err := obfuscator.DeobfsAll(stream)
+		if err != nil || len(frames) != 3 || n != len(stream) {
+			t.Errorf("expecting 3 frames from %v bytes, got %v from %v: %v", len(stream), len(frames), n, err)
+		}
+	})
+}
+
+func TestQUICRecordLayer(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfsBuf := make([]byte, 2000)
+	connectionID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	for _, pnLen := range []int{0, 1, 4} {
+		rl := QUICRecordLayer{ConnectionID: connectionID, PacketNumberLen: pnLen, Strict: true}
+		obfuscator, err := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: rl})
+		if err != nil {
+			t.Fatalf("%v: %v", pnLen, err)
+		}
+		testFrame := &Frame{StreamID: 1, Seq: 2, Closing: FlagDatagram, Payload: make([]byte, 500)}
+		rand.Read(testFrame.Payload)
+		n, err := obfuscator.Obfs(testFrame, obfsBuf)
+		if err != nil {
+			t.Fatalf("%v: %v", pnLen, err)
+		}
+		if n != obfuscator.frameLen(500) {
+			t.Errorf("%v: expecting a %v byte datagram, got %v", pnLen, obfuscator.frameLen(500), n)
+		}
+		in := obfsBuf[:n]
+		if in[0]&0xc0 != 0x40 {
+			t.Errorf("%v: expecting a short header with the fixed bit set, got %x", pnLen, in[0])
+		}
+		if int(in[0]&0x03)+1 != rl.packetNumberLen() {
+			t.Errorf("%v: expecting packet number length %v, got %v", pnLen, rl.packetNumberLen(), in[0]&0x03+1)
+		}
+		if !bytes.Equal(in[1:9], connectionID) {
+			t.Errorf("%v: expecting connection ID %x, got %x", pnLen, connectionID, in[1:9])
+		}
+		resultFrame, err := obfuscator.Deobfs(in)
+		if err != nil {
+			t.Fatalf("%v: failed to deobfs: %v", pnLen, err)
+		}
+		if !bytes.Equal(resultFrame.Payload, testFrame.Payload) {
+			t.Errorf("%v: payload mismatch", pnLen)
+		}
+
+		tampered := append([]byte{}, in...)
+		tampered[1] ^= 0xff
+		if _, err := obfuscator.Deobfs(tampered); !errors.Is(err, ErrBadRecordLayer) {
+			t.Errorf("%v: expecting %v for another connection ID, got %v", pnLen, ErrBadRecordLayer, err)
+		}
+		tampered = append([]byte{}, in...)
+		tampered[0] |= 0x80
+		if _, err := obfuscator.Deobfs(tampered); !errors.Is(err, ErrBadRecordLayer) {
+			t.Errorf("%v: expecting %v for a long header, got %v", pnLen, ErrBadRecordLayer, err)
+		}
+	}
+
+	t.Run("connection ID length", func(t *testing.T) {
+		for _, rl := range []QUICRecordLayer{{ConnectionID: make([]byte, 21)}, {PacketNumberLen: 5}} {
+			if _, err := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: rl}); err == nil {
+				t.Errorf("%+v should be refused", rl)
+			}
+		}
+		// a zero length connection ID is allowed, as it is in QUIC
+		obfuscator, err := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: QUICRecordLayer{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, _ := obfuscator.Obfs(&Frame{StreamID: 1, Payload: []byte("x")}, obfsBuf)
+		if _, err := obfuscator.Deobfs(obfsBuf[:n]); err != nil {
+			t.Error(err)
+		}
+		if _, err := obfuscator.Deobfs(obfsBuf[:0]); !errors.Is(err, ErrInputTooShort) {
+			t.Errorf("expecting %v for an empty datagram, got %v", ErrInputTooShort, err)
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package multiplex
+
+// From PROTOCOL_V4, the session key can be replaced during the lifetime of a session with Obfuscator.Rekey. Every
+// header carries the epoch of the key it was obfsed with, authenticated as additional data so that it cannot be
+// tampered with. Frames that were already in flight when the key was rotated can still be deobfsed with the key of
+// the previous epoch until the grace period runs out.
+//
+// Both ends must call Rekey with the same key. Rekey itself doesn't tell the remote that a new key is in use, this
+// has to be coordinated by the caller.
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const defaultRekeyGracePeriod = 30 * time.Second
+
+var errWrongKeyEpoch = errors.New("frame is from a different key epoch")
+
+type keyEpoch struct {
+	epoch  byte
+	obfs   obfsFunc
+	deobfs deobfsFunc
+	keys   *obfsKeys
+
+	// the Deobfser of the previous epoch, which is used until prevExpiry
+	prevDeobfs deobfsFunc
+	prevKeys   *obfsKeys
+	prevExpiry time.Time
+}
+
+// currentObfs returns the obfsFunc of the current key epoch
+func (o *Obfuscator) currentObfs() obfsFunc {
+	if o.config.ProtocolVersion >= PROTOCOL_V4 {
+		return o.epochs.Load().(*keyEpoch).obfs
+	}
+	return o.obfs
+}
+
+func (o *Obfuscator) epochObfs(f *Frame, buf []byte) (int, error) {
+	n, _, err := o.currentObfs()(f, nil, buf, false, nil)
+	return n, err
+}
+
+func (o *Obfuscator) epochDeobfs(in []byte, into *Frame) (*Frame, error) {
+	e := o.epochs.Load().(*keyEpoch)
+	f, err := e.deobfs(in, into)
+	if err == nil || e.prevDeobfs == nil {
+		return f, err
+	}
+	if !errors.Is(err, errWrongKeyEpoch) && !errors.Is(err, ErrAuthFailed) {
+		return f, err
+	}
+	if time.Now().After(e.prevExpiry) {
+		return f, err
+	}
+	return e.prevDeobfs(in, into)
+}
+
+// Rekey starts a new key epoch with newSessionKey. Frames are obfsed with the new key straight away, and frames
+// obfsed with the key being replaced are still accepted for ObfsConfig.RekeyGracePeriod.
+//
+// It requires PROTOCOL_V4 and an AEAD encryption method. Frames of E_METHOD_PLAIN aren't authenticated so the
+// epoch they belong to cannot be told with confidence. SessionKey is left unchanged as it's still the key used to
+// authenticate new connections of the session.
+func (o *Obfuscator) Rekey(newSessionKey []byte) error {
+	if o.config.ProtocolVersion < PROTOCOL_V4 {
+		return fmt.Errorf("rekeying requires protocol version %v, this session uses %v", PROTOCOL_V4, o.config.ProtocolVersion)
+	}
+	if o.payloadCipher == nil {
+		return errors.New("plain frames cannot be rekeyed")
+	}
+	if o.encryptionMethod == E_METHOD_EXTERNAL {
+		return fmt.Errorf("%w: rekeying", ErrExternalAEADUnsupported)
+	}
+
+	gracePeriod := o.config.RekeyGracePeriod
+	if gracePeriod == 0 {
+		gracePeriod = defaultRekeyGracePeriod
+	}
+
+	o.rekeyM.Lock()
+	defer o.rekeyM.Unlock()
+	if o.isClosed() {
+		return ErrObfuscatorClosed
+	}
+	old := o.epochs.Load().(*keyEpoch)
+	config := o.config
+	config.keyEpoch = old.epoch + 1
+	obfs, deobfs, _, keys, err := makeObfsPair(o.encryptionMethod, newSessionKey, config)
+	if err != nil {
+		return err
+	}
+	o.epochs.Store(&keyEpoch{
+		epoch:      config.keyEpoch,
+		obfs:       obfs,
+		deobfs:     deobfs,
+		keys:       keys,
+		prevDeobfs: old.deobfs,
+		prevKeys:   old.keys,
+		prevExpiry: time.Now().Add(gracePeriod),
+	})
+	// frames of the epoch before the old one are no longer accepted, so its keys are of no more use
+	if old.prevKeys != old.keys {
+		old.prevKeys.wipe()
+	}
+	return nil
+}
+
+// keyUsage counts the payload bytes and frames obfsed under a key, for ObfsConfig.RekeyAfterBytes and
+// RekeyAfterFrames
+type keyUsage struct {
+	// atomic
+	bytes  uint64
+	frames uint64
+}
+
+func (u *keyUsage) add(payloadLen int) {
+	atomic.AddUint64(&u.bytes, uint64(payloadLen))
+	atomic.AddUint64(&u.frames, 1)
+}
+
+// ShouldRekey reports whether ObfsConfig.RekeyAfterBytes or RekeyAfterFrames have been reached under the current key,
+// and that the caller should arrange a Rekey with the remote. It's always false if neither is set. It's safe to call
+// while frames are being obfsed, which may carry on under the current key until Rekey is called
+func (o *Obfuscator) ShouldRekey() bool {
+	config := o.config
+	if config.RekeyAfterBytes == 0 && config.RekeyAfterFrames == 0 {
+		return false
+	}
+	keys := o.keys
+	if config.ProtocolVersion >= PROTOCOL_V4 {
+		keys = o.epochs.Load().(*keyEpoch).keys
+	}
+	return config.RekeyAfterBytes != 0 && atomic.LoadUint64(&keys.usage.bytes) >= config.RekeyAfterBytes ||
+		config.RekeyAfterFrames != 0 && atomic.LoadUint64(&keys.usage.frames) >= config.RekeyAfterFrames
+}
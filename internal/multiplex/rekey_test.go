@@ -0,0 +1,211 @@
+package multiplex
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRekey(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	newKey := make([]byte, 32)
+	rand.Read(newKey)
+
+	config := ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V4, RekeyGracePeriod: 100 * time.Millisecond}
+	local, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, config)
+	remote, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, config)
+
+	testFrame := &Frame{StreamID: 1, Seq: 1, Payload: make([]byte, 100)}
+	rand.Read(testFrame.Payload)
+	obfs := func(o *Obfuscator) []byte {
+		buf := make([]byte, 512)
+		n, err := o.Obfs(testFrame, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+
+	oldEpoch := obfs(local)
+	if err := local.Rekey(newKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Rekey(newKey); err != nil {
+		t.Fatal(err)
+	}
+	newEpoch := obfs(local)
+
+	for name, in := range map[string][]byte{"previous epoch": oldEpoch, "current epoch": newEpoch} {
+		f, err := remote.Deobfs(in)
+		if err != nil {
+			t.Errorf("%v: failed to deobfs: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(f.Payload, testFrame.Payload) {
+			t.Errorf("%v: payload mismatch", name)
+		}
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if _, err := remote.Deobfs(oldEpoch); err == nil {
+		t.Error("frame of the previous epoch accepted after the grace period")
+	}
+	if _, err := remote.Deobfs(newEpoch); err != nil {
+		t.Errorf("failed to deobfs frame of the current epoch: %v", err)
+	}
+
+	if !bytes.Equal(local.SessionKey, sessionKey) {
+		t.Error("SessionKey changed by Rekey")
+	}
+}
+
+func TestKeyEpochAuthenticated(t *testing.T) {
+	var key [32]byte
+	rand.Read(key[:])
+	o, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, key[:], ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: PROTOCOL_V4})
+	config := o.config
+	config.keyEpoch = 1
+	obfs := MakeObfs(key, o.payloadCipher, config)
+	deobfs := MakeDeobfs(key, o.payloadCipher, o.config)
+
+	buf := make([]byte, 512)
+	n, _ := obfs(&Frame{StreamID: 1, Payload: make([]byte, 100)}, buf)
+	if _, err := deobfs(buf[:n]); !errors.Is(err, errWrongKeyEpoch) {
+		t.Errorf("expecting %v, got %v", errWrongKeyEpoch, err)
+	}
+
+	// the header is scrambled with a stream cipher, so flipping a bit of it flips the same bit of the epoch
+	buf[5+14] ^= 1
+	if _, err := deobfs(buf[:n]); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("expecting %v, got %v", ErrAuthFailed, err)
+	}
+}
+
+func TestRekeyUnsupported(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+
+	v3, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{ProtocolVersion: PROTOCOL_V3})
+	if err := v3.Rekey(sessionKey); err == nil {
+		t.Error("rekeying before protocol v4 should fail")
+	}
+	plain, _ := GenerateObfsWithConfig(E_METHOD_PLAIN, sessionKey, ObfsConfig{ProtocolVersion: PROTOCOL_V4})
+	if err := plain.Rekey(sessionKey); err == nil {
+		t.Error("rekeying plain frames should fail")
+	}
+	v4, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{ProtocolVersion: PROTOCOL_V4})
+	if err := v4.Rekey(sessionKey[:16]); !errors.Is(err, ErrBadSessionKeySize) {
+		t.Errorf("expecting %v, got %v", ErrBadSessionKeySize, err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	for _, version := range []byte{PROTOCOL_V1, PROTOCOL_V4} {
+		for _, method := range []Method{E_METHOD_PLAIN, E_METHOD_AES_GCM} {
+			sessionKey := make([]byte, 32)
+			rand.Read(sessionKey)
+			obfuscator, _ := GenerateObfsWithConfig(method, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: version, PlainMAC: true})
+			if version >= PROTOCOL_V4 && method != E_METHOD_PLAIN {
+				newKey := make([]byte, 32)
+				rand.Read(newKey)
+				obfuscator.Rekey(newKey)
+			}
+			obfsBuf := make([]byte, 200)
+			n, _ := obfuscator.Obfs(&Frame{StreamID: 1, Payload: make([]byte, 10)}, obfsBuf)
+
+			obfuscator.Close()
+			if !bytes.Equal(sessionKey, make([]byte, 32)) {
+				t.Errorf("v%v %v: session key isn't wiped", version+1, method)
+			}
+			if obfuscator.keys.salsaKey != [32]byte{} {
+				t.Errorf("v%v %v: header key isn't wiped", version+1, method)
+			}
+			if version >= PROTOCOL_V4 {
+				e := obfuscator.epochs.Load().(*keyEpoch)
+				if e.keys.salsaKey != [32]byte{} {
+					t.Errorf("v%v %v: header key of the current epoch isn't wiped", version+1, method)
+				}
+			}
+			if method == E_METHOD_PLAIN && obfuscator.keys.mac.key != [32]byte{} {
+				t.Errorf("v%v %v: MAC key isn't wiped", version+1, method)
+			}
+			if _, err := obfuscator.Obfs(&Frame{StreamID: 1}, obfsBuf); err != ErrObfuscatorClosed {
+				t.Errorf("v%v %v: expecting %v from Obfs, got %v", version+1, method, ErrObfuscatorClosed, err)
+			}
+			if _, err := obfuscator.Deobfs(obfsBuf[:n]); err != ErrObfuscatorClosed {
+				t.Errorf("v%v %v: expecting %v from Deobfs, got %v", version+1, method, ErrObfuscatorClosed, err)
+			}
+		}
+	}
+}
+
+func TestShouldRekey(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfsBuf := make([]byte, 512)
+	testFrame := &Frame{StreamID: 1, Payload: make([]byte, 100)}
+
+	t.Run("bytes", func(t *testing.T) {
+		obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithProtocolVersion(PROTOCOL_V4), WithRekeyAfter(250, 0))
+		for i := 0; i < 3; i++ {
+			if obfuscator.ShouldRekey() {
+				t.Fatalf("expecting no rekey after %v bytes", i*100)
+			}
+			obfuscator.Obfs(testFrame, obfsBuf)
+		}
+		if !obfuscator.ShouldRekey() {
+			t.Error("expecting a rekey after 300 bytes")
+		}
+		newKey := make([]byte, 32)
+		rand.Read(newKey)
+		if err := obfuscator.Rekey(newKey); err != nil {
+			t.Fatal(err)
+		}
+		if obfuscator.ShouldRekey() {
+			t.Error("expecting the count to start over with the new key")
+		}
+	})
+
+	t.Run("frames", func(t *testing.T) {
+		obfuscator, _ := GenerateObfs(E_METHOD_PLAIN, sessionKey, WithRekeyAfter(0, 2))
+		obfuscator.Obfs(&Frame{StreamID: 1}, obfsBuf)
+		if obfuscator.ShouldRekey() {
+			t.Error("expecting no rekey after 1 frame")
+		}
+		obfuscator.Obfs(&Frame{StreamID: 1}, obfsBuf)
+		if !obfuscator.ShouldRekey() {
+			t.Error("expecting a rekey after 2 frames")
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRekeyAfter(0, 400))
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				buf := make([]byte, 512)
+				for j := 0; j < 100; j++ {
+					obfuscator.Obfs(testFrame, buf)
+				}
+			}()
+		}
+		wg.Wait()
+		if !obfuscator.ShouldRekey() {
+			t.Error("expecting every frame obfsed concurrently to be counted")
+		}
+	})
+
+	obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey)
+	for i := 0; i < 10; i++ {
+		obfuscator.Obfs(testFrame, obfsBuf)
+	}
+	if obfuscator.ShouldRekey() {
+		t.Error("expecting no rekey without a limit")
+	}
+}
@@ -0,0 +1,148 @@
+package multiplex
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrReorderBufferFull = errors.New("too many frames are waiting for a missing seq")
+var ErrReorderGapTimeout = errors.New("a missing seq hasn't arrived in time")
+
+// ReorderBuffer puts frames returned by a Deobfser back into Seq order for each stream, for transports that can
+// reorder them. This is what streamBuffer does for a Session, for users of the obfs layer who read frames themselves,
+// such as through a FrameReader. Each stream's Seqs are expected to start from 0.
+//
+// A stream whose missing Seq doesn't arrive before MaxDepth frames are waiting behind it, or within GapTimeout of the
+// first of them, can't be delivered in order. Push then returns an error for it, and for any later frames of it, unless
+// SkipGaps is set.
+type ReorderBuffer struct {
+	// MaxDepth is how many frames of a stream can be waiting. There is no limit if it's 0
+	MaxDepth int
+	// GapTimeout is how long a frame can be waiting for a missing Seq, which is checked whenever a frame of the stream
+	// is pushed. There is no limit if it's 0
+	GapTimeout time.Duration
+	// SkipGaps gives up on the missing Seqs of a stream instead of failing it once MaxDepth or GapTimeout is exceeded.
+	// The frames waiting up to the next gap are released, and the Seqs before them are dropped if they arrive later
+	SkipGaps bool
+
+	mu      sync.Mutex
+	streams map[uint64]*reorderStream
+	skipped uint64
+}
+
+type reorderStream struct {
+	nextSeq uint64
+	sh      sorterHeap
+	// waiting has the Seqs in sh, so that duplicates are dropped
+	waiting map[uint64]struct{}
+	// since is when the frames in sh started waiting
+	since time.Time
+	err   error
+}
+
+func NewReorderBuffer(maxDepth int, gapTimeout time.Duration) *ReorderBuffer {
+	return &ReorderBuffer{
+		MaxDepth:   maxDepth,
+		GapTimeout: gapTimeout,
+		streams:    make(map[uint64]*reorderStream),
+	}
+}
+
+// Push adds f and returns the frames of its stream that are now in order, which are none if it's waiting for a
+// missing Seq. Frames whose Seq has already been released or is already waiting are dropped. A stream is forgotten
+// once a frame closing it is released
+func (rb *ReorderBuffer) Push(f *Frame) ([]*Frame, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	s, ok := rb.streams[f.StreamID]
+	if !ok {
+		s = &reorderStream{waiting: make(map[uint64]struct{})}
+		rb.streams[f.StreamID] = s
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	if f.Seq < s.nextSeq {
+		return nil, nil
+	}
+	if _, dup := s.waiting[f.Seq]; dup {
+		return nil, nil
+	}
+	if f.Seq == s.nextSeq && len(s.sh) == 0 {
+		rb.release(s, f)
+		return []*Frame{f}, nil
+	}
+
+	// the missing seq itself is always taken
+	var gapErr error
+	if f.Seq != s.nextSeq {
+		if rb.GapTimeout > 0 && len(s.sh) > 0 && time.Since(s.since) > rb.GapTimeout {
+			gapErr = ErrReorderGapTimeout
+		} else if rb.MaxDepth > 0 && len(s.sh) >= rb.MaxDepth {
+			gapErr = ErrReorderBufferFull
+		}
+		if gapErr != nil && !rb.SkipGaps {
+			return nil, rb.fail(s, fmt.Errorf("%w: stream %v is missing seq %v", gapErr, f.StreamID, s.nextSeq))
+		}
+	}
+	if len(s.sh) == 0 {
+		s.since = time.Now()
+	}
+	heap.Push(&s.sh, f)
+	s.waiting[f.Seq] = struct{}{}
+	if gapErr != nil {
+		// the frames are released from the lowest Seq waiting
+		rb.skipped += s.sh[0].Seq - s.nextSeq
+		s.nextSeq = s.sh[0].Seq
+	}
+
+	var inOrder []*Frame
+	for len(s.sh) > 0 && s.sh[0].Seq == s.nextSeq {
+		next := heap.Pop(&s.sh).(*Frame)
+		delete(s.waiting, next.Seq)
+		rb.release(s, next)
+		inOrder = append(inOrder, next)
+	}
+	if len(inOrder) > 0 && len(s.sh) > 0 {
+		// the frames left are now waiting for a different seq
+		s.since = time.Now()
+	}
+	return inOrder, nil
+}
+
+func (rb *ReorderBuffer) release(s *reorderStream, f *Frame) {
+	s.nextSeq = f.Seq + 1
+	if f.ClosesStream() || f.ClosesSession() {
+		delete(rb.streams, f.StreamID)
+	}
+}
+
+// fail drops the frames waiting in s, and makes err the error for any later frames of it
+func (rb *ReorderBuffer) fail(s *reorderStream, err error) error {
+	s.err = err
+	s.sh = nil
+	s.waiting = nil
+	return err
+}
+
+// Depth returns the number of frames of all streams that are waiting for a missing Seq
+func (rb *ReorderBuffer) Depth() int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	depth := 0
+	for _, s := range rb.streams {
+		depth += len(s.sh)
+	}
+	return depth
+}
+
+// Skipped returns the number of missing Seqs given up on with SkipGaps
+func (rb *ReorderBuffer) Skipped() uint64 {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.skipped
+}
@@ -0,0 +1,122 @@
+package multiplex
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func pushAll(t *testing.T, rb *ReorderBuffer, seqs ...uint64) []uint64 {
+	var released []uint64
+	for _, seq := range seqs {
+		frames, err := rb.Push(&Frame{StreamID: 1, Seq: seq})
+		if err != nil {
+			t.Fatalf("failed to push seq %v: %v", seq, err)
+		}
+		for _, f := range frames {
+			released = append(released, f.Seq)
+		}
+	}
+	return released
+}
+
+func TestReorderBuffer(t *testing.T) {
+	rb := NewReorderBuffer(0, 0)
+	released := pushAll(t, rb, 0, 2, 3, 1, 5, 4)
+	for i, seq := range released {
+		if seq != uint64(i) {
+			t.Fatalf("frames released out of order: %v", released)
+		}
+	}
+	if len(released) != 6 {
+		t.Errorf("expecting 6 frames to be released, got %v", released)
+	}
+
+	t.Run("duplicates", func(t *testing.T) {
+		rb := NewReorderBuffer(0, 0)
+		released := pushAll(t, rb, 0, 0, 2, 2, 1, 1)
+		if len(released) != 3 {
+			t.Errorf("expecting duplicates to be dropped, got %v", released)
+		}
+	})
+
+	t.Run("streams are independent", func(t *testing.T) {
+		rb := NewReorderBuffer(1, 0)
+		rb.Push(&Frame{StreamID: 1, Seq: 1})
+		frames, err := rb.Push(&Frame{StreamID: 2, Seq: 0})
+		if err != nil || len(frames) != 1 {
+			t.Errorf("a gap in stream 1 held up stream 2: %v %v", frames, err)
+		}
+	})
+
+	t.Run("closed streams are forgotten", func(t *testing.T) {
+		rb := NewReorderBuffer(0, 0)
+		rb.Push(&Frame{StreamID: 1, Seq: 0, Closing: C_STREAM})
+		if len(rb.streams) != 0 {
+			t.Errorf("a closed stream is still kept")
+		}
+	})
+}
+
+func TestReorderBufferLimits(t *testing.T) {
+	rb := NewReorderBuffer(2, 0)
+	pushAll(t, rb, 1, 2)
+	if _, err := rb.Push(&Frame{StreamID: 1, Seq: 3}); !errors.Is(err, ErrReorderBufferFull) {
+		t.Errorf("expecting %v, got %v", ErrReorderBufferFull, err)
+	}
+	if _, err := rb.Push(&Frame{StreamID: 1, Seq: 0}); !errors.Is(err, ErrReorderBufferFull) {
+		t.Errorf("a failed stream should keep failing, got %v", err)
+	}
+
+	rb = NewReorderBuffer(0, 10*time.Millisecond)
+	pushAll(t, rb, 1)
+	time.Sleep(20 * time.Millisecond)
+	if released := pushAll(t, rb, 0); len(released) != 2 {
+		t.Errorf("the missing seq should be taken even after the timeout, got %v", released)
+	}
+	pushAll(t, rb, 3)
+	time.Sleep(20 * time.Millisecond)
+	if _, err := rb.Push(&Frame{StreamID: 1, Seq: 4}); !errors.Is(err, ErrReorderGapTimeout) {
+		t.Errorf("expecting %v, got %v", ErrReorderGapTimeout, err)
+	}
+}
+
+func TestReorderBufferSkipGaps(t *testing.T) {
+	rb := NewReorderBuffer(2, 0)
+	rb.SkipGaps = true
+	if released := pushAll(t, rb, 0, 2, 3); len(released) != 1 {
+		t.Fatalf("expecting seq 1 to be waited for, got %v", released)
+	}
+	if rb.Depth() != 2 {
+		t.Errorf("expecting 2 frames waiting, got %v", rb.Depth())
+	}
+	// seq 5 doesn't fit, so seq 1 is given up on
+	released := pushAll(t, rb, 5)
+	if len(released) != 2 || released[0] != 2 || released[1] != 3 {
+		t.Errorf("expecting seqs 2 and 3 after skipping seq 1, got %v", released)
+	}
+	if rb.Depth() != 1 || rb.Skipped() != 1 {
+		t.Errorf("expecting 1 frame waiting and 1 seq skipped, got %v and %v", rb.Depth(), rb.Skipped())
+	}
+	if released := pushAll(t, rb, 1, 4); len(released) != 2 || released[0] != 4 || released[1] != 5 {
+		t.Errorf("expecting the skipped seq to be dropped, got %v", released)
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		rb := NewReorderBuffer(0, 10*time.Millisecond)
+		rb.SkipGaps = true
+		pushAll(t, rb, 0, 3, 4)
+		time.Sleep(20 * time.Millisecond)
+		released := pushAll(t, rb, 6)
+		if len(released) != 2 || released[0] != 3 || released[1] != 4 {
+			t.Errorf("expecting seqs 3 and 4 after the timeout, got %v", released)
+		}
+		if rb.Skipped() != 2 || rb.Depth() != 1 {
+			t.Errorf("expecting 2 seqs skipped and 1 frame waiting, got %v and %v", rb.Skipped(), rb.Depth())
+		}
+		// seq 6 waits for a gap of its own, which hasn't timed out yet
+		if released := pushAll(t, rb, 7); len(released) != 0 {
+			t.Errorf("expecting seq 5 to be waited for, got %v", released)
+		}
+	})
+}
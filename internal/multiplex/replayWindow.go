@@ -0,0 +1,99 @@
+package multiplex
+
+// An attacker who captured a frame on the wire can send it again later, and since it is a perfectly valid frame
+// it would decrypt and be delivered a second time. This file implements the anti-replay window described in
+// RFC 4303 section 3.4.3 (IPsec ESP), kept separately for each stream: the highest Seq received so far and a bitmap
+// of which of the Seqs just below it have been seen. A frame whose Seq has been seen already, or is too far below
+// the highest one to be tracked, is rejected.
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrReplayedFrame = errors.New("frame has been replayed or is too old")
+
+type replayWindow struct {
+	mu sync.Mutex
+
+	// whether anything has been received at all, so that the first frame can have any seq
+	started bool
+	highest uint64
+	// bit i is set if highest-i has been received
+	bitmap []uint64
+	size   uint64
+}
+
+func newReplayWindow(size int) *replayWindow {
+	return &replayWindow{
+		bitmap: make([]uint64, (size+63)/64),
+		size:   uint64(size),
+	}
+}
+
+func (w *replayWindow) isSet(i uint64) bool { return w.bitmap[i/64]&(1<<(i%64)) != 0 }
+func (w *replayWindow) set(i uint64)        { w.bitmap[i/64] |= 1 << (i % 64) }
+
+// shift moves every bit in the bitmap n places towards older seqs, dropping those that fall off the end
+func (w *replayWindow) shift(n uint64) {
+	if n >= w.size {
+		for i := range w.bitmap {
+			w.bitmap[i] = 0
+		}
+		return
+	}
+	words := int(n / 64)
+	bits := n % 64
+	for i := len(w.bitmap) - 1; i >= 0; i-- {
+		var v uint64
+		if i-words >= 0 {
+			v = w.bitmap[i-words] << bits
+			if bits != 0 && i-words-1 >= 0 {
+				v |= w.bitmap[i-words-1] >> (64 - bits)
+			}
+		}
+		w.bitmap[i] = v
+	}
+}
+
+// check returns whether seq is acceptable, and marks it as received if it is
+func (w *replayWindow) check(seq uint64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.started {
+		w.started = true
+		w.highest = seq
+		w.set(0)
+		return true
+	}
+	if seq > w.highest {
+		w.shift(seq - w.highest)
+		w.highest = seq
+		w.set(0)
+		return true
+	}
+	diff := w.highest - seq
+	if diff >= w.size || w.isSet(diff) {
+		return false
+	}
+	w.set(diff)
+	return true
+}
+
+// replayGuard keeps a replayWindow for each stream. Frames of different streams only contend on the lock of their own
+// window
+type replayGuard struct {
+	size    int
+	windows sync.Map // uint64 -> *replayWindow
+}
+
+func (g *replayGuard) check(streamID uint64, seq uint64) error {
+	w, ok := g.windows.Load(streamID)
+	if !ok {
+		w, _ = g.windows.LoadOrStore(streamID, newReplayWindow(g.size))
+	}
+	if !w.(*replayWindow).check(seq) {
+		return ErrReplayedFrame
+	}
+	return nil
+}
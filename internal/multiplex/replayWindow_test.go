@@ -0,0 +1,123 @@
+package multiplex
+
+import (
+	"crypto/rand"
+	"testing"
+)
+
+func TestReplayWindow(t *testing.T) {
+	t.Run("in order", func(t *testing.T) {
+		w := newReplayWindow(64)
+		for seq := uint64(0); seq < 200; seq++ {
+			if !w.check(seq) {
+				t.Errorf("seq %v should be accepted", seq)
+			}
+			if w.check(seq) {
+				t.Errorf("repeated seq %v should be rejected", seq)
+			}
+		}
+	})
+	t.Run("first frame can have any seq", func(t *testing.T) {
+		w := newReplayWindow(64)
+		if !w.check(1000) {
+			t.Error("first seq should be accepted")
+		}
+		if !w.check(990) {
+			t.Error("seq within the window should be accepted")
+		}
+	})
+	t.Run("reordered within window", func(t *testing.T) {
+		w := newReplayWindow(100)
+		for _, seq := range []uint64{5, 3, 4, 0, 104, 6, 50} {
+			if !w.check(seq) {
+				t.Errorf("seq %v should be accepted", seq)
+			}
+		}
+		for _, seq := range []uint64{5, 3, 4, 104, 6, 50} {
+			if w.check(seq) {
+				t.Errorf("repeated seq %v should be rejected", seq)
+			}
+		}
+		if !w.check(7) {
+			t.Error("seq 7 is within the window and hasn't been seen")
+		}
+	})
+	t.Run("too old", func(t *testing.T) {
+		w := newReplayWindow(100)
+		w.check(200)
+		if w.check(100) {
+			t.Error("seq 100 is outside of the window")
+		}
+		if !w.check(101) {
+			t.Error("seq 101 is the oldest in the window")
+		}
+	})
+	t.Run("shifting across words", func(t *testing.T) {
+		w := newReplayWindow(200)
+		w.check(0)
+		w.check(10)
+		w.check(70)
+		// shift by less than a word, then by more than a word
+		w.check(100)
+		w.check(180)
+		for _, seq := range []uint64{0, 10, 70, 100, 180} {
+			if w.check(seq) {
+				t.Errorf("repeated seq %v should be rejected", seq)
+			}
+		}
+		for _, seq := range []uint64{1, 11, 69, 71, 99, 179} {
+			if !w.check(seq) {
+				t.Errorf("seq %v should be accepted", seq)
+			}
+		}
+		// jumping further than the size of the window forgets everything
+		w.check(1000)
+		if !w.check(999) {
+			t.Error("seq 999 should be accepted")
+		}
+	})
+}
+
+func TestDeobfsReplay(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, ReplayWindow: 64})
+
+	obfsBuf := make([]byte, 512)
+	f := &Frame{StreamID: 1, Seq: 0, Payload: []byte("hello")}
+	n, _ := obfuscator.Obfs(f, obfsBuf)
+	if _, err := obfuscator.Deobfs(obfsBuf[:n]); err != nil {
+		t.Fatalf("failed to deobfs the first time: %v", err)
+	}
+	if _, err := obfuscator.Deobfs(obfsBuf[:n]); err != ErrReplayedFrame {
+		t.Errorf("expecting %v, got %v", ErrReplayedFrame, err)
+	}
+
+	// the same seq on a different stream is not a replay
+	f.StreamID = 2
+	n, _ = obfuscator.Obfs(f, obfsBuf)
+	if _, err := obfuscator.Deobfs(obfsBuf[:n]); err != nil {
+		t.Errorf("failed to deobfs the same seq on another stream: %v", err)
+	}
+
+	// without a window replays go through
+	noGuard, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+	for i := 0; i < 2; i++ {
+		if _, err := noGuard.Deobfs(obfsBuf[:n]); err != nil {
+			t.Errorf("failed to deobfs without a replay window: %v", err)
+		}
+	}
+}
+
+func BenchmarkReplayWindow(b *testing.B) {
+	g := &replayGuard{size: 1024}
+	b.RunParallel(func(pb *testing.PB) {
+		var streamID [1]byte
+		rand.Read(streamID[:])
+		var seq uint64
+		for pb.Next() {
+			g.check(uint64(streamID[0]), seq)
+			seq++
+		}
+	})
+}
@@ -0,0 +1,42 @@
+package multiplex
+
+// Role is which end of a session an Obfuscator is on. Both directions of a session are encrypted with the same key,
+// and both ends count Seq up from 0 on the same StreamIDs, so without a role the AEAD nonce of a frame taken from its
+// header (StreamID and Seq) is used once in each direction. Bound roles set the top bit of StreamID in the nonce of
+// frames sent by the server, which then differs from the nonce of every frame sent by the client.
+//
+// The top bit of StreamID is then not available for stream IDs, and the Obfser refuses them with
+// ErrStreamIDTooLarge. Explicit random nonces and E_METHOD_PLAIN are unaffected. With ObfsConfig.DirectionalKeys the
+// role instead picks which of the two keys derived for the directions frames are sent with, and nonces are left alone.
+type Role byte
+
+const (
+	// ROLE_UNBOUND uses the same nonces in both directions, as peers that predate Role do
+	ROLE_UNBOUND Role = iota
+	ROLE_CLIENT
+	ROLE_SERVER
+
+	maxRole = iota - 1
+)
+
+// roleNonceBit is flipped in header[0], the top byte of StreamID in every header layout, to make the nonce of frames
+// sent by the server
+const roleNonceBit = 0x80
+
+func (r Role) Valid() bool { return r <= maxRole }
+
+// sendNonceBit is what the nonce of frames sent by r is flipped by
+func (r Role) sendNonceBit() byte {
+	if r == ROLE_SERVER {
+		return roleNonceBit
+	}
+	return 0
+}
+
+// recvNonceBit is what the nonce of frames received by r is flipped by, which are sent by the opposite role
+func (r Role) recvNonceBit() byte {
+	if r == ROLE_CLIENT {
+		return roleNonceBit
+	}
+	return 0
+}
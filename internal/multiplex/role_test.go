@@ -0,0 +1,125 @@
+package multiplex
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestRoleNonce(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	for _, version := range []byte{PROTOCOL_V1, PROTOCOL_V6, PROTOCOL_V9} {
+		for _, method := range []Method{E_METHOD_AES_GCM, E_METHOD_CHACHA20_POLY1305} {
+			client, _ := GenerateObfs(method, sessionKey, WithRecordLayer(TLSRecordLayer{}), WithProtocolVersion(version), WithRole(ROLE_CLIENT))
+			server, _ := GenerateObfs(method, sessionKey, WithRecordLayer(TLSRecordLayer{}), WithProtocolVersion(version), WithRole(ROLE_SERVER))
+			payload := make([]byte, 100)
+			rand.Read(payload)
+
+			clientBuf := make([]byte, 200)
+			serverBuf := make([]byte, 200)
+			n, _ := client.Obfs(&Frame{StreamID: 1, Seq: 2, Payload: payload}, clientBuf)
+			server.Obfs(&Frame{StreamID: 1, Seq: 2, Payload: payload}, serverBuf)
+			ciphertextStart := recordHeaderLen + client.config.headerLen()
+			if bytes.Equal(clientBuf[ciphertextStart:n], serverBuf[ciphertextStart:n]) {
+				t.Errorf("v%v %v: both directions produced the same ciphertext", version+1, method)
+			}
+
+			for _, obfsed := range []struct {
+				receiver *Obfuscator
+				in       []byte
+			}{{server, clientBuf[:n]}, {client, serverBuf[:n]}} {
+				f, err := obfsed.receiver.Deobfs(obfsed.in)
+				if err != nil {
+					t.Fatalf("v%v %v: failed to deobfs: %v", version+1, method, err)
+				}
+				if !bytes.Equal(f.Payload, payload) {
+					t.Errorf("v%v %v: payload mismatch", version+1, method)
+				}
+			}
+			// a frame reflected back to its sender is refused
+			if _, err := client.Deobfs(clientBuf[:n]); !errors.Is(err, ErrAuthFailed) {
+				t.Errorf("v%v %v: expecting %v for a reflected frame, got %v", version+1, method, ErrAuthFailed, err)
+			}
+
+			if _, err := server.Obfs(&Frame{StreamID: client.config.layout().maxStreamID()/2 + 1}, serverBuf); err != ErrStreamIDTooLarge {
+				t.Errorf("v%v %v: expecting %v for a StreamID with the top bit, got %v", version+1, method, ErrStreamIDTooLarge, err)
+			}
+		}
+	}
+
+	if _, err := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRole(math.MaxUint8)); err == nil {
+		t.Error("an unknown role should be refused")
+	}
+}
+
+func TestDirectionalKeys(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	for i := range sessionKey {
+		sessionKey[i] = byte(i)
+	}
+	// the key of each direction, followed by the header and payload keys derived from it
+	vectors := map[string][3]string{
+		clientToServerKeyInfo: {
+			"3a9b025f80dab1a318e81b0660690bf78afa3c615b12f3cfc59af1be65148a00",
+			"be72c0ccf4366f06208a3161f051b40fde916bc895792949b9e8ea583eb06332",
+			"a449a076d4cf5b7d6b5868555e2e2b51f66283c0c005d6600f5d436926d21f78",
+		},
+		serverToClientKeyInfo: {
+			"7c5cb06dbecc465bf90fb96edbd91aad4879cde5b161e83260706918f3406cac",
+			"832cd6bc97fcfdb9e177eaa9b4763b0edea6c9aa80d6d8595073904d2286bb2b",
+			"38805251953b1d2e630f574b8cf4d2e7a3f3b32ee144a5e4c1c5dfec8a28420d",
+		},
+	}
+	for info, expected := range vectors {
+		directionKey := deriveSubkey(sessionKey, info)
+		headerKey := deriveSubkey(directionKey[:], headerKeyInfo)
+		payloadKey := deriveSubkey(directionKey[:], payloadKeyInfo)
+		for i, key := range [][32]byte{directionKey, headerKey, payloadKey} {
+			if hex.EncodeToString(key[:]) != expected[i] {
+				t.Errorf("%v: expecting key %v to be %v, got %x", info, i, expected[i], key)
+			}
+		}
+	}
+
+	client, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}), WithProtocolVersion(PROTOCOL_V3), WithRole(ROLE_CLIENT), WithDirectionalKeys())
+	server, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}), WithProtocolVersion(PROTOCOL_V3), WithRole(ROLE_SERVER), WithDirectionalKeys())
+	if client.keys.salsaKey == server.keys.salsaKey || client.keys.salsaKey != server.keys.recv.salsaKey {
+		t.Error("the send key of one end should be the receive key of the other")
+	}
+	expectedHeaderKey, _ := hex.DecodeString(vectors[clientToServerKeyInfo][1])
+	if !bytes.Equal(client.keys.salsaKey[:], expectedHeaderKey) {
+		t.Errorf("client sends with header key %x", client.keys.salsaKey)
+	}
+
+	obfsBuf := make([]byte, 200)
+	// the top bit of StreamID isn't needed to tell the directions apart
+	testFrame := &Frame{StreamID: math.MaxUint32, Seq: 2, Payload: []byte("directional")}
+	n, err := client.Obfs(testFrame, obfsBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the header is scrambled with a different key, so this may fail anywhere
+	if _, err := client.Deobfs(obfsBuf[:n]); err == nil {
+		t.Error("a frame reflected back to its sender should be refused")
+	}
+	f, err := server.Deobfs(obfsBuf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(f.Payload, testFrame.Payload) {
+		t.Error("payload mismatch")
+	}
+
+	for _, config := range []ObfsConfig{
+		{ProtocolVersion: PROTOCOL_V2, Role: ROLE_CLIENT, DirectionalKeys: true},
+		{ProtocolVersion: PROTOCOL_V3, DirectionalKeys: true},
+	} {
+		if _, err := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, config); err != ErrDirectionalKeysUnsupported {
+			t.Errorf("%+v: expecting %v, got %v", config, ErrDirectionalKeysUnsupported, err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package multiplex
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+// randomFrame is a Frame with any StreamID, Seq and combination of flags, and a payload that is often of one of the
+// lengths around which obfsing changes: empty, the 7 and 8 bytes plain frames are padded to, and longer than a record
+// can carry
+type randomFrame struct{ *Frame }
+
+func (randomFrame) Generate(r *rand.Rand, _ int) reflect.Value {
+	f := &Frame{
+		StreamID: r.Uint64(),
+		Seq:      r.Uint64(),
+		Closing:  uint8(r.Intn(256)) & (FlagFin | C_SESSION | FlagRst | FlagMore | FlagPadding | FlagControl | FlagDatagram),
+	}
+	var payloadLen int
+	switch r.Intn(6) {
+	case 0:
+		payloadLen = 0
+	case 1:
+		payloadLen = 7
+	case 2:
+		payloadLen = 8
+	case 3:
+		payloadLen = 65536 + r.Intn(4096)
+	default:
+		payloadLen = r.Intn(2048)
+	}
+	f.Payload = make([]byte, payloadLen)
+	r.Read(f.Payload)
+	return reflect.ValueOf(randomFrame{f})
+}
+
+func TestObfsRoundTripProperty(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	methods := []Method{E_METHOD_PLAIN, E_METHOD_AES_GCM, E_METHOD_CHACHA20_POLY1305, E_METHOD_AES_128_GCM, E_METHOD_AES_192_GCM, E_METHOD_AES_GCM_SIV, E_METHOD_XCHACHA20_POLY1305}
+	recordLayers := []RecordLayer{TLSRecordLayer{}, NoRecordLayer{}, TLSRecordLayer{MaxRecordLen: 16384}, HTTP2DataRecordLayer{}}
+	obfsBuf := make([]byte, 80000)
+
+	for _, method := range methods {
+		for _, recordLayer := range recordLayers {
+			for _, version := range []byte{PROTOCOL_V1, PROTOCOL_V5, PROTOCOL_V9} {
+				name := fmt.Sprintf("%v %T%+v v%v", method, recordLayer, recordLayer, version+1)
+				obfuscator, err := GenerateObfs(method, sessionKey, WithRecordLayer(recordLayer), WithProtocolVersion(version))
+				if err != nil {
+					t.Fatalf("%v: %v", name, err)
+				}
+				layout := obfuscator.config.layout()
+				var maxFrameLen int
+				if splitter, ok := recordLayer.(recordSplitter); ok {
+					maxFrameLen = splitter.maxFrameLen()
+				}
+
+				roundTrip := func(rf randomFrame) bool {
+					f := rf.Frame
+					f.StreamID &= layout.maxStreamID()
+					f.Seq &= layout.maxNonceSeq()
+					n, err := obfuscator.Obfs(f, obfsBuf)
+					if maxFrameLen != 0 && obfuscator.frameLen(len(f.Payload)) > maxFrameLen {
+						if !errors.Is(err, ErrRecordTooLarge) {
+							t.Logf("%v: expecting %v for a %v byte payload, got %v", name, ErrRecordTooLarge, len(f.Payload), err)
+							return false
+						}
+						return true
+					}
+					if err != nil {
+						t.Logf("%v: failed to obfs %v byte payload: %v", name, len(f.Payload), err)
+						return false
+					}
+					var result *Frame
+					if tlsLayer, ok := recordLayer.(TLSRecordLayer); ok && tlsLayer.MaxRecordLen > 0 {
+						// records split from one frame are only joined back by a FrameReader
+						fr := NewFrameReader(bytes.NewReader(obfsBuf[:n]), obfuscator.Deobfs)
+						fr.MaxRecordLen = tlsLayer.MaxRecordLen
+						fr.MaxFrameSize = 0
+						result, err = fr.ReadFrame()
+					} else {
+						result, err = obfuscator.Deobfs(obfsBuf[:n])
+					}
+					if err != nil {
+						t.Logf("%v: failed to deobfs %v byte payload: %v", name, len(f.Payload), err)
+						return false
+					}
+					if !result.Equal(f) {
+						t.Logf("%v: expecting frame %v/%v/%x with a %v byte payload, got %v/%v/%x with %v bytes", name,
+							f.StreamID, f.Seq, f.Closing, len(f.Payload), result.StreamID, result.Seq, result.Closing, len(result.Payload))
+						return false
+					}
+					return true
+				}
+				if err := quick.Check(roundTrip, &quick.Config{MaxCount: 30}); err != nil {
+					t.Error(err)
+				}
+				// the plain mode padding branch, which random lengths may not hit
+				for _, payloadLen := range []int{0, 7, 8} {
+					if !roundTrip(randomFrame{&Frame{StreamID: 1, Seq: 2, Payload: make([]byte, payloadLen)}}) {
+						t.Errorf("%v: %v byte payload doesn't round trip", name, payloadLen)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package multiplex
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	prand "math/rand"
+	"sync"
+	"time"
+)
+
+var ErrSchedulerClosed = errors.New("scheduler is closed")
+
+// JitterPolicy decides how much longer than SchedulerConfig.Interval the Scheduler waits before each frame, so that
+// frames don't go out on an exact clock
+type JitterPolicy interface {
+	Jitter() time.Duration
+}
+
+// UniformJitter waits between 0 and UniformJitter longer, chosen uniformly at random
+type UniformJitter time.Duration
+
+func (u UniformJitter) Jitter() time.Duration {
+	if u <= 0 {
+		return 0
+	}
+	return time.Duration(prand.Int63n(int64(u) + 1))
+}
+
+type SchedulerConfig struct {
+	// Interval is how long the Scheduler waits between frames
+	Interval time.Duration
+	// Jitter is added to Interval before each frame if it isn't nil
+	Jitter JitterPolicy
+	// PaddingLen is how many random bytes padding frames carry. Padding frames only look like the real frames around
+	// them if they are obfsed into records of similar lengths, such as with a BucketPadding whose buckets the real
+	// frames fall into as well
+	PaddingLen int
+	// QueueLen is how many frames can be waiting to be written before Send blocks. 0 means frames are handed over
+	// to the Scheduler one at a time
+	QueueLen int
+}
+
+// Scheduler writes frames to an io.Writer at a constant rate, regardless of how fast frames are given to it. Real
+// frames are queued and written one each interval, and when none is waiting a padding frame (FlagPadding) is written
+// in its place. Both are obfsed by the same Obfuscator, so nothing but their lengths tells them apart on the
+// wire. Padding frames are sent on StreamID 0 with Seqs counting up from 0, so the frames Sent must be on other
+// streams, or their nonces would be reused.
+//
+// Frames are written from a goroutine of the Scheduler's own, which runs until the Scheduler is closed or a write
+// fails.
+type Scheduler struct {
+	config SchedulerConfig
+	fw     *FrameWriter
+	queue  chan *Frame
+
+	// done is closed once the Scheduler stops writing frames, and err is why
+	done      chan struct{}
+	closeOnce sync.Once
+	errMu     sync.Mutex
+	err       error
+}
+
+func NewScheduler(w io.Writer, obfuscator *Obfuscator, config SchedulerConfig) *Scheduler {
+	s := &Scheduler{
+		config: config,
+		fw:     NewFrameWriter(w, obfuscator),
+		queue:  make(chan *Frame, config.QueueLen),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Send queues f to be written in one of the intervals to come, blocking while the queue is full. f must not be
+// modified until it's been written. It returns the error that stopped the Scheduler if it has stopped
+func (s *Scheduler) Send(f *Frame) error {
+	select {
+	case <-s.done:
+		return s.Err()
+	default:
+	}
+	select {
+	case s.queue <- f:
+		return nil
+	case <-s.done:
+		return s.Err()
+	}
+}
+
+// Err returns why the Scheduler has stopped, or nil if it's still running
+func (s *Scheduler) Err() error {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	return s.err
+}
+
+// Close stops the Scheduler. Frames still in the queue are dropped, and the io.Writer isn't closed
+func (s *Scheduler) Close() error {
+	s.stop(ErrSchedulerClosed)
+	return nil
+}
+
+func (s *Scheduler) stop(err error) {
+	s.closeOnce.Do(func() {
+		s.errMu.Lock()
+		s.err = err
+		s.errMu.Unlock()
+		close(s.done)
+	})
+}
+
+func (s *Scheduler) wait() time.Duration {
+	if s.config.Jitter == nil {
+		return s.config.Interval
+	}
+	return s.config.Interval + s.config.Jitter.Jitter()
+}
+
+func (s *Scheduler) run() {
+	padding := &Frame{Closing: FlagPadding, Payload: make([]byte, s.config.PaddingLen)}
+	timer := time.NewTimer(s.wait())
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-timer.C:
+		}
+
+		var f *Frame
+		select {
+		case f = <-s.queue:
+		default:
+			rand.Read(padding.Payload)
+			f = padding
+		}
+		if err := s.fw.WriteFrame(f); err != nil {
+			s.stop(err)
+			return
+		}
+		if f == padding {
+			// the StreamID and Seq make up the nonce, so no two padding frames can share a Seq
+			padding.Seq++
+		}
+		timer.Reset(s.wait())
+	}
+}
@@ -0,0 +1,88 @@
+package multiplex
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+	r, w := io.Pipe()
+	defer r.Close()
+	const interval = 5 * time.Millisecond
+	s := NewScheduler(w, obfuscator, SchedulerConfig{Interval: interval, Jitter: UniformJitter(time.Millisecond), PaddingLen: 100, QueueLen: 3})
+	defer s.Close()
+
+	var sent []*Frame
+	for i := 0; i < 3; i++ {
+		f := &Frame{StreamID: 1, Seq: uint64(i), Payload: make([]byte, 100)}
+		rand.Read(f.Payload)
+		if err := s.Send(f); err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, f)
+	}
+
+	fr := NewFrameReader(r, obfuscator.Deobfs)
+	paddingSeqs := make(map[uint64]bool)
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatalf("failed to read frame %v: %v", i, err)
+		}
+		if i < len(sent) {
+			if f.IsPadding() || f.Seq != sent[i].Seq || !bytes.Equal(f.Payload, sent[i].Payload) {
+				t.Errorf("frame %v isn't the one queued", i)
+			}
+		} else if !f.IsPadding() || len(f.Payload) != 100 {
+			t.Errorf("frame %v should be a padding frame of 100 bytes", i)
+		} else if paddingSeqs[f.Seq] {
+			t.Errorf("padding frame %v reuses Seq %v", i, f.Seq)
+		} else {
+			paddingSeqs[f.Seq] = true
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 5*interval {
+		t.Errorf("6 frames were written in %v, quicker than one every %v", elapsed, interval)
+	}
+}
+
+func TestSchedulerWriteError(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+	r, w := io.Pipe()
+	r.Close()
+	s := NewScheduler(w, obfuscator, SchedulerConfig{Interval: time.Millisecond})
+
+	var err error
+	for err == nil {
+		err = s.Send(&Frame{StreamID: 1, Payload: []byte("lost")})
+	}
+	if !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("expecting the write error %v, got %v", io.ErrClosedPipe, err)
+	}
+
+	s.Close()
+	if !errors.Is(s.Err(), io.ErrClosedPipe) {
+		t.Errorf("closing a stopped Scheduler shouldn't change why it stopped, got %v", s.Err())
+	}
+}
+
+func TestSchedulerClose(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	obfuscator, _ := GenerateObfs(E_METHOD_PLAIN, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+	s := NewScheduler(ioutil.Discard, obfuscator, SchedulerConfig{Interval: time.Hour})
+	s.Close()
+	if err := s.Send(&Frame{StreamID: 1}); !errors.Is(err, ErrSchedulerClosed) {
+		t.Errorf("expecting %v, got %v", ErrSchedulerClosed, err)
+	}
+}
@@ -1,6 +1,7 @@
 package multiplex
 
 import (
+	"crypto/cipher"
 	"crypto/rand"
 	"errors"
 	"fmt"
@@ -19,13 +20,30 @@ const (
 var ErrBrokenSession = errors.New("broken session")
 var errRepeatSessionClosing = errors.New("trying to close a closed session")
 
-// Obfuscator is responsible for the obfuscation and deobfuscation of frames
+// ErrGoingAway is returned when opening a stream on a session the remote is draining with a ControlGoAway
+var ErrGoingAway = errors.New("remote is going away, no new streams can be opened")
+
+// Obfuscator obfses and deobfses the frames of a session. Obfs, ObfsVectored, ObfsBuffers, Deobfs and Rekey are safe
+// for concurrent use by multiple goroutines, as long as ObfsConfig.Rand is and each call is given buffers of its own.
+// Clone makes an Obfuscator with the same method and config for another session key
 type Obfuscator struct {
-	// Used in Stream.Write. Add multiplexing headers, encrypt and add TLS header
-	Obfs Obfser
-	// Remove TLS header, decrypt and unmarshall frames
-	Deobfs     Deobfser
 	SessionKey []byte
+
+	obfser Obfser
+	deobfs deobfsFunc
+
+	encryptionMethod Method
+	obfs             obfsFunc
+	keys             *obfsKeys
+	payloadCipher    cipher.AEAD
+	config           ObfsConfig
+
+	// *keyEpoch, used from PROTOCOL_V4 for Rekey
+	epochs atomic.Value
+	rekeyM sync.Mutex
+
+	// atomic, set by Close
+	closed uint32
 }
 
 type switchboardStrategy int
@@ -41,16 +59,27 @@ type SessionConfig struct {
 	UnitRead func(net.Conn, []byte) (int, error)
 
 	Unordered bool
+
+	// Striping, if ROUND_ROBIN or LEAST_LOADED, spreads the frames of every stream across all of the connections,
+	// instead of sending each stream over one of them as ordered sessions otherwise do. The frames are put back in
+	// order of Seq by the stream they arrive at, so a stream isn't held up behind a connection stalled by loss when
+	// the others aren't
+	Striping switchboardStrategy
 }
 
 type Session struct {
+	// atomic. It's first in the struct so that it's 64 bit aligned on 32 bit platforms
+	nextStreamID uint64
+	// atomic, the highest ID of the streams the remote opened
+	lastAcceptedStreamID uint64
+	// atomic, the Seq of the next frame the session sends on StreamID 0 itself. Every frame obfsed with the same key
+	// must have a StreamID and Seq of its own, as they make up the nonce. Use nextStream0Seq
+	stream0SendSeq uint64
+
 	id uint32
 
 	*SessionConfig
 
-	// atomic
-	nextStreamID uint32
-
 	// atomic
 	activeStreamCount uint32
 	streams           sync.Map
@@ -65,6 +94,9 @@ type Session struct {
 	acceptCh chan *Stream
 
 	closed uint32
+	// atomic. goneAway is set once the remote has sent a ControlGoAway, and goingAway once one has been sent to it
+	goneAway  uint32
+	goingAway uint32
 
 	terminalMsg atomic.Value
 }
@@ -85,7 +117,9 @@ func MakeSession(id uint32, config *SessionConfig) *Session {
 	sbConfig := &switchboardConfig{
 		Valve: config.Valve,
 	}
-	if config.Unordered {
+	if config.Striping == ROUND_ROBIN || config.Striping == LEAST_LOADED {
+		sbConfig.strategy = config.Striping
+	} else if config.Unordered {
 		log.Debug("Connection is unordered")
 		sbConfig.strategy = UNIFORM_SPREAD
 	} else {
@@ -96,6 +130,9 @@ func MakeSession(id uint32, config *SessionConfig) *Session {
 	return sesh
 }
 
+// nextStream0Seq takes the Seq for the next frame the session sends on StreamID 0
+func (sesh *Session) nextStream0Seq() uint64 { return takeSeq(&sesh.stream0SendSeq) }
+
 func (sesh *Session) streamCountIncr() uint32 {
 	return atomic.AddUint32(&sesh.activeStreamCount, 1)
 }
@@ -112,17 +149,43 @@ func (sesh *Session) AddConnection(conn net.Conn) {
 	sesh.addrs.Store(addrs)
 }
 
+// RemoveConnection takes conn out of the session and closes it, without closing the session as a connection dropping
+// unexpectedly does. Streams sent over it are moved onto the other connections. It returns false if conn isn't one of
+// the session's. A session without connections can't send until another one is added. The remote sees its end of conn
+// closing like any connection dropping, which closes its session, so conn must have been taken out at the remote end
+// too by the time it's removed here
+func (sesh *Session) RemoveConnection(conn net.Conn) bool {
+	return sesh.sb.removeConn(conn)
+}
+
 func (sesh *Session) OpenStream() (*Stream, error) {
+	return sesh.openStream(false)
+}
+
+// OpenDatagramStream opens a stream whose writes are each delivered to the remote as a datagram of their own, as they
+// arrive and without being ordered or deduplicated. Both datagram and ordinary streams can be opened in a session that
+// isn't Unordered. The remote must know about FlagDatagram
+func (sesh *Session) OpenDatagramStream() (*Stream, error) {
+	return sesh.openStream(true)
+}
+
+func (sesh *Session) openStream(datagram bool) (*Stream, error) {
 	if sesh.IsClosed() {
 		return nil, ErrBrokenSession
 	}
-	id := atomic.AddUint32(&sesh.nextStreamID, 1) - 1
-	// Because atomic.AddUint32 returns the value after incrementation
+	if atomic.LoadUint32(&sesh.goneAway) != 0 {
+		return nil, ErrGoingAway
+	}
+	id := atomic.AddUint64(&sesh.nextStreamID, 1) - 1
+	// Because atomic.AddUint64 returns the value after incrementation
+	if id > sesh.config.layout().maxStreamID() {
+		return nil, ErrStreamIDTooLarge
+	}
 	connId, _, err := sesh.sb.pickRandConn()
 	if err != nil {
 		return nil, err
 	}
-	stream := makeStream(sesh, id, connId)
+	stream := makeStream(sesh, id, connId, datagram)
 	sesh.streams.Store(id, stream)
 	sesh.streamCountIncr()
 	log.Tracef("stream %v of session %v opened", id, sesh.id)
@@ -155,10 +218,13 @@ func (sesh *Session) closeStream(s *Stream, active bool) error {
 		pad := genRandomPadding()
 		f := &Frame{
 			StreamID: s.id,
-			Seq:      atomic.AddUint64(&s.nextSendSeq, 1) - 1,
+			Seq:      s.nextSeq(),
 			Closing:  C_STREAM,
 			Payload:  pad,
 		}
+		if s.datagram {
+			f.Closing |= FlagDatagram
+		}
 		i, err := s.session.Obfs(f, s.obfsBuf)
 		if err != nil {
 			return err
@@ -185,18 +251,58 @@ func (sesh *Session) closeStream(s *Stream, active bool) error {
 // stream and then writes to the stream buffer
 func (sesh *Session) recvDataFromRemote(data []byte) error {
 	frame, err := sesh.Deobfs(data)
+	if errors.Is(err, ErrDummyRecord) {
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("Failed to decrypt a frame for session %v: %v", sesh.id, err)
 	}
 
-	if frame.Closing == C_SESSION {
+	if frame.IsPadding() {
+		return nil
+	}
+	// the session is set up before it's made, so a handshake frame arriving now is of no use
+	if frame.IsHandshake() {
+		return nil
+	}
+
+	if controlType, token, ok := frame.Control(); ok {
+		if controlType == ControlPing {
+			return sesh.sendControl(ControlPong, token)
+		}
+		return nil
+	}
+	// streams have no flow control yet, so the credit granted is of no use
+	if _, _, ok := frame.WindowUpdate(); ok {
+		return nil
+	}
+	if lastStreamID, code, ok := frame.GoAway(); ok {
+		log.Debugf("session %v is going away after stream %v with code %v", sesh.id, lastStreamID, code)
+		atomic.StoreUint32(&sesh.goneAway, 1)
+		return nil
+	}
+	// any other control frame is malformed or of a type this end doesn't know about. It's for the session all the
+	// same, and mustn't open a stream
+	if frame.Closing&FlagControl != 0 {
+		log.Debugf("session %v dropped an unrecognised control frame on stream %v", sesh.id, frame.StreamID)
+		return nil
+	}
+
+	if frame.ClosesSession() {
 		sesh.SetTerminalMsg("Received a closing notification frame")
 		return sesh.passiveClose()
 	}
 
+	if atomic.LoadUint32(&sesh.goingAway) != 0 && frame.StreamID > atomic.LoadUint64(&sesh.lastAcceptedStreamID) {
+		if _, ok := sesh.streams.Load(frame.StreamID); !ok {
+			// the remote was told no new streams would be accepted
+			return nil
+		}
+	}
+
 	connId, _, _ := sesh.sb.pickRandConn()
 	// we ignore the error here. If the switchboard is broken, it will be reflected upon stream.Write
-	newStream := makeStream(sesh, frame.StreamID, connId)
+	newStream := makeStream(sesh, frame.StreamID, connId, frame.IsDatagram())
 	existingStreamI, existing := sesh.streams.LoadOrStore(frame.StreamID, newStream)
 	if existing {
 		if existingStreamI == nil {
@@ -205,6 +311,12 @@ func (sesh *Session) recvDataFromRemote(data []byte) error {
 		}
 		return existingStreamI.(*Stream).writeFrame(*frame)
 	} else {
+		for {
+			last := atomic.LoadUint64(&sesh.lastAcceptedStreamID)
+			if frame.StreamID <= last || atomic.CompareAndSwapUint64(&sesh.lastAcceptedStreamID, last, frame.StreamID) {
+				break
+			}
+		}
 		sesh.streamCountIncr()
 		sesh.acceptCh <- newStream
 		return newStream.writeFrame(*frame)
@@ -257,6 +369,54 @@ func genRandomPadding() []byte {
 	return pad
 }
 
+// Ping sends a ping with token to the remote, which replies with a pong carrying the same token. This keeps idle
+// connections from being timed out by middleboxes
+func (sesh *Session) Ping(token [8]byte) error {
+	return sesh.sendControl(ControlPing, token)
+}
+
+// GoAway drains the session for a graceful shutdown. The remote is told to open no more streams, and any it has
+// opened after the last one accepted are ignored, while the streams already open are carried on with until they are
+// closed
+func (sesh *Session) GoAway(code RstCode) error {
+	atomic.StoreUint32(&sesh.goingAway, 1)
+	return sesh.sendFrame(NewGoAwayFrame(sesh.nextStream0Seq(), atomic.LoadUint64(&sesh.lastAcceptedStreamID), code))
+}
+
+func (sesh *Session) sendControl(controlType ControlType, token [8]byte) error {
+	return sesh.sendFrame(NewControlFrame(sesh.nextStream0Seq(), controlType, token))
+}
+
+func (sesh *Session) sendFrame(f *Frame) error {
+	obfsBuf := make([]byte, len(f.Payload)+sesh.Overhead()+8)
+	i, err := sesh.Obfs(f, obfsBuf)
+	if err != nil {
+		return err
+	}
+	_, err = sesh.sb.send(obfsBuf[:i], new(uint32))
+	return err
+}
+
+// SendPadding sends a frame of cover traffic with payloadLen random bytes, which looks like any other frame on the wire
+// and is discarded by the remote session
+func (sesh *Session) SendPadding(payloadLen int) error {
+	pad := make([]byte, payloadLen)
+	rand.Read(pad)
+	f := &Frame{
+		StreamID: 0,
+		Seq:      sesh.nextStream0Seq(),
+		Closing:  FlagPadding,
+		Payload:  pad,
+	}
+	obfsBuf := make([]byte, payloadLen+sesh.Overhead()+8)
+	i, err := sesh.Obfs(f, obfsBuf)
+	if err != nil {
+		return err
+	}
+	_, err = sesh.sb.send(obfsBuf[:i], new(uint32))
+	return err
+}
+
 func (sesh *Session) Close() error {
 	log.Debugf("attempting to actively close session %v", sesh.id)
 	if atomic.SwapUint32(&sesh.closed, 1) == 1 {
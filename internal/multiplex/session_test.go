@@ -3,10 +3,13 @@ package multiplex
 import (
 	"bytes"
 	"github.com/cbeuw/Cloak/internal/util"
+	"math"
 	"math/rand"
+	"net"
 	"strconv"
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var seshConfigOrdered = &SessionConfig{
@@ -37,7 +40,7 @@ func TestRecvDataFromRemote(t *testing.T) {
 	sessionKey := make([]byte, 32)
 	rand.Read(sessionKey)
 	t.Run("plain ordered", func(t *testing.T) {
-		obfuscator, _ := GenerateObfs(E_METHOD_PLAIN, sessionKey, true)
+		obfuscator, _ := GenerateObfs(E_METHOD_PLAIN, sessionKey, WithRecordLayer(TLSRecordLayer{}))
 		seshConfigOrdered.Obfuscator = obfuscator
 		sesh := MakeSession(0, seshConfigOrdered)
 		n, _ := sesh.Obfs(f, obfsBuf)
@@ -64,7 +67,7 @@ func TestRecvDataFromRemote(t *testing.T) {
 		}
 	})
 	t.Run("aes-gcm ordered", func(t *testing.T) {
-		obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, true)
+		obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
 		seshConfigOrdered.Obfuscator = obfuscator
 		sesh := MakeSession(0, seshConfigOrdered)
 		n, _ := sesh.Obfs(f, obfsBuf)
@@ -91,7 +94,7 @@ func TestRecvDataFromRemote(t *testing.T) {
 		}
 	})
 	t.Run("chacha20-poly1305 ordered", func(t *testing.T) {
-		obfuscator, _ := GenerateObfs(E_METHOD_CHACHA20_POLY1305, sessionKey, true)
+		obfuscator, _ := GenerateObfs(E_METHOD_CHACHA20_POLY1305, sessionKey, WithRecordLayer(TLSRecordLayer{}))
 		seshConfigOrdered.Obfuscator = obfuscator
 		sesh := MakeSession(0, seshConfigOrdered)
 		n, _ := sesh.Obfs(f, obfsBuf)
@@ -119,7 +122,7 @@ func TestRecvDataFromRemote(t *testing.T) {
 	})
 
 	t.Run("plain unordered", func(t *testing.T) {
-		obfuscator, _ := GenerateObfs(E_METHOD_PLAIN, sessionKey, true)
+		obfuscator, _ := GenerateObfs(E_METHOD_PLAIN, sessionKey, WithRecordLayer(TLSRecordLayer{}))
 		seshConfigUnordered.Obfuscator = obfuscator
 		sesh := MakeSession(0, seshConfigOrdered)
 		n, _ := sesh.Obfs(f, obfsBuf)
@@ -154,7 +157,7 @@ func TestRecvDataFromRemote_Closing_InOrder(t *testing.T) {
 	obfsBuf := make([]byte, 17000)
 
 	sessionKey := make([]byte, 32)
-	obfuscator, _ := GenerateObfs(E_METHOD_PLAIN, sessionKey, true)
+	obfuscator, _ := GenerateObfs(E_METHOD_PLAIN, sessionKey, WithRecordLayer(TLSRecordLayer{}))
 	seshConfigOrdered.Obfuscator = obfuscator
 
 	rand.Read(sessionKey)
@@ -284,7 +287,7 @@ func TestRecvDataFromRemote_Closing_OutOfOrder(t *testing.T) {
 	obfsBuf := make([]byte, 17000)
 
 	sessionKey := make([]byte, 32)
-	obfuscator, _ := GenerateObfs(E_METHOD_PLAIN, sessionKey, true)
+	obfuscator, _ := GenerateObfs(E_METHOD_PLAIN, sessionKey, WithRecordLayer(TLSRecordLayer{}))
 	seshConfigOrdered.Obfuscator = obfuscator
 
 	rand.Read(sessionKey)
@@ -342,7 +345,7 @@ func TestParallel(t *testing.T) {
 	rand.Seed(0)
 
 	sessionKey := make([]byte, 32)
-	obfuscator, _ := GenerateObfs(E_METHOD_PLAIN, sessionKey, true)
+	obfuscator, _ := GenerateObfs(E_METHOD_PLAIN, sessionKey, WithRecordLayer(TLSRecordLayer{}))
 	seshConfigOrdered.Obfuscator = obfuscator
 	rand.Read(sessionKey)
 	sesh := MakeSession(0, seshConfigOrdered)
@@ -355,7 +358,7 @@ func TestParallel(t *testing.T) {
 	randFrame := func() *Frame {
 		id := rand.Intn(numStreams)
 		return &Frame{
-			uint32(id),
+			uint64(id),
 			atomic.AddUint64(seqs[id], 1) - 1,
 			uint8(rand.Intn(2)),
 			[]byte{1, 2, 3, 4},
@@ -414,7 +417,7 @@ func BenchmarkRecvDataFromRemote_Ordered(b *testing.B) {
 	rand.Read(sessionKey)
 
 	b.Run("plain", func(b *testing.B) {
-		obfuscator, _ := GenerateObfs(E_METHOD_PLAIN, sessionKey, true)
+		obfuscator, _ := GenerateObfs(E_METHOD_PLAIN, sessionKey, WithRecordLayer(TLSRecordLayer{}))
 		seshConfigOrdered.Obfuscator = obfuscator
 		sesh := MakeSession(0, seshConfigOrdered)
 		n, _ := sesh.Obfs(f, obfsBuf)
@@ -431,7 +434,7 @@ func BenchmarkRecvDataFromRemote_Ordered(b *testing.B) {
 	})
 
 	b.Run("aes-gcm", func(b *testing.B) {
-		obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, true)
+		obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
 		seshConfigOrdered.Obfuscator = obfuscator
 		sesh := MakeSession(0, seshConfigOrdered)
 		n, _ := sesh.Obfs(f, obfsBuf)
@@ -448,7 +451,7 @@ func BenchmarkRecvDataFromRemote_Ordered(b *testing.B) {
 	})
 
 	b.Run("chacha20-poly1305", func(b *testing.B) {
-		obfuscator, _ := GenerateObfs(E_METHOD_CHACHA20_POLY1305, sessionKey, true)
+		obfuscator, _ := GenerateObfs(E_METHOD_CHACHA20_POLY1305, sessionKey, WithRecordLayer(TLSRecordLayer{}))
 		seshConfigOrdered.Obfuscator = obfuscator
 		sesh := MakeSession(0, seshConfigOrdered)
 		n, _ := sesh.Obfs(f, obfsBuf)
@@ -464,3 +467,174 @@ func BenchmarkRecvDataFromRemote_Ordered(b *testing.B) {
 		}
 	})
 }
+
+func TestRecvPaddingFromRemote(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+	sesh := MakeSession(0, &SessionConfig{Obfuscator: obfuscator, UnitRead: util.ReadTLS})
+
+	f := &Frame{StreamID: 1, Closing: FlagPadding, Payload: make([]byte, 100)}
+	obfsBuf := make([]byte, 512)
+	n, _ := sesh.Obfs(f, obfsBuf)
+	if err := sesh.recvDataFromRemote(obfsBuf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sesh.streams.Load(uint64(1)); ok {
+		t.Error("padding frame opened a stream")
+	}
+	if sesh.IsClosed() {
+		t.Error("padding frame closed the session")
+	}
+}
+
+// readFrames deobfses the next count frames a session sent to remote
+func readFrames(t *testing.T, remote net.Conn, obfuscator *Obfuscator, count int) []*Frame {
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	recvBuf := make([]byte, 1024)
+	var frames []*Frame
+	for i := 0; i < count; i++ {
+		n, err := util.ReadTLS(remote, recvBuf)
+		if err != nil {
+			t.Fatalf("frame %v not received: %v", i, err)
+		}
+		f, err := obfuscator.Deobfs(recvBuf[:n])
+		if err != nil {
+			t.Fatalf("frame %v: %v", i, err)
+		}
+		frames = append(frames, f)
+	}
+	return frames
+}
+
+func TestSendPadding(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+	sesh := MakeSession(0, &SessionConfig{Obfuscator: obfuscator, UnitRead: util.ReadTLS})
+	local, remote := net.Pipe()
+	sesh.AddConnection(local)
+
+	go func() {
+		sesh.SendPadding(10)
+		sesh.SendPadding(10)
+	}()
+	frames := readFrames(t, remote, obfuscator, 2)
+	for _, f := range frames {
+		if !f.IsPadding() || f.StreamID != 0 {
+			t.Errorf("expecting padding on stream 0, got %+v", f)
+		}
+	}
+	// the two share StreamID 0, so they'd share the nonce too if they shared the Seq
+	if frames[0].Seq == frames[1].Seq {
+		t.Errorf("both padding frames were sent with Seq %v", frames[0].Seq)
+	}
+}
+
+func TestRecvMalformedControlFrame(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+	for _, c := range []struct {
+		name  string
+		frame *Frame
+	}{
+		{"short", &Frame{StreamID: 0, Closing: FlagControl, Payload: []byte{byte(ControlPing), 1, 2}}},
+		{"unknown type", &Frame{StreamID: 0, Closing: FlagControl, Payload: make([]byte, 20)}},
+		{"short window update", &Frame{StreamID: 0, Closing: FlagControl, Payload: NewWindowUpdateFrame(0, 5, 1).Payload[:12]}},
+		{"window update on a stream", &Frame{StreamID: 5, Closing: FlagControl, Payload: NewWindowUpdateFrame(0, 5, 1).Payload}},
+		{"short go away", &Frame{StreamID: 0, Closing: FlagControl, Payload: NewGoAwayFrame(0, 1, RstNoError).Payload[:12]}},
+		{"go away on a stream", &Frame{StreamID: 1, Closing: FlagControl, Payload: NewGoAwayFrame(0, 1, RstNoError).Payload}},
+	} {
+		sesh := MakeSession(0, &SessionConfig{Obfuscator: obfuscator, UnitRead: util.ReadTLS})
+		sesh.AddConnection(newBlackHole())
+		obfsBuf := make([]byte, 512)
+		n, _ := sesh.Obfs(c.frame, obfsBuf)
+		if err := sesh.recvDataFromRemote(obfsBuf[:n]); err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		if _, ok := sesh.streams.Load(c.frame.StreamID); ok || len(sesh.acceptCh) != 0 {
+			t.Errorf("%v: control frame opened stream %v", c.name, c.frame.StreamID)
+		}
+		if sesh.IsClosed() {
+			t.Errorf("%v: control frame closed the session", c.name)
+		}
+		if atomic.LoadUint32(&sesh.goneAway) != 0 {
+			t.Errorf("%v: control frame taken as a go away", c.name)
+		}
+	}
+}
+
+func TestStreamIDExhausted(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	for _, version := range []byte{PROTOCOL_V1, PROTOCOL_V8} {
+		obfuscator, _ := GenerateObfsWithConfig(E_METHOD_AES_GCM, sessionKey, ObfsConfig{RecordLayer: TLSRecordLayer{}, ProtocolVersion: version})
+		sesh := MakeSession(0, &SessionConfig{Obfuscator: obfuscator, UnitRead: util.ReadTLS})
+		sesh.AddConnection(newBlackHole())
+		sesh.nextStreamID = math.MaxUint32
+
+		if _, err := sesh.OpenStream(); err != nil {
+			t.Fatalf("v%v: failed to open stream %v: %v", version+1, uint64(math.MaxUint32), err)
+		}
+		_, err := sesh.OpenStream()
+		if version < PROTOCOL_V8 && err != ErrStreamIDTooLarge {
+			t.Errorf("v%v: expecting %v, got %v", version+1, ErrStreamIDTooLarge, err)
+		}
+		if version >= PROTOCOL_V8 && err != nil {
+			t.Errorf("v%v: failed to open stream %v: %v", version+1, uint64(math.MaxUint32)+1, err)
+		}
+	}
+}
+
+func TestGoAway(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+	obfsBuf := make([]byte, 512)
+
+	t.Run("received", func(t *testing.T) {
+		sesh := MakeSession(0, &SessionConfig{Obfuscator: obfuscator, UnitRead: util.ReadTLS})
+		sesh.AddConnection(newBlackHole())
+		n, _ := sesh.Obfs(NewGoAwayFrame(0, 0, RstNoError), obfsBuf)
+		if err := sesh.recvDataFromRemote(obfsBuf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := sesh.streams.Load(uint64(0)); ok {
+			t.Error("go away opened a stream")
+		}
+		if _, err := sesh.OpenStream(); err != ErrGoingAway {
+			t.Errorf("expecting %v, got %v", ErrGoingAway, err)
+		}
+		if sesh.IsClosed() {
+			t.Error("go away closed the session")
+		}
+	})
+
+	t.Run("sent", func(t *testing.T) {
+		sesh := MakeSession(0, &SessionConfig{Obfuscator: obfuscator, UnitRead: util.ReadTLS})
+		sesh.AddConnection(newBlackHole())
+		n, _ := sesh.Obfs(&Frame{StreamID: 1, Payload: []byte{1}}, obfsBuf)
+		if err := sesh.recvDataFromRemote(obfsBuf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if err := sesh.GoAway(RstNoError); err != nil {
+			t.Fatal(err)
+		}
+
+		n, _ = sesh.Obfs(&Frame{StreamID: 2, Payload: []byte{2}}, obfsBuf)
+		if err := sesh.recvDataFromRemote(obfsBuf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := sesh.streams.Load(uint64(2)); ok {
+			t.Error("stream opened after going away was accepted")
+		}
+		n, _ = sesh.Obfs(&Frame{StreamID: 1, Seq: 1, Payload: []byte{3}}, obfsBuf)
+		if err := sesh.recvDataFromRemote(obfsBuf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if sesh.streamCount() != 1 {
+			t.Errorf("expecting stream 1 to be carried on with, got %v streams", sesh.streamCount())
+		}
+	})
+}
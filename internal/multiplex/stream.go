@@ -3,6 +3,7 @@ package multiplex
 import (
 	"errors"
 	"io"
+	"math"
 	"net"
 	"time"
 
@@ -14,15 +15,15 @@ import (
 var ErrBrokenStream = errors.New("broken stream")
 
 type Stream struct {
-	id uint32
+	// atomic. It's first in the struct so that it's 64 bit aligned on 32 bit platforms. Use nextSeq
+	nextSendSeq uint64
+
+	id uint64
 
 	session *Session
 
 	recvBuf recvBuffer
 
-	// atomic
-	nextSendSeq uint64
-
 	writingM sync.RWMutex
 
 	// atomic
@@ -35,11 +36,14 @@ type Stream struct {
 	// overall the streams in a session should be uniformly distributed across all connections
 	// This is not used in unordered connection mode
 	assignedConnId uint32
+
+	// datagram streams mark their frames with FlagDatagram
+	datagram bool
 }
 
-func makeStream(sesh *Session, id uint32, assignedConnId uint32) *Stream {
+func makeStream(sesh *Session, id uint64, assignedConnId uint32, datagram bool) *Stream {
 	var recvBuf recvBuffer
-	if sesh.Unordered {
+	if sesh.Unordered || datagram {
 		recvBuf = NewDatagramBuffer()
 	} else {
 		recvBuf = NewStreamBuffer()
@@ -51,6 +55,7 @@ func makeStream(sesh *Session, id uint32, assignedConnId uint32) *Stream {
 		recvBuf:        recvBuf,
 		obfsBuf:        make([]byte, 17000), //TODO don't leave this hardcoded
 		assignedConnId: assignedConnId,
+		datagram:       datagram,
 	}
 
 	return stream
@@ -58,6 +63,23 @@ func makeStream(sesh *Session, id uint32, assignedConnId uint32) *Stream {
 
 func (s *Stream) isClosed() bool { return atomic.LoadUint32(&s.closed) == 1 }
 
+// nextSeq takes the Seq for the next frame sent. It saturates at math.MaxUint64 instead of wrapping around to reuse
+// Seqs, and the Obfser refuses that one with ErrSeqExhausted
+func (s *Stream) nextSeq() uint64 { return takeSeq(&s.nextSendSeq) }
+
+// takeSeq atomically increments the Seq counter at addr and returns its value before, saturating at math.MaxUint64
+func takeSeq(addr *uint64) uint64 {
+	for {
+		seq := atomic.LoadUint64(addr)
+		if seq == math.MaxUint64 {
+			return seq
+		}
+		if atomic.CompareAndSwapUint64(addr, seq, seq+1) {
+			return seq
+		}
+	}
+}
+
 func (s *Stream) writeFrame(frame Frame) error {
 	toBeClosed, err := s.recvBuf.Write(frame)
 	if toBeClosed {
@@ -102,10 +124,13 @@ func (s *Stream) Write(in []byte) (n int, err error) {
 
 	f := &Frame{
 		StreamID: s.id,
-		Seq:      atomic.AddUint64(&s.nextSendSeq, 1) - 1,
+		Seq:      s.nextSeq(),
 		Closing:  C_NOOP,
 		Payload:  in,
 	}
+	if s.datagram {
+		f.Closing = FlagDatagram
+	}
 
 	i, err := s.session.Obfs(f, s.obfsBuf)
 	if err != nil {
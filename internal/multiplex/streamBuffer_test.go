@@ -72,3 +72,15 @@ func TestRecvNewFrame(t *testing.T) {
 		test(outOfOrder2, t)
 	})
 }
+
+func TestStreamBufferFlags(t *testing.T) {
+	sb := NewStreamBuffer()
+	toBeClosed, _ := sb.Write(Frame{Seq: 0, Closing: FlagMore, Payload: []byte{1}})
+	if toBeClosed {
+		t.Error("a frame with more fragments to follow closed the stream")
+	}
+	toBeClosed, _ = sb.Write(Frame{Seq: 1, Closing: FlagRst})
+	if !toBeClosed {
+		t.Error("a reset frame didn't close the stream")
+	}
+}
@@ -3,8 +3,10 @@ package multiplex
 import (
 	"bytes"
 	"github.com/cbeuw/Cloak/internal/util"
+	"math"
 	"math/rand"
 	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -12,7 +14,7 @@ import (
 func setupSesh(unordered bool) *Session {
 	sessionKey := make([]byte, 32)
 	rand.Read(sessionKey)
-	obfuscator, _ := GenerateObfs(0x00, sessionKey, true)
+	obfuscator, _ := GenerateObfs(0x00, sessionKey, WithRecordLayer(TLSRecordLayer{}))
 
 	seshConfig := &SessionConfig{
 		Obfuscator: obfuscator,
@@ -116,10 +118,30 @@ func TestStream_Write(t *testing.T) {
 	}
 }
 
+func TestStream_SeqExhausted(t *testing.T) {
+	hole := newBlackHole()
+	sesh := setupSesh(false)
+	sesh.AddConnection(hole)
+	stream, _ := sesh.OpenStream()
+	atomic.StoreUint64(&stream.nextSendSeq, math.MaxUint64-1)
+
+	if _, err := stream.Write([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := stream.Write([]byte{1}); err != ErrSeqExhausted {
+			t.Errorf("expecting %v, got %v", ErrSeqExhausted, err)
+		}
+		if seq := atomic.LoadUint64(&stream.nextSendSeq); seq != math.MaxUint64 {
+			t.Errorf("seq should saturate at %v, got %v", uint64(math.MaxUint64), seq)
+		}
+	}
+}
+
 func TestStream_Close(t *testing.T) {
 	sesh := setupSesh(false)
 	testPayload := []byte{42, 42, 42}
-	streamID := uint32(1)
+	streamID := uint64(1)
 
 	f := &Frame{
 		streamID,
@@ -191,7 +213,7 @@ func TestStream_Read(t *testing.T) {
 	conn, _ := l.Accept()
 	sesh.AddConnection(conn)
 
-	var streamID uint32
+	var streamID uint64
 	buf := make([]byte, 10)
 
 	obfsBuf := make([]byte, 512)
@@ -322,7 +344,7 @@ func TestStream_UnorderedRead(t *testing.T) {
 	conn, _ := l.Accept()
 	sesh.AddConnection(conn)
 
-	var streamID uint32
+	var streamID uint64
 	buf := make([]byte, 10)
 
 	obfsBuf := make([]byte, 512)
@@ -0,0 +1,54 @@
+package multiplex
+
+// Over a transport that delivers frames in order and without loss, each frame of a stream has the Seq right after the
+// one before it, and anything else means the frames have been tampered with or corrupted. The reorder buffer and the
+// replay window tolerate some of that on purpose; this checks for the exact next Seq instead.
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var ErrSeqGap = errors.New("frame doesn't have the next seq of its stream")
+
+// strictSeqExempt are the flags of frames that aren't part of the data of a stream and so don't take up a Seq of it
+const strictSeqExempt = FlagDatagram | FlagPadding | FlagControl | FlagHandshake | C_SESSION
+
+// seqGuard keeps the Seq expected next on each stream that has been seen and not yet closed. A stream is forgotten
+// once the frame closing it has been checked, so the map only grows with the number of streams open at once
+type seqGuard struct {
+	mu       sync.Mutex
+	expected map[uint64]uint64
+}
+
+func newSeqGuard() *seqGuard {
+	return &seqGuard{expected: make(map[uint64]uint64)}
+}
+
+// check returns an error wrapping ErrSeqGap unless seq is the next one of streamID, which is 0 for a stream not seen
+// before, and records it if it is
+func (g *seqGuard) check(streamID uint64, seq uint64, closing uint8) error {
+	if closing&strictSeqExempt != 0 {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	expected := g.expected[streamID]
+	if seq != expected {
+		return fmt.Errorf("%w: expecting Seq %v on stream %v, got %v", ErrSeqGap, expected, streamID, seq)
+	}
+	if closing&(FlagFin|FlagRst) != 0 {
+		delete(g.expected, streamID)
+	} else {
+		g.expected[streamID] = seq + 1
+	}
+	return nil
+}
+
+// tracked returns the number of streams whose next Seq is being kept
+func (g *seqGuard) tracked() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.expected)
+}
@@ -0,0 +1,78 @@
+package multiplex
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestStrictSeq(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}), WithStrictSeq())
+	buf := make([]byte, 200)
+	deobfs := func(f *Frame) error {
+		n, err := obfuscator.Obfs(f, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = obfuscator.Deobfs(buf[:n])
+		return err
+	}
+
+	for seq := uint64(0); seq < 3; seq++ {
+		if err := deobfs(&Frame{StreamID: 1, Seq: seq, Payload: []byte("data")}); err != nil {
+			t.Fatalf("seq %v: %v", seq, err)
+		}
+	}
+	if err := deobfs(&Frame{StreamID: 1, Seq: 4, Payload: []byte("data")}); !errors.Is(err, ErrSeqGap) {
+		t.Errorf("expecting %v when a seq is skipped, got %v", ErrSeqGap, err)
+	}
+	if err := deobfs(&Frame{StreamID: 1, Seq: 2, Payload: []byte("data")}); !errors.Is(err, ErrSeqGap) {
+		t.Errorf("expecting %v when a seq is repeated, got %v", ErrSeqGap, err)
+	}
+	if err := deobfs(&Frame{StreamID: 2, Seq: 1, Payload: []byte("data")}); !errors.Is(err, ErrSeqGap) {
+		t.Errorf("expecting %v when a stream doesn't start at 0, got %v", ErrSeqGap, err)
+	}
+	// the rejected frames didn't move the stream on
+	if err := deobfs(&Frame{StreamID: 1, Seq: 3, Payload: []byte("data")}); err != nil {
+		t.Error(err)
+	}
+
+	for _, f := range []*Frame{
+		{StreamID: 1, Seq: 100, Closing: FlagDatagram, Payload: []byte("dgram")},
+		{StreamID: 0, Seq: 0, Closing: FlagPadding, Payload: []byte("pad")},
+		{StreamID: 0, Seq: 0, Closing: FlagPadding, Payload: []byte("pad")},
+		{StreamID: 0, Seq: 7, Closing: FlagControl, Payload: []byte{0}},
+	} {
+		if err := deobfs(f); err != nil {
+			t.Errorf("%v: expecting frames that don't take up a seq to be left alone, got %v", f, err)
+		}
+	}
+
+	t.Run("forgotten once closed", func(t *testing.T) {
+		g := newSeqGuard()
+		g.check(5, 0, 0)
+		g.check(6, 0, 0)
+		if err := g.check(5, 1, FlagFin); err != nil {
+			t.Fatal(err)
+		}
+		if err := g.check(6, 1, FlagRst); err != nil {
+			t.Fatal(err)
+		}
+		if g.tracked() != 0 {
+			t.Errorf("expecting closed streams to be forgotten, %v are still tracked", g.tracked())
+		}
+		if err := g.check(7, 3, FlagFin); !errors.Is(err, ErrSeqGap) || g.tracked() != 0 {
+			t.Errorf("expecting a closing frame out of order to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("off by default", func(t *testing.T) {
+		obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+		n, _ := obfuscator.Obfs(&Frame{StreamID: 1, Seq: 42, Payload: []byte("data")}, buf)
+		if _, err := obfuscator.Deobfs(buf[:n]); err != nil {
+			t.Errorf("expecting any seq to be accepted, got %v", err)
+		}
+	})
+}
@@ -12,6 +12,11 @@ import (
 const (
 	FIXED_CONN_MAPPING switchboardStrategy = iota
 	UNIFORM_SPREAD
+	// ROUND_ROBIN sends frames over each of the connections in turn
+	ROUND_ROBIN
+	// LEAST_LOADED sends each frame over the connection with the fewest bytes being written to it at the time, so
+	// that a connection held up by loss is given less to send until it recovers
+	LEAST_LOADED
 )
 
 type switchboardConfig struct {
@@ -19,14 +24,27 @@ type switchboardConfig struct {
 	strategy switchboardStrategy
 }
 
+// sbConn is a connection of a switchboard
+type sbConn struct {
+	net.Conn
+	id uint32
+	// atomic, the number of bytes being written to the connection
+	inFlight int64
+}
+
 // switchboard is responsible for keeping the reference of TCP connections between client and server
 type switchboard struct {
 	session *Session
 
 	*switchboardConfig
 
-	conns      sync.Map
+	// conns is a []*sbConn in the order they were added. It's replaced as a whole, under connsM, when one is added
+	// or removed, so that it can be read without a lock
+	conns      atomic.Value
+	connsM     sync.Mutex
 	nextConnId uint32
+	// atomic, the number of frames sent with ROUND_ROBIN
+	nextTurn uint32
 
 	broken uint32
 }
@@ -38,31 +56,61 @@ func makeSwitchboard(sesh *Session, config *switchboardConfig) *switchboard {
 		session:           sesh,
 		switchboardConfig: config,
 	}
+	sb.conns.Store([]*sbConn{})
 	return sb
 }
 
 var errBrokenSwitchboard = errors.New("the switchboard is broken")
 
-func (sb *switchboard) connsCount() int {
-	// count the number of entries in conns
-	var count int
-	sb.conns.Range(func(_, _ interface{}) bool {
-		count += 1
-		return true
-	})
-	return count
-}
+func (sb *switchboard) connList() []*sbConn { return sb.conns.Load().([]*sbConn) }
+
+func (sb *switchboard) connsCount() int { return len(sb.connList()) }
 
 func (sb *switchboard) addConn(conn net.Conn) {
-	connId := atomic.AddUint32(&sb.nextConnId, 1) - 1
-	sb.conns.Store(connId, conn)
-	go sb.deplex(connId, conn)
+	c := &sbConn{Conn: conn, id: atomic.AddUint32(&sb.nextConnId, 1) - 1}
+	sb.connsM.Lock()
+	old := sb.connList()
+	conns := make([]*sbConn, len(old), len(old)+1)
+	copy(conns, old)
+	sb.conns.Store(append(conns, c))
+	sb.connsM.Unlock()
+	go sb.deplex(c)
+}
+
+// removeConn takes conn out of the switchboard and closes it. It returns false if conn isn't one of its connections
+func (sb *switchboard) removeConn(conn net.Conn) bool {
+	sb.connsM.Lock()
+	old := sb.connList()
+	conns := make([]*sbConn, 0, len(old))
+	for _, c := range old {
+		if c.Conn != conn {
+			conns = append(conns, c)
+		}
+	}
+	sb.conns.Store(conns)
+	sb.connsM.Unlock()
+	if len(conns) == len(old) {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func (sb *switchboard) loadConn(connId uint32) (*sbConn, bool) {
+	for _, c := range sb.connList() {
+		if c.id == connId {
+			return c, true
+		}
+	}
+	return nil, false
 }
 
 // a pointer to connId is passed here so that the switchboard can reassign it
 func (sb *switchboard) send(data []byte, connId *uint32) (n int, err error) {
-	writeAndRegUsage := func(conn net.Conn, d []byte) (int, error) {
+	writeAndRegUsage := func(conn *sbConn, d []byte) (int, error) {
+		atomic.AddInt64(&conn.inFlight, int64(len(d)))
 		n, err = conn.Write(d)
+		atomic.AddInt64(&conn.inFlight, -int64(len(d)))
 		if err != nil {
 			sb.close("failed to write to remote " + err.Error())
 			return n, err
@@ -72,58 +120,44 @@ func (sb *switchboard) send(data []byte, connId *uint32) (n int, err error) {
 	}
 
 	sb.Valve.txWait(len(data))
-	connCount := sb.connsCount()
-	if atomic.LoadUint32(&sb.broken) == 1 || connCount == 0 {
+	conns := sb.connList()
+	if atomic.LoadUint32(&sb.broken) == 1 || len(conns) == 0 {
 		return 0, errBrokenSwitchboard
 	}
 
-	if sb.strategy == UNIFORM_SPREAD {
-		_, conn, err := sb.pickRandConn()
-		if err != nil {
-			return 0, errBrokenSwitchboard
-		}
-		return writeAndRegUsage(conn, data)
-	} else {
-		connI, ok := sb.conns.Load(*connId)
-		conn := connI.(net.Conn)
-		if ok {
-			return writeAndRegUsage(conn, data)
-		} else {
-			newConnId, conn, err := sb.pickRandConn()
-			if err != nil {
-				return 0, errBrokenSwitchboard
+	switch sb.strategy {
+	case UNIFORM_SPREAD:
+		return writeAndRegUsage(conns[rand.Intn(len(conns))], data)
+	case ROUND_ROBIN:
+		turn := atomic.AddUint32(&sb.nextTurn, 1) - 1
+		return writeAndRegUsage(conns[int(turn%uint32(len(conns)))], data)
+	case LEAST_LOADED:
+		least := conns[0]
+		for _, c := range conns[1:] {
+			if atomic.LoadInt64(&c.inFlight) < atomic.LoadInt64(&least.inFlight) {
+				least = c
 			}
-			connId = &newConnId
-			return writeAndRegUsage(conn, data)
 		}
+		return writeAndRegUsage(least, data)
+	default:
+		conn, ok := sb.loadConn(*connId)
+		if !ok {
+			// the connection has been removed, so the stream is moved to another one
+			conn = conns[rand.Intn(len(conns))]
+			*connId = conn.id
+		}
+		return writeAndRegUsage(conn, data)
 	}
-
 }
 
 // returns a random connId
 func (sb *switchboard) pickRandConn() (uint32, net.Conn, error) {
-	connCount := sb.connsCount()
-	if atomic.LoadUint32(&sb.broken) == 1 || connCount == 0 {
+	conns := sb.connList()
+	if atomic.LoadUint32(&sb.broken) == 1 || len(conns) == 0 {
 		return 0, nil, errBrokenSwitchboard
 	}
-
-	// there is no guarantee that sb.conns still has the same amount of entries
-	// between the count loop and the pick loop
-	// so if the r > len(sb.conns) at the point of range call, the last visited element is picked
-	var id uint32
-	var conn net.Conn
-	r := rand.Intn(connCount)
-	var c int
-	sb.conns.Range(func(connIdI, connI interface{}) bool {
-		if r == c {
-			id = connIdI.(uint32)
-			conn = connI.(net.Conn)
-			return false
-		}
-		c++
-		return true
-	})
-	return id, conn, nil
+	c := conns[rand.Intn(len(conns))]
+	return c.id, c.Conn, nil
 }
 
 func (sb *switchboard) close(terminalMsg string) {
@@ -136,24 +170,29 @@ func (sb *switchboard) close(terminalMsg string) {
 
 // actively triggered by session.Close()
 func (sb *switchboard) closeAll() {
-	sb.conns.Range(func(key, connI interface{}) bool {
-		conn := connI.(net.Conn)
-		conn.Close()
-		sb.conns.Delete(key)
-		return true
-	})
+	sb.connsM.Lock()
+	conns := sb.connList()
+	sb.conns.Store([]*sbConn{})
+	sb.connsM.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
 }
 
 // deplex function costantly reads from a TCP connection
-func (sb *switchboard) deplex(connId uint32, conn net.Conn) {
+func (sb *switchboard) deplex(c *sbConn) {
 	buf := make([]byte, 20480)
 	for {
-		n, err := sb.session.UnitRead(conn, buf)
+		n, err := sb.session.UnitRead(c.Conn, buf)
 		sb.rxWait(n)
 		sb.Valve.AddRx(int64(n))
 		if err != nil {
 			log.Debugf("a connection for session %v has closed: %v", sb.session.id, err)
-			go conn.Close()
+			if _, ok := sb.loadConn(c.id); !ok {
+				// removed on purpose, which doesn't affect the rest of the session
+				return
+			}
+			go c.Close()
 			sb.close("a connection has dropped unexpectedly")
 			return
 		}
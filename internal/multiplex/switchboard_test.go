@@ -1,9 +1,12 @@
 package multiplex
 
 import (
+	"bytes"
 	"github.com/cbeuw/Cloak/internal/util"
+	"io"
 	"math/rand"
 	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -193,3 +196,108 @@ func TestSwitchboard_CloseOnOneDisconn(t *testing.T) {
 		return
 	}
 }
+
+// countingHole is a blackhole that counts the writes to it
+type countingHole struct {
+	*blackhole
+	writes int32
+}
+
+func (c *countingHole) Write(in []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.blackhole.Write(in)
+}
+
+func TestSwitchboard_Striping(t *testing.T) {
+	data := make([]byte, 1000)
+	for _, strategy := range []switchboardStrategy{ROUND_ROBIN, LEAST_LOADED} {
+		sesh := MakeSession(0, &SessionConfig{UnitRead: util.ReadTLS, Striping: strategy})
+		holes := []*countingHole{{blackhole: newBlackHole()}, {blackhole: newBlackHole()}, {blackhole: newBlackHole()}}
+		for _, hole := range holes {
+			sesh.AddConnection(hole)
+		}
+		if strategy == LEAST_LOADED {
+			// the first connection is stuck with a write
+			atomic.StoreInt64(&sesh.sb.connList()[0].inFlight, 1<<20)
+		}
+		connId := uint32(0)
+		for i := 0; i < 6; i++ {
+			if _, err := sesh.sb.send(data, &connId); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var writes []int32
+		for _, hole := range holes {
+			writes = append(writes, atomic.LoadInt32(&hole.writes))
+		}
+		if strategy == ROUND_ROBIN && (writes[0] != 2 || writes[1] != 2 || writes[2] != 2) {
+			t.Errorf("expecting the frames to be spread evenly, got %v", writes)
+		}
+		if strategy == LEAST_LOADED && (writes[0] != 0 || writes[1]+writes[2] != 6) {
+			t.Errorf("expecting the loaded connection to be avoided, got %v", writes)
+		}
+	}
+
+	t.Run("stream", func(t *testing.T) {
+		sessionKey := make([]byte, 32)
+		rand.Read(sessionKey)
+		obfuscator, _ := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+		client := MakeSession(0, &SessionConfig{Obfuscator: obfuscator, UnitRead: util.ReadTLS, Striping: ROUND_ROBIN})
+		server := MakeSession(0, &SessionConfig{Obfuscator: obfuscator, UnitRead: util.ReadTLS})
+		for i := 0; i < 3; i++ {
+			clientConn, serverConn := net.Pipe()
+			client.AddConnection(clientConn)
+			server.AddConnection(serverConn)
+		}
+
+		sent := make([]byte, 100000)
+		rand.Read(sent)
+		stream, _ := client.OpenStream()
+		go func() {
+			for i := 0; i < len(sent); i += 1000 {
+				stream.Write(sent[i : i+1000])
+			}
+		}()
+		accepted, err := server.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		received := make([]byte, len(sent))
+		if _, err := io.ReadFull(accepted, received); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(received, sent) {
+			t.Error("frames striped across connections weren't put back in order")
+		}
+		client.Close()
+		server.Close()
+	})
+}
+
+func TestSwitchboard_RemoveConn(t *testing.T) {
+	sesh := MakeSession(0, &SessionConfig{UnitRead: util.ReadTLS})
+	hole0 := &countingHole{blackhole: newBlackHole()}
+	hole1 := &countingHole{blackhole: newBlackHole()}
+	sesh.AddConnection(hole0)
+	sesh.AddConnection(hole1)
+
+	connId := sesh.sb.connList()[0].id
+	if !sesh.RemoveConnection(hole0) {
+		t.Fatal("failed to remove a connection")
+	}
+	if sesh.RemoveConnection(hole0) {
+		t.Error("a connection was removed twice")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if sesh.IsClosed() {
+		t.Fatal("removing a connection closed the session")
+	}
+
+	// a stream sent over the removed connection is moved to the other one
+	if _, err := sesh.sb.send(make([]byte, 10), &connId); err != nil {
+		t.Fatal(err)
+	}
+	if connId != sesh.sb.connList()[0].id || atomic.LoadInt32(&hole1.writes) != 1 || atomic.LoadInt32(&hole0.writes) != 0 {
+		t.Error("expecting the stream to be moved to the remaining connection")
+	}
+}
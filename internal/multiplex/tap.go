@@ -0,0 +1,54 @@
+package multiplex
+
+// A tap is given the exact bytes an Obfser produced and a Deobfser was given, so that two builds that don't understand
+// each other can be diagnosed by diffing what one sent with what the other received. Nothing is wrapped when no tap
+// is set, so it costs nothing then.
+
+import "net"
+
+// TapDirection is which way the bytes given to ObfsConfig.Tap are going
+type TapDirection byte
+
+const (
+	// TAP_OBFSED is a frame produced by the Obfser, as it is to be sent
+	TAP_OBFSED TapDirection = iota
+	// TAP_DEOBFSING is the input given to the Deobfser, before anything is done with it
+	TAP_DEOBFSING
+)
+
+func (d TapDirection) String() string {
+	if d == TAP_OBFSED {
+		return "obfsed"
+	}
+	return "deobfsing"
+}
+
+// tapObfs has every frame obfs produces successfully given to tap. The pieces of a segmented frame are joined
+// together into a copy for it
+func tapObfs(obfs obfsFunc, tap func(direction TapDirection, raw []byte)) obfsFunc {
+	return func(f *Frame, payload [][]byte, buf []byte, segmented bool, segments net.Buffers) (int, net.Buffers, error) {
+		already := len(segments)
+		n, segments, err := obfs(f, payload, buf, segmented, segments)
+		if err != nil {
+			return n, segments, err
+		}
+		if !segmented {
+			tap(TAP_OBFSED, buf[:n])
+			return n, segments, nil
+		}
+		var raw []byte
+		for _, segment := range segments[already:] {
+			raw = append(raw, segment...)
+		}
+		tap(TAP_OBFSED, raw)
+		return n, segments, nil
+	}
+}
+
+// tapDeobfs has every input given to deobfs passed to tap first, as a Deobfser working in place modifies it
+func tapDeobfs(deobfs deobfsFunc, tap func(direction TapDirection, raw []byte)) deobfsFunc {
+	return func(in []byte, into *Frame) (*Frame, error) {
+		tap(TAP_DEOBFSING, in)
+		return deobfs(in, into)
+	}
+}
@@ -0,0 +1,61 @@
+package multiplex
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestTap(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	type tapped struct {
+		direction TapDirection
+		raw       []byte
+	}
+	var taps []tapped
+	tap := func(direction TapDirection, raw []byte) {
+		taps = append(taps, tapped{direction, append([]byte(nil), raw...)})
+	}
+
+	for _, method := range []Method{E_METHOD_AES_GCM, E_METHOD_PLAIN} {
+		taps = nil
+		obfuscator, _ := GenerateObfs(method, sessionKey, WithRecordLayer(TLSRecordLayer{}), WithTap(tap))
+		untapped, _ := GenerateObfs(method, sessionKey, WithRecordLayer(TLSRecordLayer{}))
+		f := &Frame{StreamID: 1, Seq: 2, Payload: []byte("tapped payload")}
+
+		buf := make([]byte, 200)
+		n, err := obfuscator.Obfs(f, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		obfsed := append([]byte(nil), buf[:n]...)
+		bufs, err := obfuscator.ObfsBuffers(f, make([]byte, 200), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var joined []byte
+		for _, b := range bufs {
+			joined = append(joined, b...)
+		}
+		if _, err := untapped.Deobfs(obfsed); err != nil {
+			t.Fatalf("%v: tapping changed what is sent: %v", method, err)
+		}
+
+		n, _ = obfuscator.Obfs(f, buf)
+		if _, err := obfuscator.Deobfs(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		obfuscator.Deobfs(obfsed[:10])
+
+		expected := []tapped{{TAP_OBFSED, obfsed}, {TAP_OBFSED, joined}, {TAP_OBFSED, buf[:n]}, {TAP_DEOBFSING, buf[:n]}, {TAP_DEOBFSING, obfsed[:10]}}
+		if len(taps) != len(expected) {
+			t.Fatalf("%v: expecting %v taps, got %v", method, len(expected), len(taps))
+		}
+		for i := range expected {
+			if taps[i].direction != expected[i].direction || !bytes.Equal(taps[i].raw, expected[i].raw) {
+				t.Errorf("%v: tap %v: expecting %v %x, got %v %x", method, i, expected[i].direction, expected[i].raw, taps[i].direction, taps[i].raw)
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package multiplex
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+	"sync"
+)
+
+// minTagLen is the shortest tag ObfsConfig.TagLen can truncate to. A forgery is accepted with a chance of 2^-64 per
+// attempt at this length
+const minTagLen = 8
+
+var ErrTagTruncationUnsupported = errors.New("tag truncation needs an AES-GCM or ChaCha20-Poly1305 method")
+
+var errTruncatedTagOpen = errors.New("cipher: message authentication failed")
+
+// truncatable returns whether the payload cipher of m is a stream cipher whose keystream doesn't depend on the
+// plaintext, which truncatedAEAD needs to recover the plaintext before it can check the tag
+func truncatable(m Method) bool {
+	switch m {
+	case E_METHOD_AES_GCM, E_METHOD_AES_128_GCM, E_METHOD_AES_192_GCM, E_METHOD_CHACHA20_POLY1305, E_METHOD_XCHACHA20_POLY1305:
+		return true
+	}
+	return false
+}
+
+// truncatedAEAD only keeps the first tagLen bytes of the tags of an AEAD.
+//
+// cipher.AEAD.Open wants the full tag, so Open recovers the keystream by sealing zeros under the same nonce, decrypts
+// the ciphertext with it, then seals the plaintext again and compares the truncated tags. Opening a frame therefore
+// costs two Seals.
+type truncatedAEAD struct {
+	cipher.AEAD
+	tagLen int
+}
+
+var truncatedTagScratch sync.Pool // *[]byte
+
+func getTruncatedTagScratch(n int) *[]byte {
+	if pooled := truncatedTagScratch.Get(); pooled != nil {
+		buf := pooled.(*[]byte)
+		if cap(*buf) >= n {
+			*buf = (*buf)[:n]
+			return buf
+		}
+	}
+	buf := make([]byte, n)
+	return &buf
+}
+
+func (t *truncatedAEAD) Overhead() int { return t.tagLen }
+
+func (t *truncatedAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	scratch := getTruncatedTagScratch(len(plaintext) + t.AEAD.Overhead())
+	defer truncatedTagScratch.Put(scratch)
+	sealed := t.AEAD.Seal((*scratch)[:0], nonce, plaintext, additionalData)
+	return append(dst, sealed[:len(plaintext)+t.tagLen]...)
+}
+
+func (t *truncatedAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < t.tagLen {
+		return nil, errTruncatedTagOpen
+	}
+	ptLen := len(ciphertext) - t.tagLen
+	scratch := getTruncatedTagScratch(ptLen + t.AEAD.Overhead())
+	defer truncatedTagScratch.Put(scratch)
+	keystream := (*scratch)[:ptLen]
+	for i := range keystream {
+		keystream[i] = 0
+	}
+	t.AEAD.Seal(keystream[:0], nonce, keystream, additionalData)
+
+	ret, plaintext := sliceForAppend(dst, ptLen)
+	for i := range plaintext {
+		plaintext[i] = ciphertext[i] ^ keystream[i]
+	}
+	// plaintext may be ciphertext itself, but the tag after it is left untouched
+	sealed := t.AEAD.Seal((*scratch)[:0], nonce, plaintext, additionalData)
+	if subtle.ConstantTimeCompare(sealed[ptLen:ptLen+t.tagLen], ciphertext[ptLen:]) != 1 {
+		for i := range plaintext {
+			plaintext[i] = 0
+		}
+		return nil, errTruncatedTagOpen
+	}
+	return ret, nil
+}
+
+// sliceForAppend extends in by n bytes, returning the whole slice and the n bytes added
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
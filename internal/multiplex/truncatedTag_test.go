@@ -0,0 +1,74 @@
+package multiplex
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestTruncatedTag(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	obfsBuf := make([]byte, 512)
+
+	for _, method := range []Method{E_METHOD_AES_GCM, E_METHOD_AES_128_GCM, E_METHOD_CHACHA20_POLY1305, E_METHOD_XCHACHA20_POLY1305} {
+		full, _ := GenerateObfs(method, sessionKey, WithRecordLayer(TLSRecordLayer{}), WithProtocolVersion(PROTOCOL_V7))
+		for _, tagLen := range []int{8, 12} {
+			obfuscator, err := GenerateObfs(method, sessionKey, WithRecordLayer(TLSRecordLayer{}), WithProtocolVersion(PROTOCOL_V7), WithTagLen(tagLen))
+			if err != nil {
+				t.Fatalf("%v: %v", method, err)
+			}
+			if obfuscator.Overhead() != full.Overhead()-16+tagLen {
+				t.Errorf("%v tag of %v: expecting overhead %v, got %v", method, tagLen, full.Overhead()-16+tagLen, obfuscator.Overhead())
+			}
+
+			for _, pldLen := range []int{0, 1, 100} {
+				payload := make([]byte, pldLen)
+				rand.Read(payload)
+				n, err := obfuscator.Obfs(&Frame{StreamID: 1, Seq: uint64(pldLen), Payload: payload}, obfsBuf)
+				if err != nil {
+					t.Fatalf("%v tag of %v: %v", method, tagLen, err)
+				}
+				if n != obfuscator.Overhead()+pldLen {
+					t.Errorf("%v tag of %v: expecting frame of %v bytes, got %v", method, tagLen, obfuscator.Overhead()+pldLen, n)
+				}
+				f, err := obfuscator.Deobfs(obfsBuf[:n])
+				if err != nil {
+					t.Fatalf("%v tag of %v: failed to deobfs: %v", method, tagLen, err)
+				}
+				if !bytes.Equal(f.Payload, payload) {
+					t.Errorf("%v tag of %v: payload mismatch", method, tagLen)
+				}
+
+				if pldLen == 0 {
+					continue
+				}
+				obfuscator.Obfs(&Frame{StreamID: 1, Seq: uint64(pldLen), Payload: payload}, obfsBuf)
+				obfsBuf[recordHeaderLen+obfuscator.config.headerLen()] ^= 1
+				if _, err := obfuscator.Deobfs(obfsBuf[:n]); !errors.Is(err, ErrAuthFailed) {
+					t.Errorf("%v tag of %v: expecting %v for a tampered frame, got %v", method, tagLen, ErrAuthFailed, err)
+				}
+			}
+
+			n, _ := obfuscator.Obfs(&Frame{StreamID: 1, Payload: []byte("hello")}, obfsBuf)
+			if _, err := full.Deobfs(obfsBuf[:n]); err == nil {
+				t.Errorf("%v tag of %v: deobfsed a frame with a truncated tag expecting the full one", method, tagLen)
+			}
+		}
+	}
+}
+
+func TestTruncatedTagRefused(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	for _, method := range []Method{E_METHOD_PLAIN, E_METHOD_AES_GCM_SIV} {
+		if _, err := GenerateObfs(method, sessionKey, WithTagLen(8)); !errors.Is(err, ErrTagTruncationUnsupported) {
+			t.Errorf("%v: expecting %v, got %v", method, ErrTagTruncationUnsupported, err)
+		}
+	}
+	for _, tagLen := range []int{-1, 4, minTagLen - 1, 17} {
+		if _, err := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithTagLen(tagLen)); err == nil {
+			t.Errorf("accepted a tag of %v bytes", tagLen)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package multiplex
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The protocol version decides the layout of every frame, so both ends must agree on it before the session starts.
+// It's carried in the handshake, where a client that predates it sends the reserved byte as 0, which is PROTOCOL_V1.
+
+// LatestProtocolVersion is the highest protocol version frames can be obfsed and deobfsed in by this build
+const LatestProtocolVersion byte = maxProtocolVersion
+
+var ErrUnknownProtocolVersion = errors.New("unknown protocol version")
+
+// ParseProtocolVersion returns the protocol version encoded as b, or ErrUnknownProtocolVersion if it's newer than
+// LatestProtocolVersion
+func ParseProtocolVersion(b byte) (byte, error) {
+	if b > LatestProtocolVersion {
+		return 0, fmt.Errorf("%w %v, supporting up to %v", ErrUnknownProtocolVersion, b, LatestProtocolVersion)
+	}
+	return b, nil
+}
+
+// SelectVersion returns the protocol version to be used between an end supporting versions up to local and one
+// supporting versions up to remote, which is the lower of the two. Every version is still supported by this build, so
+// this only fails if local itself is unknown
+func SelectVersion(local, remote byte) (byte, error) {
+	if _, err := ParseProtocolVersion(local); err != nil {
+		return 0, err
+	}
+	if remote < local {
+		return remote, nil
+	}
+	return local, nil
+}
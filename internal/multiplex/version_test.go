@@ -0,0 +1,48 @@
+package multiplex
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseProtocolVersion(t *testing.T) {
+	for v := byte(PROTOCOL_V1); v <= LatestProtocolVersion; v++ {
+		if parsed, err := ParseProtocolVersion(v); err != nil || parsed != v {
+			t.Errorf("expecting version %v to be parsed, got %v: %v", v, parsed, err)
+		}
+	}
+	if _, err := ParseProtocolVersion(LatestProtocolVersion + 1); !errors.Is(err, ErrUnknownProtocolVersion) {
+		t.Errorf("expecting %v, got %v", ErrUnknownProtocolVersion, err)
+	}
+
+	// versions that can be parsed can be used to obfs
+	sessionKey := make([]byte, 32)
+	if _, err := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithProtocolVersion(LatestProtocolVersion)); err != nil {
+		t.Errorf("expecting the latest version to be usable, got %v", err)
+	}
+	_, err := GenerateObfs(E_METHOD_AES_GCM, sessionKey, WithProtocolVersion(LatestProtocolVersion+1))
+	if !errors.Is(err, ErrUnknownProtocolVersion) {
+		t.Errorf("expecting %v, got %v", ErrUnknownProtocolVersion, err)
+	}
+}
+
+func TestSelectVersion(t *testing.T) {
+	for _, tc := range []struct {
+		local, remote, expected byte
+	}{
+		{PROTOCOL_V6, PROTOCOL_V6, PROTOCOL_V6},
+		{PROTOCOL_V6, PROTOCOL_V2, PROTOCOL_V2},
+		{PROTOCOL_V2, PROTOCOL_V6, PROTOCOL_V2},
+		// a remote newer than this build falls back to what is supported here
+		{LatestProtocolVersion, 0xff, LatestProtocolVersion},
+		{PROTOCOL_V1, LatestProtocolVersion, PROTOCOL_V1},
+	} {
+		selected, err := SelectVersion(tc.local, tc.remote)
+		if err != nil || selected != tc.expected {
+			t.Errorf("local %v remote %v: expecting %v, got %v: %v", tc.local, tc.remote, tc.expected, selected, err)
+		}
+	}
+	if _, err := SelectVersion(0xff, PROTOCOL_V1); !errors.Is(err, ErrUnknownProtocolVersion) {
+		t.Errorf("expecting %v for an unknown local version, got %v", ErrUnknownProtocolVersion, err)
+	}
+}
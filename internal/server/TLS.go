@@ -9,6 +9,8 @@ import (
 	"net"
 
 	log "github.com/sirupsen/logrus"
+
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
 )
 
 type TLS struct{}
@@ -16,7 +18,7 @@ type TLS struct{}
 var ErrBadClientHello = errors.New("non (or malformed) ClientHello")
 
 func (TLS) String() string                                    { return "TLS" }
-func (TLS) HasRecordLayer() bool                              { return true }
+func (TLS) RecordLayer() mux.RecordLayer                      { return mux.TLSRecordLayer{} }
 func (TLS) UnitReadFunc() func(net.Conn, []byte) (int, error) { return util.ReadTLS }
 
 func (TLS) handshake(clientHello []byte, privateKey crypto.PrivateKey, originalConn net.Conn) (ai authenticationInfo, finisher func([]byte) (net.Conn, error), err error) {
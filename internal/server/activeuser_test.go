@@ -13,7 +13,7 @@ import (
 func getSeshConfig(unordered bool) *mux.SessionConfig {
 	sessionKey := make([]byte, 32)
 	rand.Read(sessionKey)
-	obfuscator, _ := mux.GenerateObfs(0x00, sessionKey, true)
+	obfuscator, _ := mux.GenerateObfs(0x00, sessionKey, mux.WithRecordLayer(mux.TLSRecordLayer{}))
 
 	seshConfig := &mux.SessionConfig{
 		Obfuscator: obfuscator,
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
 	"github.com/cbeuw/Cloak/internal/util"
 	"net"
 	"time"
@@ -16,9 +17,11 @@ type ClientInfo struct {
 	UID              []byte
 	SessionId        uint32
 	ProxyMethod      string
-	EncryptionMethod byte
+	EncryptionMethod mux.Method
 	Unordered        bool
-	Transport        Transport
+	// ProtocolVersion is the version of the frame format the client obfses the session in
+	ProtocolVersion byte
+	Transport       Transport
 }
 
 type authenticationInfo struct {
@@ -46,7 +49,7 @@ func touchStone(ai authenticationInfo, now func() time.Time) (info ClientInfo, e
 		UID:              plaintext[0:16],
 		SessionId:        0,
 		ProxyMethod:      string(bytes.Trim(plaintext[16:28], "\x00")),
-		EncryptionMethod: plaintext[28],
+		EncryptionMethod: mux.Method(plaintext[28]),
 		Unordered:        plaintext[41]&UNORDERED_FLAG != 0,
 	}
 
@@ -58,6 +61,7 @@ func touchStone(ai authenticationInfo, now func() time.Time) (info ClientInfo, e
 		return
 	}
 	info.SessionId = binary.BigEndian.Uint32(plaintext[37:41])
+	info.ProtocolVersion, err = mux.ParseProtocolVersion(plaintext[42])
 	return
 }
 
@@ -4,10 +4,12 @@ import (
 	"crypto"
 	"errors"
 	"net"
+
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
 )
 
 type Transport interface {
-	HasRecordLayer() bool
+	RecordLayer() mux.RecordLayer
 	UnitReadFunc() func(net.Conn, []byte) (int, error)
 	handshake(reqPacket []byte, privateKey crypto.PrivateKey, originalConn net.Conn) (authenticationInfo, func([]byte) (net.Conn, error), error)
 }
@@ -12,12 +12,14 @@ import (
 	"github.com/cbeuw/Cloak/internal/util"
 	"net"
 	"net/http"
+
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
 )
 
 type WebSocket struct{}
 
 func (WebSocket) String() string                                    { return "WebSocket" }
-func (WebSocket) HasRecordLayer() bool                              { return false }
+func (WebSocket) RecordLayer() mux.RecordLayer                      { return mux.NoRecordLayer{} }
 func (WebSocket) UnitReadFunc() func(net.Conn, []byte) (int, error) { return util.ReadWebSocket }
 
 func (WebSocket) handshake(reqPacket []byte, privateKey crypto.PrivateKey, originalConn net.Conn) (ai authenticationInfo, finisher func([]byte) (net.Conn, error), err error) {